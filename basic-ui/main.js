@@ -68,7 +68,7 @@ async function sendMessage() {
 
 			if (!response.ok) {
 				const errorData = await response.json();
-				throw new Error(`Server error: ${response.status} - ${errorData.text}`);
+				throw new Error(`Server error: ${response.status} - ${errorData.error.message} (${errorData.error.code})`);
 			}
 
 			const result = await response.json();
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// adminToken guards admin-only endpoints. Callers send it as
+// "Authorization: Bearer <token>". When unset, admin endpoints are disabled.
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+// isAdmin reports whether the request carries the admin token.
+func isAdmin(r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// requireAdmin writes a 401 and returns false unless the request is from an
+// admin.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if isAdmin(r) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+	writeError(w, http.StatusUnauthorized, codeUnauthorized, "Admin authorization required")
+	return false
+}
+
+// debugStoredValue is one raw Redis value as reported by /debug/session.
+type debugStoredValue struct {
+	Key string `json:"key"`
+	// Raw is the exact stored string, not re-encoded.
+	Raw *string `json:"raw"`
+	// TTLSeconds is -1 for keys without expiry and -2 for missing keys, as
+	// reported by Redis.
+	TTLSeconds int64 `json:"ttlSeconds"`
+}
+
+// inspectKey reads a key's raw value and remaining TTL.
+func inspectKey(key string) (debugStoredValue, error) {
+	value := debugStoredValue{Key: key}
+	raw, err := redisClient.Get(ctx, key).Result()
+	if err == redis.Nil {
+		value.TTLSeconds = -2
+		return value, nil
+	}
+	if err != nil {
+		return value, err
+	}
+	value.Raw = &raw
+
+	ttl, err := redisClient.TTL(ctx, key).Result()
+	if err != nil {
+		return value, err
+	}
+	if ttl < 0 {
+		// go-redis reports -1/-2 as raw durations rather than seconds
+		value.TTLSeconds = int64(ttl)
+	} else {
+		value.TTLSeconds = int64(ttl / time.Second)
+	}
+	return value, nil
+}
+
+// debugSessionHandler serves the admin-only GET /debug/session?sessionId=...,
+// returning exactly what is stored for a session (history and metadata) with
+// the remaining TTLs, bypassing any normalization done by the public
+// endpoints.
+func debugSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only GET requests are allowed")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	sessionId := r.URL.Query().Get("sessionId")
+	if sessionId == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing sessionId query parameter")
+		return
+	}
+	if redisClient == nil {
+		writeError(w, http.StatusServiceUnavailable, codeStorageError, "Redis client is not initialized")
+		return
+	}
+
+	history, err := inspectKey(historyKey(sessionId))
+	if err == nil && history.Raw == nil {
+		// Not yet migrated to the namespaced key
+		history, err = inspectKey(sessionId)
+	}
+	if err != nil {
+		slog.Error("Redis error inspecting session", "sessionId", sessionId, "error", err)
+		writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving session")
+		return
+	}
+
+	meta, err := inspectKey(sessionMetaKey(sessionId))
+	if err != nil {
+		slog.Error("Redis error inspecting session metadata", "sessionId", sessionId, "error", err)
+		writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving session")
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"sessionId": sessionId,
+		"history":   history,
+		"meta":      meta,
+	})
+}
+
+// flushBatchSize is the SCAN COUNT hint and the largest DEL issued by
+// flushSessions.
+const flushBatchSize = 500
+
+// globEscaper escapes the characters SCAN MATCH treats as wildcards, so a
+// prefix is matched literally.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// flushSessions deletes the history and metadata of every session whose ID
+// starts with prefix and, when owner is set, that belongs to owner. It returns
+// the number of sessions deleted. Keys are found with SCAN and removed in
+// batches, so Redis is never blocked by KEYS or one huge DEL.
+//
+// Histories still under their legacy bare key can only be found through their
+// metadata, that is, when an owner is given.
+func flushSessions(prefix, owner string) (int, error) {
+	if redisClient == nil {
+		return 0, fmt.Errorf("Redis client is not initialized")
+	}
+	// Rather than tracking which sessions went, the history cache is
+	// dropped whole.
+	defer historyCache.forget()
+	pattern := globEscaper.Replace(prefix) + "*"
+
+	if owner != "" {
+		return flushSessionKeys(sessionMetaKey(pattern), func(keys []string) ([]string, error) {
+			values, err := redisGetMany(keys...)
+			if err != nil {
+				return nil, err
+			}
+			var doomed []string
+			for i, v := range values {
+				metaJSON, ok := v.(string)
+				if !ok {
+					continue
+				}
+				var meta SessionMeta
+				if err := json.Unmarshal([]byte(metaJSON), &meta); err != nil || meta.Owner != owner {
+					continue
+				}
+				sessionId := strings.TrimPrefix(keys[i], sessionMetaKey(""))
+				doomed = append(doomed, keys[i], historyKey(sessionId))
+				if !isInternalKey(sessionId) {
+					doomed = append(doomed, sessionId)
+				}
+			}
+			return doomed, nil
+		}, sessionMetaKey(""))
+	}
+
+	deleted, err := flushSessionKeys(historyKey(pattern), func(keys []string) ([]string, error) {
+		doomed := append([]string{}, keys...)
+		for _, key := range keys {
+			doomed = append(doomed, sessionMetaKey(strings.TrimPrefix(key, historyKey(""))))
+		}
+		return doomed, nil
+	}, historyKey(""))
+	if err != nil {
+		return deleted, err
+	}
+
+	// Sessions created through /session that have no history yet.
+	orphans, err := flushSessionKeys(sessionMetaKey(pattern), func(keys []string) ([]string, error) {
+		return keys, nil
+	}, sessionMetaKey(""))
+	return deleted + orphans, err
+}
+
+// flushSessionKeys scans keys matching pattern and, batch by batch, deletes
+// the keys returned by expand. It counts the deleted keys that start with
+// countPrefix, one per session.
+func flushSessionKeys(pattern string, expand func(keys []string) ([]string, error), countPrefix string) (int, error) {
+	deleted := 0
+	var cursor uint64
+	for {
+		keys, next, err := redisScan(cursor, pattern, flushBatchSize)
+		if err != nil {
+			return deleted, fmt.Errorf("redis error scanning sessions: %w", err)
+		}
+		cursor = next
+
+		if len(keys) > 0 {
+			doomed, err := expand(keys)
+			if err != nil {
+				return deleted, fmt.Errorf("redis error reading sessions: %w", err)
+			}
+			if len(doomed) > 0 {
+				// A pipelined DEL per key tells which of them actually existed.
+				pipe := redisClient.Pipeline()
+				cmds := make([]*redis.IntCmd, len(doomed))
+				for i, key := range doomed {
+					cmds[i] = pipe.Del(ctx, key)
+				}
+				if _, err := pipe.Exec(ctx); err != nil {
+					return deleted, fmt.Errorf("redis error deleting sessions: %w", err)
+				}
+				for i, cmd := range cmds {
+					if cmd.Val() > 0 && strings.HasPrefix(doomed[i], countPrefix) {
+						deleted++
+					}
+				}
+			}
+		}
+
+		if cursor == 0 {
+			return deleted, nil
+		}
+	}
+}
+
+// flushRequest is the body of POST /admin/flush. All must be set to flush
+// every session, so an empty body cannot wipe the store by accident.
+type flushRequest struct {
+	Prefix string `json:"prefix"`
+	Owner  string `json:"owner"`
+	All    bool   `json:"all"`
+}
+
+// flushHandler serves the admin-only POST /admin/flush, deleting sessions in
+// bulk for test environments and GDPR erasure requests.
+func flushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only POST requests are allowed")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+
+	var req flushRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+	if req.Prefix == "" && req.Owner == "" && !req.All {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, `Provide a prefix or owner, or "all": true to flush every session`)
+		return
+	}
+
+	deleted, err := flushSessions(req.Prefix, req.Owner)
+	if err != nil {
+		slog.Error("Error flushing sessions", "prefix", req.Prefix, "owner", req.Owner, "deleted", deleted, "error", err)
+		writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error flushing sessions")
+		return
+	}
+	slog.Info("Flushed sessions", "prefix", req.Prefix, "owner", req.Owner, "deleted", deleted)
+
+	writeJSON(w, r, http.StatusOK, map[string]int{"deleted": deleted})
+}
+
+// lookupSessionsHandler serves the admin-only GET
+// /admin/sessions?prefix=...&cursor=...&limit=..., listing the sessions whose
+// ID starts with prefix so support agents can find a conversation from a
+// partial ID. Pages work as for /sessions.
+func lookupSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only GET requests are allowed")
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	if prefix == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing prefix query parameter")
+		return
+	}
+	cursor, limit, ok := sessionPageParams(w, query)
+	if !ok {
+		return
+	}
+
+	sessions, next, err := listSessionsPage("", prefix, cursor, limit)
+	if err != nil {
+		slog.Error("Error looking up sessions", "prefix", prefix, "error", err)
+		writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error listing sessions")
+		return
+	}
+	writeSessionPage(w, r, sessions, next)
+}
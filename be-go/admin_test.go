@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDebugSessionReturnsRawValueAndTTL(t *testing.T) {
+	mr := setupRedis(t)
+	// Spacing and field order that re-encoding would not keep.
+	raw := `{"v":1,  "messages":[{"text":"hi","role":"user","createdAt":"2024-01-02T03:04:05Z"}]}`
+	mr.Set(historyKey("debug-1"), raw)
+	mr.SetTTL(historyKey("debug-1"), 90*time.Minute)
+
+	w := httptest.NewRecorder()
+	debugSessionHandler(w, withAdmin(t, httptest.NewRequest("GET", "/debug/session?sessionId=debug-1", nil)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var body struct {
+		History debugStoredValue `json:"history"`
+		Meta    debugStoredValue `json:"meta"`
+	}
+	decodeBody(t, w, &body)
+	if body.History.Raw == nil || *body.History.Raw != raw {
+		t.Fatalf("raw = %v, want the stored bytes %q", body.History.Raw, raw)
+	}
+	if body.History.TTLSeconds != int64((90 * time.Minute).Seconds()) {
+		t.Errorf("ttlSeconds = %d, want %d", body.History.TTLSeconds, int64((90 * time.Minute).Seconds()))
+	}
+	if body.Meta.Raw != nil || body.Meta.TTLSeconds != -2 {
+		t.Errorf("meta = %+v, want a missing key", body.Meta)
+	}
+}
+
+func TestDebugSessionRequiresAdmin(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &adminToken, "test-admin-token")
+	r := httptest.NewRequest("GET", "/debug/session?sessionId=debug-1", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+
+	w := httptest.NewRecorder()
+	debugSessionHandler(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", w.Code)
+	}
+}
+
+func TestFlushSessions(t *testing.T) {
+	mr := setupRedis(t)
+	pagedScans(t, mr)
+	for _, id := range []string{"test-1", "test-2", "test-3", "keep-1"} {
+		mr.Set(historyKey(id), `{"v":1,"messages":[]}`)
+	}
+	// A session created through /session with no history yet.
+	if err := saveSessionMeta(&SessionMeta{SessionID: "test-4", Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSessionMeta(&SessionMeta{SessionID: "test-1", Owner: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	flushHandler(w, withAdmin(t, newJSONRequest(t, "POST", "/admin/flush", map[string]string{"prefix": "test-"})))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var body struct{ Deleted int }
+	decodeBody(t, w, &body)
+	if body.Deleted != 4 {
+		t.Errorf("deleted = %d, want 4 sessions", body.Deleted)
+	}
+	for _, key := range mr.Keys() {
+		if key != historyKey("keep-1") {
+			t.Errorf("key %q survived the flush", key)
+		}
+	}
+}
+
+func TestFlushSessionsByOwner(t *testing.T) {
+	mr := setupRedis(t)
+	for id, owner := range map[string]string{"a-1": "alice", "a-2": "alice", "b-1": "bob"} {
+		mr.Set(historyKey(id), `{"v":1,"messages":[]}`)
+		if err := saveSessionMeta(&SessionMeta{SessionID: id, Owner: owner}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	flushHandler(w, withAdmin(t, newJSONRequest(t, "POST", "/admin/flush", map[string]string{"owner": "alice"})))
+	var body struct{ Deleted int }
+	decodeBody(t, w, &body)
+	if body.Deleted != 2 {
+		t.Errorf("deleted = %d, want alice's 2 sessions", body.Deleted)
+	}
+	if !mr.Exists(historyKey("b-1")) || mr.Exists(historyKey("a-1")) || mr.Exists(sessionMetaKey("a-2")) {
+		t.Errorf("keys left = %v, want only bob's session", mr.Keys())
+	}
+}
+
+func TestFlushRequiresScopeAndAdmin(t *testing.T) {
+	setupRedis(t)
+	w := httptest.NewRecorder()
+	flushHandler(w, withAdmin(t, newJSONRequest(t, "POST", "/admin/flush", map[string]string{})))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unscoped flush status = %d, want 400", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	flushHandler(w, newJSONRequest(t, "POST", "/admin/flush", map[string]bool{"all": true}))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("flush without admin token status = %d, want 401", w.Code)
+	}
+}
+
+func TestLookupSessionsByPrefix(t *testing.T) {
+	pagedScans(t, setupRedis(t))
+	for _, id := range []string{"ticket-1234-a", "ticket-1234-b", "ticket-1234-c", "ticket-5678", "tick*et-1", "other-1234"} {
+		if err := saveSessionMeta(&SessionMeta{SessionID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"ticket-1234", []string{"ticket-1234-a", "ticket-1234-b", "ticket-1234-c"}},
+		{"ticket-5", []string{"ticket-5678"}},
+		{"tick*", []string{"tick*et-1"}},
+		{"nothing", nil},
+	}
+	for _, tt := range tests {
+		ids, _ := listSessionPages(t, lookupSessionsHandler, "/admin/sessions?limit=1&prefix="+url.QueryEscape(tt.prefix), true)
+		slices.Sort(ids)
+		if !slices.Equal(ids, tt.want) {
+			t.Errorf("prefix %q matched %v, want %v", tt.prefix, ids, tt.want)
+		}
+	}
+}
+
+func TestLookupSessionsRequiresAdminAndPrefix(t *testing.T) {
+	setupRedis(t)
+	w := httptest.NewRecorder()
+	lookupSessionsHandler(w, httptest.NewRequest("GET", "/admin/sessions?prefix=ticket", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without admin auth: status = %d, want 401", w.Code)
+	}
+	w = httptest.NewRecorder()
+	lookupSessionsHandler(w, withAdmin(t, httptest.NewRequest("GET", "/admin/sessions", nil)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("without a prefix: status = %d, want 400", w.Code)
+	}
+}
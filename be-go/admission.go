@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// Chat requests run on at most MAX_CONCURRENT_CHATS workers, with up to
+// CHAT_QUEUE_DEPTH more waiting for a free worker. Anything beyond that is
+// rejected immediately with 503 and a Retry-After of CHAT_RETRY_AFTER_SECONDS,
+// so overload sheds requests instead of piling up goroutines.
+// MAX_CONCURRENT_CHATS=0 (the default) disables the limit.
+var (
+	maxConcurrentChats = envInt("MAX_CONCURRENT_CHATS", 0)
+	chatQueueDepth     = envInt("CHAT_QUEUE_DEPTH", 0)
+	chatRetryAfter     = envInt("CHAT_RETRY_AFTER_SECONDS", 1)
+)
+
+// chatAdmission is the limiter shared by the chat endpoints.
+var chatAdmission = newAdmission(maxConcurrentChats, chatQueueDepth)
+
+var chatRequestsRejected = newCounter("maya_chat_requests_rejected_total", "Chat requests rejected with 503 because the queue was full.")
+
+func init() {
+	newGaugeFunc("maya_chat_queue_depth", "Chat requests waiting for a worker.", func() float64 {
+		return float64(chatAdmission.waiting.Load())
+	})
+	newGaugeFunc("maya_chat_in_flight", "Chat requests currently being handled.", func() float64 {
+		return float64(chatAdmission.running.Load())
+	})
+}
+
+// admission bounds both running and waiting requests.
+type admission struct {
+	// slots has one entry per running request; nil means unlimited.
+	slots      chan struct{}
+	maxWaiting int64
+	waiting    atomic.Int64
+	running    atomic.Int64
+}
+
+func newAdmission(workers, queueDepth int) *admission {
+	a := &admission{maxWaiting: int64(queueDepth)}
+	if workers > 0 {
+		a.slots = make(chan struct{}, workers)
+	}
+	return a
+}
+
+// acquire waits for a worker slot. It returns false without waiting when the
+// queue is already full, or when ctx ends first.
+func (a *admission) acquire(ctx context.Context) bool {
+	if a.slots == nil {
+		a.running.Add(1)
+		return true
+	}
+
+	select {
+	case a.slots <- struct{}{}:
+		a.running.Add(1)
+		return true
+	default:
+	}
+
+	if a.waiting.Add(1) > a.maxWaiting {
+		a.waiting.Add(-1)
+		return false
+	}
+	defer a.waiting.Add(-1)
+
+	select {
+	case a.slots <- struct{}{}:
+		a.running.Add(1)
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (a *admission) release() {
+	a.running.Add(-1)
+	if a.slots != nil {
+		<-a.slots
+	}
+}
+
+// withAdmission runs next only once a worker is free, rejecting the request
+// with 503 when the queue is full.
+func withAdmission(a *admission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.acquire(r.Context()) {
+			chatRequestsRejected.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(chatRetryAfter))
+			writeError(w, http.StatusServiceUnavailable, codeOverloaded, "Server is overloaded, please retry later")
+			return
+		}
+		defer a.release()
+		next(w, r)
+	}
+}
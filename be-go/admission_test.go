@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdmissionRejectsWhenQueueFull(t *testing.T) {
+	a := newAdmission(1, 1)
+	started := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	handler := withAdmission(a, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// One request runs and one waits for the worker.
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("POST", "/chat", nil))
+			codes[i] = w.Code
+		}()
+	}
+	<-started
+	deadline := time.Now().Add(2 * time.Second)
+	for a.waiting.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("waiting = %d, want 1", a.waiting.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/chat", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("excess request status = %d, want 503", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("503 has no Retry-After header")
+	}
+
+	close(unblock)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("admitted request %d status = %d, want 200", i, code)
+		}
+	}
+	if a.running.Load() != 0 || a.waiting.Load() != 0 {
+		t.Errorf("running = %d, waiting = %d after all requests finished", a.running.Load(), a.waiting.Load())
+	}
+}
+
+func TestAdmissionUnlimitedByDefault(t *testing.T) {
+	a := newAdmission(0, 0)
+	for i := 0; i < 10; i++ {
+		if !a.acquire(t.Context()) {
+			t.Fatalf("acquire %d refused with no limit", i)
+		}
+	}
+	if a.running.Load() != 10 {
+		t.Errorf("running = %d, want 10", a.running.Load())
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// claudeModelID is the Anthropic model Claude requests go to.
+const claudeModelID = "claude-3-opus-20240229"
+
+// claudeAPIURL is Anthropic's Messages endpoint, for plain and streamed calls.
+const claudeAPIURL = "https://api.anthropic.com/v1/messages"
+
+func callClaudeAPI(ctx context.Context, req ProviderRequest) (_ ProviderResponse, err error) {
+	defer wrapProviderError(&err, "Claude", claudeModelID)
+	if claudeAPIKey == "" {
+		return ProviderResponse{}, fmt.Errorf("CLAUDE_API_KEY environment variable not set")
+	}
+
+	if req.N > 1 {
+		slog.Debug("Claude does not support multiple choices, ignoring n", "n", req.N)
+	}
+
+	jsonPayload, _ := json.Marshal(claudePayload(req))
+	resp, err := makeAPIRequestWithAuthAndHeader(ctx, claudeAPIURL, "x-api-key", claudeAPIKey, "anthropic-version", "2023-06-01", bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return ProviderResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var result AnthropicResponse
+	if err := decodeProviderResponse("Claude", resp.Body, &result); err != nil {
+		return ProviderResponse{}, err
+	}
+
+	text := ""
+	var toolCalls []ToolCall
+	for _, block := range result.Content {
+		switch block.Type {
+		case "text":
+			if text == "" {
+				text = block.Text
+			}
+		case "tool_use":
+			toolCalls = append(toolCalls, ToolCall{ID: block.ID, Name: block.Name, Arguments: block.Input})
+		}
+	}
+	if text != "" || len(toolCalls) > 0 {
+		// Anthropic has no equivalent of n, so there is only ever one choice.
+		recordFinishReason(ctx, result.StopReason)
+		if result.Usage != nil {
+			recordProviderUsage(ctx, result.Usage.InputTokens, result.Usage.OutputTokens, 0)
+		}
+		return ProviderResponse{Text: text, Choices: []string{text}, ToolCalls: toolCalls}, nil
+	}
+
+	return ProviderResponse{}, emptyResponseError("Claude", result.StopReason)
+}
+
+// callClaudeAPIStream is the streaming variant of callClaudeAPI. The token
+// counts come from the message_start and message_delta events.
+func callClaudeAPIStream(ctx context.Context, req ProviderRequest, onDelta func(string) error) (_ string, err error) {
+	defer wrapProviderError(&err, "Claude", claudeModelID)
+	if claudeAPIKey == "" {
+		return "", fmt.Errorf("CLAUDE_API_KEY environment variable not set")
+	}
+
+	payload := claudePayload(req)
+	payload.Stream = true
+	jsonPayload, _ := json.Marshal(payload)
+	headers := map[string]string{"x-api-key": claudeAPIKey, "anthropic-version": "2023-06-01"}
+	resp, err := openStream(ctx, claudeAPIURL, headers, jsonPayload, "text/event-stream")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return readClaudeStream(ctx, resp.Body, onDelta)
+}
+
+// readClaudeStream parses a Messages stream, forwarding the text deltas
+// until message_stop.
+func readClaudeStream(ctx context.Context, body io.Reader, onDelta func(string) error) (string, error) {
+	var full strings.Builder
+	inputTokens := 0
+	reason := ""
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		var event AnthropicStreamEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event); err != nil {
+			return full.String(), fmt.Errorf("error parsing stream event: %w", err)
+		}
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil && event.Message.Usage != nil {
+				inputTokens = event.Message.Usage.InputTokens
+			}
+		case "content_block_delta":
+			if event.Delta == nil || event.Delta.Text == "" {
+				continue
+			}
+			full.WriteString(event.Delta.Text)
+			if err := onDelta(event.Delta.Text); err != nil {
+				return full.String(), err
+			}
+		case "message_delta":
+			if event.Delta != nil && event.Delta.StopReason != "" {
+				reason = event.Delta.StopReason
+			}
+			if event.Usage != nil {
+				// output_tokens is the running total for the message.
+				recordProviderUsage(ctx, inputTokens, event.Usage.OutputTokens, 0)
+			}
+		case "error":
+			if event.Error != nil {
+				return full.String(), fmt.Errorf("Claude stream error: %s: %s", event.Error.Type, event.Error.Message)
+			}
+		}
+		if event.Type == "message_stop" {
+			break
+		}
+	}
+
+	// A cancelled context surfaces as a read error on the body.
+	if ctx.Err() != nil {
+		return full.String(), ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return full.String(), fmt.Errorf("error reading Claude stream: %w", err)
+	}
+	if full.Len() == 0 {
+		return "", emptyResponseError("Claude", reason)
+	}
+	recordFinishReason(ctx, reason)
+	return full.String(), nil
+}
+
+// claudePayload builds the Messages body shared by the plain and the
+// streaming call.
+func claudePayload(req ProviderRequest) AnthropicPayload {
+	if req.PresencePenalty != nil || req.FrequencyPenalty != nil {
+		slog.Debug("Claude does not support presence/frequency penalties, ignoring them")
+	}
+	if req.ReasoningEffort != "" {
+		slog.Debug("Claude does not support reasoning effort, ignoring it")
+	}
+
+	system, messages := applySystemPromptStrategy(req.Messages, req.systemPromptStrategy("claude"))
+	claudeMessages := toAnthropicMessages(messages)
+	if n := len(claudeMessages); n > 0 && claudeMessages[n-1].Role == "assistant" {
+		// A trailing assistant turn is a prefill for Claude to continue.
+		claudeMessages[n-1].Content = trimPrefill(claudeMessages[n-1].Content)
+	}
+	payload := AnthropicPayload{
+		Model:     claudeModelID,
+		Messages:  claudeMessages,
+		MaxTokens: maxTokensFor("claude", req.MaxTokens),
+		System:    system,
+	}
+	if req.UserID != "" {
+		payload.Metadata = &AnthropicMetadata{UserID: req.UserID}
+	}
+	if len(req.Metadata) > 0 {
+		slog.Debug("Claude only accepts a user id as metadata, ignoring the rest")
+	}
+	if req.Temperature != nil {
+		// Anthropic only accepts temperatures up to 1.
+		payload.Temperature = float64Ptr(min(*req.Temperature, 1))
+	}
+	return payload
+}
+
+// toAnthropicMessages maps the stored history onto Anthropic's roles and
+// enforces its strict alternation: consecutive messages with the same role
+// (e.g. the system prompt mapped to user followed by the first user turn, or
+// a client sending two user turns) are merged into one, and the conversation
+// must open with a user turn.
+func toAnthropicMessages(contents []Message) []AnthropicMessage {
+	claudeMessages := make([]AnthropicMessage, 0, len(contents))
+	for _, c := range contents {
+		role := ""
+		switch c.Role {
+		case "user":
+			role = "user"
+		case "ai":
+			role = "assistant"
+		case "system":
+			// Under the "user" system prompt strategy, map the system role
+			// to "user" so the LLM processes it as a context-setting
+			// instruction.
+			role = "user"
+		case "tool":
+			// Tool results are tool_result blocks of a user turn.
+			role = "user"
+		default:
+			// Skip any unknown roles
+			continue
+		}
+
+		n := len(claudeMessages)
+		if n == 0 || claudeMessages[n-1].Role != role {
+			if n == 0 && role == "assistant" {
+				slog.Debug("Dropping leading assistant message, Anthropic requires the first turn to be from the user")
+				continue
+			}
+			claudeMessages = append(claudeMessages, AnthropicMessage{Role: role})
+			n++
+		}
+		last := &claudeMessages[n-1]
+		switch {
+		case c.Role == "tool":
+			last.Blocks = append(last.Blocks, AnthropicContentBlock{Type: "tool_result", ToolUseID: c.ToolCallID, Content: c.Text})
+			continue
+		case c.Text == "":
+		case last.Content == "":
+			last.Content = c.Text
+		default:
+			last.Content += "\n\n" + c.Text
+		}
+		for _, call := range c.ToolCalls {
+			last.Blocks = append(last.Blocks, AnthropicContentBlock{Type: "tool_use", ID: call.ID, Name: call.Name, Input: toolCallObject(call.Arguments)})
+		}
+	}
+	return claudeMessages
+}
+
+// MarshalJSON sends a message with tool calls or results as content blocks.
+// Tool results come first as Anthropic requires, followed by any text; an
+// assistant's text comes before the tool calls it makes.
+func (m AnthropicMessage) MarshalJSON() ([]byte, error) {
+	if len(m.Blocks) == 0 {
+		return json.Marshal(struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		}{m.Role, m.Content})
+	}
+	blocks := m.Blocks
+	if m.Content != "" {
+		text := AnthropicContentBlock{Type: "text", Text: m.Content}
+		if m.Role == "assistant" {
+			blocks = append([]AnthropicContentBlock{text}, blocks...)
+		} else {
+			blocks = append(blocks[:len(blocks):len(blocks)], text)
+		}
+	}
+	return json.Marshal(struct {
+		Role    string                  `json:"role"`
+		Content []AnthropicContentBlock `json:"content"`
+	}{m.Role, blocks})
+}
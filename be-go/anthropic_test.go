@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// fakeClaudeAPI answers Claude calls with response and returns the decoded
+// payloads it received.
+func fakeClaudeAPI(t *testing.T, response string) *[]map[string]interface{} {
+	t.Helper()
+	setVar(t, &claudeAPIKey, "test-key")
+	var payloads []map[string]interface{}
+	fakeProviderAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload map[string]interface{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("decoding Claude payload %s: %v", body, err)
+		}
+		payloads = append(payloads, payload)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, response)
+	})
+	return &payloads
+}
+
+const claudeHello = `{"content":[{"type":"text","text":"Hello"}],"stop_reason":"end_turn","usage":{"input_tokens":3,"output_tokens":1}}`
+
+func TestClaudeMergesConsecutiveUserMessages(t *testing.T) {
+	payloads := fakeClaudeAPI(t, claudeHello)
+
+	_, err := callClaudeAPI(context.Background(), ProviderRequest{Messages: []Message{
+		{Role: "user", Text: "First question"},
+		{Role: "user", Text: "And a second one"},
+		{Role: "ai", Text: "Answer"},
+		{Role: "user", Text: "Thanks"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := (*payloads)[0]["messages"].([]interface{})
+	if len(messages) != 3 {
+		t.Fatalf("messages = %v, want 3 after merging", messages)
+	}
+	first := messages[0].(map[string]interface{})
+	if first["role"] != "user" || first["content"] != "First question\n\nAnd a second one" {
+		t.Fatalf("first message = %v, want the two user turns merged", first)
+	}
+	for i, m := range messages {
+		want := []string{"user", "assistant", "user"}[i]
+		if role := m.(map[string]interface{})["role"]; role != want {
+			t.Fatalf("message %d role = %v, want %s", i, role, want)
+		}
+	}
+}
+
+func TestClaudeConversationOpensWithUser(t *testing.T) {
+	got := toAnthropicMessages([]Message{
+		{Role: "ai", Text: "Welcome!"},
+		{Role: "user", Text: "Hi"},
+	})
+	if len(got) != 1 || got[0].Role != "user" {
+		t.Fatalf("messages = %+v, want the leading assistant turn dropped", got)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Error codes returned in the "code" field of error responses. They are part
+// of the API: clients switch on them, so existing codes must not change.
+const (
+	codeInvalidRequest      = "invalid_request"
+	codeUnauthorized        = "unauthorized"
+	codeForbidden           = "forbidden"
+	codeNotFound            = "not_found"
+	codeModelNotFound       = "model_not_found"
+	codeProviderUnavailable = "provider_unavailable"
+	codeRateLimited         = "rate_limited"
+	codeContextTooLong      = "context_too_long"
+	codeContentBlocked      = "content_blocked"
+	codeConversationExpired = "conversation_expired"
+	codeOverloaded          = "overloaded"
+	codeStorageError        = "storage_error"
+	codeSessionLimit        = "session_limit"
+	codeSessionBusy         = "session_busy"
+	codeInternalError       = "internal_error"
+)
+
+// apiError is the body of every error response:
+//
+//	{"error": {"code": "model_not_found", "message": "Invalid model name"}}
+//
+// Provider failures also name the provider and model that failed.
+type apiError struct {
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model,omitempty"`
+	// EstimatedTokens and AllowedTokens are set when a prompt was rejected
+	// under STRICT_PROMPT_LIMIT.
+	EstimatedTokens int `json:"estimatedTokens,omitempty"`
+	AllowedTokens   int `json:"allowedTokens,omitempty"`
+}
+
+// writeError writes a JSON error envelope with the given status.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, nil, status, map[string]apiError{"error": {Code: code, Message: message}})
+}
+
+// writeProviderError writes the error envelope for a failed provider call.
+func writeProviderError(w http.ResponseWriter, err error) {
+	status, code := providerErrorCode(err)
+	body := apiError{Code: code, Message: err.Error()}
+	var provErr *providerError
+	if errors.As(err, &provErr) {
+		body.Provider, body.Model = provErr.Provider, provErr.Model
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, nil, status, map[string]apiError{"error": body})
+}
+
+// contextTooLongMarkers are fragments of the errors providers return for
+// prompts over the model's context length.
+var contextTooLongMarkers = []string{
+	"context length",
+	"context_length",
+	"maximum context",
+	"prompt is too long",
+	"input token count",
+	"too many tokens",
+}
+
+// isContextTooLong reports whether err is a provider rejecting the prompt
+// for its length.
+func isContextTooLong(err error) bool {
+	var statusErr *providerStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	if statusErr.Status == http.StatusRequestEntityTooLarge {
+		return true
+	}
+	if statusErr.Status != http.StatusBadRequest {
+		return false
+	}
+	body := strings.ToLower(statusErr.Body)
+	for _, marker := range contextTooLongMarkers {
+		if strings.Contains(body, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// providerErrorCode maps a provider call error to the status and code
+// returned to the client.
+func providerErrorCode(err error) (int, string) {
+	switch {
+	case errors.Is(err, errProviderOverloaded), errors.Is(err, errAttemptBudgetExhausted):
+		return http.StatusServiceUnavailable, codeProviderUnavailable
+	case errors.Is(err, errProviderRateLimited):
+		return http.StatusTooManyRequests, codeRateLimited
+	case errors.Is(err, errContentBlocked):
+		return http.StatusUnprocessableEntity, codeContentBlocked
+	case errors.Is(err, errEmptyResponse):
+		return http.StatusBadGateway, codeProviderUnavailable
+	case isContextTooLong(err):
+		return http.StatusBadRequest, codeContextTooLong
+	case errors.Is(err, errMalformedResponse):
+		return http.StatusBadGateway, codeProviderUnavailable
+	case errors.Is(err, errStreamIdle):
+		return http.StatusGatewayTimeout, codeProviderUnavailable
+	}
+	return http.StatusInternalServerError, codeProviderUnavailable
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// failWith is a chat call failing with err.
+func failWith(err error) chatFunc {
+	return func(context.Context, ProviderRequest) (ProviderResponse, error) {
+		return ProviderResponse{}, err
+	}
+}
+
+func TestChatErrorCodes(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		call       chatFunc
+		payload    map[string]interface{}
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "unknown model",
+			payload:    map[string]interface{}{"sessionId": "codes", "modelName": "no-such-model", "contents": userTurn("Hi")},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codeModelNotFound,
+		},
+		{
+			name:       "missing contents",
+			payload:    map[string]interface{}{"sessionId": "codes", "modelName": "gemini"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codeInvalidRequest,
+		},
+		{
+			name:       "rate limited",
+			call:       failWith(statusError(http.StatusTooManyRequests, []byte(`{"error":"quota"}`))),
+			wantStatus: http.StatusTooManyRequests,
+			wantCode:   codeRateLimited,
+		},
+		{
+			name:       "overloaded",
+			call:       failWith(statusError(statusOverloaded, nil)),
+			wantStatus: http.StatusServiceUnavailable,
+			wantCode:   codeProviderUnavailable,
+		},
+		{
+			name:       "context too long",
+			call:       failWith(statusError(http.StatusBadRequest, []byte(`{"error":{"message":"This model's maximum context length is 8192 tokens"}}`))),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codeContextTooLong,
+		},
+		{
+			name:       "content blocked",
+			call:       failWith(emptyResponseError("Gemini", "SAFETY")),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   codeContentBlocked,
+		},
+		{
+			name:       "malformed response",
+			call:       failWith(fmt.Errorf("error parsing Gemini response: %w", errMalformedResponse)),
+			wantStatus: http.StatusBadGateway,
+			wantCode:   codeProviderUnavailable,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setupRedis(t)
+			if tt.call != nil {
+				stubChat(t, "gemini", tt.call)
+			}
+			payload := tt.payload
+			if payload == nil {
+				payload = map[string]interface{}{"sessionId": "codes", "modelName": "gemini", "contents": userTurn("Hi")}
+			}
+			w := postJSON(t, chatHandler, "/chat", payload)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := decodeError(t, w); got.Code != tt.wantCode || got.Message == "" {
+				t.Errorf("error = %+v, want code %s with a message", got, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestStorageErrorCode(t *testing.T) {
+	mr := setupRedis(t)
+	stubChat(t, "gemini", reply("Hi"))
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "codes", "modelName": "gemini", "contents": userTurn("Hi")})
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+	if got := decodeError(t, w); got.Code != codeStorageError {
+		t.Errorf("code = %q, want %s", got.Code, codeStorageError)
+	}
+}
+
+func TestProviderErrorNamesProviderAndModel(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &overloadRetries, 0)
+	flakyClaudeAPI(t, http.StatusTooManyRequests)
+
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "attributed-1", "modelName": "claude", "contents": userTurn("Hi")})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429, body %s", w.Code, w.Body)
+	}
+	e := decodeError(t, w)
+	if e.Provider != "Claude" || e.Model != claudeModelID {
+		t.Errorf("error provider %q, model %q; want Claude and %q", e.Provider, e.Model, claudeModelID)
+	}
+	if want := fmt.Sprintf("provider Claude (%s): ", claudeModelID); !strings.HasPrefix(e.Message, want) {
+		t.Errorf("message = %q, want it to start with %q", e.Message, want)
+	}
+}
+
+func TestProviderErrorWrappedOnce(t *testing.T) {
+	err := errors.New("boom")
+	wrapProviderError(&err, "Gemini", "gemini-test")
+	wrapProviderError(&err, "Claude", "claude-test")
+	var provErr *providerError
+	if !errors.As(err, &provErr) || provErr.Provider != "Gemini" {
+		t.Fatalf("err = %v, want it attributed to the provider that failed first", err)
+	}
+	if err.Error() != "provider Gemini (gemini-test): boom" {
+		t.Errorf("message = %q", err)
+	}
+
+	var none error
+	wrapProviderError(&none, "Gemini", "gemini-test")
+	if none != nil {
+		t.Errorf("nil error wrapped into %v", none)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "fmt"
+
+// Request bodies may carry an "apiVersion" naming the revision of the
+// payload semantics the client was written against. A version this server
+// doesn't know is rejected rather than guessed at; an absent one means the
+// current version.
+const (
+	minAPIVersion     = 1
+	currentAPIVersion = 1
+)
+
+// applyAPIVersion checks the payload's apiVersion and fills in the defaults
+// of older versions, so the rest of the handler only deals with the current
+// semantics. When a version changes the meaning of a field, its defaults go
+// here.
+func applyAPIVersion(clientPayload *ClientRequestPayload) error {
+	if clientPayload.APIVersion == 0 {
+		clientPayload.APIVersion = currentAPIVersion
+	}
+	if clientPayload.APIVersion < minAPIVersion || clientPayload.APIVersion > currentAPIVersion {
+		if minAPIVersion == currentAPIVersion {
+			return fmt.Errorf("unsupported apiVersion %d: this server only supports apiVersion %d", clientPayload.APIVersion, currentAPIVersion)
+		}
+		return fmt.Errorf("unsupported apiVersion %d: this server supports apiVersion %d to %d", clientPayload.APIVersion, minAPIVersion, currentAPIVersion)
+	}
+	return nil
+}
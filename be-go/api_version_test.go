@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestAPIVersion(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Hello"))
+
+	tests := []struct {
+		name    string
+		version interface{}
+		status  int
+	}{
+		{"absent", nil, http.StatusOK},
+		{"current", currentAPIVersion, http.StatusOK},
+		{"newer", currentAPIVersion + 1, http.StatusBadRequest},
+		{"negative", -1, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := map[string]interface{}{"sessionId": "version-" + tt.name, "modelName": "gemini", "contents": userTurn("Hi")}
+			if tt.version != nil {
+				payload["apiVersion"] = tt.version
+			}
+			w := postJSON(t, chatHandler, "/chat", payload)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d, body %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusBadRequest {
+				return
+			}
+			e := decodeError(t, w)
+			if e.Code != codeInvalidRequest || e.Message != fmt.Sprintf("unsupported apiVersion %v: this server only supports apiVersion 1", tt.version) {
+				t.Errorf("error = %+v, want a clear unsupported version message", e)
+			}
+		})
+	}
+}
+
+func TestAPIVersionDefaultsToCurrent(t *testing.T) {
+	var payload ClientRequestPayload
+	if err := applyAPIVersion(&payload); err != nil || payload.APIVersion != currentAPIVersion {
+		t.Fatalf("apiVersion = %d, %v; want the current version", payload.APIVersion, err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// maxAttachmentBytes caps the text of one uploaded attachment.
+var maxAttachmentBytes = envInt("MAX_ATTACHMENT_BYTES", 1<<20)
+
+// errAttachmentNotFound is returned when a new message references an
+// attachment that was never uploaded or has expired.
+var errAttachmentNotFound = errors.New("attachment not found")
+
+// Attachment is a document uploaded once through POST /attachments and
+// referenced by ID from messages, so its text is not repeated in every
+// stored turn. It is stored under attachment:<id>.
+type Attachment struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// attachmentKey is the Redis key holding an attachment.
+func attachmentKey(id string) string {
+	return "attachment:" + id
+}
+
+// saveAttachment stores an attachment with the history TTL.
+func saveAttachment(a *Attachment) error {
+	if redisClient == nil {
+		return fmt.Errorf("Redis client is not initialized")
+	}
+	attachmentJSON, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("error marshaling attachment: %w", err)
+	}
+	if err := redisClient.Set(ctx, attachmentKey(a.ID), attachmentJSON, CHAT_HISTORY_TTL).Err(); err != nil {
+		return fmt.Errorf("redis error saving attachment: %w", err)
+	}
+	return nil
+}
+
+// getAttachment loads an attachment and extends its TTL, so attachments stay
+// available for as long as the sessions using them. It returns
+// errAttachmentNotFound for unknown IDs.
+func getAttachment(id string) (*Attachment, error) {
+	if redisClient == nil {
+		return nil, fmt.Errorf("Redis client is not initialized")
+	}
+	attachmentJSON, err := redisClient.GetEx(ctx, attachmentKey(id), CHAT_HISTORY_TTL).Result()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("%w: %s", errAttachmentNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis error retrieving attachment: %w", err)
+	}
+	var a Attachment
+	if err := json.Unmarshal([]byte(attachmentJSON), &a); err != nil {
+		return nil, fmt.Errorf("error unmarshaling attachment: %w", err)
+	}
+	return &a, nil
+}
+
+// resolveAttachments returns messages with the text of every referenced
+// attachment placed before the message's own text. A missing attachment is
+// an error for the newest message; on older turns, whose attachments may have
+// expired, it is replaced by a note so the session stays usable.
+func resolveAttachments(messages []Message) ([]Message, error) {
+	var resolved []Message
+	for i, m := range messages {
+		if len(m.Attachments) == 0 {
+			continue
+		}
+		if resolved == nil {
+			resolved = append([]Message(nil), messages...)
+		}
+		var text strings.Builder
+		for _, id := range m.Attachments {
+			a, err := getAttachment(id)
+			if errors.Is(err, errAttachmentNotFound) && i < len(messages)-1 {
+				slog.Debug("Referenced attachment is gone", "attachmentId", id)
+				fmt.Fprintf(&text, "[Attachment %s is no longer available]\n\n", id)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			name := a.Name
+			if name == "" {
+				name = a.ID
+			}
+			text.WriteString(formatAttachment(name, a.Text))
+		}
+		text.WriteString(m.Text)
+		resolved[i].Text = text.String()
+	}
+	if resolved == nil {
+		return messages, nil
+	}
+	return resolved, nil
+}
+
+// attachmentsHandler stores an uploaded attachment (POST {"name", "text"})
+// and returns its ID for use in a message's attachments.
+func attachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only POST requests are allowed")
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+
+	var upload struct {
+		Name string `json:"name"`
+		Text string `json:"text"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxAttachmentBytes)+4096)
+	if err := decodeJSON(r.Body, &upload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid attachment payload")
+		return
+	}
+	if upload.Text == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing attachment text")
+		return
+	}
+	if len(upload.Text) > maxAttachmentBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, codeInvalidRequest, fmt.Sprintf("Attachment is larger than %d bytes", maxAttachmentBytes))
+		return
+	}
+
+	text := upload.Text
+	if redactPIIEnabled {
+		text, _ = redactPII(text)
+	}
+	a := &Attachment{ID: newRequestID(), Name: upload.Name, Text: text, CreatedAt: time.Now().UTC()}
+	if err := saveAttachment(a); err != nil {
+		slog.Error("Error saving attachment", "error", err)
+		writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error saving attachment")
+		return
+	}
+	writeJSON(w, r, http.StatusCreated, map[string]string{"id": a.ID})
+}
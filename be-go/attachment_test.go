@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// uploadAttachment posts an attachment and returns its ID.
+func uploadAttachment(t *testing.T, name, text string) string {
+	t.Helper()
+	w := postJSON(t, attachmentsHandler, "/attachments", map[string]string{"name": name, "text": text})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload status = %d, body %s", w.Code, w.Body)
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	decodeBody(t, w, &resp)
+	if resp.ID == "" {
+		t.Fatal("upload returned no attachment ID")
+	}
+	return resp.ID
+}
+
+func TestAttachmentUpload(t *testing.T) {
+	mr := setupRedis(t)
+
+	id := uploadAttachment(t, "report.txt", "Quarterly revenue grew 12%.")
+	if !mr.Exists(attachmentKey(id)) {
+		t.Fatalf("attachment not stored under %s", attachmentKey(id))
+	}
+	a, err := getAttachment(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Name != "report.txt" || a.Text != "Quarterly revenue grew 12%." {
+		t.Fatalf("stored attachment = %+v", a)
+	}
+
+	w := postJSON(t, attachmentsHandler, "/attachments", map[string]string{"name": "empty.txt"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("empty upload status = %d, want 400", w.Code)
+	}
+}
+
+func TestAttachmentResolvedIntoPrompt(t *testing.T) {
+	setupRedis(t)
+	requests := recordRequests(t, "gemini", "It grew 12%.")
+	id := uploadAttachment(t, "report.txt", "Quarterly revenue grew 12%.")
+
+	chatTurn(t, map[string]interface{}{
+		"sessionId": "attachment-1",
+		"modelName": "gemini",
+		"contents":  []map[string]interface{}{{"role": "user", "text": "How much did revenue grow?", "attachments": []string{id}}},
+	})
+
+	if userText := lastUserText((*requests)[0].Messages); !strings.Contains(userText, "Quarterly revenue grew 12%.") || !strings.Contains(userText, "How much did revenue grow?") {
+		t.Fatalf("provider user message = %q, want the attachment text and the question", userText)
+	}
+	history := storedHistory(t, "attachment-1")
+	for _, m := range history {
+		if strings.Contains(m.Text, "Quarterly revenue") {
+			t.Fatalf("stored %s message %q duplicates the attachment text", m.Role, m.Text)
+		}
+	}
+	user := history[len(history)-2]
+	if len(user.Attachments) != 1 || user.Attachments[0] != id {
+		t.Fatalf("stored user attachments = %v, want [%s]", user.Attachments, id)
+	}
+}
+
+func TestMissingAttachment(t *testing.T) {
+	setupRedis(t)
+	requests := recordRequests(t, "gemini", "unused")
+
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{
+		"sessionId": "attachment-2",
+		"modelName": "gemini",
+		"contents":  []map[string]interface{}{{"role": "user", "text": "Summarize it", "attachments": []string{"missing-id"}}},
+	})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404, body %s", w.Code, w.Body)
+	}
+	if e := decodeError(t, w); e.Code != codeNotFound {
+		t.Fatalf("error code = %q, want %q", e.Code, codeNotFound)
+	}
+	if len(*requests) != 0 {
+		t.Fatalf("provider calls = %d, want none", len(*requests))
+	}
+}
+
+func TestExpiredAttachmentOnOlderTurn(t *testing.T) {
+	setupRedis(t)
+
+	messages, err := resolveAttachments([]Message{
+		{Role: "user", Text: "Summarize it", Attachments: []string{"gone"}},
+		{Role: "ai", Text: "Done"},
+		{Role: "user", Text: "Thanks"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(messages[0].Text, "[Attachment gone is no longer available]") {
+		t.Fatalf("older turn = %q, want a note for the expired attachment", messages[0].Text)
+	}
+}
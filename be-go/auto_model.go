@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// autoModelName is the pseudo-model that picks a concrete model per request
+// by weight, for A/B testing models against each other.
+const autoModelName = "auto"
+
+// modelWeight is one entry of AUTO_MODEL_WEIGHTS.
+type modelWeight struct {
+	Model  string
+	Weight float64
+}
+
+// autoModelWeights lists the models "auto" chooses from, read from
+// AUTO_MODEL_WEIGHTS as comma-separated model=weight pairs:
+//
+//	AUTO_MODEL_WEIGHTS=gemini=3,claude=1
+var autoModelWeights = loadAutoModelWeights()
+
+// autoModelSticky keeps a session on the model "auto" first chose for it.
+// Set AUTO_MODEL_STICKY=false to pick again on every turn.
+var autoModelSticky = os.Getenv("AUTO_MODEL_STICKY") != "false"
+
+// autoModelRand returns a number in [0, 1) for the weighted choice.
+var autoModelRand = rand.Float64
+
+var errNoAutoModel = errors.New(`no model configured for "auto", set AUTO_MODEL_WEIGHTS`)
+
+// errAutoModelHistory wraps a failure to read the session a sticky choice
+// is made from.
+var errAutoModelHistory = errors.New("reading session history for auto")
+
+func loadAutoModelWeights() []modelWeight {
+	value := os.Getenv("AUTO_MODEL_WEIGHTS")
+	if value == "" {
+		return nil
+	}
+	var weights []modelWeight
+	for _, pair := range strings.Split(value, ",") {
+		model, weight, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		w, err := strconv.ParseFloat(weight, 64)
+		if model == "" || err != nil || w <= 0 {
+			warnConfig("Ignoring invalid AUTO_MODEL_WEIGHTS entry", "entry", pair)
+			continue
+		}
+		if _, ok := providers[model]; !ok {
+			warnConfig("Ignoring AUTO_MODEL_WEIGHTS entry for an unregistered model", "model", model)
+			continue
+		}
+		weights = append(weights, modelWeight{Model: model, Weight: w})
+	}
+	return weights
+}
+
+// pickWeighted chooses one of the eligible models with a probability
+// proportional to its weight. It returns "" when none is eligible.
+func pickWeighted(weights []modelWeight, eligible func(string) bool) string {
+	total := 0.0
+	for _, w := range weights {
+		if eligible(w.Model) {
+			total += w.Weight
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	target := autoModelRand() * total
+	chosen := ""
+	for _, w := range weights {
+		if !eligible(w.Model) {
+			continue
+		}
+		chosen = w.Model
+		if target < w.Weight {
+			break
+		}
+		target -= w.Weight
+	}
+	return chosen
+}
+
+// stickyModel returns the model that answered the first reply of history, or
+// "" when none is recorded.
+func stickyModel(history []Message) string {
+	for _, m := range history {
+		if m.Role == "ai" && m.Model != "" {
+			return m.Model
+		}
+	}
+	return ""
+}
+
+// resolveAutoModel picks the concrete model for an "auto" request. Persisted
+// sessions keep the model of their first reply when it is still eligible and
+// AUTO_MODEL_STICKY is on; otherwise a model is drawn by weight. Models
+// whose circuit breaker is open are passed over while a healthy one is left.
+// eligible reports whether the calling endpoint can use a model.
+func resolveAutoModel(clientPayload ClientRequestPayload, eligible func(string) bool) (string, error) {
+	if autoModelSticky && clientPayload.persistEnabled() {
+		history, err := getHistoryFromRedis(clientPayload.SessionID)
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", errAutoModelHistory, err)
+		}
+		if model := stickyModel(history); model != "" && eligible(model) {
+			if !breakerOpen(model) {
+				return model, nil
+			}
+			slog.Info("Sticky model is unhealthy, selecting another for this turn", "sessionId", clientPayload.SessionID, "model", model)
+		}
+	}
+
+	candidates := make([]string, 0, len(autoModelWeights))
+	for _, w := range autoModelWeights {
+		if eligible(w.Model) {
+			candidates = append(candidates, w.Model)
+		}
+	}
+	allowed := make(map[string]bool)
+	for _, name := range healthiest(candidates) {
+		allowed[name] = true
+	}
+	model := pickWeighted(autoModelWeights, func(name string) bool { return allowed[name] })
+	if model == "" {
+		return "", errNoAutoModel
+	}
+	slog.Debug("Selected model for auto", "sessionId", clientPayload.SessionID, "model", model)
+	return model, nil
+}
+
+// writeAutoModelError writes the response for an error from resolveAutoModel.
+func writeAutoModelError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNoAutoModel):
+		writeError(w, http.StatusBadRequest, codeModelNotFound, err.Error())
+	case errors.Is(err, errAutoModelHistory):
+		slog.Error("Error in getHistoryFromRedis", "error", err)
+		writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving history")
+	default:
+		slog.Error("Error selecting model for auto", "error", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Internal server error selecting a model")
+	}
+}
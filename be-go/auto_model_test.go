@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var testAutoWeights = []modelWeight{{Model: "gemini", Weight: 3}, {Model: "claude", Weight: 1}}
+
+func TestPickWeighted(t *testing.T) {
+	all := func(string) bool { return true }
+	for _, tt := range []struct {
+		draw float64
+		want string
+	}{
+		{0, "gemini"},
+		{0.74, "gemini"},
+		{0.76, "claude"},
+		{0.999, "claude"},
+	} {
+		setVar(t, &autoModelRand, func() float64 { return tt.draw })
+		if got := pickWeighted(testAutoWeights, all); got != tt.want {
+			t.Errorf("draw %v picked %q, want %q", tt.draw, got, tt.want)
+		}
+	}
+
+	setVar(t, &autoModelRand, func() float64 { return 0 })
+	if got := pickWeighted(testAutoWeights, func(m string) bool { return m == "claude" }); got != "claude" {
+		t.Errorf("picked %q, want the only eligible model", got)
+	}
+	if got := pickWeighted(testAutoWeights, func(string) bool { return false }); got != "" {
+		t.Errorf("picked %q with no eligible model", got)
+	}
+}
+
+func TestPickWeightedDistribution(t *testing.T) {
+	counts := map[string]int{}
+	const draws = 4000
+	for i := 0; i < draws; i++ {
+		counts[pickWeighted(testAutoWeights, func(string) bool { return true })]++
+	}
+	if share := float64(counts["gemini"]) / draws; share < 0.70 || share > 0.80 {
+		t.Errorf("gemini picked %.0f%% of the time, want about 75%%", share*100)
+	}
+}
+
+func TestAutoModelSticksToSession(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &autoModelWeights, testAutoWeights)
+	stubChat(t, "gemini", reply("From Gemini"))
+	stubChat(t, "claude", reply("From Claude"))
+	draw := 0.9
+	setVar(t, &autoModelRand, func() float64 { return draw })
+
+	first := chatTurn(t, map[string]interface{}{"sessionId": "auto-1", "modelName": "auto", "contents": userTurn("Hi")})
+	if first.Model != "claude" || first.Text != "From Claude" {
+		t.Fatalf("first turn = %q from %q, want claude", first.Text, first.Model)
+	}
+
+	// A draw that would pick gemini keeps the session on claude.
+	draw = 0
+	second := chatTurn(t, map[string]interface{}{"sessionId": "auto-1", "modelName": "auto", "contents": userTurn("Again")})
+	if second.Model != "claude" {
+		t.Errorf("second turn model = %q, want the sticky claude", second.Model)
+	}
+	for _, m := range storedHistory(t, "auto-1") {
+		if m.Role == "ai" && m.Model != "claude" {
+			t.Errorf("stored reply model = %q, want claude", m.Model)
+		}
+	}
+
+	setVar(t, &autoModelSticky, false)
+	if third := chatTurn(t, map[string]interface{}{"sessionId": "auto-1", "modelName": "auto", "contents": userTurn("Once more")}); third.Model != "gemini" {
+		t.Errorf("non-sticky turn model = %q, want a fresh draw of gemini", third.Model)
+	}
+}
+
+func TestAutoModelErrors(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &autoModelWeights, nil)
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "auto-2", "modelName": "auto", "contents": userTurn("Hi")})
+	if got := decodeError(t, w); w.Code != http.StatusBadRequest || got.Code != codeModelNotFound {
+		t.Errorf("no weights: %d %q, want 400 %s", w.Code, got.Code, codeModelNotFound)
+	}
+
+	setVar(t, &autoModelWeights, testAutoWeights)
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	w = postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "auto-2", "modelName": "auto", "contents": userTurn("Hi")})
+	if got := decodeError(t, w); w.Code != http.StatusInternalServerError || got.Code != codeStorageError {
+		t.Errorf("history error: %d %q, want 500 %s", w.Code, got.Code, codeStorageError)
+	}
+}
+
+func TestWriteAutoModelError(t *testing.T) {
+	for _, tt := range []struct {
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{errNoAutoModel, http.StatusBadRequest, codeModelNotFound},
+		{fmt.Errorf("%w: %w", errAutoModelHistory, errors.New("i/o timeout")), http.StatusInternalServerError, codeStorageError},
+		{errors.New("unexpected"), http.StatusInternalServerError, codeInternalError},
+	} {
+		w := httptest.NewRecorder()
+		writeAutoModelError(w, tt.err)
+		if got := decodeError(t, w); w.Code != tt.wantStatus || got.Code != tt.wantCode {
+			t.Errorf("%v: %d %q, want %d %s", tt.err, w.Code, got.Code, tt.wantStatus, tt.wantCode)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A model's circuit breaker opens after breakerFailures consecutive outage
+// errors and stays open for breakerCooldown. Open breakers don't block calls;
+// they steer model selection (such as "auto") towards healthy providers. After
+// the cooldown the next call probes the provider again: success closes the
+// breaker, another failure reopens it.
+var (
+	breakerFailures = envInt("BREAKER_FAILURES", 5)
+	breakerCooldown = envDuration("BREAKER_COOLDOWN", 30*time.Second)
+)
+
+// breakerState is the health record of one model.
+type breakerState struct {
+	failures    int
+	openUntil   time.Time
+	lastFailure time.Time
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*breakerState)
+)
+
+// isOutage reports whether err says something about the provider's health,
+// as opposed to the request (a rejected prompt, blocked content) or the
+// client going away.
+func isOutage(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr *providerStatusError
+	if errors.As(err, &statusErr) && statusErr.Status < 500 && statusErr.Status != http.StatusTooManyRequests {
+		return false
+	}
+	status, _ := providerErrorCode(err)
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// recordProviderResult updates the breaker of modelName after a call.
+func recordProviderResult(modelName string, err error) {
+	if err != nil && !isOutage(err) {
+		return
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	state, ok := breakers[modelName]
+	if !ok {
+		state = &breakerState{}
+		breakers[modelName] = state
+	}
+	if err == nil {
+		state.failures = 0
+		state.openUntil = time.Time{}
+		return
+	}
+	now := time.Now()
+	state.failures++
+	state.lastFailure = now
+	if breakerFailures > 0 && state.failures >= breakerFailures {
+		if !state.openUntil.After(now) {
+			slog.Warn("Opening circuit breaker", "model", modelName, "failures", state.failures, "cooldown", breakerCooldown)
+		}
+		state.openUntil = now.Add(breakerCooldown)
+	}
+}
+
+// breakerOpen reports whether modelName is currently considered unhealthy.
+func breakerOpen(modelName string) bool {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	state, ok := breakers[modelName]
+	return ok && state.openUntil.After(time.Now())
+}
+
+// lastFailure returns when modelName last failed, or the zero time.
+func lastFailure(modelName string) time.Time {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	if state, ok := breakers[modelName]; ok {
+		return state.lastFailure
+	}
+	return time.Time{}
+}
+
+// withBreaker records every call's outcome in the breaker of modelName.
+func withBreaker(modelName string, call chatFunc) chatFunc {
+	return func(ctx context.Context, req ProviderRequest) (ProviderResponse, error) {
+		result, err := call(ctx, req)
+		recordProviderResult(modelName, err)
+		return result, err
+	}
+}
+
+// withStreamBreaker is withBreaker for streaming calls.
+func withStreamBreaker(modelName string, stream streamFunc) streamFunc {
+	return func(ctx context.Context, req ProviderRequest, onDelta func(string) error) (string, error) {
+		text, err := stream(ctx, req, onDelta)
+		recordProviderResult(modelName, err)
+		return text, err
+	}
+}
+
+// healthiest narrows candidates to those whose breaker is closed. When every
+// candidate is degraded it returns the one that failed least recently.
+func healthiest(candidates []string) []string {
+	var healthy []string
+	for _, name := range candidates {
+		if !breakerOpen(name) {
+			healthy = append(healthy, name)
+		}
+	}
+	if len(healthy) > 0 || len(candidates) == 0 {
+		return healthy
+	}
+	best := candidates[0]
+	for _, name := range candidates[1:] {
+		if lastFailure(name).Before(lastFailure(best)) {
+			best = name
+		}
+	}
+	return []string{best}
+}
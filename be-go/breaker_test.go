@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// openBreaker records enough outages to open the breaker of model.
+func openBreaker(model string) {
+	for i := 0; i < breakerFailures; i++ {
+		recordProviderResult(model, errProviderOverloaded)
+	}
+}
+
+func TestAutoRoutesAroundOpenBreaker(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &breakers, map[string]*breakerState{})
+	setVar(t, &autoModelWeights, testAutoWeights)
+	setVar(t, &autoModelRand, func() float64 { return 0 })
+	stubChat(t, "gemini", reply("From Gemini"))
+	stubChat(t, "claude", reply("From Claude"))
+	openBreaker("gemini")
+
+	// The draw favours gemini, whose breaker is open.
+	resp := chatTurn(t, map[string]interface{}{"sessionId": "breaker-1", "modelName": "auto", "contents": userTurn("Hi")})
+	if resp.Model != "claude" {
+		t.Fatalf("model = %q, want claude while gemini's breaker is open", resp.Model)
+	}
+}
+
+func TestStickyModelSkippedWhileUnhealthy(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &breakers, map[string]*breakerState{})
+	setVar(t, &autoModelWeights, testAutoWeights)
+	setVar(t, &autoModelRand, func() float64 { return 0.9 })
+	stubChat(t, "gemini", reply("From Gemini"))
+	stubChat(t, "claude", reply("From Claude"))
+
+	chatTurn(t, map[string]interface{}{"sessionId": "breaker-2", "modelName": "auto", "contents": userTurn("Hi")})
+	openBreaker("claude")
+	if resp := chatTurn(t, map[string]interface{}{"sessionId": "breaker-2", "modelName": "auto", "contents": userTurn("Again")}); resp.Model != "gemini" {
+		t.Errorf("model = %q, want gemini while the sticky claude is unhealthy", resp.Model)
+	}
+}
+
+func TestHealthiest(t *testing.T) {
+	setVar(t, &breakers, map[string]*breakerState{})
+	openBreaker("gemini")
+	if got := healthiest([]string{"gemini", "claude"}); len(got) != 1 || got[0] != "claude" {
+		t.Errorf("healthiest = %v, want [claude]", got)
+	}
+
+	// With every candidate degraded, the least recently failed is used.
+	time.Sleep(time.Millisecond)
+	openBreaker("claude")
+	if got := healthiest([]string{"claude", "gemini"}); len(got) != 1 || got[0] != "gemini" {
+		t.Errorf("healthiest = %v, want [gemini], which failed first", got)
+	}
+}
+
+func TestBreakerIgnoresClientErrors(t *testing.T) {
+	setVar(t, &breakers, map[string]*breakerState{})
+	for i := 0; i < breakerFailures; i++ {
+		recordProviderResult("gemini", &providerStatusError{Status: 400, Body: "bad request"})
+		recordProviderResult("gemini", errContentBlocked)
+	}
+	if breakerOpen("gemini") {
+		t.Error("breaker opened on errors caused by the request")
+	}
+
+	openBreaker("gemini")
+	recordProviderResult("gemini", nil)
+	if breakerOpen("gemini") {
+		t.Error("breaker still open after a successful call")
+	}
+	if !isOutage(errProviderOverloaded) {
+		t.Error("an overloaded provider is not an outage")
+	}
+}
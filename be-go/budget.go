@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// maxAttempts caps the total number of upstream provider calls a single client
+// request may make, across retries and fallbacks. 0 disables the cap.
+var maxAttempts = envInt("MAX_ATTEMPTS", 5)
+
+// errAttemptBudgetExhausted is returned instead of making a call once the
+// request has used up its attempts.
+var errAttemptBudgetExhausted = errors.New("upstream attempt budget exhausted")
+
+type attemptBudgetKey struct{}
+
+// attemptBudget counts the upstream calls left for one client request. It is
+// shared by everything running under the request's context.
+type attemptBudget struct {
+	remaining atomic.Int64
+}
+
+// withAttemptBudget returns a context carrying a budget of n upstream calls.
+// A non-positive n leaves the context unbudgeted.
+func withAttemptBudget(parent context.Context, n int) context.Context {
+	if n <= 0 {
+		return parent
+	}
+	budget := &attemptBudget{}
+	budget.remaining.Store(int64(n))
+	return context.WithValue(parent, attemptBudgetKey{}, budget)
+}
+
+// consumeAttempt takes one attempt from the context's budget before an
+// upstream call. Contexts without a budget are never limited.
+func consumeAttempt(ctx context.Context) error {
+	budget, ok := ctx.Value(attemptBudgetKey{}).(*attemptBudget)
+	if !ok {
+		return nil
+	}
+	if budget.remaining.Add(-1) < 0 {
+		return fmt.Errorf("%w (MAX_ATTEMPTS=%d)", errAttemptBudgetExhausted, maxAttempts)
+	}
+	return nil
+}
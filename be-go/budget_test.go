@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAttemptBudgetCapsRetriesAndFallback(t *testing.T) {
+	setVar(t, &overloadRetries, 2)
+	setVar(t, &overloadBackoff, time.Millisecond)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var payload OpenaiPayload
+		decodeJSON(r.Body, &payload)
+		if payload.Messages[0].Role == "system" {
+			http.Error(w, `{"error":"system messages are not supported"}`, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(statusOverloaded)
+	}))
+	defer srv.Close()
+	provider := &OpenAICompatibleProvider{Name: "Budgeted", Key: "budgeted", URL: srv.URL, Model: "m"}
+	call := withSystemPromptFallback("budgeted", provider.Chat)
+	req := ProviderRequest{
+		Messages:             []Message{{Role: "system", Text: "Be brief."}, {Role: "user", Text: "Hi"}},
+		SystemPromptStrategy: systemPromptNative,
+	}
+
+	// Unbudgeted, the rejected system prompt and the overload retries of
+	// the fallback make four calls.
+	if _, err := call(context.Background(), req); err == nil {
+		t.Fatal("call succeeded, want the overload error")
+	}
+	if got := calls.Load(); got != 4 {
+		t.Fatalf("unbudgeted calls = %d, want 4", got)
+	}
+
+	calls.Store(0)
+	_, err := call(withAttemptBudget(context.Background(), 3), req)
+	if !errors.Is(err, errAttemptBudgetExhausted) {
+		t.Fatalf("error = %v, want errAttemptBudgetExhausted", err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("budgeted calls = %d, want 3", got)
+	}
+}
+
+func TestConsumeAttemptWithoutBudget(t *testing.T) {
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if err := consumeAttempt(ctx); err != nil {
+			t.Fatalf("consumeAttempt without a budget = %v", err)
+		}
+	}
+	if withAttemptBudget(ctx, 0) != ctx {
+		t.Fatal("a zero budget should leave the context unbudgeted")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// sessionBundleVersion is the schema version of session bundles. Imports of
+// any other version are refused, so it must be bumped whenever the bundle
+// changes in a way older instances would misread.
+const sessionBundleVersion = 1
+
+// SessionBundle is the portable form of a session, served by GET /chat/bundle
+// and accepted by POST /chat/bundle, for backups and moving sessions between
+// instances. Attachments holds those the history references that had not
+// expired when it was exported.
+type SessionBundle struct {
+	Version     int           `json:"version"`
+	SessionID   string        `json:"sessionId"`
+	History     []Message     `json:"history"`
+	Meta        *SessionMeta  `json:"meta,omitempty"`
+	Attachments []*Attachment `json:"attachments,omitempty"`
+	ExportedAt  time.Time     `json:"exportedAt"`
+}
+
+// exportSessionBundle collects the stored state of a session. It returns nil
+// (and no error) for a session with no history.
+func exportSessionBundle(sessionId string) (*SessionBundle, error) {
+	history, err := getHistoryAllowStale(sessionId)
+	if err != nil || len(history) == 0 {
+		return nil, err
+	}
+	meta, err := getSessionMeta(sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &SessionBundle{Version: sessionBundleVersion, SessionID: sessionId, History: history, Meta: meta, ExportedAt: time.Now().UTC()}
+	seen := map[string]bool{}
+	for _, m := range history {
+		for _, id := range m.Attachments {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			a, err := getAttachment(id)
+			if errors.Is(err, errAttachmentNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			bundle.Attachments = append(bundle.Attachments, a)
+		}
+	}
+	return bundle, nil
+}
+
+// validate checks that a bundle can be imported.
+func (b *SessionBundle) validate() error {
+	if b.Version != sessionBundleVersion {
+		return fmt.Errorf("unsupported bundle version %d, expected %d", b.Version, sessionBundleVersion)
+	}
+	if b.SessionID == "" {
+		return errors.New("missing sessionId")
+	}
+	if len(b.History) == 0 {
+		return errors.New("missing history")
+	}
+	for i := range b.History {
+		switch b.History[i].Role = normalizeRole(b.History[i].Role); b.History[i].Role {
+		case "user", "ai", "system", "tool":
+		default:
+			return fmt.Errorf("history message %d has invalid role %q", i, b.History[i].Role)
+		}
+	}
+	for _, a := range b.Attachments {
+		if a == nil || a.ID == "" {
+			return errors.New("attachments must have an id")
+		}
+	}
+	if b.Meta != nil && b.Meta.Generation != nil {
+		if err := b.Meta.Generation.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importSessionBundle stores a validated bundle, replacing the session's
+// history and, when the bundle has it, its metadata. Its tenant is the one the
+// metadata names, if this instance has it.
+func importSessionBundle(b *SessionBundle) error {
+	for _, a := range b.Attachments {
+		if err := saveAttachment(a); err != nil {
+			return err
+		}
+	}
+
+	tenant := defaultTenant
+	if b.Meta != nil {
+		previous, err := getSessionMeta(b.SessionID)
+		if err != nil {
+			return err
+		}
+		previousOwner := ""
+		if previous != nil {
+			previousOwner = previous.Owner
+		}
+		if err := claimOwnerSession(b.Meta.Owner, previousOwner, b.SessionID); err != nil {
+			return err
+		}
+		b.Meta.SessionID = b.SessionID
+		tenant = tenantNamed(b.Meta.Tenant)
+		if err := saveSessionMeta(b.Meta); err != nil {
+			return err
+		}
+	}
+	return saveHistoryToRedis(b.SessionID, b.History, tenant)
+}
+
+// bundleHandler exports a session as a bundle (GET ?sessionId=...) or
+// imports one (POST), both for admins only: a bundle holds the whole stored
+// session, system prompts included, which HIDE_SYSTEM_IN_HISTORY keeps from
+// other clients. An import refuses to replace a session that already has
+// history unless ?overwrite=true is given.
+func bundleHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !requireAdmin(w, r) {
+			return
+		}
+		sessionId := r.URL.Query().Get("sessionId")
+		if sessionId == "" {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing sessionId query parameter")
+			return
+		}
+
+		bundle, err := exportSessionBundle(sessionId)
+		if err != nil {
+			slog.Error("Error exporting session bundle", "sessionId", sessionId, "error", err)
+			writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving session")
+			return
+		}
+		if bundle == nil {
+			writeError(w, http.StatusNotFound, codeNotFound, "Session not found")
+			return
+		}
+		writeJSON(w, r, http.StatusOK, bundle)
+	case "POST":
+		if !requireAdmin(w, r) || !requireJSON(w, r) {
+			return
+		}
+		var bundle SessionBundle
+		if err := decodeJSON(r.Body, &bundle); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+			return
+		}
+		if err := bundle.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid bundle: "+err.Error())
+			return
+		}
+
+		lock, ok := admitSessionLock(w, r, bundle.SessionID)
+		if !ok {
+			return
+		}
+		defer lock.release()
+
+		if r.URL.Query().Get("overwrite") != "true" {
+			existing, err := getHistoryFromRedis(bundle.SessionID)
+			if err != nil {
+				slog.Error("Error in getHistoryFromRedis", "sessionId", bundle.SessionID, "error", err)
+				writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving history")
+				return
+			}
+			if len(existing) > 0 {
+				writeError(w, http.StatusConflict, codeInvalidRequest, "Session already exists, set overwrite=true to replace it")
+				return
+			}
+		}
+
+		err := importSessionBundle(&bundle)
+		if errors.Is(err, errSessionCapReached) {
+			writeError(w, http.StatusTooManyRequests, codeSessionLimit, fmt.Sprintf("Owner already has the maximum of %d sessions", maxSessionsPerOwner))
+			return
+		}
+		if err != nil {
+			slog.Error("Error importing session bundle", "sessionId", bundle.SessionID, "error", err)
+			writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error saving session")
+			return
+		}
+		writeJSON(w, r, http.StatusCreated, map[string]interface{}{"sessionId": bundle.SessionID, "messages": len(bundle.History)})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only GET and POST requests are allowed")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// exportBundle fetches the bundle of a session from GET /chat/bundle.
+func exportBundle(t *testing.T, sessionId string) SessionBundle {
+	t.Helper()
+	w := httptest.NewRecorder()
+	bundleHandler(w, withAdmin(t, httptest.NewRequest("GET", "/chat/bundle?sessionId="+sessionId, nil)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("export status = %d, body %s", w.Code, w.Body)
+	}
+	var bundle SessionBundle
+	decodeBody(t, w, &bundle)
+	return bundle
+}
+
+// importBundle posts a bundle to POST /chat/bundle as an admin.
+func importBundle(t *testing.T, target string, bundle interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	bundleHandler(w, withAdmin(t, newJSONRequest(t, "POST", target, bundle)))
+	return w
+}
+
+// bundleJSON encodes a bundle without its export time, to compare bundles.
+func bundleJSON(t *testing.T, b SessionBundle) string {
+	t.Helper()
+	b.ExportedAt = time.Time{}
+	encoded, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Pack light"))
+	id := uploadAttachment(t, "list.txt", "socks, boots")
+	chatTurn(t, map[string]interface{}{
+		"sessionId": "bundle-1",
+		"modelName": "gemini",
+		"contents":  []map[string]interface{}{{"role": "user", "text": "What should I bring?", "attachments": []string{id}}},
+	})
+	temperature := 0.3
+	meta := &SessionMeta{
+		SessionID:  "bundle-1",
+		Owner:      "alice",
+		Title:      "Hiking trip",
+		Tags:       []string{"travel"},
+		Generation: &GenerationSettings{Temperature: &temperature},
+		CreatedAt:  time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		UpdatedAt:  time.Date(2026, 1, 2, 3, 5, 0, 0, time.UTC),
+	}
+	if err := saveSessionMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	exported := exportBundle(t, "bundle-1")
+	if len(exported.Attachments) != 1 || exported.Attachments[0].Text != "socks, boots" {
+		t.Fatalf("attachments = %+v, want the referenced attachment", exported.Attachments)
+	}
+	if exported.Meta == nil || exported.Meta.Title != "Hiking trip" {
+		t.Fatalf("meta = %+v, want the session's", exported.Meta)
+	}
+
+	// A fresh store, as on another instance.
+	setupRedis(t)
+	if w := importBundle(t, "/chat/bundle", exported); w.Code != http.StatusCreated {
+		t.Fatalf("import status = %d, body %s", w.Code, w.Body)
+	}
+	if got, want := bundleJSON(t, exportBundle(t, "bundle-1")), bundleJSON(t, exported); got != want {
+		t.Fatalf("imported session = %s\nwant %s", got, want)
+	}
+	sessions, err := activeOwnerSessions("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0] != "bundle-1" {
+		t.Errorf("owner sessions = %v, want the imported session", sessions)
+	}
+}
+
+func TestBundleImportRefusesExistingSession(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Hi"))
+	chatTurn(t, map[string]interface{}{"sessionId": "bundle-2", "modelName": "gemini", "contents": userTurn("Hello")})
+	bundle := exportBundle(t, "bundle-2")
+	bundle.History[len(bundle.History)-1].Text = "Replaced"
+
+	if w := importBundle(t, "/chat/bundle", bundle); w.Code != http.StatusConflict {
+		t.Fatalf("import status = %d, want 409", w.Code)
+	}
+	if w := importBundle(t, "/chat/bundle?overwrite=true", bundle); w.Code != http.StatusCreated {
+		t.Fatalf("overwrite status = %d, body %s", w.Code, w.Body)
+	}
+	history := storedHistory(t, "bundle-2")
+	if history[len(history)-1].Text != "Replaced" {
+		t.Errorf("history = %+v, want the bundle's", history)
+	}
+}
+
+func TestBundleImportValidates(t *testing.T) {
+	setupRedis(t)
+	history := []map[string]string{{"role": "user", "text": "Hi"}}
+	for name, bundle := range map[string]map[string]interface{}{
+		"version":   {"version": 2, "sessionId": "bundle-3", "history": history},
+		"sessionId": {"version": 1, "history": history},
+		"history":   {"version": 1, "sessionId": "bundle-3"},
+		"role":      {"version": 1, "sessionId": "bundle-3", "history": []map[string]string{{"role": "robot", "text": "Hi"}}},
+	} {
+		if w := importBundle(t, "/chat/bundle", bundle); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", name, w.Code)
+		}
+	}
+	if len(storedHistory(t, "bundle-3")) != 0 {
+		t.Error("an invalid bundle was stored")
+	}
+}
+
+func TestBundleRequiresAdmin(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &adminToken, "test-admin-token")
+	stubChat(t, "gemini", reply("Hi"))
+	chatTurn(t, map[string]interface{}{"sessionId": "bundle-4", "modelName": "gemini", "contents": userTurn("Hello")})
+
+	w := httptest.NewRecorder()
+	bundleHandler(w, httptest.NewRequest("GET", "/chat/bundle?sessionId=bundle-4", nil))
+	if w.Code == http.StatusOK {
+		t.Fatal("export served without admin auth")
+	}
+	w = postJSON(t, bundleHandler, "/chat/bundle", map[string]interface{}{"version": 1, "sessionId": "bundle-5", "history": userTurn("Hi")})
+	if w.Code == http.StatusCreated {
+		t.Fatal("import accepted without admin auth")
+	}
+	if len(storedHistory(t, "bundle-5")) != 0 {
+		t.Error("an unauthorized import was stored")
+	}
+}
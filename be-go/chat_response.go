@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ChatResponse is the body of a /chat reply. Every provider fills the same
+// fields, so clients never need to know which one answered.
+type ChatResponse struct {
+	Text  string    `json:"text"`
+	Model string    `json:"model"`
+	Usage turnUsage `json:"usage"`
+	// FinishReason is normalized across providers, see finishReasonName.
+	FinishReason string     `json:"finishReason,omitempty"`
+	Citations    []string   `json:"citations"`
+	ToolCalls    []ToolCall `json:"toolCalls"`
+	// Truncated is a truncationInfo, or true under TRUNCATION_DETAILS=false.
+	Truncated interface{} `json:"truncated,omitempty"`
+	// Choices holds every completion when more than one was requested.
+	Choices []string `json:"choices,omitempty"`
+	// Continuation is the part of Text a /chat/continue call added.
+	Continuation string    `json:"continuation,omitempty"`
+	Cached       bool      `json:"cached,omitempty"`
+	Duplicate    bool      `json:"duplicate,omitempty"`
+	Denied       bool      `json:"denied,omitempty"`
+	History      []Message `json:"history,omitempty"`
+	// ProviderPayload and ProviderResponse are admin debugging aids, see
+	// ?echoPayload=1 and ?rawResponse=1.
+	ProviderPayload  []echoedCall      `json:"providerPayload,omitempty"`
+	ProviderResponse []json.RawMessage `json:"providerResponse,omitempty"`
+}
+
+// newChatResponse returns a response with the fields every reply carries.
+// Citations and ToolCalls are empty lists rather than null when the
+// provider returned none.
+func newChatResponse(text, modelName string) ChatResponse {
+	return ChatResponse{Text: text, Model: modelName, Citations: []string{}, ToolCalls: []ToolCall{}}
+}
+
+// ToolCall is a tool the model asked to call, with its arguments as JSON.
+type ToolCall struct {
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+// finishReasonNames maps provider finish and stop reasons onto the names
+// reported to clients.
+var finishReasonNames = map[string]string{
+	// OpenAI-compatible
+	"stop":           "stop",
+	"length":         "length",
+	"content_filter": "content_filter",
+	"tool_calls":     "tool_calls",
+	"function_call":  "tool_calls",
+	// Gemini
+	"STOP":               "stop",
+	"MAX_TOKENS":         "length",
+	"SAFETY":             "content_filter",
+	"RECITATION":         "content_filter",
+	"BLOCKLIST":          "content_filter",
+	"SPII":               "content_filter",
+	"PROHIBITED_CONTENT": "content_filter",
+	// Anthropic
+	"end_turn":      "stop",
+	"stop_sequence": "stop",
+	"max_tokens":    "length",
+	"tool_use":      "tool_calls",
+	"refusal":       "content_filter",
+}
+
+// finishReasonName returns the normalized name of a provider's finish reason:
+// stop, length, content_filter or tool_calls, and the lowercased reason for
+// anything else.
+func finishReasonName(reason string) string {
+	if name, ok := finishReasonNames[reason]; ok {
+		return name
+	}
+	return strings.ToLower(reason)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestMultipleChoicesReturned(t *testing.T) {
+	setupRedis(t)
+	var sentN int
+	srv := fakeChatCompletions(t, `{"choices":[
+		{"message":{"role":"assistant","content":"Blue"},"finish_reason":"stop"},
+		{"message":{"role":"assistant","content":"Green"},"finish_reason":"stop"}]}`, func(_ *http.Request, payload OpenaiPayload) {
+		sentN = payload.N
+	})
+	setVar(t, &chatGPTProvider.URL, srv.URL)
+	setVar(t, &chatGPTProvider.APIKey, "test-key")
+
+	resp := chatTurn(t, map[string]interface{}{"sessionId": "choices-1", "modelName": "chatgpt", "n": 2, "contents": userTurn("Pick a colour")})
+
+	if sentN != 2 {
+		t.Errorf("n sent to the provider = %d, want 2", sentN)
+	}
+	if len(resp.Choices) != 2 || resp.Choices[0] != "Blue" || resp.Choices[1] != "Green" {
+		t.Fatalf("choices = %v, want [Blue Green]", resp.Choices)
+	}
+	if resp.Text != "Blue" {
+		t.Errorf("text = %q, want the first choice", resp.Text)
+	}
+	history := storedHistory(t, "choices-1")
+	if last := history[len(history)-1]; last.Text != "Blue" {
+		t.Errorf("stored reply = %q, want only the first choice", last.Text)
+	}
+}
+
+func TestSingleChoiceOmitsChoices(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Blue"))
+
+	resp := chatTurn(t, map[string]interface{}{"sessionId": "choices-2", "modelName": "gemini", "contents": userTurn("Pick a colour")})
+	if resp.Choices != nil {
+		t.Fatalf("choices = %v, want none without n", resp.Choices)
+	}
+}
+
+// providerReplies fakes each provider's API with the given bodies, which
+// must carry the same reply, and returns the /chat responses decoded
+// generically.
+func providerReplies(t *testing.T, gemini, claude, openai string) map[string]map[string]interface{} {
+	t.Helper()
+	responses := map[string]map[string]interface{}{}
+	ask := func(model string) {
+		w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "schema-" + model, "modelName": model, "contents": userTurn("Hi")})
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body %s", model, w.Code, w.Body)
+		}
+		var resp map[string]interface{}
+		decodeBody(t, w, &resp)
+		responses[model] = resp
+	}
+
+	setupRedis(t)
+	// The plain HTTP fake goes first: fakeProviderAPI routes every
+	// connection to its TLS server.
+	srv := fakeChatCompletions(t, openai, nil)
+	setVar(t, &chatGPTProvider.URL, srv.URL)
+	setVar(t, &chatGPTProvider.APIKey, "test-key")
+	ask("chatgpt")
+	fakeGeminiAPI(t, gemini)
+	ask("gemini")
+	fakeClaudeAPI(t, claude)
+	ask("claude")
+	return responses
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestEveryProviderSameSchema(t *testing.T) {
+	responses := providerReplies(t,
+		`{"candidates":[{"content":{"role":"model","parts":[{"text":"Hello"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":3,"candidatesTokenCount":1,"totalTokenCount":4}}`,
+		claudeHello,
+		`{"choices":[{"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":3,"completion_tokens":1,"total_tokens":4}}`)
+
+	want := sortedKeys(responses["gemini"])
+	for _, key := range []string{"text", "model", "usage", "finishReason", "citations", "toolCalls"} {
+		if _, ok := responses["gemini"][key]; !ok {
+			t.Errorf("response %v has no %q", responses["gemini"], key)
+		}
+	}
+	for model, resp := range responses {
+		if got := sortedKeys(resp); !slices.Equal(got, want) {
+			t.Errorf("%s: fields = %v, want %v", model, got, want)
+		}
+		if resp["text"] != "Hello" || resp["model"] != model || resp["finishReason"] != "stop" {
+			t.Errorf("%s: response = %v", model, resp)
+		}
+		usage := resp["usage"].(map[string]interface{})
+		if usage["promptTokens"] != float64(3) || usage["completionTokens"] != float64(1) || usage["totalTokens"] != float64(4) {
+			t.Errorf("%s: usage = %v, want the provider's counts", model, usage)
+		}
+		if citations, ok := resp["citations"].([]interface{}); !ok || len(citations) != 0 {
+			t.Errorf("%s: citations = %#v, want an empty list", model, resp["citations"])
+		}
+		if calls, ok := resp["toolCalls"].([]interface{}); !ok || len(calls) != 0 {
+			t.Errorf("%s: toolCalls = %#v, want an empty list", model, resp["toolCalls"])
+		}
+	}
+}
+
+func TestEveryProviderSameToolCalls(t *testing.T) {
+	responses := providerReplies(t,
+		`{"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"id":"call-1","name":"weather","args":{"city":"Paris"}}}]},"finishReason":"STOP"}]}`,
+		`{"content":[{"type":"tool_use","id":"call-1","name":"weather","input":{"city":"Paris"}}],"stop_reason":"tool_use"}`,
+		`{"choices":[{"message":{"role":"assistant","content":"","tool_calls":[{"id":"call-1","type":"function","function":{"name":"weather","arguments":"{\"city\":\"Paris\"}"}}]},"finish_reason":"tool_calls"}]}`)
+
+	for model, resp := range responses {
+		calls, _ := resp["toolCalls"].([]interface{})
+		if len(calls) != 1 {
+			t.Fatalf("%s: toolCalls = %#v, want one call", model, resp["toolCalls"])
+		}
+		call := calls[0].(map[string]interface{})
+		args, _ := call["arguments"].(map[string]interface{})
+		if call["id"] != "call-1" || call["name"] != "weather" || args["city"] != "Paris" {
+			t.Errorf("%s: tool call = %v", model, call)
+		}
+	}
+}
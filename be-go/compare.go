@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// /chat/compare sends one stateless conversation to several models at once,
+// at most compareMaxFanout calls in flight. Results are collected as they
+// complete until compareTimeout; models still pending then are reported as
+// timed out instead of holding up the others. Each call also keeps its own
+// per-model timeout.
+var (
+	compareMaxFanout = envInt("COMPARE_MAX_FANOUT", 4)
+	compareTimeout   = envDuration("COMPARE_TIMEOUT", 30*time.Second)
+)
+
+// Statuses of a compareResult.
+const (
+	compareOK       = "ok"
+	compareFailed   = "error"
+	compareTimedOut = "timed_out"
+	// compareCancelled is only reported by /chat/compare/stream, whose
+	// streams can be stopped from /chat/cancel.
+	compareCancelled = "cancelled"
+)
+
+// compareResult is one model's entry in a /chat/compare response.
+type compareResult struct {
+	Model     string `json:"model"`
+	Status    string `json:"status"`
+	Text      string `json:"text,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latencyMs,omitempty"`
+}
+
+// compareCall is a prepared provider call of one compared model. stream is
+// set instead of call for /chat/compare/stream.
+type compareCall struct {
+	model  string
+	call   chatFunc
+	stream streamFunc
+	req    ProviderRequest
+}
+
+// compareModels runs the calls with at most fanout in flight and returns
+// their results in order once all are done or ctx ends, whichever is first.
+func compareModels(ctx context.Context, calls []compareCall, fanout int) []compareResult {
+	results := make([]compareResult, len(calls))
+	for i, c := range calls {
+		results[i] = compareResult{Model: c.model, Status: compareTimedOut}
+	}
+	if fanout <= 0 {
+		fanout = len(calls)
+	}
+
+	type done struct {
+		index  int
+		result compareResult
+	}
+	// Buffered so calls finishing after the deadline don't block.
+	finished := make(chan done, len(calls))
+	slots := make(chan struct{}, fanout)
+	for i, c := range calls {
+		go func() {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				return
+			}
+			start := time.Now()
+			callCtx := withProviderTimeout(withAttemptBudget(ctx, maxAttempts), c.model)
+			resp, err := c.call(callCtx, c.req)
+			result := compareResult{Model: c.model, Status: compareOK, Text: resp.Text, LatencyMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				_, code := providerErrorCode(err)
+				result = compareResult{Model: c.model, Status: compareFailed, Code: code, Error: err.Error(), LatencyMs: result.LatencyMs}
+			}
+			finished <- done{index: i, result: result}
+		}()
+	}
+
+	for pending := len(calls); pending > 0; pending-- {
+		select {
+		case d := <-finished:
+			if ctx.Err() != nil && d.result.Status == compareFailed {
+				// Cut off by the deadline rather than failed on its own.
+				continue
+			}
+			results[d.index] = d.result
+		case <-ctx.Done():
+			return results
+		}
+	}
+	return results
+}
+
+// compareEvent is what a stream of /chat/compare/stream reports: a delta, or
+// its result once it ends.
+type compareEvent struct {
+	index  int
+	delta  string
+	result *compareResult
+}
+
+// streamCompare runs the streaming calls with at most fanout in flight,
+// forwarding each delta as a `data: {"model": ..., "delta": ...}` event as it
+// arrives and each model's result as an `event: done`. When ctx ends first,
+// the models still streaming get a done event with what they sent so far.
+func streamCompare(ctx context.Context, w http.ResponseWriter, calls []compareCall, fanout int) {
+	if fanout <= 0 {
+		fanout = len(calls)
+	}
+	// Events are written from this goroutine alone; a stream blocks on its
+	// next delta until then, or gives up when ctx ends.
+	events := make(chan compareEvent)
+	send := func(e compareEvent) error {
+		select {
+		case events <- e:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	slots := make(chan struct{}, fanout)
+	for i, c := range calls {
+		go func() {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				return
+			}
+			start := time.Now()
+			callCtx := withProviderTimeout(withAttemptBudget(ctx, maxAttempts), c.model)
+			text, err := c.stream(callCtx, c.req, func(delta string) error {
+				return send(compareEvent{index: i, delta: delta})
+			})
+			result := compareResult{Model: c.model, Status: compareOK, Text: text, LatencyMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				_, code := providerErrorCode(err)
+				result = compareResult{Model: c.model, Status: compareFailed, Text: text, Code: code, Error: err.Error(), LatencyMs: result.LatencyMs}
+			}
+			send(compareEvent{index: i, result: &result})
+		}()
+	}
+
+	partial := make([]strings.Builder, len(calls))
+	finished := make([]bool, len(calls))
+	for pending := len(calls); pending > 0; {
+		select {
+		case e := <-events:
+			if e.result == nil {
+				partial[e.index].WriteString(e.delta)
+				writeSSE(w, "", map[string]string{"model": calls[e.index].model, "delta": e.delta})
+				continue
+			}
+			if ctx.Err() != nil && e.result.Status == compareFailed {
+				// Cut off by the deadline or a cancel rather than
+				// failed on its own.
+				continue
+			}
+			finished[e.index] = true
+			pending--
+			writeSSE(w, "done", e.result)
+		case <-ctx.Done():
+			status := compareCancelled
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				status = compareTimedOut
+			}
+			for i, c := range calls {
+				if !finished[i] {
+					writeSSE(w, "done", compareResult{Model: c.model, Status: status, Text: partial[i].String()})
+				}
+			}
+			return
+		}
+	}
+}
+
+// compareHandler serves POST /chat/compare: a stateless /chat request with a
+// "models" list in place of modelName.
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only POST requests are allowed")
+		return
+	}
+	calls, ok := prepareCompare(w, r, false)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), compareTimeout)
+	defer cancel()
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{"results": compareModels(ctx, calls, compareMaxFanout)})
+}
+
+// compareStreamHandler serves POST /chat/compare/stream, the streaming
+// variant of /chat/compare: the models' deltas are interleaved in one
+// text/event-stream, tagged by model, and each model ends with its own
+// `event: done` carrying its result. The X-Request-Id response header holds
+// the ID to pass to /chat/cancel to stop every model.
+func compareStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only POST requests are allowed")
+		return
+	}
+	calls, ok := prepareCompare(w, r, true)
+	if !ok {
+		return
+	}
+
+	requestID := newRequestID()
+	ctx, cancelTimeout := context.WithTimeout(r.Context(), compareTimeout)
+	defer cancelTimeout()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if !activeStreams.add(requestID, cancel) {
+		writeError(w, http.StatusServiceUnavailable, codeOverloaded, "Server is shutting down, please retry later")
+		return
+	}
+	defer activeStreams.remove(requestID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Request-Id", requestID)
+	w.WriteHeader(http.StatusOK)
+	if streamStartEvent {
+		models := make([]string, len(calls))
+		for i, c := range calls {
+			models[i] = c.model
+		}
+		writeSSE(w, "start", map[string]interface{}{"requestId": requestID, "models": models})
+	} else if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	streamCompare(ctx, w, calls, compareMaxFanout)
+}
+
+// prepareCompare decodes and validates a compare request and prepares one
+// call per distinct model, streaming calls when stream is set. It writes the
+// error response and reports false when the request is rejected.
+func prepareCompare(w http.ResponseWriter, r *http.Request, stream bool) ([]compareCall, bool) {
+	if !requireJSON(w, r) {
+		return nil, false
+	}
+	if admitTenant(w, r) == nil {
+		return nil, false
+	}
+
+	var payload struct {
+		ClientRequestPayload
+		Models []string `json:"models"`
+	}
+	if err := decodeJSON(r.Body, &payload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return nil, false
+	}
+	if err := applyAPIVersion(&payload.ClientRequestPayload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return nil, false
+	}
+	if len(payload.Models) == 0 || len(payload.Contents) == 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing models or message content")
+		return nil, false
+	}
+	if err := validateSafetySettings(payload.SafetySettings); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return nil, false
+	}
+	if err := payload.GenerationSettings.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return nil, false
+	}
+	if err := validateSystemPrompts(payload.ClientRequestPayload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return nil, false
+	}
+	if err := validateUserMetadata(payload.ClientRequestPayload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return nil, false
+	}
+
+	// Comparisons never touch stored history.
+	persist := false
+	payload.Persist = &persist
+	payload.N = 0
+	generation := generationFor(payload.ClientRequestPayload)
+
+	calls := make([]compareCall, 0, len(payload.Models))
+	seen := make(map[string]bool, len(payload.Models))
+	for _, model := range payload.Models {
+		model = resolveModelAlias(model)
+		prepared := compareCall{model: model}
+		var ok bool
+		if stream {
+			prepared.stream, ok = streamProviderFor(model)
+		} else {
+			prepared.call, ok = providers[model]
+		}
+		if !ok {
+			message := fmt.Sprintf("Invalid model name %q", model)
+			if stream {
+				message += " or model does not support streaming"
+			}
+			writeError(w, http.StatusBadRequest, codeModelNotFound, invalidModelMessage(message))
+			return nil, false
+		}
+		if err := validateMaxTokens(model, payload.MaxTokens); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return nil, false
+		}
+		if seen[model] {
+			continue
+		}
+		seen[model] = true
+
+		modelPayload := payload.ClientRequestPayload
+		modelPayload.ModelName = model
+		messages, _, err := statelessMessages(modelPayload)
+		if err != nil {
+			writeMessagesError(w, err)
+			return nil, false
+		}
+		prepared.req = ProviderRequest{
+			Messages:         messages,
+			MaxTokens:        generation.MaxTokens,
+			Temperature:      generation.Temperature,
+			PresencePenalty:  generation.PresencePenalty,
+			FrequencyPenalty: generation.FrequencyPenalty,
+			ReasoningEffort:  generation.ReasoningEffort,
+			SafetySettings:   payload.SafetySettings,
+			UserID:           payload.UserID,
+			Metadata:         payload.Metadata,
+		}
+		calls = append(calls, prepared)
+	}
+	return calls, true
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowChat blocks until its call is cancelled.
+func slowChat(ctx context.Context, _ ProviderRequest) (ProviderResponse, error) {
+	<-ctx.Done()
+	return ProviderResponse{}, ctx.Err()
+}
+
+func TestCompareReportsSlowModelAsTimedOut(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &compareTimeout, 50*time.Millisecond)
+	stubChat(t, "gemini", reply("Fast answer"))
+	stubChat(t, "claude", slowChat)
+
+	start := time.Now()
+	w := postJSON(t, compareHandler, "/chat/compare", map[string]interface{}{
+		"models":   []string{"gemini", "claude"},
+		"contents": userTurn("Hi"),
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("compare took %v, want it to return at the deadline", elapsed)
+	}
+
+	var body struct {
+		Results []compareResult `json:"results"`
+	}
+	decodeBody(t, w, &body)
+	if len(body.Results) != 2 {
+		t.Fatalf("results = %+v, want 2", body.Results)
+	}
+	if fast := body.Results[0]; fast.Model != "gemini" || fast.Status != compareOK || fast.Text != "Fast answer" {
+		t.Errorf("fast result = %+v, want the gemini answer", fast)
+	}
+	if slow := body.Results[1]; slow.Model != "claude" || slow.Status != compareTimedOut || slow.Error != "" {
+		t.Errorf("slow result = %+v, want claude timed out", slow)
+	}
+}
+
+func TestCompareFailedModel(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Fine"))
+	stubChat(t, "claude", failWith(errProviderOverloaded))
+
+	w := postJSON(t, compareHandler, "/chat/compare", map[string]interface{}{
+		"models":   []string{"gemini", "claude", "gemini"},
+		"contents": userTurn("Hi"),
+	})
+	var body struct {
+		Results []compareResult `json:"results"`
+	}
+	decodeBody(t, w, &body)
+	if len(body.Results) != 2 {
+		t.Fatalf("results = %+v, want one per distinct model", body.Results)
+	}
+	if failed := body.Results[1]; failed.Status != compareFailed || failed.Code != codeProviderUnavailable {
+		t.Errorf("failed result = %+v, want a %s error", failed, codeProviderUnavailable)
+	}
+}
+
+func TestCompareRespectsFanout(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	call := func(context.Context, ProviderRequest) (ProviderResponse, error) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return ProviderResponse{Text: "ok"}, nil
+	}
+	calls := []compareCall{{model: "a", call: call}, {model: "b", call: call}, {model: "c", call: call}}
+
+	results := compareModels(context.Background(), calls, 2)
+	for _, r := range results {
+		if r.Status != compareOK {
+			t.Fatalf("results = %+v, want all ok", results)
+		}
+	}
+	if peak != 2 {
+		t.Errorf("peak calls in flight = %d, want the fan-out of 2", peak)
+	}
+}
+
+// takeTurns returns two streaming calls sending deltas in alternation,
+// first's before second's.
+func takeTurns(first, second []string) (streamFunc, streamFunc) {
+	turns := []chan struct{}{make(chan struct{}, 1), make(chan struct{}, 1)}
+	turns[0] <- struct{}{}
+	stream := func(me int, deltas []string) streamFunc {
+		return func(ctx context.Context, _ ProviderRequest, onDelta func(string) error) (string, error) {
+			for _, d := range deltas {
+				<-turns[me]
+				if err := onDelta(d); err != nil {
+					return "", err
+				}
+				turns[1-me] <- struct{}{}
+			}
+			return strings.Join(deltas, ""), nil
+		}
+	}
+	return stream(0, first), stream(1, second)
+}
+
+// compareStream posts a /chat/compare/stream request and returns its events.
+func compareStream(t *testing.T, models ...string) []sseEvent {
+	t.Helper()
+	setVar(t, &activeStreams, &streamRegistry{cancels: make(map[string]context.CancelCauseFunc)})
+	w := postJSON(t, compareStreamHandler, "/chat/compare/stream", map[string]interface{}{
+		"models":   models,
+		"contents": userTurn("Hi"),
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	return readSSE(t, bufio.NewReader(w.Body))
+}
+
+func TestCompareStreamInterleavesDeltas(t *testing.T) {
+	setupRedis(t)
+	gemini, claude := takeTurns([]string{"G1", "G2"}, []string{"C1", "C2"})
+	stubStream(t, "gemini", gemini)
+	stubStream(t, "claude", claude)
+
+	var deltas []string
+	done := map[string]map[string]interface{}{}
+	for _, e := range compareStream(t, "gemini", "claude") {
+		switch e.Name {
+		case "":
+			model, delta := e.Data["model"].(string), e.Data["delta"].(string)
+			if !strings.HasPrefix(delta, strings.ToUpper(model[:1])) {
+				t.Errorf("delta %q tagged %q", delta, model)
+			}
+			deltas = append(deltas, delta)
+		case "done":
+			model := e.Data["model"].(string)
+			if done[model] != nil {
+				t.Errorf("second done event for %s", model)
+			}
+			done[model] = e.Data
+		}
+	}
+	if want := []string{"G1", "C1", "G2", "C2"}; !slices.Equal(deltas, want) {
+		t.Errorf("deltas = %v, want %v", deltas, want)
+	}
+	if len(done) != 2 || done["gemini"]["text"] != "G1G2" || done["claude"]["text"] != "C1C2" {
+		t.Fatalf("done events = %v, want one per model with its text", done)
+	}
+	for model, d := range done {
+		if d["status"] != compareOK {
+			t.Errorf("%s status = %v, want ok", model, d["status"])
+		}
+	}
+}
+
+func TestCompareStreamTimedOutModelKeepsPartialText(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &compareTimeout, 50*time.Millisecond)
+	stubStream(t, "gemini", func(_ context.Context, _ ProviderRequest, onDelta func(string) error) (string, error) {
+		return "Fast", onDelta("Fast")
+	})
+	stubStream(t, "claude", func(ctx context.Context, _ ProviderRequest, onDelta func(string) error) (string, error) {
+		if err := onDelta("Slow"); err != nil {
+			return "", err
+		}
+		<-ctx.Done()
+		return "Slow", ctx.Err()
+	})
+
+	done := map[string]map[string]interface{}{}
+	for _, e := range compareStream(t, "gemini", "claude") {
+		if e.Name == "done" {
+			done[e.Data["model"].(string)] = e.Data
+		}
+	}
+	if d := done["gemini"]; d["status"] != compareOK || d["text"] != "Fast" {
+		t.Errorf("gemini done = %v, want ok", d)
+	}
+	if d := done["claude"]; d["status"] != compareTimedOut || d["text"] != "Slow" {
+		t.Errorf("claude done = %v, want timed_out with the partial text", d)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Configuration is mostly read while the package variables are initialized,
+// before main has called InitLogging, so warnings about invalid values are
+// held until the logger is installed and then written with its format and
+// level instead of the default logger's.
+var (
+	configWarningsMu sync.Mutex
+	configWarnings   []configWarning
+	loggingReady     bool
+)
+
+type configWarning struct {
+	msg  string
+	args []interface{}
+}
+
+// warnConfig logs a warning about the configuration, or holds it until
+// InitLogging when logging isn't set up yet.
+func warnConfig(msg string, args ...interface{}) {
+	configWarningsMu.Lock()
+	defer configWarningsMu.Unlock()
+	if !loggingReady {
+		configWarnings = append(configWarnings, configWarning{msg, args})
+		return
+	}
+	slog.Warn(msg, args...)
+}
+
+// flushConfigWarnings logs the warnings held by warnConfig. Later warnings
+// are logged as they come.
+func flushConfigWarnings() {
+	configWarningsMu.Lock()
+	defer configWarningsMu.Unlock()
+	loggingReady = true
+	for _, w := range configWarnings {
+		slog.Warn(w.msg, w.args...)
+	}
+	configWarnings = nil
+}
+
+// envInt reads an integer environment variable, returning def when it is
+// unset or invalid.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		warnConfig("Ignoring invalid integer environment variable", "name", name, "value", value)
+		return def
+	}
+	return n
+}
+
+// envDuration reads a duration environment variable such as "5s", returning
+// def when it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		warnConfig("Ignoring invalid duration environment variable", "name", name, "value", value)
+		return def
+	}
+	return d
+}
+
+// envPositiveDuration is envDuration for settings that must be above zero:
+// a zero or negative value is ignored with a warning.
+func envPositiveDuration(name string, def time.Duration) time.Duration {
+	d := envDuration(name, def)
+	if d <= 0 {
+		warnConfig("Ignoring non-positive duration environment variable", "name", name, "value", d, "default", def)
+		return def
+	}
+	return d
+}
+
+// envString reads an environment variable, returning def when it is unset.
+func envString(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// envFloat reads a floating-point environment variable, returning def when it
+// is unset or invalid.
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		warnConfig("Ignoring invalid number environment variable", "name", name, "value", value)
+		return def
+	}
+	return f
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"os"
+)
+
+// allowAnyContentType turns off the application/json check on POST bodies,
+// for older clients that post JSON without declaring it.
+var allowAnyContentType = os.Getenv("ALLOW_ANY_CONTENT_TYPE") == "true"
+
+// requireJSON rejects a request whose Content-Type is not application/json
+// (parameters such as charset are allowed) with 415. It reports whether the
+// request may proceed.
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	if allowAnyContentType {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, codeInvalidRequest, "Content-Type must be application/json")
+		return false
+	}
+	return true
+}
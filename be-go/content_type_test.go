@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPlainTextPostRejected(t *testing.T) {
+	setupRedis(t)
+	body := `{"sessionId":"ct-1","modelName":"gemini","contents":[{"role":"user","text":"Hi"}]}`
+	for _, tt := range []struct {
+		target  string
+		handler http.HandlerFunc
+	}{
+		{"/chat", chatHandler},
+		{"/chat/stream", chatStreamHandler},
+		{"/session", sessionHandler},
+		{"/admin/session/bundle", bundleHandler},
+	} {
+		r := httptest.NewRequest("POST", tt.target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "text/plain")
+		withAdmin(t, r)
+		w := httptest.NewRecorder()
+		tt.handler(w, r)
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%s status = %d, want 415", tt.target, w.Code)
+			continue
+		}
+		if got := decodeError(t, w); !strings.Contains(got.Message, "application/json") {
+			t.Errorf("%s message = %q, want it to name application/json", tt.target, got.Message)
+		}
+	}
+}
+
+func TestRequireJSONAcceptsCharset(t *testing.T) {
+	for _, contentType := range []string{"application/json", "application/json; charset=utf-8", "Application/JSON"} {
+		r := httptest.NewRequest("POST", "/chat", nil)
+		r.Header.Set("Content-Type", contentType)
+		if !requireJSON(httptest.NewRecorder(), r) {
+			t.Errorf("requireJSON rejected %q", contentType)
+		}
+	}
+
+	setVar(t, &allowAnyContentType, true)
+	r := httptest.NewRequest("POST", "/chat", nil)
+	r.Header.Set("Content-Type", "text/plain")
+	if !requireJSON(httptest.NewRecorder(), r) {
+		t.Error("requireJSON rejected text/plain with ALLOW_ANY_CONTENT_TYPE")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// contextWindowMessages limits how many of the most recent messages (on top of
+// the leading system prompt) are sent to the provider. The full history is
+// still stored and returned by /chat/history. 0 sends everything.
+var contextWindowMessages = envInt("CONTEXT_WINDOW_MESSAGES", 0)
+
+// contextWindow returns the leading system messages followed by the last n
+// other messages of history, and more if the window would open on a tool
+// result: then its whole turn is included. A non-positive n returns history
+// unchanged.
+func contextWindow(history []Message, n int) []Message {
+	if n <= 0 {
+		return history
+	}
+
+	pinned := 0
+	for pinned < len(history) && history[pinned].Role == "system" {
+		pinned++
+	}
+	rest := history[pinned:]
+	if len(rest) <= n {
+		return history
+	}
+
+	start := toolTurnStart(rest, len(rest)-n, 0)
+	window := make([]Message, 0, pinned+len(rest)-start)
+	window = append(window, history[:pinned]...)
+	return append(window, rest[start:]...)
+}
+
+// contextWindowFor returns the window size for a request: its own override
+// when given, otherwise CONTEXT_WINDOW_MESSAGES.
+func contextWindowFor(clientPayload ClientRequestPayload) int {
+	if clientPayload.ContextWindowMessages > 0 {
+		return clientPayload.ContextWindowMessages
+	}
+	return contextWindowMessages
+}
+
+// maxContextTokens caps the estimated prompt size sent to the provider; the
+// oldest messages are dropped until the conversation fits. 0 disables it.
+var maxContextTokens = envInt("MAX_CONTEXT_TOKENS", 0)
+
+// trimHistory drops the oldest messages after the leading system messages
+// until the estimate from t fits in maxTokens. A reply or tool result is
+// dropped together with the turn it answers, so the kept conversation never
+// opens with an orphaned ai or tool message. The newest message is always
+// kept, even if it alone is over the limit, and so is the turn with the tool
+// call it answers when it is a tool result. A non-positive maxTokens returns
+// messages unchanged.
+func trimHistory(messages []Message, maxTokens int, t Tokenizer) []Message {
+	if maxTokens <= 0 {
+		return messages
+	}
+
+	pinned := 0
+	for pinned < len(messages) && messages[pinned].Role == "system" {
+		pinned++
+	}
+	total := countMessageTokens(t, messages)
+	drop := pinned
+	for total > maxTokens && drop < len(messages)-1 {
+		total -= messageOverheadTokens + t.CountTokens(messages[drop].Text)
+		drop++
+	}
+	for drop > pinned && drop < len(messages)-1 && (messages[drop].Role == "ai" || messages[drop].Role == "tool") {
+		drop++
+	}
+	drop = toolTurnStart(messages, drop, pinned)
+	if drop == pinned {
+		return messages
+	}
+
+	trimmed := make([]Message, 0, pinned+len(messages)-drop)
+	trimmed = append(trimmed, messages[:pinned]...)
+	return append(trimmed, messages[drop:]...)
+}
+
+// strictPromptLimit rejects a prompt over MAX_CONTEXT_TOKENS with a 413
+// instead of trimming it, when operators would rather fail a request than
+// send less of the conversation than asked.
+var strictPromptLimit = os.Getenv("STRICT_PROMPT_LIMIT") == "true"
+
+// promptTooLargeError is returned under STRICT_PROMPT_LIMIT for a prompt
+// whose estimate is over the limit.
+type promptTooLargeError struct {
+	Estimated, Allowed int
+}
+
+func (e *promptTooLargeError) Error() string {
+	return fmt.Sprintf("prompt too large: an estimated %d tokens, at most %d allowed", e.Estimated, e.Allowed)
+}
+
+// fitPrompt applies MAX_CONTEXT_TOKENS to the messages sent for a model:
+// trimmed by trimHistory, or rejected under STRICT_PROMPT_LIMIT. Tool
+// results whose call isn't sent are left out first.
+func fitPrompt(messages []Message, modelName string) ([]Message, error) {
+	messages = pairToolResults(messages)
+	t := tokenizerFor(modelName)
+	if strictPromptLimit && maxContextTokens > 0 {
+		if estimated := countMessageTokens(t, messages); estimated > maxContextTokens {
+			return nil, &promptTooLargeError{Estimated: estimated, Allowed: maxContextTokens}
+		}
+	}
+	return trimHistory(messages, maxContextTokens, t), nil
+}
+
+// writeMessagesError writes the response for an error from providerMessages
+// or statelessMessages.
+func writeMessagesError(w http.ResponseWriter, err error) {
+	var tooLarge *promptTooLargeError
+	switch {
+	case errors.As(err, &tooLarge):
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		writeJSON(w, nil, http.StatusRequestEntityTooLarge, map[string]apiError{"error": {
+			Code:            codeContextTooLong,
+			Message:         err.Error(),
+			EstimatedTokens: tooLarge.Estimated,
+			AllowedTokens:   tooLarge.Allowed,
+		}})
+	case errors.Is(err, errAttachmentNotFound):
+		writeError(w, http.StatusNotFound, codeNotFound, err.Error())
+	default:
+		slog.Error("Error resolving attachments", "error", err)
+		writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving attachments")
+	}
+}
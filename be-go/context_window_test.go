@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// recordRequests replaces model's chat call with one answering text and
+// returns the requests it receives.
+func recordRequests(t *testing.T, model, text string) *[]ProviderRequest {
+	t.Helper()
+	var requests []ProviderRequest
+	stubChat(t, model, func(_ context.Context, req ProviderRequest) (ProviderResponse, error) {
+		requests = append(requests, req)
+		return ProviderResponse{Text: text, Choices: []string{text}}, nil
+	})
+	return &requests
+}
+
+func TestContextWindowSendsLastMessages(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &contextWindowMessages, 3)
+	history := []Message{
+		{Role: "system", Text: "Be brief."},
+		{Role: "user", Text: "one"},
+		{Role: "ai", Text: "1"},
+		{Role: "user", Text: "two"},
+		{Role: "ai", Text: "2"},
+	}
+	if err := saveHistoryToRedis("window-1", history, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+	requests := recordRequests(t, "gemini", "3")
+
+	chatTurn(t, map[string]interface{}{"sessionId": "window-1", "modelName": "gemini", "contents": userTurn("three")})
+
+	sent := (*requests)[0].Messages
+	want := []string{"Be brief.", "two", "2", "three"}
+	if len(sent) != len(want) {
+		t.Fatalf("sent %d messages %+v, want %v", len(sent), sent, want)
+	}
+	for i, m := range sent {
+		if m.Text != want[i] {
+			t.Fatalf("sent %+v, want %v", sent, want)
+		}
+	}
+
+	if stored := storedHistory(t, "window-1"); len(stored) != 7 {
+		t.Fatalf("stored %d messages, want the full 7", len(stored))
+	}
+	w := httptest.NewRecorder()
+	getChatHistoryHandler(w, httptest.NewRequest("GET", "/chat/history?sessionId=window-1", nil))
+	var returned []Message
+	decodeBody(t, w, &returned)
+	// The system prompt is hidden from clients by default.
+	if len(returned) != 6 {
+		t.Fatalf("/chat/history returned %d messages, want the 6 of the full conversation", len(returned))
+	}
+}
+
+func TestContextWindowRequestOverride(t *testing.T) {
+	setupRedis(t)
+	history := []Message{{Role: "user", Text: "one"}, {Role: "ai", Text: "1"}}
+	if err := saveHistoryToRedis("window-2", history, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+	requests := recordRequests(t, "gemini", "2")
+
+	chatTurn(t, map[string]interface{}{"sessionId": "window-2", "modelName": "gemini", "contextWindowMessages": 1, "contents": userTurn("two")})
+
+	if sent := (*requests)[0].Messages; len(sent) != 1 || sent[0].Text != "two" {
+		t.Fatalf("sent %+v, want only the new message", sent)
+	}
+}
+
+// toolHistory interleaves two tool turns, the second with two calls.
+var toolHistory = []Message{
+	{Role: "system", Text: "You can look things up."},
+	{Role: "user", Text: "Weather in Paris?"},
+	{Role: "ai", ToolCalls: []ToolCall{{ID: "call-1", Name: "weather"}}},
+	{Role: "tool", Text: `{"temp":18}`, ToolCallID: "call-1", ToolName: "weather"},
+	{Role: "ai", Text: "It is 18 degrees in Paris."},
+	{Role: "user", Text: "And in Rome and Madrid?"},
+	{Role: "ai", ToolCalls: []ToolCall{{ID: "call-2", Name: "weather"}, {ID: "call-3", Name: "weather"}}},
+	{Role: "tool", Text: `{"temp":24}`, ToolCallID: "call-2", ToolName: "weather"},
+	{Role: "tool", Text: `{"temp":27}`, ToolCallID: "call-3", ToolName: "weather"},
+	{Role: "ai", Text: "24 in Rome, 27 in Madrid."},
+	{Role: "user", Text: "Thanks!"},
+}
+
+// assertToolsPaired fails unless every tool result in messages follows the
+// ai message with its call, and every call is followed by its result.
+func assertToolsPaired(t *testing.T, messages []Message) {
+	t.Helper()
+	calls := make(map[string]bool)
+	for _, m := range messages {
+		for _, call := range m.ToolCalls {
+			calls[call.ID] = true
+		}
+		if m.Role == "tool" {
+			if !calls[m.ToolCallID] {
+				t.Fatalf("tool result %s sent without its call: %+v", m.ToolCallID, messages)
+			}
+			delete(calls, m.ToolCallID)
+		}
+	}
+	for id := range calls {
+		t.Fatalf("tool call %s sent without its result: %+v", id, messages)
+	}
+}
+
+func TestTrimHistoryKeepsToolPairs(t *testing.T) {
+	tok := heuristicTokenizer{}
+	total := countMessageTokens(tok, toolHistory)
+	tests := []struct {
+		name string
+		// over is how many tokens too many the budget leaves.
+		over      int
+		wantFirst string
+	}{
+		{"drops a whole tool turn", countMessageTokens(tok, toolHistory[1:3]), "And in Rome and Madrid?"},
+		{"drops two tool turns", countMessageTokens(tok, toolHistory[1:7]), "Thanks!"},
+		{"fits", 0, "Weather in Paris?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trimmed := trimHistory(toolHistory, total-tt.over, tok)
+			if trimmed[0].Role != "system" {
+				t.Fatalf("trimmed = %+v, want the system prompt pinned", trimmed)
+			}
+			if trimmed[1].Text != tt.wantFirst {
+				t.Fatalf("first kept message = %+v, want %q", trimmed[1], tt.wantFirst)
+			}
+			assertToolsPaired(t, trimmed)
+		})
+	}
+}
+
+func TestTrimHistoryKeepsCallOfNewestResult(t *testing.T) {
+	// Over any budget, a newest message that is a tool result keeps its call.
+	trimmed := trimHistory(toolHistory[:9], 1, heuristicTokenizer{})
+	if len(trimmed) != 5 || trimmed[1].Text != "And in Rome and Madrid?" {
+		t.Fatalf("trimmed = %+v, want the system prompt and the whole last tool turn", trimmed)
+	}
+	assertToolsPaired(t, trimmed)
+}
+
+func TestOrphanedToolResultNeverSent(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &contextWindowMessages, 3)
+	if err := saveHistoryToRedis("tools-1", toolHistory[:10], defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+	requests := recordRequests(t, "gemini", "Done")
+
+	chatTurn(t, map[string]interface{}{"sessionId": "tools-1", "modelName": "gemini", "contents": userTurn("Go on")})
+
+	// The window of 3 would open on the second tool result; its whole turn
+	// is sent instead.
+	sent := (*requests)[0].Messages
+	if len(sent) != 7 || sent[1].Text != "And in Rome and Madrid?" {
+		t.Fatalf("sent %+v, want the system prompt and the whole tool turn", sent)
+	}
+	assertToolsPaired(t, sent)
+
+	orphaned := pairToolResults([]Message{
+		{Role: "user", Text: "Hi"},
+		{Role: "tool", Text: "{}", ToolCallID: "call-9", ToolName: "weather"},
+		{Role: "user", Text: "Again"},
+	})
+	if len(orphaned) != 2 || orphaned[1].Text != "Again" {
+		t.Fatalf("pairToolResults = %+v, want the orphaned result left out", orphaned)
+	}
+}
+
+// overLimitPrompt is a stateless conversation well over a 60 token limit.
+func overLimitPrompt(sessionId string) map[string]interface{} {
+	long := strings.Repeat("word ", 40)
+	return map[string]interface{}{
+		"sessionId": sessionId,
+		"modelName": "gemini",
+		"persist":   false,
+		"contents":  []map[string]string{{"role": "user", "text": long}, {"role": "ai", "text": long}, {"role": "user", "text": "And now?"}},
+	}
+}
+
+func TestStrictPromptLimitRejects(t *testing.T) {
+	setupRedis(t)
+	requests := recordRequests(t, "gemini", "unused")
+	setVar(t, &maxContextTokens, 60)
+	setVar(t, &strictPromptLimit, true)
+
+	w := postJSON(t, chatHandler, "/chat", overLimitPrompt("strict-1"))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413, body %s", w.Code, w.Body)
+	}
+	e := decodeError(t, w)
+	if e.Code != codeContextTooLong || e.AllowedTokens != 60 || e.EstimatedTokens <= 60 {
+		t.Fatalf("error = %+v, want the estimate over the 60 allowed tokens", e)
+	}
+	if len(*requests) != 0 {
+		t.Fatalf("provider calls = %d, want none", len(*requests))
+	}
+}
+
+func TestLenientPromptLimitTrims(t *testing.T) {
+	setupRedis(t)
+	requests := recordRequests(t, "gemini", "Fine.")
+	setVar(t, &maxContextTokens, 60)
+	setVar(t, &strictPromptLimit, false)
+
+	chatTurn(t, overLimitPrompt("lenient-1"))
+	sent := (*requests)[0].Messages
+	if len(sent) >= 3 || lastUserText(sent) != "And now?" {
+		t.Fatalf("sent %d messages ending %q, want the oldest trimmed", len(sent), lastUserText(sent))
+	}
+	if n := countMessageTokens(tokenizerFor("gemini"), sent); n > 60 {
+		t.Errorf("sent an estimated %d tokens, want at most 60", n)
+	}
+}
+
+func TestStrictPromptLimitOnStoredHistory(t *testing.T) {
+	setupRedis(t)
+	requests := recordRequests(t, "gemini", "unused")
+	setVar(t, &maxContextTokens, 60)
+	setVar(t, &strictPromptLimit, true)
+	long := strings.Repeat("word ", 40)
+	if err := saveHistoryToRedis("strict-2", []Message{{Role: "user", Text: long}, {Role: "ai", Text: long}}, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "strict-2", "modelName": "gemini", "contents": userTurn("And now?")})
+	if w.Code != http.StatusRequestEntityTooLarge || len(*requests) != 0 {
+		t.Fatalf("status = %d with %d provider calls, want 413 and none", w.Code, len(*requests))
+	}
+
+	// Under the limit the prompt goes through untouched.
+	setVar(t, &maxContextTokens, 10000)
+	chatTurn(t, map[string]interface{}{"sessionId": "strict-2", "modelName": "gemini", "contents": userTurn("And now?")})
+	if len((*requests)[0].Messages) != 3 {
+		t.Fatalf("sent %+v, want the whole history", (*requests)[0].Messages)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// prefillModels are the models that can continue a trailing AI message
+// (prefill) instead of starting a new reply.
+var prefillModels = map[string]bool{
+	"claude": true,
+}
+
+var errContinueWithoutPrefill = errors.New("continue requires the last message of contents to be an ai message")
+
+// continuationEntry returns the Contents entry that ends the conversation
+// sent for this request: the new message for stored sessions, the last one
+// for stateless requests.
+func continuationEntry(clientPayload *ClientRequestPayload) *ClientMessage {
+	if clientPayload.persistEnabled() {
+		return &clientPayload.Contents[0]
+	}
+	return &clientPayload.Contents[len(clientPayload.Contents)-1]
+}
+
+// validateContinuation checks that an AI message only ends the conversation
+// when the client asked to continue it, and that the model can. The entry's
+// role is normalized so "assistant" is accepted too.
+func validateContinuation(clientPayload *ClientRequestPayload) error {
+	last := continuationEntry(clientPayload)
+	last.Role = normalizeRole(last.Role)
+	if last.Role != "ai" {
+		if clientPayload.Continue {
+			return errContinueWithoutPrefill
+		}
+		return nil
+	}
+	if !clientPayload.Continue {
+		return errors.New("an ai message can only end contents when continue is set")
+	}
+	if !prefillModels[clientPayload.ModelName] {
+		return fmt.Errorf("model %q cannot continue an ai message", clientPayload.ModelName)
+	}
+	if !clientPayload.persistsAIMessage() {
+		return errors.New("persistAiMessage cannot be false when continue is set")
+	}
+	return nil
+}
+
+// trimPrefill strips the trailing whitespace providers reject at the end of
+// a prefill; the model supplies its own leading space.
+func trimPrefill(prefill string) string {
+	return strings.TrimRight(prefill, " \t\n")
+}
+
+// continuedText is the complete reply made of a prefill and the model's
+// continuation of it.
+func continuedText(prefill, continuation string) string {
+	return trimPrefill(prefill) + continuation
+}
+
+// continueHandler serves POST /chat/continue: it extends the last AI message
+// of a session, when it was cut off at the token limit, with the model's
+// continuation instead of adding a new turn. The reply is a /chat
+// ChatResponse whose text is the whole extended message.
+func continueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only POST requests are allowed")
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+	tenant := admitTenant(w, r)
+	if tenant == nil {
+		return
+	}
+
+	var body struct {
+		SessionID string `json:"sessionId"`
+		// ModelName defaults to the model that wrote the truncated message.
+		ModelName string            `json:"modelName"`
+		UserID    string            `json:"userId,omitempty"`
+		Metadata  map[string]string `json:"metadata,omitempty"`
+		GenerationSettings
+	}
+	if err := decodeJSON(r.Body, &body); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+	if body.SessionID == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing sessionId")
+		return
+	}
+	if err := body.GenerationSettings.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if err := validateUserMetadata(ClientRequestPayload{UserID: body.UserID, Metadata: body.Metadata}); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if !admitSession(w, tenant, body.SessionID) {
+		return
+	}
+	lock, ok := admitSessionLock(w, r, body.SessionID)
+	if !ok {
+		return
+	}
+	defer lock.release()
+
+	history, err := getHistoryFromRedis(body.SessionID)
+	if err != nil {
+		slog.Error("Error in getHistoryFromRedis", "error", err)
+		writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving history")
+		return
+	}
+	if err := checkConversationAge(body.SessionID, history); err != nil {
+		writeError(w, http.StatusGone, codeConversationExpired, err.Error())
+		return
+	}
+	if len(history) == 0 || history[len(history)-1].Role != "ai" || history[len(history)-1].FinishReason != finishLength {
+		writeError(w, http.StatusConflict, codeInvalidRequest, "The last AI message of the session was not cut off at the token limit")
+		return
+	}
+	last := history[len(history)-1]
+
+	modelName := resolveModelAlias(body.ModelName)
+	if modelName == "" {
+		modelName = resolveModelName(last.Model)
+	}
+	call, ok := providers[modelName]
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeModelNotFound, invalidModelMessage("Invalid model name"))
+		return
+	}
+	if err := validateMaxTokens(modelName, body.MaxTokens); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	// The truncated message stands in for the new message of a chat turn.
+	payload := ClientRequestPayload{
+		SessionID:          body.SessionID,
+		ModelName:          modelName,
+		Contents:           []ClientMessage{{Role: "ai", Text: last.Text}},
+		UserID:             body.UserID,
+		Metadata:           body.Metadata,
+		GenerationSettings: body.GenerationSettings,
+	}
+	messages, dropped, err := providerMessages(payload, history)
+	if err != nil {
+		writeMessagesError(w, err)
+		return
+	}
+	// Prefill models continue a trailing AI message on their own; the others
+	// are asked to.
+	if !prefillModels[modelName] {
+		messages = append(messages, Message{Role: "user", Text: continueInstruction})
+	}
+
+	callCtx, finish := withFinishReason(withProviderTimeout(withAttemptBudget(r.Context(), maxAttempts), modelName))
+	callCtx, reported := withProviderUsage(callCtx)
+	generation := generationFor(payload)
+	result, err := call(callCtx, ProviderRequest{
+		Messages:         messages,
+		MaxTokens:        generation.MaxTokens,
+		Temperature:      generation.Temperature,
+		PresencePenalty:  generation.PresencePenalty,
+		FrequencyPenalty: generation.FrequencyPenalty,
+		ReasoningEffort:  generation.ReasoningEffort,
+		UserID:           payload.UserID,
+		Metadata:         payload.Metadata,
+	})
+	if err != nil {
+		writeProviderError(w, err)
+		return
+	}
+	usage := reported.or(estimateUsage(modelName, messages, result.Text))
+	recordUsage(tenant, body.SessionID, modelName, usage)
+
+	text := last.Text + result.Text
+	if prefillModels[modelName] {
+		text = continuedText(last.Text, result.Text)
+	}
+	last.Text, last.Model, last.FinishReason = text, modelName, finish.stored()
+	history[len(history)-1] = last
+	recordTurn(tenant, body.SessionID, history)
+	emitTurnEvent(tenant, body.SessionID, modelName, history)
+
+	response := newChatResponse(text, modelName)
+	response.Continuation = result.Text
+	response.Usage = usage
+	response.FinishReason = finishReasonName(finish.reason)
+	if result.Citations != nil {
+		response.Citations = result.Citations
+	}
+	if result.ToolCalls != nil {
+		response.ToolCalls = result.ToolCalls
+	}
+	response.Truncated = truncationFor(dropped, finish)
+	writeJSON(w, r, http.StatusOK, response)
+}
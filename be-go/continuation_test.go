@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func statelessPrefill(model string, continued bool) map[string]interface{} {
+	return map[string]interface{}{
+		"sessionId": "prefill-session",
+		"modelName": model,
+		"persist":   false,
+		"continue":  continued,
+		"contents": []map[string]string{
+			{"role": "user", "text": "Write a haiku about autumn"},
+			{"role": "assistant", "text": "Crisp leaves "},
+		},
+	}
+}
+
+func TestContinueSendsPrefillToClaude(t *testing.T) {
+	setupRedis(t)
+	payloads := fakeClaudeAPI(t, claudeHello)
+
+	resp := chatTurn(t, statelessPrefill("claude", true))
+	if resp.Text != "Crisp leavesHello" {
+		t.Fatalf("text = %q, want the prefill followed by the continuation", resp.Text)
+	}
+
+	messages := (*payloads)[0]["messages"].([]interface{})
+	last := messages[len(messages)-1].(map[string]interface{})
+	if last["role"] != "assistant" || last["content"] != "Crisp leaves" {
+		t.Fatalf("last message = %v, want the trimmed assistant prefill", last)
+	}
+}
+
+func TestContinueReplacesStoredPrefill(t *testing.T) {
+	setupRedis(t)
+	fakeClaudeAPI(t, claudeHello)
+
+	chatTurn(t, map[string]interface{}{
+		"sessionId": "prefill-stored",
+		"modelName": "claude",
+		"contents":  userTurn("Write a haiku about autumn"),
+	})
+	chatTurn(t, map[string]interface{}{
+		"sessionId": "prefill-stored",
+		"modelName": "claude",
+		"continue":  true,
+		"contents":  []map[string]string{{"role": "ai", "text": "Crisp leaves "}},
+	})
+
+	history := storedHistory(t, "prefill-stored")
+	last := history[len(history)-1]
+	if last.Role != "ai" || last.Text != "Crisp leavesHello" {
+		t.Fatalf("last stored message = %+v, want the continued reply", last)
+	}
+	if n := conversationTurns(t, "prefill-stored"); n != 3 {
+		t.Fatalf("stored turns = %d, want the prefill replaced rather than kept", n)
+	}
+}
+
+func TestTrailingAIMessageRejected(t *testing.T) {
+	setupRedis(t)
+	payloads := fakeClaudeAPI(t, claudeHello)
+
+	tests := []struct {
+		name    string
+		payload map[string]interface{}
+	}{
+		{"without continue", statelessPrefill("claude", false)},
+		{"model without prefill", statelessPrefill("gemini", true)},
+		{"continue without prefill", map[string]interface{}{
+			"sessionId": "prefill-session",
+			"modelName": "claude",
+			"persist":   false,
+			"continue":  true,
+			"contents":  userTurn("Write a haiku about autumn"),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := postJSON(t, chatHandler, "/chat", tt.payload)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400, body %s", w.Code, w.Body)
+			}
+		})
+	}
+	if len(*payloads) != 0 {
+		t.Fatalf("provider calls = %d, want none for rejected requests", len(*payloads))
+	}
+}
+
+// saveTruncatedTurn stores a session whose last reply was cut off at the
+// token limit.
+func saveTruncatedTurn(t *testing.T, sessionId, model string) {
+	t.Helper()
+	history := []Message{
+		{Role: "system", Text: "Be brief."},
+		{Role: "user", Text: "Write a haiku about autumn"},
+		{Role: "ai", Text: "Crisp leaves ", Model: model, FinishReason: finishLength},
+	}
+	if err := saveHistoryToRedis(sessionId, history, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContinueTruncatedTurn(t *testing.T) {
+	setupRedis(t)
+	saveTruncatedTurn(t, "truncated-1", "gemini")
+	requests := recordRequests(t, "gemini", "fall softly")
+
+	w := postJSON(t, continueHandler, "/chat/continue", map[string]string{"sessionId": "truncated-1"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var resp struct {
+		ChatResponse
+		Truncated truncationInfo `json:"truncated"`
+	}
+	decodeBody(t, w, &resp)
+	if resp.Text != "Crisp leaves fall softly" || resp.Continuation != "fall softly" || resp.Model != "gemini" || resp.Truncated.Output {
+		t.Errorf("response = %+v, want the appended reply", resp)
+	}
+	if resp.Citations == nil || resp.ToolCalls == nil || resp.Usage.TotalTokens == 0 {
+		t.Errorf("response = %+v, want the /chat response fields", resp)
+	}
+
+	sent := (*requests)[0].Messages
+	if last := sent[len(sent)-1]; last.Role != "user" || last.Text != continueInstruction {
+		t.Errorf("last sent message = %+v, want the continue instruction", last)
+	}
+	history := storedHistory(t, "truncated-1")
+	if len(history) != 3 {
+		t.Fatalf("stored %d messages, want the continuation appended to the reply", len(history))
+	}
+	if last := history[2]; last.Text != "Crisp leaves fall softly" || last.FinishReason == finishLength {
+		t.Errorf("stored reply = %+v, want the full text and no length finish", last)
+	}
+}
+
+func TestContinueTruncatedTurnWithPrefill(t *testing.T) {
+	setupRedis(t)
+	saveTruncatedTurn(t, "truncated-2", "claude")
+	payloads := fakeClaudeAPI(t, claudeHello)
+
+	w := postJSON(t, continueHandler, "/chat/continue", map[string]string{"sessionId": "truncated-2"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	messages := (*payloads)[0]["messages"].([]interface{})
+	if last := messages[len(messages)-1].(map[string]interface{}); last["role"] != "assistant" || last["content"] != "Crisp leaves" {
+		t.Errorf("last Claude message = %v, want the truncated reply as a prefill", last)
+	}
+	if last := storedHistory(t, "truncated-2")[2]; last.Text != "Crisp leavesHello" {
+		t.Errorf("stored reply = %q, want the prefill and its continuation", last.Text)
+	}
+}
+
+func TestContinueNeedsTruncatedTurn(t *testing.T) {
+	setupRedis(t)
+	if err := saveHistoryToRedis("complete-1", []Message{{Role: "user", Text: "Hi"}, {Role: "ai", Text: "Hello", FinishReason: "stop"}}, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+	requests := recordRequests(t, "gemini", "unused")
+
+	for _, session := range []string{"complete-1", "missing-1"} {
+		if w := postJSON(t, continueHandler, "/chat/continue", map[string]string{"sessionId": session}); w.Code != http.StatusConflict {
+			t.Errorf("%s: status = %d, want 409", session, w.Code)
+		}
+	}
+	if len(*requests) != 0 {
+		t.Errorf("provider calls = %d, want none", len(*requests))
+	}
+}
+
+func TestContinueValidatesLikeChat(t *testing.T) {
+	setupRedis(t)
+	saveTruncatedTurn(t, "truncated-3", "gemini")
+	requests := recordRequests(t, "gemini", "unused")
+
+	for name, body := range map[string]map[string]interface{}{
+		"maxTokens over the ceiling": {"sessionId": "truncated-3", "maxTokens": 10_000_000},
+		"userId too long":            {"sessionId": "truncated-3", "userId": strings.Repeat("u", maxUserIDChars+1)},
+		"invalid temperature":        {"sessionId": "truncated-3", "temperature": -1},
+	} {
+		if w := postJSON(t, continueHandler, "/chat/continue", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", name, w.Code)
+		}
+	}
+	if len(*requests) != 0 {
+		t.Errorf("provider calls = %d, want none for rejected requests", len(*requests))
+	}
+}
+
+func TestContinueForwardsUserMetadata(t *testing.T) {
+	setupRedis(t)
+	saveTruncatedTurn(t, "truncated-4", "gemini")
+	requests := recordRequests(t, "gemini", "fall softly")
+
+	w := postJSON(t, continueHandler, "/chat/continue", map[string]interface{}{
+		"sessionId": "truncated-4",
+		"userId":    "user-7",
+		"metadata":  map[string]string{"plan": "pro"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if req := (*requests)[0]; req.UserID != "user-7" || req.Metadata["plan"] != "pro" {
+		t.Errorf("provider request = %+v, want the userId and metadata", req)
+	}
+}
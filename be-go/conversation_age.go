@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// maxConversationAge refuses to continue a conversation started longer ago
+// than this, even while its history is still stored. 0 disables the check.
+var maxConversationAge = envDuration("MAX_CONVERSATION_AGE", 0)
+
+// errConversationTooOld is returned when a session is past
+// maxConversationAge; the client should start a new session.
+var errConversationTooOld = errors.New("conversation is too old to continue, start a new session")
+
+// conversationStart returns when a conversation began: the timestamp of its
+// first timestamped message or, for histories stored before messages carried
+// one, the session's creation time. The zero time means unknown.
+func conversationStart(sessionId string, history []Message) (time.Time, error) {
+	for _, m := range history {
+		if !m.CreatedAt.IsZero() {
+			return m.CreatedAt, nil
+		}
+	}
+	meta, err := getSessionMeta(sessionId)
+	if err != nil || meta == nil {
+		return time.Time{}, err
+	}
+	return meta.CreatedAt, nil
+}
+
+// checkConversationAge returns errConversationTooOld if the stored
+// conversation is older than maxConversationAge.
+func checkConversationAge(sessionId string, history []Message) error {
+	if maxConversationAge <= 0 || len(history) == 0 {
+		return nil
+	}
+	start, err := conversationStart(sessionId, history)
+	if err != nil {
+		return err
+	}
+	if !start.IsZero() && time.Since(start) > maxConversationAge {
+		return fmt.Errorf("%w (started %s)", errConversationTooOld, start.Format(time.RFC3339))
+	}
+	return nil
+}
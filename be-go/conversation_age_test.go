@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAgedConversationGone(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &maxConversationAge, 24*time.Hour)
+	requests := recordRequests(t, "gemini", "OK")
+	started := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	mr.Set(historyKey("aged-1"), fmt.Sprintf(`[{"role":"user","text":"Hi","createdAt":%q},{"role":"ai","text":"Hello","createdAt":%q}]`, started, started))
+
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "aged-1", "modelName": "gemini", "contents": userTurn("Still there?")})
+	if w.Code != http.StatusGone {
+		t.Fatalf("status = %d, want 410", w.Code)
+	}
+	if len(*requests) != 0 {
+		t.Error("provider called for an aged conversation")
+	}
+	if history := storedHistory(t, "aged-1"); len(history) != 2 {
+		t.Errorf("history has %d messages, want the aged one untouched", len(history))
+	}
+
+	// A new session is unaffected.
+	chatTurn(t, map[string]interface{}{"sessionId": "aged-2", "modelName": "gemini", "contents": userTurn("Hi")})
+}
+
+func TestConversationAgeFallsBackToSessionCreation(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &maxConversationAge, time.Hour)
+	mr.Set(historyKey("aged-legacy"), `[{"role":"user","text":"Hi"}]`)
+	if err := saveSessionMeta(&SessionMeta{SessionID: "aged-legacy", CreatedAt: time.Now().Add(-2 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "aged-legacy", "modelName": "gemini", "contents": userTurn("Hello?")})
+	if w.Code != http.StatusGone {
+		t.Fatalf("status = %d, want 410 from the session's creation time", w.Code)
+	}
+}
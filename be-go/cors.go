@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// corsMaxAge is how long, in seconds, browsers may cache a preflight response.
+var corsMaxAge = envInt("CORS_MAX_AGE", 600)
+
+// CORS_ALLOW_CREDENTIALS lets browsers send cookies and HTTP auth. The spec
+// forbids the wildcard origin with credentials, so responses then name the
+// request's origin instead, and only for those listed in CORS_ALLOWED_ORIGINS
+// (comma-separated, e.g. https://app.example.com): echoing any origin would
+// let every site make credentialed requests.
+var (
+	corsAllowCredentials = os.Getenv("CORS_ALLOW_CREDENTIALS") == "true"
+	corsAllowedOrigins   = loadCORSAllowedOrigins()
+)
+
+func loadCORSAllowedOrigins() map[string]bool {
+	origins := map[string]bool{}
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins[strings.TrimSuffix(origin, "/")] = true
+		}
+	}
+	if corsAllowCredentials && len(origins) == 0 {
+		warnConfig("CORS_ALLOW_CREDENTIALS is set without CORS_ALLOWED_ORIGINS, no origin is allowed")
+	}
+	return origins
+}
+
+// Every route shares one CORS policy, so the headers are the union of what
+// the handlers need.
+const (
+	corsAllowHeaders  = "Content-Type, Authorization, If-None-Match, X-API-Key"
+	corsExposeHeaders = "ETag, X-Request-Id, Retry-After"
+)
+
+// routeMethods holds the methods of the routes registered with handleRoute.
+var routeMethods = map[string]bool{"OPTIONS": true}
+
+// handleRoute registers handler for pattern on the default mux, recording the
+// methods it serves for Access-Control-Allow-Methods.
+func handleRoute(pattern string, handler http.HandlerFunc, methods ...string) {
+	for _, method := range methods {
+		routeMethods[method] = true
+	}
+	http.HandleFunc(pattern, handler)
+}
+
+// corsAllowMethods lists the methods of every registered route.
+func corsAllowMethods() string {
+	methods := make([]string, 0, len(routeMethods))
+	for method := range routeMethods {
+		methods = append(methods, method)
+	}
+	slices.Sort(methods)
+	return strings.Join(methods, ", ")
+}
+
+// withCORS sets the CORS headers on every response and answers preflight
+// requests itself, so individual handlers only see their real methods. It
+// must be called once the routes are registered.
+func withCORS(next http.Handler) http.Handler {
+	allowMethods := corsAllowMethods()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if corsAllowCredentials {
+			w.Header().Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); corsAllowedOrigins[origin] {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// corsHandler wraps a handler answering 200 with withCORS, as main does with
+// the default mux. It fails the test if a preflight request reaches it.
+func corsHandler(t *testing.T) http.Handler {
+	t.Helper()
+	setVar(t, &routeMethods, map[string]bool{"OPTIONS": true, "GET": true, "POST": true})
+	return withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			t.Errorf("preflight for %s reached the handler", r.URL.Path)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestPreflightOnEveryRoute(t *testing.T) {
+	handler := corsHandler(t)
+	for _, path := range []string{"/chat", "/chat/history", "/models", "/session", "/admin/flush"} {
+		r := httptest.NewRequest("OPTIONS", path, nil)
+		r.Header.Set("Origin", "https://app.example.com")
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusNoContent {
+			t.Errorf("OPTIONS %s status = %d, want 204", path, w.Code)
+		}
+		h := w.Header()
+		if h.Get("Access-Control-Allow-Origin") != "*" {
+			t.Errorf("OPTIONS %s Allow-Origin = %q", path, h.Get("Access-Control-Allow-Origin"))
+		}
+		if methods := h.Get("Access-Control-Allow-Methods"); methods != "GET, OPTIONS, POST" {
+			t.Errorf("OPTIONS %s Allow-Methods = %q", path, methods)
+		}
+		if !strings.Contains(h.Get("Access-Control-Allow-Headers"), "Content-Type") {
+			t.Errorf("OPTIONS %s Allow-Headers = %q", path, h.Get("Access-Control-Allow-Headers"))
+		}
+		if h.Get("Access-Control-Max-Age") == "" {
+			t.Errorf("OPTIONS %s has no Access-Control-Max-Age", path)
+		}
+	}
+}
+
+func TestCORSHeadersOnRegularRequests(t *testing.T) {
+	w := httptest.NewRecorder()
+	corsHandler(t).ServeHTTP(w, httptest.NewRequest("GET", "/models", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want the handler's 200", w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || !strings.Contains(w.Header().Get("Access-Control-Expose-Headers"), "ETag") {
+		t.Errorf("headers = %v, want CORS headers exposing ETag", w.Header())
+	}
+	if w.Header().Get("Access-Control-Max-Age") != "" {
+		t.Error("Max-Age set on a non-preflight response")
+	}
+}
+
+// credentialedRequest sends an OPTIONS or GET from origin through withCORS in
+// credentials mode.
+func credentialedRequest(t *testing.T, method, origin string) http.Header {
+	t.Helper()
+	setVar(t, &corsAllowCredentials, true)
+	setVar(t, &corsAllowedOrigins, map[string]bool{"https://app.example.com": true})
+	r := httptest.NewRequest(method, "/chat/history", nil)
+	r.Header.Set("Origin", origin)
+	w := httptest.NewRecorder()
+	corsHandler(t).ServeHTTP(w, r)
+	return w.Header()
+}
+
+func TestCORSCredentialsEchoesOrigin(t *testing.T) {
+	for _, method := range []string{"OPTIONS", "GET"} {
+		h := credentialedRequest(t, method, "https://app.example.com")
+		if got := h.Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+			t.Errorf("%s Allow-Origin = %q, want the request's origin instead of *", method, got)
+		}
+		if h.Get("Access-Control-Allow-Credentials") != "true" {
+			t.Errorf("%s has no Access-Control-Allow-Credentials", method)
+		}
+		if h.Get("Vary") != "Origin" {
+			t.Errorf("%s Vary = %q, want Origin", method, h.Get("Vary"))
+		}
+	}
+}
+
+func TestCORSCredentialsRejectsOtherOrigins(t *testing.T) {
+	h := credentialedRequest(t, "GET", "https://evil.example.com")
+	if got := h.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Allow-Origin = %q for an unlisted origin, want none", got)
+	}
+	if h.Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("credentials allowed for an unlisted origin")
+	}
+}
+
+func TestCORSMethodsFollowRoutes(t *testing.T) {
+	setVar(t, &routeMethods, map[string]bool{"OPTIONS": true, "GET": true, "POST": true, "DELETE": true, "PUT": true})
+	if got := corsAllowMethods(); got != "DELETE, GET, OPTIONS, POST, PUT" {
+		t.Fatalf("Allow-Methods = %q, want every registered method", got)
+	}
+}
+
+func TestLoadCORSAllowedOrigins(t *testing.T) {
+	setVar(t, &loggingReady, false)
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://a.example.com/, https://b.example.com,,")
+	origins := loadCORSAllowedOrigins()
+	if len(origins) != 2 || !origins["https://a.example.com"] || !origins["https://b.example.com"] {
+		t.Fatalf("origins = %v", origins)
+	}
+}
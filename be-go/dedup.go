@@ -0,0 +1,60 @@
+package main
+
+import "log/slog"
+
+// answeredReply looks for an earlier user message with the client-supplied id
+// and returns the AI reply that followed it. The ids stored on the history's
+// messages act as the session's set of seen ids, so a client resending a
+// message after a dropped connection gets the original answer instead of a
+// duplicate turn. Messages without an id are never deduplicated.
+func answeredReply(history []Message, id string) (Message, bool) {
+	if id == "" {
+		return Message{}, false
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role != "user" || history[i].ID != id {
+			continue
+		}
+		for _, m := range history[i+1:] {
+			if m.Role == "ai" {
+				return m, true
+			}
+		}
+		// Seen, but not answered yet; treat it as a new turn.
+		return Message{}, false
+	}
+	return Message{}, false
+}
+
+// duplicateReply checks a freshly prepared history (the new message last) for
+// an earlier copy of the new message.
+func duplicateReply(clientPayload ClientRequestPayload, history []Message) (Message, bool) {
+	if len(history) == 0 {
+		return Message{}, false
+	}
+	reply, ok := answeredReply(history[:len(history)-1], clientPayload.Contents[0].ID)
+	if ok {
+		slog.Debug("Returning stored reply for resent message", "sessionId", clientPayload.SessionID, "messageId", clientPayload.Contents[0].ID)
+	}
+	return reply, ok
+}
+
+// reconcileDanglingTurn prepares history for a new user message when the
+// stored history already ends with an unanswered user turn, e.g. because the
+// provider call for it failed. Providers reject two user turns in a row, so
+// the dangling turn is dropped when the new message resends it (same id or
+// same text) and otherwise merged into the new message. It returns the
+// history to append to and the text of the new message.
+func reconcileDanglingTurn(sessionId string, history []Message, id, text string) ([]Message, string) {
+	if len(history) == 0 || history[len(history)-1].Role != "user" || history[len(history)-1].ReplyOmitted {
+		return history, text
+	}
+	dangling := history[len(history)-1]
+	history = history[:len(history)-1]
+	if (id != "" && dangling.ID == id) || dangling.Text == text {
+		slog.Debug("Dropping unanswered user turn resent by the client", "sessionId", sessionId)
+		return history, text
+	}
+	slog.Debug("Merging unanswered user turn into the new message", "sessionId", sessionId)
+	return history, dangling.Text + "\n\n" + text
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// countingReply answers "reply 1", "reply 2", ... and counts the calls.
+func countingReply(t *testing.T, model string) *int {
+	t.Helper()
+	calls := 0
+	stubChat(t, model, func(context.Context, ProviderRequest) (ProviderResponse, error) {
+		calls++
+		text := fmt.Sprintf("reply %d", calls)
+		return ProviderResponse{Text: text, Choices: []string{text}}, nil
+	})
+	return &calls
+}
+
+// conversationTurns counts the stored user and AI messages of a session.
+func conversationTurns(t *testing.T, sessionId string) int {
+	t.Helper()
+	n := 0
+	for _, m := range storedHistory(t, sessionId) {
+		if m.Role == "user" || m.Role == "ai" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestResentMessageIsNotDuplicated(t *testing.T) {
+	setupRedis(t)
+	calls := countingReply(t, "gemini")
+	send := func(id, text string) ChatResponse {
+		return chatTurn(t, map[string]interface{}{
+			"sessionId": "dedup-1",
+			"modelName": "gemini",
+			"contents":  []map[string]string{{"role": "user", "text": text, "id": id}},
+		})
+	}
+
+	send("m1", "How tall is Everest?")
+	send("m2", "And K2?")
+	resp := send("m1", "How tall is Everest?")
+
+	if resp.Text != "reply 1" || !resp.Duplicate {
+		t.Errorf("resend = %q (duplicate %v), want the original reply flagged as a duplicate", resp.Text, resp.Duplicate)
+	}
+	if *calls != 2 {
+		t.Errorf("provider called %d times, want 2", *calls)
+	}
+	if turns := conversationTurns(t, "dedup-1"); turns != 4 {
+		t.Errorf("history has %d user and AI messages, want 4 without the resend", turns)
+	}
+}
+
+func TestMessagesWithoutIdAreNotDeduplicated(t *testing.T) {
+	setupRedis(t)
+	calls := countingReply(t, "gemini")
+	for i := 0; i < 2; i++ {
+		chatTurn(t, map[string]interface{}{"sessionId": "dedup-2", "modelName": "gemini", "contents": userTurn("Hi")})
+	}
+	if *calls != 2 {
+		t.Errorf("provider called %d times, want 2", *calls)
+	}
+	if turns := conversationTurns(t, "dedup-2"); turns != 4 {
+		t.Errorf("history has %d user and AI messages, want 4", turns)
+	}
+}
+
+func TestDanglingUserTurnMerged(t *testing.T) {
+	mr := setupRedis(t)
+	mr.Set(historyKey("dangling-1"), `[
+		{"role":"user","text":"Hi"},
+		{"role":"ai","text":"Hello"},
+		{"role":"user","text":"What is the capital of Peru?"}
+	]`)
+	requests := recordRequests(t, "gemini", "Lima, and Bolivia's is Sucre.")
+
+	chatTurn(t, map[string]interface{}{"sessionId": "dangling-1", "modelName": "gemini", "contents": userTurn("And of Bolivia?")})
+
+	var roles []string
+	for _, m := range (*requests)[0].Messages {
+		roles = append(roles, m.Role)
+	}
+	for i := 1; i < len(roles); i++ {
+		if roles[i] == "user" && roles[i-1] == "user" {
+			t.Fatalf("provider roles = %v, want no consecutive user turns", roles)
+		}
+	}
+	history := storedHistory(t, "dangling-1")
+	if len(history) != 4 {
+		t.Fatalf("history has %d messages, want 4", len(history))
+	}
+	if got := history[2].Text; got != "What is the capital of Peru?\n\nAnd of Bolivia?" {
+		t.Errorf("merged turn = %q, want the dangling and the new message joined", got)
+	}
+}
+
+func TestDanglingUserTurnResentIsDropped(t *testing.T) {
+	mr := setupRedis(t)
+	mr.Set(historyKey("dangling-2"), `[{"role":"user","text":"Hi"},{"role":"ai","text":"Hello"},{"role":"user","text":"Tell me a joke"}]`)
+	stubChat(t, "gemini", reply("Why did the chicken cross the road?"))
+
+	chatTurn(t, map[string]interface{}{"sessionId": "dangling-2", "modelName": "gemini", "contents": userTurn("Tell me a joke")})
+	history := storedHistory(t, "dangling-2")
+	if len(history) != 4 || history[2].Text != "Tell me a joke" || history[3].Role != "ai" {
+		t.Errorf("history = %+v, want the resent turn stored once and answered", history)
+	}
+}
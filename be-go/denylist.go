@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The deny-list answers /chat messages containing a listed phrase with
+// denyResponse without calling a model. It is a cheap keyword gate for
+// deployments such as kid-safe ones, not a moderation model. DENY_LIST_FILE
+// holds one entry per line: a phrase matched case-insensitively anywhere in a
+// user message, or a regular expression between slashes. Blank lines and
+// lines starting with # are skipped:
+//
+//	# phrases
+//	credit card number
+//	/\bkill(ing)?\b/
+//
+// With DENY_PERSIST=true the message and the canned reply are stored as a
+// normal turn; otherwise the session is left untouched.
+var (
+	denyPatterns = loadDenyList(os.Getenv("DENY_LIST_FILE"))
+	denyResponse = envString("DENY_RESPONSE", "Sorry, I can't help with that. Let's talk about something else!")
+	denyPersist  = os.Getenv("DENY_PERSIST") == "true"
+)
+
+func loadDenyList(path string) []*regexp.Regexp {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		warnConfig("Ignoring unreadable DENY_LIST_FILE", "path", path, "error", err)
+		return nil
+	}
+	defer file.Close()
+
+	var patterns []*regexp.Regexp
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		expr := regexp.QuoteMeta(line)
+		if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+			expr = line[1 : len(line)-1]
+		}
+		pattern, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			warnConfig("Ignoring invalid DENY_LIST_FILE entry", "entry", line, "error", err)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	if err := scanner.Err(); err != nil {
+		warnConfig("Error reading DENY_LIST_FILE", "path", path, "error", err)
+	}
+	return patterns
+}
+
+// deniedMessage reports whether a user message of the payload matches the
+// deny-list.
+func deniedMessage(clientPayload ClientRequestPayload) bool {
+	for _, c := range clientPayload.Contents {
+		if c.Role != "user" {
+			continue
+		}
+		for _, pattern := range denyPatterns {
+			if pattern.MatchString(c.Text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recordDeniedTurn stores the message and the canned reply when DENY_PERSIST
+// is set. Failures are only logged, the client still gets the reply.
+func recordDeniedTurn(tenant *Tenant, clientPayload ClientRequestPayload) {
+	if !denyPersist || !clientPayload.persistEnabled() {
+		return
+	}
+	history, err := prepareHistory(clientPayload)
+	if err != nil {
+		slog.Error("Error storing denied turn", "sessionId", clientPayload.SessionID, "error", err)
+		return
+	}
+	history = append(history, Message{Role: "ai", Text: denyResponse, CreatedAt: time.Now().UTC()})
+	recordTurn(tenant, clientPayload.SessionID, history)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setDenyList installs the deny-list read from a file with lines.
+func setDenyList(t *testing.T, lines string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(path, []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setVar(t, &denyPatterns, loadDenyList(path))
+}
+
+func TestDeniedPhraseGetsCannedReply(t *testing.T) {
+	mr := setupRedis(t)
+	setDenyList(t, "# phrases\ncredit card number\n\n/\\bkill(ing)?\\b/\n")
+	setVar(t, &denyResponse, "Let's talk about something else!")
+	calls := countingReply(t, "gemini")
+
+	for _, text := range []string{"What is my mom's Credit Card Number?", "how do I kill a process"} {
+		resp := chatTurn(t, map[string]interface{}{"sessionId": "denied-1", "modelName": "gemini", "contents": userTurn(text)})
+		if resp.Text != "Let's talk about something else!" || !resp.Denied {
+			t.Errorf("%q: response = %+v, want the canned reply", text, resp)
+		}
+	}
+	if *calls != 0 {
+		t.Errorf("provider calls = %d, want none", *calls)
+	}
+	if mr.Exists(historyKey("denied-1")) {
+		t.Error("denied turns were stored without DENY_PERSIST")
+	}
+
+	chatTurn(t, map[string]interface{}{"sessionId": "denied-1", "modelName": "gemini", "contents": userTurn("Tell me about skills")})
+	if *calls != 1 {
+		t.Errorf("provider calls = %d, want the unlisted message answered", *calls)
+	}
+}
+
+func TestDeniedTurnPersisted(t *testing.T) {
+	setupRedis(t)
+	setDenyList(t, "credit card number\n")
+	setVar(t, &denyPersist, true)
+	countingReply(t, "gemini")
+
+	chatTurn(t, map[string]interface{}{"sessionId": "denied-2", "modelName": "gemini", "contents": userTurn("my credit card number is")})
+	history := storedHistory(t, "denied-2")
+	if last := history[len(history)-1]; last.Role != "ai" || last.Text != denyResponse {
+		t.Fatalf("last stored message = %+v, want the canned reply", last)
+	}
+}
+
+func TestLoadDenyListSkipsInvalidEntries(t *testing.T) {
+	setVar(t, &loggingReady, false)
+	setDenyList(t, "/([/\nok phrase\n")
+	if len(denyPatterns) != 1 || !denyPatterns[0].MatchString("an OK PHRASE here") {
+		t.Fatalf("patterns = %v, want only the valid phrase", denyPatterns)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// safeEchoHeaders are the request headers echoed verbatim; all others may
+// carry credentials and are redacted.
+var safeEchoHeaders = map[string]bool{
+	"Content-Type":      true,
+	"Accept":            true,
+	"anthropic-version": true,
+}
+
+// echoedCall is one provider request as sent, reported by /chat?echoPayload=1.
+type echoedCall struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+// payloadEcho collects the provider requests made under a context.
+type payloadEcho struct {
+	mu       sync.Mutex
+	recorded []echoedCall
+}
+
+type payloadEchoKey struct{}
+
+// withPayloadEcho returns a context whose provider requests are recorded in
+// the returned echo.
+func withPayloadEcho(parent context.Context) (context.Context, *payloadEcho) {
+	echo := &payloadEcho{}
+	return context.WithValue(parent, payloadEchoKey{}, echo), echo
+}
+
+// recordPayload notes a provider request if ctx asks for it. Credentials in
+// the headers and the query string are redacted.
+func recordPayload(ctx context.Context, rawURL string, headers map[string]string, payload []byte) {
+	echo, ok := ctx.Value(payloadEchoKey{}).(*payloadEcho)
+	if !ok {
+		return
+	}
+
+	call := echoedCall{URL: redactURLQuery(rawURL), Headers: map[string]string{}, Body: json.RawMessage(payload)}
+	if !json.Valid(payload) {
+		body, _ := json.Marshal(string(payload))
+		call.Body = body
+	}
+	call.Headers["Content-Type"] = "application/json"
+	for name, value := range headers {
+		if !safeEchoHeaders[name] {
+			value = "REDACTED"
+		}
+		call.Headers[name] = value
+	}
+
+	echo.mu.Lock()
+	defer echo.mu.Unlock()
+	echo.recorded = append(echo.recorded, call)
+}
+
+// redactURLQuery replaces every query parameter value, such as Gemini's
+// ?key=, with a placeholder.
+func redactURLQuery(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redactURL(rawURL)
+	}
+	query := u.Query()
+	for name := range query {
+		query.Set(name, "REDACTED")
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// calls returns the recorded requests.
+func (e *payloadEcho) calls() []echoedCall {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]echoedCall{}, e.recorded...)
+}
+
+// wantsPayloadEcho reports whether a /chat request asked for ?echoPayload=1.
+// Only admins may see it; for anyone else it writes a 401 and ok is false.
+func wantsPayloadEcho(w http.ResponseWriter, r *http.Request) (echo bool, ok bool) {
+	switch r.URL.Query().Get("echoPayload") {
+	case "", "0", "false":
+		return false, true
+	}
+	return true, requireAdmin(w, r)
+}
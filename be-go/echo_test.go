@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEchoPayloadMatchesProviderRequest(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &geminiAPIKey, "secret-gemini-key")
+	var sent []byte
+	var sentURL string
+	fakeProviderAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		sent, _ = io.ReadAll(r.Body)
+		sentURL = r.URL.String()
+		io.WriteString(w, geminiHello)
+	})
+
+	r := withAdmin(t, newJSONRequest(t, "POST", "/chat?echoPayload=1", map[string]interface{}{
+		"sessionId": "echo-1",
+		"modelName": "gemini",
+		"contents":  userTurn("Hi"),
+	}))
+	w := httptest.NewRecorder()
+	chatHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "secret-gemini-key") {
+		t.Fatalf("response leaks the API key: %s", w.Body)
+	}
+
+	var resp ChatResponse
+	decodeBody(t, w, &resp)
+	if resp.Text != "Hello" || len(resp.ProviderPayload) != 1 {
+		t.Fatalf("response = %+v, want the reply and one echoed call", resp)
+	}
+	echoed := resp.ProviderPayload[0]
+	if !bytes.Equal(echoed.Body, sent) {
+		t.Errorf("echoed body = %s\nsent body   = %s", echoed.Body, sent)
+	}
+	if !strings.Contains(echoed.URL, ":generateContent?key=REDACTED") || !strings.Contains(sentURL, "key=secret-gemini-key") {
+		t.Errorf("echoed URL = %q (sent %q), want the key redacted", echoed.URL, sentURL)
+	}
+}
+
+func TestEchoPayloadRequiresAdmin(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &adminToken, "test-admin-token")
+	stubChat(t, "gemini", reply("Hi"))
+	w := postJSON(t, chatHandler, "/chat?echoPayload=1", map[string]interface{}{
+		"sessionId": "echo-2",
+		"modelName": "gemini",
+		"contents":  userTurn("Hi"),
+	})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", w.Code)
+	}
+}
+
+func TestEchoRedactsCredentialHeaders(t *testing.T) {
+	ctx, echo := withPayloadEcho(t.Context())
+	recordPayload(ctx, "https://api.example.com/v1?user=1", map[string]string{"x-api-key": "secret", "anthropic-version": "2023-06-01"}, []byte(`{"a":1}`))
+	calls := echo.calls()
+	if len(calls) != 1 {
+		t.Fatalf("calls = %+v", calls)
+	}
+	if calls[0].Headers["x-api-key"] != "REDACTED" || calls[0].Headers["anthropic-version"] != "2023-06-01" {
+		t.Errorf("headers = %v, want only the credential redacted", calls[0].Headers)
+	}
+}
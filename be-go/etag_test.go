@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func getHistory(t *testing.T, sessionId, ifNoneMatch string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/chat/history?sessionId="+sessionId, nil)
+	if ifNoneMatch != "" {
+		r.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	w := httptest.NewRecorder()
+	getChatHistoryHandler(w, r)
+	return w
+}
+
+func TestHistoryETagNotModified(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Hello!"))
+	turn := func(text string) {
+		chatTurn(t, map[string]interface{}{"sessionId": "etag-1", "modelName": "gemini", "contents": userTurn(text)})
+	}
+	turn("Hi")
+
+	w := getHistory(t, "etag-1", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("status = %d, ETag %q; want 200 with an ETag", w.Code, etag)
+	}
+
+	w = getHistory(t, "etag-1", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("status = %d with %d body bytes, want an empty 304", w.Code, w.Body.Len())
+	}
+	if got := getHistory(t, "etag-1", "W/"+etag).Code; got != http.StatusNotModified {
+		t.Errorf("weak validator status = %d, want 304", got)
+	}
+
+	turn("Another message")
+	w = getHistory(t, "etag-1", etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status after a new message = %d, want 200", w.Code)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Error("ETag unchanged after a new message")
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		want   bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`*`, true},
+		{`"xyz"`, false},
+		{`abc`, false},
+	} {
+		if got := etagMatches(tt.header, `"abc"`); got != tt.want {
+			t.Errorf("etagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exportFormat describes one format of GET /chat/export.
+type exportFormat struct {
+	contentType string
+	extension   string
+	render      func(title string, history []Message) (string, error)
+}
+
+var exportFormats = map[string]exportFormat{
+	"md":   {"text/markdown; charset=utf-8", "md", renderMarkdown},
+	"txt":  {"text/plain; charset=utf-8", "txt", renderText},
+	"html": {"text/html; charset=utf-8", "html", renderHTML},
+}
+
+// speaker is the label a transcript uses for a message's role.
+func speaker(role string) string {
+	switch role {
+	case "user":
+		return "User"
+	case "ai":
+		return "Assistant"
+	case "system":
+		return "System"
+	}
+	return role
+}
+
+func renderMarkdown(title string, history []Message) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", title)
+	for _, m := range history {
+		fmt.Fprintf(&b, "\n**%s:**\n\n%s\n", speaker(m.Role), m.Text)
+	}
+	return b.String(), nil
+}
+
+func renderText(title string, history []Message) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", title)
+	for _, m := range history {
+		fmt.Fprintf(&b, "\n%s: %s\n", speaker(m.Role), m.Text)
+	}
+	return b.String(), nil
+}
+
+// exportHTML is a standalone page; html/template escapes the messages, so
+// their content can never inject markup or scripts.
+var exportHTML = template.Must(template.New("export").Funcs(template.FuncMap{"speaker": speaker}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 46rem; margin: 2rem auto; padding: 0 1rem; color: #222; }
+.message { margin: 1rem 0; padding: 0.75rem 1rem; border-radius: 0.5rem; white-space: pre-wrap; }
+.user { background: #e8f0fe; }
+.ai { background: #f1f3f4; }
+.system { background: #fff8e1; font-style: italic; }
+.speaker { font-weight: bold; display: block; margin-bottom: 0.25rem; }
+time { color: #777; font-size: 0.8rem; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .History}}<div class="message {{.Role}}"><span class="speaker">{{speaker .Role}}</span>{{.Text}}{{if not .CreatedAt.IsZero}}
+<time datetime="{{.CreatedAt.Format "2006-01-02T15:04:05Z07:00"}}">{{.CreatedAt.Format "2006-01-02 15:04"}}</time>{{end}}</div>
+{{end}}</body>
+</html>
+`))
+
+func renderHTML(title string, history []Message) (string, error) {
+	var b strings.Builder
+	err := exportHTML.Execute(&b, struct {
+		Title   string
+		History []Message
+	}{title, history})
+	return b.String(), err
+}
+
+// exportHandler serves GET /chat/export?sessionId=...&format=md|txt|html, a
+// downloadable transcript of the messages /chat/history shows.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only GET requests are allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	sessionId := query.Get("sessionId")
+	if sessionId == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing sessionId query parameter")
+		return
+	}
+	if admitSessionRequest(w, r, sessionId) == nil {
+		return
+	}
+	name := query.Get("format")
+	if name == "" {
+		name = "md"
+	}
+	format, ok := exportFormats[name]
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "format must be one of md, txt or html")
+		return
+	}
+
+	history, err := getHistoryAllowStale(sessionId)
+	if err != nil {
+		slog.Error("Error retrieving history for export", "sessionId", sessionId, "error", err)
+		writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving history")
+		return
+	}
+	if len(history) == 0 {
+		writeError(w, http.StatusNotFound, codeNotFound, "Session not found")
+		return
+	}
+
+	title := "Conversation " + sessionId
+	if meta, err := getSessionMeta(sessionId); err == nil && meta != nil && meta.Title != "" {
+		title = meta.Title
+	}
+	body, err := format.render(title, visibleHistory(history))
+	if err != nil {
+		slog.Error("Error rendering export", "sessionId", sessionId, "format", name, "error", err)
+		writeError(w, http.StatusInternalServerError, codeInternalError, "Internal server error rendering export")
+		return
+	}
+
+	filename := fmt.Sprintf("conversation-%s.%s", time.Now().UTC().Format("20060102"), format.extension)
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write([]byte(body))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func exportSession(t *testing.T, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	exportHandler(w, httptest.NewRequest("GET", "/chat/export?"+query, nil))
+	return w
+}
+
+func TestExportHTMLEscapesMessages(t *testing.T) {
+	setupRedis(t)
+	history := []Message{
+		{Role: "user", Text: `<script>alert("hi")</script>`},
+		{Role: "ai", Text: "I won't run that."},
+	}
+	if err := saveHistoryToRedis("export-1", history, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+
+	w := exportSession(t, "sessionId=export-1&format=html")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/html; charset=utf-8", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment;") || !strings.HasSuffix(cd, `.html"`) {
+		t.Errorf("Content-Disposition = %q, want an .html attachment", cd)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "<script>") {
+		t.Fatalf("body contains an unescaped script tag:\n%s", body)
+	}
+	if !strings.Contains(body, "&lt;script&gt;") {
+		t.Errorf("body = %s, want the escaped message", body)
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	setupRedis(t)
+	history := []Message{
+		{Role: "system", Text: "Hidden instructions."},
+		{Role: "user", Text: "Hi"},
+		{Role: "ai", Text: "Hello"},
+	}
+	if err := saveHistoryToRedis("export-2", history, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query, contentType, want string
+	}{
+		{"sessionId=export-2", "text/markdown; charset=utf-8", "**User:**\n\nHi\n"},
+		{"sessionId=export-2&format=txt", "text/plain; charset=utf-8", "\nAssistant: Hello\n"},
+	}
+	for _, tt := range tests {
+		w := exportSession(t, tt.query)
+		if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+			t.Errorf("%s: Content-Type = %q, want %q", tt.query, ct, tt.contentType)
+		}
+		if body := w.Body.String(); !strings.Contains(body, tt.want) || strings.Contains(body, "Hidden instructions.") {
+			t.Errorf("%s: body = %q, want %q without the system prompt", tt.query, body, tt.want)
+		}
+	}
+
+	if w := exportSession(t, "sessionId=export-2&format=docx"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format status = %d, want 400", w.Code)
+	}
+	if w := exportSession(t, "sessionId=export-missing"); w.Code != http.StatusNotFound {
+		t.Errorf("missing session status = %d, want 404", w.Code)
+	}
+}
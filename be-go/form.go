@@ -0,0 +1,71 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// acceptFormPosts lets /chat take application/x-www-form-urlencoded bodies
+// from plain HTML forms, with the fields sessionId, modelName and message.
+// Off by default: browsers send such forms cross-origin without a CORS
+// preflight.
+var acceptFormPosts = os.Getenv("ACCEPT_FORM_POSTS") == "true"
+
+// isFormPost reports whether r is a form post /chat accepts.
+func isFormPost(r *http.Request) bool {
+	if !acceptFormPosts {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// decodeChatRequest reads a /chat body, JSON or a form post. A form carries
+// a single user message.
+func decodeChatRequest(r *http.Request, payload *ClientRequestPayload) error {
+	if !isFormPost(r) {
+		return decodeJSON(r.Body, payload)
+	}
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	payload.SessionID = r.PostForm.Get("sessionId")
+	payload.ModelName = r.PostForm.Get("modelName")
+	if message := r.PostForm.Get("message"); message != "" {
+		payload.Contents = []ClientMessage{{Role: "user", Text: message}}
+	}
+	return nil
+}
+
+// wantsHTML reports whether a form post asked for an HTML answer.
+func wantsHTML(r *http.Request) bool {
+	if !isFormPost(r) {
+		return false
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if mediaType == "text/html" {
+			return true
+		}
+	}
+	return false
+}
+
+// chatReplyHTML is the snippet a form post gets; html/template escapes the
+// reply, so it can never inject markup or scripts.
+var chatReplyHTML = template.Must(template.New("reply").Parse(
+	`<div class="chat-reply" data-model="{{.Model}}" style="white-space: pre-wrap">{{.Text}}</div>` + "\n"))
+
+// writeChatHTML writes the answer of a chat turn as an HTML snippet.
+func writeChatHTML(w http.ResponseWriter, modelName, text string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if err := chatReplyHTML.Execute(w, struct{ Model, Text string }{modelName, text}); err != nil {
+		slog.Error("Error writing HTML reply", "error", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func postForm(t *testing.T, fields url.Values, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/chat", strings.NewReader(fields.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	chatHandler(w, r)
+	return w
+}
+
+var chatForm = url.Values{"sessionId": {"form-1"}, "modelName": {"gemini"}, "message": {"Hi from a form"}}
+
+func TestFormPostChatTurn(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &acceptFormPosts, true)
+	requests := recordRequests(t, "gemini", "Hello")
+
+	w := postForm(t, chatForm, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var resp ChatResponse
+	decodeBody(t, w, &resp)
+	if resp.Text != "Hello" {
+		t.Errorf("text = %q, want Hello", resp.Text)
+	}
+	if got := lastUserText((*requests)[0].Messages); !strings.Contains(got, "Hi from a form") {
+		t.Errorf("sent user message %q, want the form's message", got)
+	}
+	if n := conversationTurns(t, "form-1"); n != 2 {
+		t.Errorf("stored turns = %d, want 2", n)
+	}
+}
+
+func TestFormPostHTMLReply(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &acceptFormPosts, true)
+	stubChat(t, "gemini", reply("<b>Hello</b>"))
+
+	w := postForm(t, chatForm, "text/html,application/xhtml+xml;q=0.9")
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Fatalf("Content-Type = %q, want text/html", ct)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "&lt;b&gt;Hello&lt;/b&gt;") || strings.Contains(body, "<b>") {
+		t.Errorf("body = %q, want the reply escaped in the snippet", body)
+	}
+}
+
+func TestFormPostDisabled(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &acceptFormPosts, false)
+	if w := postForm(t, chatForm, ""); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("status = %d, want 415 unless ACCEPT_FORM_POSTS is set", w.Code)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// geminiHarmCategories and geminiHarmThresholds are the values accepted in
+// Gemini safety settings.
+var geminiHarmCategories = map[string]bool{
+	"HARM_CATEGORY_HARASSMENT":        true,
+	"HARM_CATEGORY_HATE_SPEECH":       true,
+	"HARM_CATEGORY_SEXUALLY_EXPLICIT": true,
+	"HARM_CATEGORY_DANGEROUS_CONTENT": true,
+	"HARM_CATEGORY_CIVIC_INTEGRITY":   true,
+}
+
+var geminiHarmThresholds = map[string]bool{
+	"HARM_BLOCK_THRESHOLD_UNSPECIFIED": true,
+	"BLOCK_LOW_AND_ABOVE":              true,
+	"BLOCK_MEDIUM_AND_ABOVE":           true,
+	"BLOCK_ONLY_HIGH":                  true,
+	"BLOCK_NONE":                       true,
+	"OFF":                              true,
+}
+
+// geminiSafetySettings is the default sent with every Gemini request, read
+// from GEMINI_SAFETY_SETTINGS as comma-separated CATEGORY=THRESHOLD pairs:
+//
+//	GEMINI_SAFETY_SETTINGS=HARM_CATEGORY_HARASSMENT=BLOCK_ONLY_HIGH,HARM_CATEGORY_HATE_SPEECH=BLOCK_MEDIUM_AND_ABOVE
+//
+// Requests may override it with a "safetySettings" array of
+// {"category", "threshold"} objects using the same names. Categories left out
+// keep Gemini's own defaults.
+var geminiSafetySettings = loadGeminiSafetySettings()
+
+func loadGeminiSafetySettings() []GeminiSafetySetting {
+	value := os.Getenv("GEMINI_SAFETY_SETTINGS")
+	if value == "" {
+		return nil
+	}
+
+	var settings []GeminiSafetySetting
+	for _, pair := range strings.Split(value, ",") {
+		category, threshold, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		settings = append(settings, GeminiSafetySetting{Category: category, Threshold: threshold})
+	}
+	if err := validateSafetySettings(settings); err != nil {
+		warnConfig("Ignoring invalid GEMINI_SAFETY_SETTINGS", "error", err)
+		return nil
+	}
+	return settings
+}
+
+// validateSafetySettings checks every entry against the known categories and
+// thresholds and rejects duplicate categories.
+func validateSafetySettings(settings []GeminiSafetySetting) error {
+	seen := make(map[string]bool, len(settings))
+	for _, s := range settings {
+		if !geminiHarmCategories[s.Category] {
+			return fmt.Errorf("unknown safety category %q", s.Category)
+		}
+		if !geminiHarmThresholds[s.Threshold] {
+			return fmt.Errorf("unknown safety threshold %q for %s", s.Threshold, s.Category)
+		}
+		if seen[s.Category] {
+			return fmt.Errorf("duplicate safety category %q", s.Category)
+		}
+		seen[s.Category] = true
+	}
+	return nil
+}
+
+// geminiModelURL is the Generative Language API base URL of the Gemini model
+// used by both the plain and the streaming call.
+const geminiModelURL = "https://generativelanguage.googleapis.com/v1beta/models/" + geminiModelID
+
+func callGeminiAPI(ctx context.Context, req ProviderRequest) (_ ProviderResponse, err error) {
+	defer wrapProviderError(&err, "Gemini", geminiModelID)
+	apiUrl, headers, err := geminiEndpoint(ctx, "generateContent")
+	if err != nil {
+		return ProviderResponse{}, err
+	}
+
+	jsonPayload, _ := json.Marshal(geminiPayload(req))
+	resp, err := makeAPIRequestWithHeaders(ctx, apiUrl, headers, bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return ProviderResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var result GeminiResponse
+	if err := decodeProviderResponse("Gemini", resp.Body, &result); err != nil {
+		return ProviderResponse{}, err
+	}
+
+	// The reply is the first candidate with parts, and its tool calls,
+	// citations and finish reason go with it.
+	var choices []string
+	reason := ""
+	first := -1
+	for i, candidate := range result.Candidates {
+		if len(candidate.Content.Parts) > 0 {
+			if first < 0 {
+				first = i
+			}
+			choices = append(choices, candidate.Content.Parts[0].Text)
+		} else if reason == "" {
+			reason = candidate.FinishReason
+		}
+	}
+	var toolCalls []ToolCall
+	var citations []string
+	if first >= 0 {
+		candidate := result.Candidates[first]
+		for _, part := range candidate.Content.Parts {
+			if call := part.FunctionCall; call != nil {
+				toolCalls = append(toolCalls, ToolCall{ID: call.ID, Name: call.Name, Arguments: call.Args})
+			}
+		}
+		if candidate.CitationMetadata != nil {
+			for _, source := range candidate.CitationMetadata.CitationSources {
+				if source.URI != "" {
+					citations = append(citations, source.URI)
+				}
+			}
+		}
+	}
+	if len(choices) > 0 && (choices[0] != "" || len(toolCalls) > 0) {
+		recordFinishReason(ctx, result.Candidates[first].FinishReason)
+		if usage := result.UsageMetadata; usage != nil {
+			recordProviderUsage(ctx, usage.PromptTokenCount, usage.CandidatesTokenCount, usage.TotalTokenCount)
+		}
+		return ProviderResponse{Text: choices[0], Choices: choices, Citations: citations, ToolCalls: toolCalls}, nil
+	}
+
+	if result.PromptFeedback != nil && result.PromptFeedback.BlockReason != "" {
+		reason = result.PromptFeedback.BlockReason
+	}
+	return ProviderResponse{}, emptyResponseError("Gemini", reason)
+}
+
+// callGeminiAPIStream is the streaming variant of callGeminiAPI, using the
+// :streamGenerateContent endpoint.
+func callGeminiAPIStream(ctx context.Context, req ProviderRequest, onDelta func(string) error) (_ string, err error) {
+	defer wrapProviderError(&err, "Gemini", geminiModelID)
+	apiUrl, headers, err := geminiEndpoint(ctx, "streamGenerateContent")
+	if err != nil {
+		return "", err
+	}
+
+	// Streams produce a single candidate; n is rejected by /chat/stream.
+	req.N = 0
+	jsonPayload, _ := json.Marshal(geminiPayload(req))
+	resp, err := openStream(ctx, apiUrl, headers, jsonPayload, "application/json")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	return readGeminiStream(ctx, resp.Body, onDelta)
+}
+
+// readGeminiStream parses a streamGenerateContent body, a JSON array whose
+// elements arrive one by one, each a partial GeminiResponse. The text parts of
+// the first candidate are emitted as deltas and concatenated into the result.
+func readGeminiStream(ctx context.Context, body io.Reader, onDelta func(string) error) (string, error) {
+	var full strings.Builder
+	var usage *GeminiUsage
+	reason := ""
+
+	// A cancelled context surfaces as a read error on the body.
+	fail := func(err error) (string, error) {
+		if ctx.Err() != nil {
+			return full.String(), ctx.Err()
+		}
+		return full.String(), fmt.Errorf("error reading Gemini stream: %w", err)
+	}
+
+	dec := json.NewDecoder(body)
+	if _, err := dec.Token(); err != nil {
+		return fail(err)
+	}
+	for dec.More() {
+		var chunk GeminiResponse
+		if err := dec.Decode(&chunk); err != nil {
+			return fail(err)
+		}
+		if chunk.UsageMetadata != nil {
+			// Usage is cumulative; the last chunk carries the totals.
+			usage = chunk.UsageMetadata
+		}
+		if chunk.PromptFeedback != nil && chunk.PromptFeedback.BlockReason != "" {
+			reason = chunk.PromptFeedback.BlockReason
+		}
+		if len(chunk.Candidates) == 0 {
+			continue
+		}
+		candidate := chunk.Candidates[0]
+		if candidate.FinishReason != "" {
+			reason = candidate.FinishReason
+		}
+		for _, part := range candidate.Content.Parts {
+			if part.Text == "" {
+				continue
+			}
+			full.WriteString(part.Text)
+			if err := onDelta(part.Text); err != nil {
+				return full.String(), err
+			}
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fail(err)
+	}
+
+	if usage != nil {
+		recordProviderUsage(ctx, usage.PromptTokenCount, usage.CandidatesTokenCount, usage.TotalTokenCount)
+	}
+	if full.Len() == 0 {
+		return "", emptyResponseError("Gemini", reason)
+	}
+	recordFinishReason(ctx, reason)
+	return full.String(), nil
+}
+
+// geminiThinkingBudgets maps reasoning efforts onto Gemini thinking budgets,
+// in tokens.
+var geminiThinkingBudgets = map[string]int{
+	"low":    1024,
+	"medium": 8192,
+	"high":   24576,
+}
+
+// geminiPayload builds the generateContent body shared by the plain and the
+// streaming call.
+func geminiPayload(req ProviderRequest) GeminiPayload {
+	system, messages := applySystemPromptStrategy(req.Messages, req.systemPromptStrategy("gemini"))
+	geminiContents := toGeminiContents(messages)
+
+	payload := GeminiPayload{
+		Contents: geminiContents,
+		GenerationConfig: map[string]interface{}{
+			"temperature":     0.7,
+			"topP":            0.95,
+			"topK":            40,
+			"maxOutputTokens": maxTokensFor("gemini", req.MaxTokens),
+		},
+	}
+	if req.N > 1 {
+		payload.GenerationConfig["candidateCount"] = req.N
+	}
+	if req.PresencePenalty != nil || req.FrequencyPenalty != nil {
+		slog.Debug("Gemini does not support presence/frequency penalties, ignoring them")
+	}
+	if req.UserID != "" || len(req.Metadata) > 0 {
+		slog.Debug("Gemini does not support user metadata, ignoring it")
+	}
+	if req.Temperature != nil {
+		payload.GenerationConfig["temperature"] = *req.Temperature
+	}
+	if req.ReasoningEffort != "" {
+		payload.GenerationConfig["thinkingConfig"] = map[string]int{"thinkingBudget": geminiThinkingBudgets[req.ReasoningEffort]}
+	}
+	payload.SafetySettings = geminiSafetySettings
+	if len(req.SafetySettings) > 0 {
+		payload.SafetySettings = req.SafetySettings
+	}
+	if system != "" {
+		payload.SystemInstruction = &GeminiMessage{Parts: []GeminiPart{{Text: system}}}
+	}
+	return payload
+}
+
+// toGeminiContents maps the stored history onto Gemini's user/model roles.
+// A tool result without a tool name takes the name of the call it answers.
+func toGeminiContents(contents []Message) []GeminiMessage {
+	geminiContents := make([]GeminiMessage, 0, len(contents))
+	callNames := make(map[string]string)
+	for _, c := range contents {
+		for _, call := range c.ToolCalls {
+			callNames[call.ID] = call.Name
+		}
+		if c.Role == "tool" && c.ToolName == "" && callNames[c.ToolCallID] != "" {
+			c.ToolName = callNames[c.ToolCallID]
+		}
+		role := ""
+		switch c.Role {
+		case "user":
+			role = "user"
+		case "ai":
+			role = "model"
+		case "system":
+			// Under the "user" system prompt strategy, map the system role
+			// to "user" so the LLM processes it as a context-setting
+			// instruction.
+			role = "user"
+		case "tool":
+			geminiContents = append(geminiContents, GeminiMessage{
+				Role:  "user",
+				Parts: []GeminiPart{{FunctionResponse: geminiFunctionResponse(c)}},
+			})
+			continue
+		default:
+			// If the role is unexpected (e.g., a typo), we skip it entirely
+			slog.Debug("Skipping message with invalid role", "role", c.Role)
+			continue
+		}
+		parts := []GeminiPart{{Text: c.Text}}
+		if c.Text == "" && len(c.ToolCalls) > 0 {
+			parts = nil
+		}
+		for _, call := range c.ToolCalls {
+			parts = append(parts, GeminiPart{FunctionCall: &GeminiFunctionCall{ID: call.ID, Name: call.Name, Args: toolCallObject(call.Arguments)}})
+		}
+		geminiContents = append(geminiContents, GeminiMessage{
+			Role:  role,
+			Parts: parts,
+		})
+	}
+	return geminiContents
+}
+
+// geminiFunctionResponse wraps a tool result for Gemini, which takes it as a
+// JSON object: results that aren't one are sent as {"content": <text>}.
+func geminiFunctionResponse(m Message) *GeminiFunctionResponse {
+	response := json.RawMessage(m.Text)
+	if trimmed := strings.TrimSpace(m.Text); !strings.HasPrefix(trimmed, "{") || !json.Valid([]byte(trimmed)) {
+		response, _ = json.Marshal(map[string]string{"content": m.Text})
+	}
+	name := m.ToolName
+	if name == "" {
+		name = m.ToolCallID
+	}
+	return &GeminiFunctionResponse{ID: m.ToolCallID, Name: name, Response: response}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const geminiHello = `{"candidates":[{"content":{"role":"model","parts":[{"text":"Hello"}]},"finishReason":"STOP"}]}`
+
+// fakeGeminiAPI answers Gemini calls with response and returns the payloads
+// it received.
+func fakeGeminiAPI(t *testing.T, response string) *[]GeminiPayload {
+	t.Helper()
+	setVar(t, &geminiAPIKey, "test-key")
+	var payloads []GeminiPayload
+	fakeProviderAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload GeminiPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("decoding Gemini payload %s: %v", body, err)
+		}
+		payloads = append(payloads, payload)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, response)
+	})
+	return &payloads
+}
+
+func TestGeminiSafetySettingsInPayload(t *testing.T) {
+	setupRedis(t)
+	payloads := fakeGeminiAPI(t, geminiHello)
+	setVar(t, &geminiSafetySettings, []GeminiSafetySetting{{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_LOW_AND_ABOVE"}})
+
+	chatTurn(t, map[string]interface{}{
+		"sessionId": "safety-default",
+		"modelName": "gemini",
+		"contents":  userTurn("Hi"),
+	})
+	chatTurn(t, map[string]interface{}{
+		"sessionId":      "safety-override",
+		"modelName":      "gemini",
+		"contents":       userTurn("Hi"),
+		"safetySettings": []map[string]string{{"category": "HARM_CATEGORY_DANGEROUS_CONTENT", "threshold": "BLOCK_ONLY_HIGH"}},
+	})
+
+	if len(*payloads) != 2 {
+		t.Fatalf("got %d Gemini calls, want 2", len(*payloads))
+	}
+	if got := (*payloads)[0].SafetySettings; len(got) != 1 || got[0].Category != "HARM_CATEGORY_HARASSMENT" || got[0].Threshold != "BLOCK_LOW_AND_ABOVE" {
+		t.Errorf("default safetySettings = %+v, want the env default", got)
+	}
+	if got := (*payloads)[1].SafetySettings; len(got) != 1 || got[0].Category != "HARM_CATEGORY_DANGEROUS_CONTENT" || got[0].Threshold != "BLOCK_ONLY_HIGH" {
+		t.Errorf("override safetySettings = %+v, want the request's settings", got)
+	}
+}
+
+func TestGeminiSafetySettingsValidated(t *testing.T) {
+	setupRedis(t)
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{
+		"sessionId":      "safety-bad",
+		"modelName":      "gemini",
+		"contents":       userTurn("Hi"),
+		"safetySettings": []map[string]string{{"category": "HARM_CATEGORY_MADE_UP", "threshold": "BLOCK_NONE"}},
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400 for an unknown category", w.Code)
+	}
+}
+
+func TestLoadGeminiSafetySettings(t *testing.T) {
+	t.Setenv("GEMINI_SAFETY_SETTINGS", "HARM_CATEGORY_HARASSMENT=BLOCK_ONLY_HIGH, HARM_CATEGORY_HATE_SPEECH=OFF")
+	got := loadGeminiSafetySettings()
+	if len(got) != 2 || got[1].Category != "HARM_CATEGORY_HATE_SPEECH" || got[1].Threshold != "OFF" {
+		t.Fatalf("settings = %+v", got)
+	}
+
+	t.Setenv("GEMINI_SAFETY_SETTINGS", "HARM_CATEGORY_HARASSMENT=SOMETIMES")
+	setVar(t, &loggingReady, true)
+	logs := captureLogs(t, slog.LevelWarn)
+	if got := loadGeminiSafetySettings(); got != nil {
+		t.Fatalf("settings = %+v, want nil for an invalid threshold", got)
+	}
+	if !strings.Contains(logs.String(), "SOMETIMES") {
+		t.Errorf("logs = %q, want a warning naming the bad threshold", logs)
+	}
+}
+
+func TestReadGeminiStreamReassemblesText(t *testing.T) {
+	body := `[{"candidates":[{"content":{"role":"model","parts":[{"text":"The quick "}]}}]}
+,{"candidates":[{"content":{"role":"model","parts":[{"text":"brown "},{"text":"fox"}]}}]}
+,{"candidates":[{"content":{"role":"model","parts":[{"text":"."}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":4,"candidatesTokenCount":5,"totalTokenCount":9}}
+]`
+	ctx, usage := withProviderUsage(context.Background())
+	var deltas []string
+	text, err := readGeminiStream(ctx, strings.NewReader(body), func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "The quick brown fox." {
+		t.Errorf("text = %q", text)
+	}
+	if len(deltas) != 4 || deltas[2] != "fox" {
+		t.Errorf("deltas = %q, want one per text part", deltas)
+	}
+	if got := usage.or(turnUsage{}); got.PromptTokens != 4 || got.CompletionTokens != 5 || got.TotalTokens != 9 {
+		t.Errorf("usage = %+v, want the totals of the last chunk", got)
+	}
+}
+
+func TestReadGeminiStreamBlocked(t *testing.T) {
+	body := `[{"promptFeedback":{"blockReason":"SAFETY"}}]`
+	_, err := readGeminiStream(context.Background(), strings.NewReader(body), func(string) error { return nil })
+	if !errors.Is(err, errContentBlocked) {
+		t.Fatalf("err = %v, want errContentBlocked", err)
+	}
+}
+
+func TestGeminiReplyFromFirstCandidateWithParts(t *testing.T) {
+	// The first candidate was blocked: its finish reason, tool calls and
+	// citations must not be mixed into the second candidate's reply.
+	fakeGeminiAPI(t, `{"candidates":[
+		{"content":{"role":"model","parts":[]},"finishReason":"SAFETY",
+		 "citationMetadata":{"citationSources":[{"uri":"https://blocked.example"}]}},
+		{"content":{"role":"model","parts":[{"text":"Hello"},{"functionCall":{"name":"lookup","args":{"q":"hi"}}}]},"finishReason":"MAX_TOKENS",
+		 "citationMetadata":{"citationSources":[{"uri":"https://source.example"}]}}]}`)
+
+	ctx, finish := withFinishReason(context.Background())
+	resp, err := callGeminiAPI(ctx, ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}, N: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "Hello" || len(resp.Choices) != 1 {
+		t.Errorf("reply = %q, choices %q; want the second candidate's", resp.Text, resp.Choices)
+	}
+	if finish.reason != "MAX_TOKENS" {
+		t.Errorf("finish reason = %q, want the second candidate's", finish.reason)
+	}
+	if len(resp.ToolCalls) != 1 || resp.ToolCalls[0].Name != "lookup" {
+		t.Errorf("tool calls = %+v, want the second candidate's", resp.ToolCalls)
+	}
+	if len(resp.Citations) != 1 || resp.Citations[0] != "https://source.example" {
+		t.Errorf("citations = %v, want the second candidate's", resp.Citations)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// maxTemperature is the highest temperature accepted; providers with a
+// narrower range clamp it.
+const maxTemperature = 2.0
+
+// GenerationSettings are the sampling parameters of a turn. A session can
+// store them in its metadata ("generation") so they apply to every turn, and
+// a chat request can override them with the same fields at its top level.
+type GenerationSettings struct {
+	// Preset names a bundle of settings from generationPresets, e.g.
+	// "creative". Explicit fields take precedence over it.
+	Preset      string   `json:"preset,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   int      `json:"maxTokens,omitempty"`
+	// PresencePenalty and FrequencyPenalty discourage repetition. Only
+	// OpenAI-compatible providers support them; others ignore them.
+	PresencePenalty  *float64 `json:"presencePenalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequencyPenalty,omitempty"`
+	// ReasoningEffort ("low", "medium" or "high") sets how much reasoning
+	// models think before answering. Providers without it ignore it.
+	ReasoningEffort string `json:"reasoningEffort,omitempty"`
+}
+
+// reasoningEfforts are the values accepted in ReasoningEffort.
+var reasoningEfforts = []string{"low", "medium", "high"}
+
+// maxPenalty bounds PresencePenalty and FrequencyPenalty to [-maxPenalty,
+// maxPenalty], OpenAI's range.
+const maxPenalty = 2.0
+
+// generationPresets are the presets accepted in GenerationSettings.Preset.
+var generationPresets = map[string]GenerationSettings{
+	"precise":  {Temperature: float64Ptr(0.2)},
+	"balanced": {Temperature: float64Ptr(0.7)},
+	"creative": {Temperature: float64Ptr(1.0)},
+}
+
+func float64Ptr(f float64) *float64 {
+	return &f
+}
+
+// validate checks the preset name and parameter ranges.
+func (g GenerationSettings) validate() error {
+	if g.Preset != "" {
+		if _, ok := generationPresets[g.Preset]; !ok {
+			names := make([]string, 0, len(generationPresets))
+			for name := range generationPresets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown preset %q (expected one of %s)", g.Preset, strings.Join(names, ", "))
+		}
+	}
+	if g.Temperature != nil && (*g.Temperature < 0 || *g.Temperature > maxTemperature) {
+		return fmt.Errorf("temperature must be between 0 and %g", maxTemperature)
+	}
+	if g.MaxTokens < 0 {
+		return fmt.Errorf("maxTokens must not be negative")
+	}
+	if g.PresencePenalty != nil && (*g.PresencePenalty < -maxPenalty || *g.PresencePenalty > maxPenalty) {
+		return fmt.Errorf("presencePenalty must be between %g and %g", -maxPenalty, maxPenalty)
+	}
+	if g.FrequencyPenalty != nil && (*g.FrequencyPenalty < -maxPenalty || *g.FrequencyPenalty > maxPenalty) {
+		return fmt.Errorf("frequencyPenalty must be between %g and %g", -maxPenalty, maxPenalty)
+	}
+	if g.ReasoningEffort != "" && !slices.Contains(reasoningEfforts, g.ReasoningEffort) {
+		return fmt.Errorf("unknown reasoningEffort %q (expected one of %s)", g.ReasoningEffort, strings.Join(reasoningEfforts, ", "))
+	}
+	return nil
+}
+
+// over returns g layered over base: g's preset replaces whatever the preset
+// sets, then g's explicit fields replace the rest.
+func (g GenerationSettings) over(base GenerationSettings) GenerationSettings {
+	for _, layer := range []GenerationSettings{generationPresets[g.Preset], g} {
+		if layer.Temperature != nil {
+			base.Temperature = layer.Temperature
+		}
+		if layer.MaxTokens > 0 {
+			base.MaxTokens = layer.MaxTokens
+		}
+		if layer.PresencePenalty != nil {
+			base.PresencePenalty = layer.PresencePenalty
+		}
+		if layer.FrequencyPenalty != nil {
+			base.FrequencyPenalty = layer.FrequencyPenalty
+		}
+		if layer.ReasoningEffort != "" {
+			base.ReasoningEffort = layer.ReasoningEffort
+		}
+	}
+	base.Preset = ""
+	return base
+}
+
+// generationFor resolves the settings of a chat turn: the session's stored
+// settings, if any, overridden by those sent with the request.
+func generationFor(payload ClientRequestPayload) GenerationSettings {
+	settings := GenerationSettings{}
+	if payload.persistEnabled() {
+		meta, err := getSessionMeta(payload.SessionID)
+		if err != nil {
+			// The turn can still run on provider defaults.
+			slog.Warn("Error loading session generation settings", "sessionId", payload.SessionID, "error", err)
+		} else if meta != nil && meta.Generation != nil {
+			settings = meta.Generation.over(settings)
+		}
+	}
+	return payload.GenerationSettings.over(settings)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestStoredPresetAppliesToLaterTurns(t *testing.T) {
+	setupRedis(t)
+	requests := recordRequests(t, "gemini", "Once upon a time")
+	w := postJSON(t, sessionHandler, "/session", map[string]interface{}{
+		"sessionId":  "preset-1",
+		"generation": map[string]interface{}{"preset": "creative", "maxTokens": 300},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("session status = %d, body %s", w.Code, w.Body)
+	}
+
+	chatTurn(t, map[string]interface{}{"sessionId": "preset-1", "modelName": "gemini", "contents": userTurn("Tell me a story")})
+	chatTurn(t, map[string]interface{}{"sessionId": "preset-1", "modelName": "gemini", "contents": userTurn("Another"), "temperature": 0.3})
+
+	if len(*requests) != 2 {
+		t.Fatalf("got %d provider calls, want 2", len(*requests))
+	}
+	first, second := (*requests)[0], (*requests)[1]
+	if first.Temperature == nil || *first.Temperature != 1.0 || first.MaxTokens != 300 {
+		t.Errorf("first turn temperature %v, maxTokens %d; want the stored creative preset and 300", first.Temperature, first.MaxTokens)
+	}
+	if second.Temperature == nil || *second.Temperature != 0.3 || second.MaxTokens != 300 {
+		t.Errorf("second turn temperature %v, maxTokens %d; want the override and the stored 300", second.Temperature, second.MaxTokens)
+	}
+}
+
+func TestGenerationPresetValidation(t *testing.T) {
+	setupRedis(t)
+	w := postJSON(t, sessionHandler, "/session", map[string]interface{}{
+		"sessionId":  "preset-bad",
+		"generation": map[string]interface{}{"preset": "wild"},
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400 for an unknown preset", w.Code)
+	}
+}
+
+func TestGenerationOver(t *testing.T) {
+	base := GenerationSettings{Temperature: float64Ptr(0.5), MaxTokens: 100}
+	got := GenerationSettings{Preset: "precise", MaxTokens: 50}.over(base)
+	if *got.Temperature != 0.2 || got.MaxTokens != 50 || got.Preset != "" {
+		t.Errorf("over = %+v, want the preset temperature and explicit maxTokens", got)
+	}
+}
+
+const chatGPTHello = `{"choices":[{"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}]}`
+
+func TestReasoningEffortReachesOpenAI(t *testing.T) {
+	setupRedis(t)
+	var got []string
+	srv := fakeChatCompletions(t, chatGPTHello, func(_ *http.Request, payload OpenaiPayload) {
+		got = append(got, payload.ReasoningEffort)
+	})
+	setVar(t, &chatGPTProvider.URL, srv.URL)
+	setVar(t, &chatGPTProvider.APIKey, "test-key")
+
+	chatTurn(t, map[string]interface{}{"sessionId": "reasoning-1", "modelName": "chatgpt", "contents": userTurn("Prove it"), "reasoningEffort": "high"})
+	chatTurn(t, map[string]interface{}{"sessionId": "reasoning-1", "modelName": "chatgpt", "contents": userTurn("Again")})
+
+	if len(got) != 2 || got[0] != "high" || got[1] != "" {
+		t.Fatalf("reasoning_effort sent = %q, want high and then none", got)
+	}
+}
+
+func TestReasoningEffortIgnoredWithoutSupport(t *testing.T) {
+	var got string
+	srv := fakeChatCompletions(t, chatGPTHello, func(_ *http.Request, payload OpenaiPayload) {
+		got = payload.ReasoningEffort
+	})
+	mistral := *mistralProvider
+	mistral.URL = srv.URL
+	mistral.APIKey = "test-key"
+
+	if _, err := mistral.Chat(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}, ReasoningEffort: "low"}); err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Fatalf("reasoning_effort = %q, want none for a provider without it", got)
+	}
+}
+
+func TestReasoningEffortReachesGemini(t *testing.T) {
+	setupRedis(t)
+	payloads := fakeGeminiAPI(t, geminiHello)
+
+	for _, effort := range []string{"low", "medium", "high"} {
+		chatTurn(t, map[string]interface{}{"sessionId": "reasoning-2", "modelName": "gemini", "contents": userTurn("Think about " + effort), "reasoningEffort": effort})
+	}
+
+	for i, want := range []float64{1024, 8192, 24576} {
+		config, ok := (*payloads)[i].GenerationConfig["thinkingConfig"].(map[string]interface{})
+		if !ok || config["thinkingBudget"] != want {
+			t.Errorf("turn %d thinkingConfig = %v, want a budget of %v", i, (*payloads)[i].GenerationConfig["thinkingConfig"], want)
+		}
+	}
+}
+
+func TestReasoningEffortValidation(t *testing.T) {
+	setupRedis(t)
+	requests := recordRequests(t, "gemini", "unused")
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "reasoning-3", "modelName": "gemini", "contents": userTurn("Hi"), "reasoningEffort": "extreme"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400 for an unknown reasoningEffort", w.Code)
+	}
+	if len(*requests) != 0 {
+		t.Fatalf("provider calls = %d, want none", len(*requests))
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// readinessTimeout bounds the Redis ping made by /readyz.
+const readinessTimeout = 2 * time.Second
+
+// providerConfigured reports, per model, whether the credentials it needs
+// are present.
+var providerConfigured = map[string]func() bool{
+	"gemini":  geminiConfigured,
+	"claude":  func() bool { return claudeAPIKey != "" },
+	"llama":   llamaProvider.configured,
+	"chatgpt": chatGPTProvider.configured,
+	"mistral": mistralProvider.configured,
+}
+
+// configuredModels returns the registered models that can actually be called.
+func configuredModels() []string {
+	var models []string
+	for name := range providers {
+		if configured, ok := providerConfigured[name]; !ok || configured() {
+			models = append(models, name)
+		}
+	}
+	sort.Strings(models)
+	return models
+}
+
+// livezHandler serves GET /livez. It answers 200 for as long as the process
+// can serve HTTP at all, so a failing dependency never gets it restarted.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler serves GET /readyz. It answers 200 only when Redis, if
+// configured, answers a ping and at least one provider has credentials, and
+// 503 with the failing checks otherwise, so traffic is routed elsewhere.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+
+	if redisClient == nil {
+		checks["redis"] = "disabled"
+	} else {
+		pingCtx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		err := redisClient.Ping(pingCtx).Err()
+		cancel()
+		if err != nil {
+			checks["redis"] = err.Error()
+			ready = false
+		} else {
+			checks["redis"] = "ok"
+		}
+	}
+
+	if len(configuredModels()) == 0 {
+		checks["providers"] = "no provider is configured"
+		ready = false
+	} else {
+		checks["providers"] = "ok"
+	}
+
+	status := "ready"
+	code := http.StatusOK
+	if !ready {
+		status = "not ready"
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, r, code, map[string]interface{}{"status": status, "checks": checks})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func probe(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", target, nil))
+	return w
+}
+
+func TestReadyzFailsWhenRedisDown(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &claudeAPIKey, "test-key")
+
+	if w := probe(readyzHandler, "/readyz"); w.Code != http.StatusOK {
+		t.Fatalf("readyz with Redis up = %d, body %s", w.Code, w.Body)
+	}
+
+	mr.Close()
+	w := probe(readyzHandler, "/readyz")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz with Redis down = %d, want 503", w.Code)
+	}
+	var body struct {
+		Status string
+		Checks map[string]string
+	}
+	decodeBody(t, w, &body)
+	if body.Status != "not ready" || body.Checks["redis"] == "ok" || body.Checks["providers"] != "ok" {
+		t.Errorf("body = %+v, want only the redis check failing", body)
+	}
+
+	if w := probe(livezHandler, "/livez"); w.Code != http.StatusOK {
+		t.Errorf("livez with Redis down = %d, want 200", w.Code)
+	}
+}
+
+func TestReadyzNeedsAProvider(t *testing.T) {
+	setVar(t, &redisClient, nil)
+	for name := range providers {
+		if _, ok := providerConfigured[name]; !ok {
+			t.Skipf("model %s needs no credentials", name)
+		}
+	}
+	setVar(t, &geminiAPIKey, "")
+	setVar(t, &geminiUseVertex, false)
+	setVar(t, &claudeAPIKey, "")
+	setVar(t, &llamaProvider.APIKey, "")
+	setVar(t, &chatGPTProvider.APIKey, "")
+	setVar(t, &mistralProvider.APIKey, "")
+
+	if w := probe(readyzHandler, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz without providers = %d, want 503", w.Code)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// Stale-while-revalidate history reads, opt-in with HISTORY_SOFT_DEADLINE: a
+// read-only history endpoint whose Redis read takes longer than the deadline
+// is answered from a per-instance cache of recently used sessions, when it
+// holds the session, while the Redis read completes in the background and
+// refreshes it. Chat turns and imports, which write the history back, always
+// wait for Redis, and refresh the cache too. The cache keeps HISTORY_CACHE_SIZE sessions for at most
+// HISTORY_CACHE_TTL, so a stale answer is at most that old or misses writes
+// made through other instances since.
+var (
+	historySoftDeadline = envDuration("HISTORY_SOFT_DEADLINE", 0)
+	historyCacheSize    = envInt("HISTORY_CACHE_SIZE", 1000)
+	historyCacheTTL     = envDuration("HISTORY_CACHE_TTL", 30*time.Second)
+)
+
+var historyStaleReads = newCounter("maya_history_stale_reads_total", "History reads answered from the in-process cache after the soft deadline.")
+
+// historyCache is nil unless HISTORY_SOFT_DEADLINE is set.
+var historyCache = newHistoryCache()
+
+func newHistoryCache() *lruHistoryCache {
+	if historySoftDeadline <= 0 || historyCacheSize <= 0 {
+		return nil
+	}
+	return &lruHistoryCache{entries: map[string]*list.Element{}, order: list.New(), size: historyCacheSize, ttl: historyCacheTTL}
+}
+
+// lruHistoryCache holds the raw history JSON of recently used sessions.
+type lruHistoryCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order has the most recently used session at the front.
+	order *list.List
+	size  int
+	ttl   time.Duration
+}
+
+type cachedHistory struct {
+	sessionId string
+	json      string
+	// at is when the value was read or written, so a background read
+	// doesn't overwrite a newer save.
+	at time.Time
+}
+
+// get returns the cached history of a session if it is younger than the TTL.
+func (c *lruHistoryCache) get(sessionId string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[sessionId]
+	if !ok {
+		return "", false
+	}
+	entry := element.Value.(*cachedHistory)
+	if time.Since(entry.at) > c.ttl {
+		c.order.Remove(element)
+		delete(c.entries, sessionId)
+		return "", false
+	}
+	c.order.MoveToFront(element)
+	return entry.json, true
+}
+
+// put caches a session's history as of at, unless a newer value is held.
+func (c *lruHistoryCache) put(sessionId, historyJSON string, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[sessionId]; ok {
+		entry := element.Value.(*cachedHistory)
+		if entry.at.After(at) {
+			return
+		}
+		entry.json, entry.at = historyJSON, at
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[sessionId] = c.order.PushFront(&cachedHistory{sessionId: sessionId, json: historyJSON, at: at})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedHistory).sessionId)
+	}
+}
+
+// forget drops sessions from the cache, all of them when none are given.
+func (c *lruHistoryCache) forget(sessionIds ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(sessionIds) == 0 {
+		c.entries = map[string]*list.Element{}
+		c.order.Init()
+		return
+	}
+	for _, sessionId := range sessionIds {
+		if element, ok := c.entries[sessionId]; ok {
+			c.order.Remove(element)
+			delete(c.entries, sessionId)
+		}
+	}
+}
+
+// refresh reads a session's history JSON like readRawHistory and updates the
+// cache with it.
+func (c *lruHistoryCache) refresh(sessionId string) (string, error) {
+	start := time.Now()
+	historyJSON, err := readRawHistory(sessionId)
+	switch err {
+	case nil:
+		c.put(sessionId, historyJSON, start)
+	case redis.Nil:
+		c.forget(sessionId)
+	}
+	return historyJSON, err
+}
+
+// read returns a session's history JSON like refresh, falling back to the
+// cache when Redis hasn't answered within the soft deadline.
+func (c *lruHistoryCache) read(sessionId string) (string, error) {
+	type result struct {
+		json string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		historyJSON, err := c.refresh(sessionId)
+		done <- result{historyJSON, err}
+	}()
+
+	deadline := time.NewTimer(historySoftDeadline)
+	defer deadline.Stop()
+	select {
+	case r := <-done:
+		return r.json, r.err
+	case <-deadline.C:
+	}
+	if historyJSON, ok := c.get(sessionId); ok {
+		historyStaleReads.Inc()
+		return historyJSON, nil
+	}
+	r := <-done
+	return r.json, r.err
+}
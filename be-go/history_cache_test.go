@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// slowGets delays every GET on redisClient by the current delay, to stand in
+// for a momentarily slow Redis.
+type slowGets struct{ delay *atomic.Int64 }
+
+func (slowGets) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (slowGets) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (s slowGets) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == "get" {
+			time.Sleep(time.Duration(s.delay.Load()))
+		}
+		return next(ctx, cmd)
+	}
+}
+
+// enableHistoryCache turns on the soft deadline and returns the delay added to
+// Redis reads, zero to start with.
+func enableHistoryCache(t *testing.T, deadline time.Duration) *atomic.Int64 {
+	t.Helper()
+	setVar(t, &historySoftDeadline, deadline)
+	setVar(t, &historyCache, newHistoryCache())
+	delay := &atomic.Int64{}
+	redisClient.AddHook(slowGets{delay})
+	return delay
+}
+
+func textsOf(history []Message) []string {
+	texts := make([]string, len(history))
+	for i, m := range history {
+		texts[i] = m.Text
+	}
+	return texts
+}
+
+func TestSlowRedisServedFromCache(t *testing.T) {
+	mr := setupRedis(t)
+	delay := enableHistoryCache(t, 50*time.Millisecond)
+	if err := saveHistoryToRedis("slow-1", []Message{{Role: "user", Text: "Cached"}}, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+	// Another instance has since written a newer history.
+	mr.Set(historyKey("slow-1"), `[{"role":"user","text":"Fresh"}]`)
+	delay.Store(int64(400 * time.Millisecond))
+	stale := historyStaleReads.Value()
+
+	start := time.Now()
+	w := getHistory(t, "slow-1", "")
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Fatalf("history read took %v, want the cached history within the deadline", elapsed)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var history []Message
+	decodeBody(t, w, &history)
+	if texts := textsOf(history); len(texts) != 1 || texts[0] != "Cached" {
+		t.Fatalf("history = %v, want the cached one", texts)
+	}
+	if historyStaleReads.Value() != stale+1 {
+		t.Errorf("stale reads rose by %d, want 1", historyStaleReads.Value()-stale)
+	}
+
+	// The background read refreshes the cache.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if cached, _ := historyCache.get("slow-1"); cached == `[{"role":"user","text":"Fresh"}]` {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cache not refreshed by the background read")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSlowRedisWritersReadFresh(t *testing.T) {
+	mr := setupRedis(t)
+	delay := enableHistoryCache(t, 20*time.Millisecond)
+	if err := saveHistoryToRedis("slow-2", []Message{{Role: "user", Text: "Cached"}}, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+	mr.Set(historyKey("slow-2"), `[{"role":"user","text":"Fresh"}]`)
+	delay.Store(int64(100 * time.Millisecond))
+
+	history, err := getHistoryFromRedis("slow-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if texts := textsOf(history); len(texts) != 1 || texts[0] != "Fresh" {
+		t.Fatalf("history = %v, want Redis's, never the cache's", texts)
+	}
+}
+
+func TestSlowRedisCacheMissWaits(t *testing.T) {
+	mr := setupRedis(t)
+	delay := enableHistoryCache(t, 20*time.Millisecond)
+	mr.Set(historyKey("slow-3"), `[{"role":"user","text":"Only in Redis"}]`)
+	delay.Store(int64(100 * time.Millisecond))
+
+	history, err := getHistoryAllowStale("slow-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if texts := textsOf(history); len(texts) != 1 || texts[0] != "Only in Redis" {
+		t.Fatalf("history = %v, want Redis's answer after the deadline", texts)
+	}
+}
+
+func TestHistoryCacheOptIn(t *testing.T) {
+	setVar(t, &historySoftDeadline, 0)
+	if newHistoryCache() != nil {
+		t.Error("history cache enabled without HISTORY_SOFT_DEADLINE")
+	}
+}
+
+func TestHistoryCacheEvictsAndExpires(t *testing.T) {
+	setVar(t, &historySoftDeadline, time.Second)
+	setVar(t, &historyCacheSize, 2)
+	setVar(t, &historyCacheTTL, time.Minute)
+	c := newHistoryCache()
+	now := time.Now()
+
+	c.put("a", "A", now)
+	c.put("b", "B", now)
+	c.get("a")
+	c.put("c", "C", now)
+	if _, ok := c.get("b"); ok {
+		t.Error("least recently used session kept past the cache size")
+	}
+	if got, ok := c.get("a"); !ok || got != "A" {
+		t.Errorf("a = %q, %v, want it kept", got, ok)
+	}
+
+	// An older background read doesn't overwrite a newer save.
+	c.put("a", "older", now.Add(-time.Second))
+	if got, _ := c.get("a"); got != "A" {
+		t.Errorf("a = %q, want the newer value kept", got)
+	}
+
+	c.put("old", "O", now.Add(-2*time.Minute))
+	if _, ok := c.get("old"); ok {
+		t.Error("entry older than HISTORY_CACHE_TTL served")
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+// hideSystemInHistory leaves system messages out of the histories returned to
+// clients (/chat/history and /chat?includeHistory=1), since they can hold
+// proprietary instructions. They are still stored and sent to providers. Set
+// HIDE_SYSTEM_IN_HISTORY=false to return them.
+var hideSystemInHistory = os.Getenv("HIDE_SYSTEM_IN_HISTORY") != "false"
+
+// visibleHistory returns the messages of history a client is shown.
+func visibleHistory(history []Message) []Message {
+	visible := make([]Message, 0, len(history))
+	for _, m := range history {
+		if m.Role == "system" && hideSystemInHistory {
+			continue
+		}
+		visible = append(visible, m)
+	}
+	return visible
+}
+
+// wantsHistory reports whether a /chat request asked for the updated history
+// in its response, via ?includeHistory=1 or includeHistory in the body.
+func wantsHistory(r *http.Request, clientPayload ClientRequestPayload) bool {
+	return clientPayload.IncludeHistory || r.URL.Query().Get("includeHistory") == "1"
+}
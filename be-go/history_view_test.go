@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChatIncludesHistory(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Paris."))
+	chatTurn(t, map[string]interface{}{"sessionId": "include-1", "modelName": "gemini", "contents": userTurn("Capital of France?")})
+
+	// Through the body flag.
+	resp := chatTurn(t, map[string]interface{}{"sessionId": "include-1", "modelName": "gemini", "contents": userTurn("Of Italy?"), "includeHistory": true})
+	want := []Message{{Role: "user", Text: "Capital of France?"}, {Role: "ai", Text: "Paris."}, {Role: "user", Text: "Of Italy?"}, {Role: "ai", Text: "Paris."}}
+	if len(resp.History) != len(want) {
+		t.Fatalf("history = %+v, want %d messages", resp.History, len(want))
+	}
+	for i, m := range resp.History {
+		if m.Role != want[i].Role || m.Text != want[i].Text {
+			t.Errorf("history[%d] = %s %q, want %s %q", i, m.Role, m.Text, want[i].Role, want[i].Text)
+		}
+	}
+
+	// Through the query parameter, with the system prompt shown when not
+	// hidden.
+	setVar(t, &hideSystemInHistory, false)
+	w := httptest.NewRecorder()
+	chatHandler(w, newJSONRequest(t, "POST", "/chat?includeHistory=1", map[string]interface{}{"sessionId": "include-1", "modelName": "gemini", "contents": userTurn("Of Spain?")}))
+	var queried ChatResponse
+	decodeBody(t, w, &queried)
+	if len(queried.History) != 7 || queried.History[0].Role != "system" {
+		t.Errorf("history = %+v, want all 7 messages with the system prompt", queried.History)
+	}
+}
+
+func TestChatOmitsHistoryByDefault(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Hi"))
+	if resp := chatTurn(t, map[string]interface{}{"sessionId": "include-2", "modelName": "gemini", "contents": userTurn("Hi")}); resp.History != nil {
+		t.Errorf("history = %+v, want none unless asked for", resp.History)
+	}
+}
+
+func TestHistoryHidesSystemMessages(t *testing.T) {
+	setupRedis(t)
+	history := []Message{
+		{Role: "system", Text: "Proprietary instructions."},
+		{Role: "user", Text: "Hi"},
+		{Role: "ai", Text: "Hello"},
+	}
+	if err := saveHistoryToRedis("hidden-system", history, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hide := range []bool{true, false} {
+		setVar(t, &hideSystemInHistory, hide)
+		w := getHistory(t, "hidden-system", "")
+		var got []Message
+		decodeBody(t, w, &got)
+		wantLen := 3
+		if hide {
+			wantLen = 2
+		}
+		if len(got) != wantLen || (hide && got[0].Role == "system") {
+			t.Errorf("hide=%v: history = %+v, want %d messages", hide, got, wantLen)
+		}
+	}
+	if stored := storedHistory(t, "hidden-system"); stored[0].Role != "system" {
+		t.Errorf("stored history = %+v, want the system prompt kept", stored)
+	}
+}
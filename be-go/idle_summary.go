@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// idleSummaryGap folds a session's earlier turns into a running summary when
+// the conversation resumes after being idle for longer than this. The summary
+// is kept in the session metadata and sent in place of the turns it covers;
+// the stored history itself is left intact. 0 disables it.
+var idleSummaryGap = envDuration("IDLE_SUMMARY_GAP", 0)
+
+const (
+	idleSummaryMaxTokens = 512
+	idleSummaryTimeout   = 30 * time.Second
+	idleSummaryPrompt    = "Summarize the following conversation between a user and an assistant so it can be continued later. Keep the facts, decisions and open questions; leave out pleasantries. Reply with the summary only."
+)
+
+// summarizedUntil returns the number of leading messages of history covered
+// by a summary made through the given time. Messages without a timestamp count
+// as covered when a later covered message follows them.
+func summarizedUntil(history []Message, through time.Time) int {
+	if through.IsZero() {
+		return 0
+	}
+	covered := 0
+	for i, m := range history {
+		if !m.CreatedAt.IsZero() && !m.CreatedAt.After(through) {
+			covered = i + 1
+		}
+	}
+	return covered
+}
+
+// idleSince reports whether the last message of history is older than
+// idleSummaryGap.
+func idleSince(history []Message, now time.Time) bool {
+	if len(history) == 0 {
+		return false
+	}
+	last := history[len(history)-1].CreatedAt
+	return !last.IsZero() && now.Sub(last) > idleSummaryGap
+}
+
+// idleCompaction returns the compaction of a session that a turn resumes
+// after an idle gap, or nil when there is none to do. history is the prepared
+// history, the new message last. The compaction is run in the background
+// once the turn is stored, so the turn doesn't wait for the summary, which
+// applies from the next turn on; it draws on the attempt budget of ctx, the
+// turn's request.
+func idleCompaction(ctx context.Context, sessionId, modelName string, history []Message) func() {
+	if idleSummaryGap <= 0 || len(history) == 0 {
+		return nil
+	}
+	previous := append([]Message(nil), history[:len(history)-1]...)
+	if !idleSince(previous, time.Now()) {
+		return nil
+	}
+	ctx = context.WithoutCancel(ctx)
+	return func() { compactIdleSession(ctx, sessionId, modelName, previous) }
+}
+
+// compactIdleSession extends the session's summary with the turns stored
+// before an idle gap. Failures are only logged: the session goes on with the
+// unsummarized history.
+func compactIdleSession(ctx context.Context, sessionId, modelName string, history []Message) {
+	call, ok := providers[modelName]
+	if !ok {
+		return
+	}
+	meta, err := getSessionMeta(sessionId)
+	if err != nil {
+		slog.Warn("Idle summary skipped, could not read session metadata", "sessionId", sessionId, "error", err)
+		return
+	}
+	if meta == nil {
+		now := time.Now().UTC()
+		meta = &SessionMeta{SessionID: sessionId, CreatedAt: now, UpdatedAt: now}
+	}
+
+	pending := history[summarizedUntil(history, meta.SummaryThrough):]
+	if !hasTurns(pending) {
+		return
+	}
+	summary, err := summarizeTurns(ctx, call, meta.Summary, pending)
+	if err != nil {
+		slog.Warn("Idle summary failed", "sessionId", sessionId, "model", modelName, "error", err)
+		return
+	}
+
+	// The turn stored the metadata again while the summary was made.
+	if latest, err := getSessionMeta(sessionId); err == nil && latest != nil {
+		meta = latest
+	}
+	meta.Summary = summary
+	meta.SummaryThrough = history[len(history)-1].CreatedAt
+	if err := saveSessionMeta(meta); err != nil {
+		slog.Error("Error saving idle summary", "sessionId", sessionId, "error", err)
+		return
+	}
+	slog.Info("Summarized session after idle gap", "sessionId", sessionId, "messages", len(pending))
+}
+
+// hasTurns reports whether messages holds any user or AI message.
+func hasTurns(messages []Message) bool {
+	for _, m := range messages {
+		if m.Role == "user" || m.Role == "ai" {
+			return true
+		}
+	}
+	return false
+}
+
+// summarizeTurns asks the model to fold turns into the previous summary.
+func summarizeTurns(ctx context.Context, call chatFunc, previous string, turns []Message) (string, error) {
+	var transcript strings.Builder
+	if previous != "" {
+		fmt.Fprintf(&transcript, "Summary of the conversation so far: %s\n", previous)
+	}
+	for _, m := range turns {
+		switch m.Role {
+		case "user":
+			fmt.Fprintf(&transcript, "User: %s\n", m.Text)
+		case "ai":
+			fmt.Fprintf(&transcript, "Assistant: %s\n", m.Text)
+		}
+	}
+
+	summaryCtx, cancel := context.WithTimeout(ctx, idleSummaryTimeout)
+	defer cancel()
+	result, err := call(summaryCtx, ProviderRequest{
+		Messages:  []Message{{Role: "user", Text: idleSummaryPrompt + "\n\n" + transcript.String()}},
+		MaxTokens: idleSummaryMaxTokens,
+	})
+	if err != nil {
+		return "", err
+	}
+	summary := strings.TrimSpace(result.Text)
+	if summary == "" {
+		return "", fmt.Errorf("model returned an empty summary")
+	}
+	return summary, nil
+}
+
+// withIdleSummary replaces the turns covered by the session's summary with a
+// single system message holding it, placed after the leading system prompt.
+func withIdleSummary(sessionId string, history []Message) []Message {
+	if idleSummaryGap <= 0 {
+		return history
+	}
+	meta, err := getSessionMeta(sessionId)
+	if err != nil {
+		slog.Warn("Could not read session summary", "sessionId", sessionId, "error", err)
+		return history
+	}
+	if meta == nil || meta.Summary == "" {
+		return history
+	}
+
+	pinned := 0
+	for pinned < len(history) && history[pinned].Role == "system" {
+		pinned++
+	}
+	covered := max(summarizedUntil(history, meta.SummaryThrough), pinned)
+
+	messages := make([]Message, 0, pinned+1+len(history)-covered)
+	messages = append(messages, history[:pinned]...)
+	messages = append(messages, Message{Role: "system", Text: "Summary of the earlier conversation: " + meta.Summary})
+	return append(messages, history[covered:]...)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdleGapCompactedOnResume(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &idleSummaryGap, time.Hour)
+	before := time.Now().Add(-3 * time.Hour).UTC().Format(time.RFC3339)
+	mr.Set(historyKey("idle-1"), fmt.Sprintf(`[
+		{"role":"system","text":"Be brief.","createdAt":%[1]q},
+		{"role":"user","text":"I am planning a trip to Kyoto.","createdAt":%[1]q},
+		{"role":"ai","text":"Great, when are you going?","createdAt":%[1]q}
+	]`, before))
+
+	summaryStarted := make(chan string, 1)
+	releaseSummary := make(chan struct{})
+	var turns []ProviderRequest
+	stubChat(t, "gemini", func(_ context.Context, req ProviderRequest) (ProviderResponse, error) {
+		if strings.HasPrefix(req.Messages[0].Text, idleSummaryPrompt) {
+			summaryStarted <- req.Messages[0].Text
+			<-releaseSummary
+			return ProviderResponse{Text: "The user is planning a trip to Kyoto."}, nil
+		}
+		turns = append(turns, req)
+		return ProviderResponse{Text: "Noted.", Choices: []string{"Noted."}}, nil
+	})
+
+	// The resumed turn is answered while the summary is still being made.
+	chatTurn(t, map[string]interface{}{"sessionId": "idle-1", "modelName": "gemini", "contents": userTurn("In April.")})
+	select {
+	case prompt := <-summaryStarted:
+		if !strings.Contains(prompt, "User: I am planning a trip to Kyoto.") || strings.Contains(prompt, "In April.") {
+			t.Errorf("summary prompt = %q, want only the turns before the gap", prompt)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no summary was requested after the idle gap")
+	}
+	close(releaseSummary)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		meta, err := getSessionMeta("idle-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta != nil && meta.Summary != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("meta = %+v, want the summary stored", meta)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The next turn sends the summary in place of the summarized turns.
+	chatTurn(t, map[string]interface{}{"sessionId": "idle-1", "modelName": "gemini", "contents": userTurn("Any tips?")})
+	var sent []string
+	for _, m := range turns[len(turns)-1].Messages {
+		sent = append(sent, m.Text)
+	}
+	joined := strings.Join(sent, "\n")
+	if !strings.Contains(joined, "Summary of the earlier conversation: The user is planning a trip to Kyoto.") {
+		t.Errorf("messages = %q, want the summary", sent)
+	}
+	if strings.Contains(joined, "Great, when are you going?") {
+		t.Errorf("messages = %q, want the summarized turns left out", sent)
+	}
+	if !strings.Contains(joined, "In April.") {
+		t.Errorf("messages = %q, want the turns after the gap kept", sent)
+	}
+	if history := storedHistory(t, "idle-1"); len(history) != 7 {
+		t.Errorf("stored history has %d messages, want all 7 kept", len(history))
+	}
+}
+
+func TestNoCompactionWithoutIdleGap(t *testing.T) {
+	setVar(t, &idleSummaryGap, time.Hour)
+	now := time.Now()
+	history := []Message{
+		{Role: "user", Text: "Hi", CreatedAt: now.Add(-time.Minute)},
+		{Role: "ai", Text: "Hello", CreatedAt: now.Add(-time.Minute)},
+		{Role: "user", Text: "Again", CreatedAt: now},
+	}
+	if idleCompaction(context.Background(), "idle-2", "gemini", history) != nil {
+		t.Error("compaction scheduled for a session resumed within the gap")
+	}
+	history[0].CreatedAt, history[1].CreatedAt = now.Add(-2*time.Hour), now.Add(-2*time.Hour)
+	if idleCompaction(context.Background(), "idle-2", "gemini", history) == nil {
+		t.Error("no compaction for a session resumed after the gap")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+// debugPretty indents every JSON response, for eyeballing them during manual
+// testing. Single requests can ask for the same with ?pretty=1.
+var debugPretty = os.Getenv("DEBUG_PRETTY") == "true"
+
+// prettyJSON reports whether the response to r is indented. r may be nil for
+// responses written without the request at hand.
+func prettyJSON(r *http.Request) bool {
+	return debugPretty || (r != nil && r.URL.Query().Get("pretty") == "1")
+}
+
+// writeJSON writes v as the JSON response with the given status, its keys in
+// responseKeyStyle and indented when prettyJSON says so.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(v)
+	w.Write(prettyRawJSON(r, styleResponseJSON(body.Bytes())))
+}
+
+// prettyRawJSON indents an already encoded JSON body when prettyJSON says so,
+// and returns it unchanged otherwise or if it doesn't parse.
+func prettyRawJSON(r *http.Request, body []byte) []byte {
+	if !prettyJSON(r) {
+		return body
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		return body
+	}
+	indented.WriteByte('\n')
+	return indented.Bytes()
+}
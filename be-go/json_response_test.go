@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrettyJSONResponses(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Hi"))
+	payload := map[string]interface{}{"sessionId": "pretty-1", "modelName": "gemini", "contents": userTurn("Hi")}
+
+	w := postJSON(t, chatHandler, "/chat", payload)
+	if body := w.Body.String(); strings.Contains(body, "\n  ") {
+		t.Errorf("default /chat body is indented: %s", body)
+	}
+	w = postJSON(t, chatHandler, "/chat?pretty=1", payload)
+	if body := w.Body.String(); !strings.HasPrefix(body, "{\n  \"") {
+		t.Errorf("pretty /chat body is not indented: %s", body)
+	}
+
+	// The history endpoint writes its body itself and must indent it too.
+	w = httptest.NewRecorder()
+	getChatHistoryHandler(w, httptest.NewRequest("GET", "/chat/history?sessionId=pretty-1&pretty=1", nil))
+	if body := w.Body.String(); !strings.HasPrefix(body, "[\n  {") {
+		t.Errorf("pretty history body is not indented: %s", body)
+	}
+	w = httptest.NewRecorder()
+	getChatHistoryHandler(w, httptest.NewRequest("GET", "/chat/history?sessionId=pretty-1", nil))
+	if body := w.Body.String(); strings.Contains(body, "\n  ") {
+		t.Errorf("default history body is indented: %s", body)
+	}
+}
+
+func TestDebugPrettyEnv(t *testing.T) {
+	setVar(t, &debugPretty, true)
+	w := httptest.NewRecorder()
+	writeError(w, 400, codeInvalidRequest, "Bad")
+	if !strings.HasPrefix(w.Body.String(), "{\n  \"error\"") {
+		t.Errorf("body = %q, want it indented under DEBUG_PRETTY", w.Body)
+	}
+}
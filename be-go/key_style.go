@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Key styles of JSON responses.
+const (
+	keyStyleCamel = "camelCase"
+	keyStyleSnake = "snake_case"
+)
+
+// responseKeyStyle is the style of the keys in JSON responses and stream
+// events, read from RESPONSE_KEY_STYLE: camelCase (the default), as the
+// struct tags are written, or snake_case, e.g. session_id for sessionId.
+// Request bodies are accepted in either style whatever it is set to.
+var responseKeyStyle = loadResponseKeyStyle()
+
+func loadResponseKeyStyle() string {
+	value := os.Getenv("RESPONSE_KEY_STYLE")
+	switch value {
+	case "", keyStyleCamel:
+		return keyStyleCamel
+	case keyStyleSnake:
+		return keyStyleSnake
+	}
+	warnConfig("Ignoring invalid RESPONSE_KEY_STYLE, using camelCase", "value", value)
+	return keyStyleCamel
+}
+
+// opaqueKeys hold values that are passed through with their keys as they
+// are: caller-supplied metadata and the provider exchange shown to admins.
+var opaqueKeys = map[string]bool{
+	"metadata":         true,
+	"providerPayload":  true,
+	"providerResponse": true,
+}
+
+// styleResponseJSON rewrites the keys of an encoded response to
+// responseKeyStyle. It returns body unchanged under camelCase or if it
+// doesn't parse.
+func styleResponseJSON(body []byte) []byte {
+	if responseKeyStyle != keyStyleSnake {
+		return body
+	}
+	styled, err := rewriteKeys(body, snakeCase)
+	if err != nil {
+		return body
+	}
+	if bytes.HasSuffix(body, []byte("\n")) {
+		styled = append(styled, '\n')
+	}
+	return styled
+}
+
+// decodeJSON decodes the JSON value at the start of r into v, like
+// json.Decoder.Decode, accepting snake_case keys for the camelCase ones of
+// v's struct tags.
+func decodeJSON(r io.Reader, v interface{}) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return err
+	}
+	if bytes.IndexByte(raw, '_') >= 0 {
+		if camel, err := rewriteKeys(raw, camelCase); err == nil {
+			raw = camel
+		}
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// rewriteKeys re-encodes a JSON value with every object key passed through
+// rename, except below opaqueKeys. Key order and formatting of numbers are
+// kept; the result is compact.
+func rewriteKeys(data []byte, rename func(string) string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	// Each open object or array counts the tokens written in it, so keys
+	// (the even tokens of an object) and separators can be told apart.
+	type container struct {
+		object bool
+		n      int
+	}
+	var stack []container
+	var out bytes.Buffer
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			stack = stack[:len(stack)-1]
+			out.WriteByte(byte(d))
+			continue
+		}
+
+		isKey := false
+		if n := len(stack); n > 0 {
+			top := &stack[n-1]
+			isKey = top.object && top.n%2 == 0
+			switch {
+			case top.n == 0:
+			case top.object && !isKey:
+				out.WriteByte(':')
+			default:
+				out.WriteByte(',')
+			}
+			top.n++
+		}
+
+		switch v := tok.(type) {
+		case json.Delim:
+			out.WriteByte(byte(v))
+			stack = append(stack, container{object: v == '{'})
+		case string:
+			if !isKey {
+				writeJSONString(&out, v)
+				continue
+			}
+			renamed := rename(v)
+			writeJSONString(&out, renamed)
+			if opaqueKeys[v] || opaqueKeys[renamed] {
+				var value json.RawMessage
+				if err := dec.Decode(&value); err != nil {
+					return nil, err
+				}
+				out.WriteByte(':')
+				out.Write(value)
+				stack[len(stack)-1].n++
+			}
+		case json.Number:
+			out.WriteString(v.String())
+		case bool:
+			out.WriteString(strconv.FormatBool(v))
+		case nil:
+			out.WriteString("null")
+		}
+	}
+}
+
+func writeJSONString(out *bytes.Buffer, s string) {
+	encoded, _ := json.Marshal(s)
+	out.Write(encoded)
+}
+
+// snakeCase turns a camelCase key into snake_case: sessionId becomes
+// session_id.
+func snakeCase(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// camelCase turns a snake_case key into camelCase: session_id becomes
+// sessionId. Keys without an underscore are returned as they are.
+func camelCase(key string) string {
+	if !strings.Contains(key, "_") {
+		return key
+	}
+	parts := strings.Split(key, "_")
+	var b strings.Builder
+	b.WriteString(parts[0])
+	for _, part := range parts[1:] {
+		if part == "" {
+			continue
+		}
+		runes := []rune(part)
+		runes[0] = unicode.ToUpper(runes[0])
+		b.WriteString(string(runes))
+	}
+	return b.String()
+}
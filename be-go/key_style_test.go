@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// chatKeys posts a chat turn in the given request style and returns the
+// top-level keys and usage keys of the response.
+func chatKeys(t *testing.T, payload map[string]interface{}) (top, usage []string) {
+	t.Helper()
+	w := postJSON(t, chatHandler, "/chat", payload)
+	if w.Code != http.StatusOK {
+		t.Fatalf("chat status = %d, body %s", w.Code, w.Body)
+	}
+	var resp map[string]interface{}
+	decodeBody(t, w, &resp)
+	return sortedKeys(resp), sortedKeys(resp["usage"].(map[string]interface{}))
+}
+
+func TestResponseKeyStyle(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Hello"))
+	payload := map[string]interface{}{"sessionId": "style-1", "modelName": "gemini", "contents": userTurn("Hi")}
+
+	top, usage := chatKeys(t, payload)
+	if !slices.Contains(top, "toolCalls") || !slices.Contains(usage, "promptTokens") {
+		t.Fatalf("camelCase keys = %v, usage %v", top, usage)
+	}
+
+	setVar(t, &responseKeyStyle, keyStyleSnake)
+	top, usage = chatKeys(t, payload)
+	if !slices.Contains(top, "tool_calls") || !slices.Contains(usage, "prompt_tokens") {
+		t.Fatalf("snake_case keys = %v, usage %v", top, usage)
+	}
+	for _, key := range append(top, usage...) {
+		if snakeCase(key) != key {
+			t.Errorf("key %q is not snake_case", key)
+		}
+	}
+}
+
+func TestSnakeCaseRequestsAccepted(t *testing.T) {
+	for _, style := range []string{keyStyleCamel, keyStyleSnake} {
+		setupRedis(t)
+		requests := recordRequests(t, "gemini", "Hello")
+		setVar(t, &responseKeyStyle, style)
+
+		postJSON(t, chatHandler, "/chat", map[string]interface{}{
+			"session_id": "style-" + style,
+			"model_name": "gemini",
+			"max_tokens": 50,
+			"contents":   userTurn("Hi"),
+		})
+		if len(*requests) != 1 || (*requests)[0].MaxTokens != 50 {
+			t.Fatalf("%s: provider requests = %+v, want the snake_case fields decoded", style, *requests)
+		}
+		if history := storedHistory(t, "style-"+style); len(history) == 0 {
+			t.Fatalf("%s: nothing stored under the snake_case session_id", style)
+		}
+	}
+}
+
+func TestStreamEventKeyStyle(t *testing.T) {
+	setupRedis(t)
+	stubStream(t, "gemini", streamDeltas(nil, "Hello"))
+	setVar(t, &responseKeyStyle, keyStyleSnake)
+
+	events := postStream(t, map[string]interface{}{"sessionId": "style-stream", "modelName": "gemini", "contents": userTurn("Hi")})
+	if start := events[0]; start.Name != "start" || start.Data["request_id"] == nil {
+		t.Fatalf("start event = %+v, want request_id", start)
+	}
+	usage := events[len(events)-1].Data["usage"].(map[string]interface{})
+	if usage["completion_tokens"] == nil {
+		t.Fatalf("done usage = %v, want snake_case keys", usage)
+	}
+}
+
+func TestRewriteKeysKeepsOpaqueValues(t *testing.T) {
+	got, err := rewriteKeys([]byte(`{"sessionId":"s1","metadata":{"userTier":"pro"},"items":[{"createdAt":1.50}]}`), snakeCase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"session_id":"s1","metadata":{"userTier":"pro"},"items":[{"created_at":1.50}]}`; string(got) != want {
+		t.Fatalf("rewritten = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevel is the minimum level that gets written. It is set from the
+// LOG_LEVEL environment variable (debug|info|warn|error) and defaults to info.
+var logLevel = new(slog.LevelVar)
+
+// parseLogLevel converts a LOG_LEVEL value into a slog level. An empty value
+// means info.
+func parseLogLevel(value string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q", value)
+}
+
+// InitLogging installs the structured logger as the default for both slog and
+// the standard log package, then logs the configuration warnings held until
+// now.
+func InitLogging() {
+	level, err := parseLogLevel(os.Getenv("LOG_LEVEL"))
+	logLevel.Set(level)
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr)))
+	if err != nil {
+		slog.Warn("Invalid LOG_LEVEL, defaulting to info", "error", err)
+	}
+	flushConfigWarnings()
+}
+
+// newLogHandler returns the handler InitLogging installs, writing to w at
+// logLevel.
+func newLogHandler(w io.Writer) slog.Handler {
+	return slog.NewTextHandler(w, &slog.HandlerOptions{Level: logLevel})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// captureLogs installs a default logger writing to the returned buffer at
+// level, for the duration of the test.
+func captureLogs(t *testing.T, level slog.Level) *bytes.Buffer {
+	t.Helper()
+	old := logLevel.Level()
+	logLevel.Set(level)
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(newLogHandler(&buf)))
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+		logLevel.Set(old)
+	})
+	return &buf
+}
+
+func TestDebugSuppressedAtInfo(t *testing.T) {
+	buf := captureLogs(t, slog.LevelInfo)
+	slog.Debug("Skipping message with invalid role", "role", "robot")
+	slog.Info("Request served")
+
+	if strings.Contains(buf.String(), "Skipping message") {
+		t.Errorf("debug message logged at info level:\n%s", buf)
+	}
+	if !strings.Contains(buf.String(), "Request served") {
+		t.Errorf("info message missing:\n%s", buf)
+	}
+}
+
+func TestDebugLoggedAtDebug(t *testing.T) {
+	buf := captureLogs(t, slog.LevelDebug)
+	slog.Debug("Skipping message with invalid role", "role", "robot")
+
+	if !strings.Contains(buf.String(), "Skipping message") {
+		t.Errorf("debug message missing at debug level:\n%s", buf)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := map[string]slog.Level{
+		"":        slog.LevelInfo,
+		"debug":   slog.LevelDebug,
+		"INFO":    slog.LevelInfo,
+		"warn":    slog.LevelWarn,
+		"warning": slog.LevelWarn,
+		" error ": slog.LevelError,
+	}
+	for value, want := range tests {
+		got, err := parseLogLevel(value)
+		if err != nil || got != want {
+			t.Errorf("parseLogLevel(%q) = %v, %v; want %v", value, got, err, want)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("parseLogLevel(\"verbose\") succeeded, want an error")
+	}
+}
+
+func TestConfigWarningsHeldUntilLogging(t *testing.T) {
+	setVar(t, &loggingReady, false)
+	setVar(t, &configWarnings, nil)
+	buf := captureLogs(t, slog.LevelWarn)
+
+	warnConfig("Ignoring invalid duration environment variable", "name", "X")
+	if buf.Len() != 0 {
+		t.Fatalf("warning logged before logging was set up:\n%s", buf)
+	}
+	flushConfigWarnings()
+	if !strings.Contains(buf.String(), "Ignoring invalid duration") {
+		t.Fatalf("held warning not logged on flush:\n%s", buf)
+	}
+
+	buf.Reset()
+	warnConfig("Later warning")
+	if !strings.Contains(buf.String(), "Later warning") {
+		t.Fatalf("warning after flush not logged:\n%s", buf)
+	}
+}
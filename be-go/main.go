@@ -1,21 +1,25 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 	
 	//Import the Redis client library
 	redis "github.com/redis/go-redis/v9"
 )
 
-var redisClient *redis.Client
+var redisClient redis.UniversalClient
 var ctx = context.Background()
 
 // Define API keys for different models from environment variables.
@@ -23,61 +27,244 @@ var geminiAPIKey = os.Getenv("GEMINI_API_KEY")
 var llamaAPIKey = os.Getenv("LLAMA_API_KEY")
 var claudeAPIKey = os.Getenv("CLAUDE_API_KEY")
 var chatGPTAPIKey = os.Getenv("CHATGPT_API_KEY")
+var mistralAPIKey = os.Getenv("MISTRAL_API_KEY")
 
 // ClientRequestPayload represents the structure of the incoming request from the client,
 // now including a field to specify the model.
 type ClientRequestPayload struct {
+	// APIVersion is the payload revision the client targets; see applyAPIVersion.
+	APIVersion int `json:"apiVersion,omitempty"`
 	SessionID string `json:"sessionId"` // <-- NEW!
-	ModelName string `json:"modelName"`
-	Contents []struct {
-		Role string `json:"role"`
-		Text string `json:"text"`
-	} `json:"contents"` // This contents array now only holds the NEW user message
+	ModelName string `json:"modelName"` // Optional when DEFAULT_MODEL is set
+	Contents []ClientMessage `json:"contents"` // This contents array now only holds the NEW user message
+	// ContextWindowMessages overrides CONTEXT_WINDOW_MESSAGES for this request.
+	ContextWindowMessages int `json:"contextWindowMessages,omitempty"`
+	// N asks for that many alternative completions (OpenAI n, Gemini candidateCount).
+	N int `json:"n,omitempty"`
+	// SafetySettings overrides GEMINI_SAFETY_SETTINGS for Gemini requests.
+	SafetySettings []GeminiSafetySetting `json:"safetySettings,omitempty"`
+	// Persist set to false makes the request stateless: Redis is neither read
+	// nor written and Contents must carry the full conversation.
+	Persist *bool `json:"persist,omitempty"`
+	// PersistUserMessage and PersistAiMessage set to false leave the new
+	// message or the AI reply out of the stored turn; both default to true.
+	PersistUserMessage *bool `json:"persistUserMessage,omitempty"`
+	PersistAiMessage   *bool `json:"persistAiMessage,omitempty"`
+	// IncludeHistory returns the full updated history with the reply, as
+	// ?includeHistory=1 does.
+	IncludeHistory bool `json:"includeHistory,omitempty"`
+	// Continue asks the model to carry on from a trailing ai message
+	// (prefill) instead of answering the last user message.
+	Continue bool `json:"continue,omitempty"`
+	// DisableSystemPrompt starts a new session without the default system
+	// message. It has no effect on existing sessions.
+	DisableSystemPrompt bool `json:"disableSystemPrompt,omitempty"`
+	// AssistantName overrides ASSISTANT_NAME in the default system prompt of
+	// a new session.
+	AssistantName string `json:"assistantName,omitempty"`
+	// UserID identifies the end user to providers for abuse detection; an
+	// opaque or hashed id is best. Metadata is forwarded where supported
+	// (OpenAI metadata). Both are ignored by providers without them.
+	UserID   string            `json:"userId,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// preset, temperature and maxTokens override the session's stored
+	// generation settings for this turn.
+	GenerationSettings
+}
+
+// ClientMessage is one entry of a request's Contents.
+type ClientMessage struct {
+	Role string `json:"role"`
+	Text string `json:"text"`
+	// ID optionally identifies the message so a resend is answered
+	// from the history instead of creating a duplicate turn.
+	ID string `json:"id,omitempty"`
+	// Attachments lists IDs returned by POST /attachments whose text is
+	// sent along with the message.
+	Attachments []string `json:"attachments,omitempty"`
+	// ToolCallID and ToolName are set on "tool" messages carrying a tool
+	// result.
+	ToolCallID string `json:"toolCallId,omitempty"`
+	ToolName   string `json:"toolName,omitempty"`
+	// ToolCalls are the tool calls of an "ai" message, which the "tool"
+	// messages after it answer.
+	ToolCalls []ToolCall `json:"toolCalls,omitempty"`
+}
+
+// persistEnabled reports whether the turn is read from and saved to Redis.
+func (p ClientRequestPayload) persistEnabled() bool {
+	return p.Persist == nil || *p.Persist
+}
+
+// persistsUserMessage and persistsAIMessage report which parts of a
+// persisted turn are stored.
+func (p ClientRequestPayload) persistsUserMessage() bool {
+	return p.PersistUserMessage == nil || *p.PersistUserMessage
+}
+
+func (p ClientRequestPayload) persistsAIMessage() bool {
+	return p.PersistAiMessage == nil || *p.PersistAiMessage
 }
 
 // Message represents a single turn in the conversation, used for storage and retrieval.
 // We will also use the Message struct defined earlier (Step 2.3) for Redis storage
 type Message struct {
-	Role string `json:"role"` // "user", "ai", or "system"
+	Role string `json:"role"` // "user", "ai", "system", or "tool"
 	Text string `json:"text"`
+	// ToolCallID and ToolName identify the tool call a "tool" message holds
+	// the result of; the result itself is Text.
+	ToolCallID string `json:"toolCallId,omitempty"`
+	ToolName   string `json:"toolName,omitempty"`
+	// ToolCalls are the tools an AI message asked to call. Each is sent
+	// with the tool results answering it, or left out with them.
+	ToolCalls []ToolCall `json:"toolCalls,omitempty"`
+	// Partial marks an AI message checkpointed while it was still streaming.
+	Partial bool `json:"partial,omitempty"`
+	// ReplyOmitted marks a user message whose AI reply was deliberately not
+	// stored (persistAiMessage: false), so it isn't taken for a failed turn.
+	ReplyOmitted bool `json:"replyOmitted,omitempty"`
+	// Seeded marks the system prompt the server started the session with.
+	Seeded bool `json:"seeded,omitempty"`
+	// ID is the client-supplied message id, used to deduplicate resends.
+	ID string `json:"id,omitempty"`
+	// Model is the model that wrote an AI message.
+	Model string `json:"model,omitempty"`
+	// FinishReason is "length" on an AI message cut off at the token limit,
+	// which POST /chat/continue can extend.
+	FinishReason string `json:"finishReason,omitempty"`
+	// Attachments holds the IDs of the attachments the message references;
+	// their text is only added when the message is sent to a provider.
+	Attachments []string `json:"attachments,omitempty"`
+	// CreatedAt is when the message was added. Messages stored before it
+	// was recorded have the zero time.
+	CreatedAt time.Time `json:"createdAt,omitzero"`
 }
 
 // ---- Gemini API structs ----
 type GeminiPayload struct {
 	Contents         []GeminiMessage `json:"contents"`
+	SystemInstruction *GeminiMessage `json:"systemInstruction,omitempty"`
 	GenerationConfig map[string]interface{} `json:"generationConfig"`
+	SafetySettings   []GeminiSafetySetting  `json:"safetySettings,omitempty"`
+}
+
+// GeminiSafetySetting sets the blocking threshold of one harm category, e.g.
+// {"category": "HARM_CATEGORY_HARASSMENT", "threshold": "BLOCK_ONLY_HIGH"}.
+type GeminiSafetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
 }
 
 type GeminiMessage struct {
-	Role  string        `json:"role"`
+	Role  string        `json:"role,omitempty"`
 	Parts []GeminiPart  `json:"parts"`
 }
 
 type GeminiPart struct {
-	Text string `json:"text"`
+	Text string `json:"text,omitempty"`
+	FunctionCall     *GeminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *GeminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+// GeminiFunctionCall is a tool call requested by Gemini.
+type GeminiFunctionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+// GeminiFunctionResponse returns a tool result to Gemini. Response must be a
+// JSON object.
+type GeminiFunctionResponse struct {
+	ID       string          `json:"id,omitempty"`
+	Name     string          `json:"name"`
+	Response json.RawMessage `json:"response"`
 }
 
 type GeminiResponse struct {
 	Candidates []struct {
-		Content GeminiMessage `json:"content"`
+		Content      GeminiMessage `json:"content"`
+		FinishReason string        `json:"finishReason"`
+		CitationMetadata *struct {
+			CitationSources []struct {
+				URI string `json:"uri"`
+			} `json:"citationSources"`
+		} `json:"citationMetadata,omitempty"`
 	} `json:"candidates"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	UsageMetadata *GeminiUsage `json:"usageMetadata,omitempty"`
+}
+
+type GeminiUsage struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
 }
 
 // ---- OpenAI (ChatGPT) API structs ----
 type OpenaiPayload struct {
 	Model    string `json:"model"`
 	Messages []OpenaiMessage `json:"messages"`
+	MaxTokens int   `json:"max_tokens,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	ReasoningEffort  string   `json:"reasoning_effort,omitempty"`
+	User     string            `json:"user,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	N        int    `json:"n,omitempty"`
+	Stream   bool   `json:"stream,omitempty"`
+	StreamOptions *OpenaiStreamOptions `json:"stream_options,omitempty"`
 }
 
 type OpenaiMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// ToolCallID links a "tool" message to the call it answers.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	ToolCalls  []OpenaiToolCall `json:"tool_calls,omitempty"`
+}
+
+type OpenaiToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
 }
 
 type OpenaiResponse struct {
 	Choices []struct {
-		Message OpenaiMessage `json:"message"`
+		Message      OpenaiMessage `json:"message"`
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *OpenaiUsage `json:"usage,omitempty"`
+	// Citations is only sent by Perplexity.
+	Citations []string `json:"citations,omitempty"`
+}
+
+// OpenaiStreamChunk is a single `data:` event of a streamed chat completion.
+type OpenaiStreamChunk struct {
+	Choices []struct {
+		Delta        OpenaiMessage `json:"delta"`
+		FinishReason string        `json:"finish_reason"`
 	} `json:"choices"`
+	// Usage is only set on the last chunk, when requested with
+	// stream_options.include_usage or sent unasked (Mistral).
+	Usage *OpenaiUsage `json:"usage,omitempty"`
+}
+
+type OpenaiUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type OpenaiStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 // ---- Anthropic (Claude) API structs ----
@@ -85,34 +272,72 @@ type AnthropicPayload struct {
 	Model    string `json:"model"`
 	Messages []AnthropicMessage `json:"messages"`
 	MaxTokens int    `json:"max_tokens"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	System   string `json:"system,omitempty"`
+	Metadata *AnthropicMetadata `json:"metadata,omitempty"`
+	Stream   bool   `json:"stream,omitempty"`
+}
+
+// AnthropicMetadata is the request metadata Anthropic accepts: only an end
+// user id.
+type AnthropicMetadata struct {
+	UserID string `json:"user_id"`
 }
 
+// AnthropicMessage is sent with Content as a plain string unless it carries
+// Blocks (tool results), see MarshalJSON.
 type AnthropicMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	Blocks  []AnthropicContentBlock `json:"-"`
+}
+
+type AnthropicContentBlock struct {
+	Type      string `json:"type"`
+	Text      string `json:"text,omitempty"`
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+	// ID, Name and Input are set on tool_use blocks.
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
 }
 
 type AnthropicResponse struct {
 	Content []struct {
-		Text string `json:"text"`
+		Type  string `json:"type"`
+		Text  string `json:"text"`
+		// ID, Name and Input are set on tool_use blocks.
+		ID    string          `json:"id"`
+		Name  string          `json:"name"`
+		Input json.RawMessage `json:"input"`
 	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+	Usage *struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage,omitempty"`
 }
 
-// ---- Perplexity (Llama) API structs ----
-type PerplexityPayload struct {
-	Model    string `json:"model"`
-	Messages []PerplexityMessage `json:"messages"`
-}
-
-type PerplexityMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
-
-type PerplexityResponse struct {
-	Choices []struct {
-		Message PerplexityMessage `json:"message"`
-	} `json:"choices"`
+// AnthropicStreamEvent is a single `data:` event of a streamed message.
+type AnthropicStreamEvent struct {
+	Type string `json:"type"`
+	// Message is set on message_start, with the input token count.
+	Message *AnthropicResponse `json:"message,omitempty"`
+	// Delta holds the text of a content_block_delta and the stop reason
+	// of a message_delta.
+	Delta *struct {
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta,omitempty"`
+	// Usage is set on message_delta, with the output token count.
+	Usage *struct {
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage,omitempty"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
 }
 
 // CHAT_HISTORY_TTL is the Time-To-Live (expiry) for the Redis key (e.g., 24 hours)
@@ -120,40 +345,98 @@ const CHAT_HISTORY_TTL = 24 * time.Hour
 
 // InitRedis connects to Redis and checks the connection.
 func InitRedis() {
-    redisAddr := os.Getenv("REDIS_ADDR")
-    if redisAddr == "" {
+    opts := redisOptions()
+    if opts == nil {
         // We will default to skipping Redis if the variable isn't set
         // This makes the service flexible in different environments.
-        fmt.Println("REDIS_ADDR not set. Running in stateless mode.")
+        slog.Info("REDIS_ADDR not set. Running in stateless mode.")
         return
     }
 
     // 1. Create a new client instance
-    redisClient = redis.NewClient(&redis.Options{
-        Addr:     redisAddr,
-        Password: "", // No password set in our docker-compose for now
-        DB:       0,  // Use default DB
-    })
+    redisClient = newRedisClient(opts)
 
     // 2. Test the connection with PING
     pingResult, err := redisClient.Ping(ctx).Result()
     if err != nil {
-        fmt.Printf("❌ Failed to connect to Redis at %s: %v\n", redisAddr, err)
+        slog.Error("❌ Failed to connect to Redis", "addrs", opts.Addrs, "cluster", redisCluster, "error", err)
         // Crash the application if connection is essential (Best Practice for production)
         os.Exit(1) 
     }
 
-    fmt.Printf("✅ Successfully connected to Redis: %s\n", pingResult)
+    slog.Info("✅ Successfully connected to Redis", "ping", pingResult)
+}
+
+// historyKey is the Redis key holding the message history of a session.
+func historyKey(sessionId string) string {
+	return "session:" + sessionId
+}
+
+// internalKeyPrefixes start the Redis keys that are not legacy histories. As
+// a legacy session is stored under its bare ID, a sessionId with one of them
+// would name another internal key, so such IDs are refused.
+var internalKeyPrefixes = []string{"session:", "session-meta:", "attachment:", "owner-sessions:", "lock:", "ratelimit:", "audit:", "response-cache:"}
+
+// isInternalKey reports whether sessionId starts with an internal key prefix.
+func isInternalKey(sessionId string) bool {
+	for _, prefix := range internalKeyPrefixes {
+		if strings.HasPrefix(sessionId, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// getRawHistory returns the stored history JSON for a session, or redis.Nil.
+// It always reads Redis, and refreshes the history cache when one is
+// configured.
+func getRawHistory(sessionId string) (string, error) {
+	if historyCache != nil {
+		return historyCache.refresh(sessionId)
+	}
+	return readRawHistory(sessionId)
+}
+
+// getRawHistoryAllowStale is getRawHistory for the read-only endpoints, which
+// may be answered from the history cache when Redis is slow.
+func getRawHistoryAllowStale(sessionId string) (string, error) {
+	if historyCache != nil {
+		return historyCache.read(sessionId)
+	}
+	return readRawHistory(sessionId)
+}
+
+// readRawHistory reads a session's history JSON from Redis. Sessions saved
+// before keys were namespaced live under the bare session ID; they are still
+// read from there and move to historyKey on their next save.
+func readRawHistory(sessionId string) (string, error) {
+	historyJSON, err := redisClient.Get(ctx, historyKey(sessionId)).Result()
+	if err == redis.Nil && !isInternalKey(sessionId) {
+		historyJSON, err = redisClient.Get(ctx, sessionId).Result()
+	}
+	return historyJSON, err
 }
 
 // getHistoryFromRedis fetches the chat history for a given session ID.
 func getHistoryFromRedis(sessionId string) ([]Message, error) {
+	return loadHistory(sessionId, getRawHistory)
+}
+
+// getHistoryAllowStale is getHistoryFromRedis for the read-only endpoints:
+// their answer may come from the history cache. Anything that writes the
+// history back must read it with getHistoryFromRedis.
+func getHistoryAllowStale(sessionId string) ([]Message, error) {
+	return loadHistory(sessionId, getRawHistoryAllowStale)
+}
+
+// loadHistory decodes a session's history as read by getRaw.
+func loadHistory(sessionId string, getRaw func(string) (string, error)) ([]Message, error) {
 	if redisClient == nil {
 		// Fallback for stateless mode (should not happen if InitRedis succeeded)
 		return nil, fmt.Errorf("Redis client is not initialized")
 	}
 
-	historyJSON, err := redisClient.Get(ctx, sessionId).Result()
+	historyJSON, err := getRaw(sessionId)
 	if err == redis.Nil {
 		// Key not found (new session), return empty history
 		return []Message{}, nil 
@@ -167,536 +450,585 @@ func getHistoryFromRedis(sessionId string) ([]Message, error) {
 	if err := json.Unmarshal([]byte(historyJSON), &history); err != nil {
 		return nil, fmt.Errorf("error unmarshaling history JSON: %w", err)
 	}
+	// Older sessions may hold provider role spellings; map them back.
+	normalizeRoles(history)
 	return history, nil
 }
 
-// saveHistoryToRedis saves the updated chat history for a given session ID, setting a TTL.
-func saveHistoryToRedis(sessionId string, history []Message) error {
+// saveHistoryToRedis saves the updated chat history for a given session ID,
+// capped and with the TTL of the session's tenant.
+func saveHistoryToRedis(sessionId string, history []Message, tenant *Tenant) error {
 	if redisClient == nil {
 		return fmt.Errorf("Redis client is not initialized")
 	}
 
-	historyJSON, err := json.Marshal(history)
+	historyJSON, err := marshalHistory(sessionId, tenant.capMessages(history))
 	if err != nil {
 		return fmt.Errorf("error marshaling history: %w", err)
 	}
 
-	// Save the JSON string to Redis with a 24-hour TTL
-	err = redisClient.Set(ctx, sessionId, historyJSON, CHAT_HISTORY_TTL).Err()
+	// Save the JSON string to Redis with the tenant's TTL (24 hours by default)
+	err = redisClient.Set(ctx, historyKey(sessionId), historyJSON, tenant.TTL).Err()
 	if err != nil {
 		return fmt.Errorf("redis error saving history: %w", err)
 	}
+	if historyCache != nil {
+		historyCache.put(sessionId, string(historyJSON), time.Now())
+	}
 	return nil
 }
 
-// chatHandler acts as a router to the correct LLM API.
-func chatHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
+// prepareHistory loads the stored history for the payload's session, seeds the
+// system prompt for new sessions and appends the new user message.
+func prepareHistory(clientPayload ClientRequestPayload) ([]Message, error) {
+	history, err := getHistoryFromRedis(clientPayload.SessionID)
+	if err != nil {
+		return nil, err
 	}
-
-	if r.Method != "POST" {
-		http.Error(w, "Only POST requests are allowed", http.StatusMethodNotAllowed)
-		return
+	if err := checkConversationAge(clientPayload.SessionID, history); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+
+	// If the history is empty, prepend the system prompt unless the client
+	// opted out of it.
+	if len(history) == 0 && !clientPayload.DisableSystemPrompt {
+		systemPrompt := Message{
+			Role: "system",
+			Text: defaultSystemPrompt(clientPayload),
+			Seeded: true,
+			CreatedAt: now,
+		}
+		history = append(history, systemPrompt)
 	}
 
-	var clientPayload ClientRequestPayload
-	if err := json.NewDecoder(r.Body).Decode(&clientPayload); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
+	// The clientPayload.Contents[0] is the new message sent from the FE.
+	newMessage := clientPayload.Contents[0]
+	text := newMessage.Text
+	if redactPIIEnabled {
+		var found bool
+		if text, found = redactPII(text); found {
+			slog.Debug("Redacted PII from user message", "sessionId", clientPayload.SessionID)
+		}
 	}
-	
-	// Check for required fields
-    if clientPayload.SessionID == "" || len(clientPayload.Contents) == 0 {
-        http.Error(w, "Missing sessionId or message content", http.StatusBadRequest)
-        return
-    }
-    
-    // 2. Retrieve History from Redis
-	history, err := getHistoryFromRedis(clientPayload.SessionID)
-	if err != nil {
-		log.Printf("Error in getHistoryFromRedis: %v", err)
-		http.Error(w, "Internal server error retrieving history", http.StatusInternalServerError)
-		return
+	if wrapStoredPrompts && newMessage.Role == "user" {
+		text = wrapUserPrompt(text)
+	}
+	if newMessage.Role == "user" {
+		history, text = reconcileDanglingTurn(clientPayload.SessionID, history, newMessage.ID, text)
 	}
-	
-	// 3. System Prompt (Handle new session context)
-    // If the history is empty, prepend the system prompt.
-    if len(history) == 0 {
-        // NOTE: We will hardcode the system prompt for now, 
-        // but this will be moved to a config variable later.
-        systemPrompt := Message{
-            Role: "system",
-            Text: "You are a helpful and friendly AI assistant. Keep your answers concise.",
-        }
-        history = append(history, systemPrompt)
-    }
-    
-    // 4. Append the NEW User Message to the full history
-	// The clientPayload.Contents[0] is the new message sent from the FE.
-    newMessage := clientPayload.Contents[0]
 	history = append(history, Message{
-        Role: newMessage.Role,
-        Text: newMessage.Text,
-    })
-    
-    // 5. Prepare Full Context for LLM Call
-	// We pass the full, assembled 'history' array to the LLM functions.
-	// NOTE: The LLM API functions must be updated in Step 4 below to accept the []Message type.
-	var aiText string
-	//var err error
-
-	switch clientPayload.ModelName {
-	case "gemini":
-		aiText, err = callGeminiAPI(history)
-	case "llama":
-		aiText, err = callLlamaAPI(history)
-	case "claude":
-		aiText, err = callClaudeAPI(history)
-	case "chatgpt":
-		aiText, err = callChatGPTAPI(history)
-	default:
-		http.Error(w, "Invalid model name", http.StatusBadRequest)
-		return
+		Role: normalizeRole(newMessage.Role),
+		Text: text,
+		ID:   newMessage.ID,
+		Attachments: newMessage.Attachments,
+		ToolCallID: newMessage.ToolCallID,
+		ToolName: newMessage.ToolName,
+		ToolCalls: newMessage.ToolCalls,
+		CreatedAt: now,
+	})
+	if history[len(history)-1].Role == "system" {
+		if err := checkStoredSystemPrompts(history); err != nil {
+			return nil, err
+		}
 	}
+	return history, nil
+}
 
+// statelessMessages turns all of Contents into the conversation for a request
+// that doesn't use stored history. It also returns how many messages were
+// left out to fit the context window and MAX_CONTEXT_TOKENS.
+func statelessMessages(clientPayload ClientRequestPayload) ([]Message, int, error) {
+	messages := make([]Message, 0, len(clientPayload.Contents))
+	for _, c := range clientPayload.Contents {
+		text := c.Text
+		if redactPIIEnabled && !redactOnlyStorage {
+			text, _ = redactPII(text)
+		}
+		messages = append(messages, Message{Role: normalizeRole(c.Role), Text: text, Attachments: c.Attachments, ToolCallID: c.ToolCallID, ToolName: c.ToolName, ToolCalls: c.ToolCalls})
+	}
+	messages, err := resolveAttachments(wrapUserMessages(contextWindow(messages, contextWindowFor(clientPayload))))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, 0, err
 	}
-	
-	// 6. Append the AI Response to the history
-    aiMessage := Message{
-        Role: "ai",
-        Text: aiText,
-    }
-    history = append(history, aiMessage)
-
-	// 7. Save the Full Updated History back to Redis
-	if err := saveHistoryToRedis(clientPayload.SessionID, history); err != nil {
-		log.Printf("Error in saveHistoryToRedis: %v", err)
-        // Log the error but don't necessarily fail the response, as the user got the answer.
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"text": aiText})
-}
-
-//func callGeminiAPI(contents []struct {
-//	Role string `json:"role"`
-//	Text string `json:"text"`
-//}) (string, error) {
-func callGeminiAPI(contents []Message) (string, error) { // NEW
-	if geminiAPIKey == "" {
-		return "", fmt.Errorf("GEMINI_API_KEY environment variable not set")
-	}
-
-	geminiContents := make([]GeminiMessage, 0, len(contents))
-	//for i, c := range contents {
-	for _, c := range contents {
-		role := "" // Initialize role to an empty string
-		
-		// 1. Handle Role Mapping for Gemini API
-		switch c.Role {
-		case "user":
-			role = "user"
-		case "ai":
-			role = "model"
-        case "system":
-            // 2. IMPORTANT FIX: Map the system role to "user" for now, 
-            // so the LLM processes it as a context-setting instruction.
-            // This is temporary until you adopt the proper systemInstruction field.
-            role = "user" 
-		default:
-            // Skip any unknown roles
-            // If the role is unexpected (e.g., a typo), we skip it entirely
-            log.Printf("Warning: Skipping message with invalid role: %s", c.Role)
-            continue
-		}
-	//	role := "user"
-	//	if c.Role == "ai" {
-	//		role = "model"
-	//	}
-
-	//	geminiContents[i] = GeminiMessage{
-	//		Role: role,
-	//		Parts: []GeminiPart{{Text: c.Text}},
-	//	}
-		// 3. Create the GeminiMessage using the Message struct fields (c.Text)
-		if role != "" {
-			geminiContents = append(geminiContents, GeminiMessage{
-				Role: role,
-				Parts: []GeminiPart{{Text: c.Text}}, // c.Text comes from the Message struct
-			})
-		}
+	messages, err = fitPrompt(messages, clientPayload.ModelName)
+	if err != nil {
+		return nil, 0, err
 	}
+	return messages, len(clientPayload.Contents) - len(messages), nil
+}
 
-	payload := GeminiPayload{
-		Contents: geminiContents,
-		GenerationConfig: map[string]interface{}{
-			"temperature": 0.7,
-			"topP": 0.95,
-			"topK": 40,
-			"maxOutputTokens": 1024,
-		},
+// providerMessages returns the part of the stored history that is sent to the
+// provider for this request. With REDACT_ONLY_STORAGE the new message goes out
+// unredacted. Turns covered by an idle summary are replaced by it. User
+// messages are wrapped in the configured prompt prefix and suffix unless the
+// history already stores them wrapped, referenced attachments are filled in,
+// and the oldest are dropped if the result is over MAX_CONTEXT_TOKENS, unless
+// STRICT_PROMPT_LIMIT makes that a *promptTooLargeError instead. The
+// count of messages left out by the context window and the token limit is
+// returned with them; turns replaced by the summary are not counted.
+func providerMessages(clientPayload ClientRequestPayload, history []Message) ([]Message, int, error) {
+	summarized := withIdleSummary(clientPayload.SessionID, history)
+	messages := contextWindow(summarized, contextWindowFor(clientPayload))
+	if redactPIIEnabled && redactOnlyStorage && len(messages) > 0 {
+		messages = append([]Message(nil), messages...)
+		last := &messages[len(messages)-1]
+		last.Text = clientPayload.Contents[0].Text
+		if wrapStoredPrompts && last.Role == "user" {
+			last.Text = wrapUserPrompt(last.Text)
+		}
 	}
-
-	jsonPayload, _ := json.Marshal(payload)
-	apiUrl := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/gemini-2.0-flash:generateContent?key=%s", geminiAPIKey)
-	resp, err := makeAPIRequest(apiUrl, bytes.NewBuffer(jsonPayload))
+	if !wrapStoredPrompts {
+		messages = wrapUserMessages(messages)
+	}
+	messages, err := resolveAttachments(messages)
 	if err != nil {
-		return "", err
+		return nil, 0, err
 	}
-	defer resp.Body.Close()
+	messages, err = fitPrompt(messages, clientPayload.ModelName)
+	if err != nil {
+		return nil, 0, err
+	}
+	return messages, len(summarized) - len(messages), nil
+}
 
-	var result GeminiResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("error parsing Gemini response: %w", err)
+// chatHandler acts as a router to the correct LLM API.
+func chatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only POST requests are allowed")
+		return
 	}
 
-	if len(result.Candidates) > 0 && len(result.Candidates[0].Content.Parts) > 0 {
-		return result.Candidates[0].Content.Parts[0].Text, nil
+	if !isFormPost(r) && !requireJSON(w, r) {
+		return
 	}
 
-	return "", fmt.Errorf("unexpected Gemini response structure")
-}
+	tenant := admitTenant(w, r)
+	if tenant == nil {
+		return
+	}
 
-//func callLlamaAPI(contents []struct {
-//	Role string `json:"role"`
-//	Text string `json:"text"`
-//}) (string, error) {
-func callLlamaAPI(contents []Message) (string, error) { // NEW
-	if llamaAPIKey == "" {
-		return "", fmt.Errorf("LLAMA_API_KEY environment variable not set")
+	echoPayload, ok := wantsPayloadEcho(w, r)
+	if !ok {
+		return
+	}
+	rawResponse, ok := wantsRawResponse(w, r)
+	if !ok {
+		return
 	}
 
-	llamaMessages := make([]PerplexityMessage, len(contents))
+	var clientPayload ClientRequestPayload
+	if err := decodeChatRequest(r, &clientPayload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+	if err := applyAPIVersion(&clientPayload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
 	
-	//for i, c := range contents {
-	//	role := "user"
-	//	if c.Role == "ai" {
-	//		role = "assistant"
-	//	}
-	//	llamaMessages[i] = PerplexityMessage{
-	//		Role:    role,
-	//		Content: c.Text,
-	//	}
-	//}
-	//for i, c := range contents {
-	for _, c := range contents {
-		role := "" // Initialize role to an empty string
-		
-		// 1. Handle Role Mapping for Gemini API
-		switch c.Role {
-		case "user":
-			role = "user"
-		case "ai":
-			role = "assistant"
-        case "system":
-            // 2. IMPORTANT FIX: Map the system role to "user" for now, 
-            // so the LLM processes it as a context-setting instruction.
-            // This is temporary until you adopt the proper systemInstruction field.
-            role = "user" 
-		default:
-            // Skip any unknown roles
-            continue
-		}
-		// 3. Create the GeminiMessage using the Message struct fields (c.Text)
-		llamaMessages = append(llamaMessages, PerplexityMessage{
-			Role: role,
-			Content: c.Text, // c.Text comes from the Message struct
-		})
+	// Check for required fields. Stateless requests need no session.
+	persist := clientPayload.persistEnabled()
+	if (persist && clientPayload.SessionID == "") || len(clientPayload.Contents) == 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing sessionId or message content")
+		return
 	}
-
-	payload := PerplexityPayload{
-		Model: "llama-3-sonar-small-32k-online",
-		Messages: llamaMessages,
+	if persist && !admitSession(w, tenant, clientPayload.SessionID) {
+		return
 	}
 
-	jsonPayload, _ := json.Marshal(payload)
-	apiUrl := "https://api.perplexity.ai/chat/completions"
-	resp, err := makeAPIRequestWithAuth(apiUrl, "Bearer "+llamaAPIKey, bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		return "", err
+	if clientPayload.N < 0 || clientPayload.N > maxChoices {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("n must be between 1 and %d", maxChoices))
+		return
 	}
-	defer resp.Body.Close()
 
-	var result PerplexityResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("error parsing Llama response: %w", err)
+	if err := validateSafetySettings(clientPayload.SafetySettings); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
 	}
 
-	if len(result.Choices) > 0 {
-		return result.Choices[0].Message.Content, nil
+	if err := clientPayload.GenerationSettings.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
 	}
 
-	return "", fmt.Errorf("unexpected Llama response structure")
-}
+	if err := validateSystemPrompts(clientPayload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
 
-//func callClaudeAPI(contents []struct {
-//	Role string `json:"role"`
-//	Text string `json:"text"`
-//}) (string, error) {
-func callClaudeAPI(contents []Message) (string, error) { // NEW
-	if claudeAPIKey == "" {
-		return "", fmt.Errorf("CLAUDE_API_KEY environment variable not set")
+	if err := validateUserMetadata(clientPayload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
 	}
 
-	claudeMessages := make([]AnthropicMessage, len(contents))
-	
-	//for i, c := range contents {
-	//	role := "user"
-	//	if c.Role == "ai" {
-	//		role = "assistant"
-	//	}
-	//	claudeMessages[i] = AnthropicMessage{
-	//		Role:    role,
-	//		Content: c.Text,
-	//	}
-	//}
-	for _, c := range contents {
-		role := "" // Initialize role to an empty string
-		
-		// 1. Handle Role Mapping for Gemini API
-		switch c.Role {
-		case "user":
-			role = "user"
-		case "ai":
-			role = "asssitant"
-        case "system":
-            // 2. IMPORTANT FIX: Map the system role to "user" for now, 
-            // so the LLM processes it as a context-setting instruction.
-            // This is temporary until you adopt the proper systemInstruction field.
-            role = "user" 
-		default:
-            // Skip any unknown roles
-            continue
+	clientPayload.ModelName = resolveModelName(clientPayload.ModelName)
+	if clientPayload.ModelName == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing modelName and no DEFAULT_MODEL configured")
+		return
+	}
+	if clientPayload.ModelName == autoModelName {
+		model, err := resolveAutoModel(clientPayload, func(name string) bool { _, ok := providers[name]; return ok })
+		if err != nil {
+			writeAutoModelError(w, err)
+			return
 		}
-		// 3. Create the GeminiMessage using the Message struct fields (c.Text)
-		claudeMessages = append(claudeMessages, AnthropicMessage{
-			Role: role,
-			Content: c.Text, // c.Text comes from the Message struct
-		})
+		clientPayload.ModelName = model
 	}
-
-	payload := AnthropicPayload{
-		Model:    "claude-3-opus-20240229",
-		Messages: claudeMessages,
-		MaxTokens: 1024,
+	call, ok := providers[clientPayload.ModelName]
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeModelNotFound, invalidModelMessage("Invalid model name"))
+		return
 	}
-
-	jsonPayload, _ := json.Marshal(payload)
-	apiUrl := "https://api.anthropic.com/v1/messages"
-	resp, err := makeAPIRequestWithAuthAndHeader(apiUrl, "x-api-key", claudeAPIKey, "anthropic-version", "2023-06-01", bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		return "", err
+	if err := validateMaxTokens(clientPayload.ModelName, clientPayload.MaxTokens); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
 	}
-	defer resp.Body.Close()
 
-	var result AnthropicResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("error parsing Claude response: %w", err)
+	if err := validateContinuation(&clientPayload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
 	}
 
-	if len(result.Content) > 0 {
-		return result.Content[0].Text, nil
+	// The session stays locked until the turn is stored.
+	if persist {
+		lock, ok := admitSessionLock(w, r, clientPayload.SessionID)
+		if !ok {
+			return
+		}
+		defer lock.release()
 	}
 
-	return "", fmt.Errorf("unexpected Claude response structure")
-}
-
-//func callChatGPTAPI(contents []struct {
-//	Role string `json:"role"`
-//	Text string `json:"text"`
-//}) (string, error) {
-func callChatGPTAPI(contents []Message) (string, error) { // NEW
-	if chatGPTAPIKey == "" {
-		return "", fmt.Errorf("CHATGPT_API_KEY environment variable not set")
+	// Deny-listed messages get the canned reply and never reach a model.
+	if deniedMessage(clientPayload) {
+		slog.Info("Answering deny-listed message with the canned response", "sessionId", clientPayload.SessionID)
+		recordDeniedTurn(tenant, clientPayload)
+		if wantsHTML(r) {
+			writeChatHTML(w, clientPayload.ModelName, denyResponse)
+			return
+		}
+		response := newChatResponse(denyResponse, clientPayload.ModelName)
+		response.Denied = true
+		writeJSON(w, r, http.StatusOK, response)
+		return
 	}
 
-	openaiMessages := make([]OpenaiMessage, len(contents))
-	
-	//for i, c := range contents {
-	//	role := "user"
-	//	if c.Role == "ai" {
-	//		role = "assistant"
-	//	}
-	//	openaiMessages[i] = OpenaiMessage{
-	//		Role:    role,
-	//		Content: c.Text,
-	//	}
-	//}
-	for _, c := range contents {
-		role := "" // Initialize role to an empty string
-		
-		// 1. Handle Role Mapping for Gemini API
-		switch c.Role {
-		case "user":
-			role = "user"
-		case "ai":
-			role = "assistant"
-        case "system":
-            // 2. IMPORTANT FIX: Map the system role to "user" for now, 
-            // so the LLM processes it as a context-setting instruction.
-            // This is temporary until you adopt the proper systemInstruction field.
-            role = "user" 
-		default:
-            // Skip any unknown roles
-            continue
+	// Every upstream call made for this request draws from one shared budget.
+	requestCtx := withAttemptBudget(r.Context(), maxAttempts)
+
+	// 2-4. Retrieve History from Redis and append the new user message.
+	// Stateless requests skip Redis and send the Contents they were given.
+	var compact func()
+	var history, messages []Message
+	var dropped int
+	var err error
+	if persist {
+		history, err = prepareHistory(clientPayload)
+		if errors.Is(err, errConversationTooOld) {
+			writeError(w, http.StatusGone, codeConversationExpired, err.Error())
+			return
 		}
-		// 3. Create the GeminiMessage using the Message struct fields (c.Text)
-		openaiMessages = append(openaiMessages, OpenaiMessage{
-			Role: role,
-			Content: c.Text, // c.Text comes from the Message struct
-		})
+		if isSystemPromptLimit(err) {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if err != nil {
+			slog.Error("Error in getHistoryFromRedis", "error", err)
+			writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving history")
+			return
+		}
+		if reply, ok := duplicateReply(clientPayload, history); ok {
+			response := newChatResponse(reply.Text, clientPayload.ModelName)
+			if reply.Model != "" {
+				response.Model = reply.Model
+			}
+			response.Duplicate = true
+			writeJSON(w, r, http.StatusOK, response)
+			return
+		}
+		compact = idleCompaction(requestCtx, clientPayload.SessionID, clientPayload.ModelName, history)
+		messages, dropped, err = providerMessages(clientPayload, history)
+	} else {
+		messages, dropped, err = statelessMessages(clientPayload)
+	}
+	if err != nil {
+		writeMessagesError(w, err)
+		return
 	}
 
-	payload := OpenaiPayload{
-		Model:    "gpt-4o",
-		Messages: openaiMessages,
+	// 5. Call the provider with the assembled context.
+	// Only a window of recent messages is sent; the full history is stored.
+	// The call uses the model's own timeout.
+	callCtx, finish := withFinishReason(withProviderTimeout(requestCtx, clientPayload.ModelName))
+	callCtx, reported := withProviderUsage(callCtx)
+	var echo *payloadEcho
+	if echoPayload {
+		callCtx, echo = withPayloadEcho(callCtx)
+	}
+	var raw *rawResponses
+	if rawResponse {
+		callCtx, raw = withRawResponses(callCtx)
+	}
+	generation := generationFor(clientPayload)
+	providerReq := ProviderRequest{
+		Messages:         messages,
+		N:                clientPayload.N,
+		MaxTokens:        generation.MaxTokens,
+		Temperature:      generation.Temperature,
+		PresencePenalty:  generation.PresencePenalty,
+		FrequencyPenalty: generation.FrequencyPenalty,
+		ReasoningEffort:  generation.ReasoningEffort,
+		SafetySettings:   clientPayload.SafetySettings,
+		UserID:           clientPayload.UserID,
+		Metadata:         clientPayload.Metadata,
+	}
+	// Stateless requests may be answered from the response cache, unless
+	// the caller asked to see the provider exchange itself.
+	var result ProviderResponse
+	cached := false
+	if !persist && echo == nil && raw == nil {
+		result, cached, err = cachedCall(callCtx, clientPayload.ModelName, call, providerReq)
+	} else {
+		result, err = call(callCtx, providerReq)
 	}
 
-	jsonPayload, _ := json.Marshal(payload)
-	apiUrl := "https://api.openai.com/v1/chat/completions"
-	resp, err := makeAPIRequestWithAuth(apiUrl, "Bearer "+chatGPTAPIKey, bytes.NewBuffer(jsonPayload))
 	if err != nil {
-		return "", err
+		writeProviderError(w, err)
+		return
 	}
-	defer resp.Body.Close()
-
-	var result OpenaiResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("error parsing ChatGPT response: %w", err)
+	usage := reported.or(estimateUsage(clientPayload.ModelName, messages, result.Choices...))
+	if !cached {
+		recordUsage(tenant, clientPayload.SessionID, clientPayload.ModelName, usage)
 	}
-
-	if len(result.Choices) > 0 {
-		return result.Choices[0].Message.Content, nil
+	aiText := result.Text
+	storedText := aiText
+	if clientPayload.Continue {
+		// The model only returns what follows the prefill; the reply is both
+		// together, and replaces the stored prefill.
+		aiText = continuedText(continuationEntry(&clientPayload).Text, result.Text)
+		if persist {
+			storedText = continuedText(history[len(history)-1].Text, result.Text)
+			history = history[:len(history)-1]
+		}
 	}
 
-	return "", fmt.Errorf("unexpected ChatGPT response structure")
-}
+	if persist {
+		// 6. Append the AI Response to the history
+		history = append(history, Message{
+			Role: "ai",
+			Text: storedText,
+			Model: clientPayload.ModelName,
+			FinishReason: finish.stored(),
+			ToolCalls: result.ToolCalls,
+			CreatedAt: time.Now().UTC(),
+		})
 
-func makeAPIRequest(url string, body io.Reader) (*http.Response, error) {
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
+		// 7. Save the Full Updated History (and session metadata) back to Redis
+		// Errors are logged but don't fail the response, as the user got the answer.
+		history = storedTurn(clientPayload, history)
+		recordTurn(tenant, clientPayload.SessionID, history)
+		maybeGenerateTitle(clientPayload.SessionID, clientPayload.ModelName, history)
+		emitTurnEvent(tenant, clientPayload.SessionID, clientPayload.ModelName, history)
+		if compact != nil {
+			go compact()
+		}
 	}
-	req.Header.Set("Content-Type", "application/json")
-	
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error making API request: %w", err)
+
+	// Only the first choice goes into the history; all of them are returned
+	// when more than one was requested.
+	response := newChatResponse(aiText, clientPayload.ModelName)
+	response.Usage = usage
+	response.FinishReason = finishReasonName(finish.reason)
+	if result.Citations != nil {
+		response.Citations = result.Citations
 	}
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		return nil, fmt.Errorf("API returned status code %d: %s", resp.StatusCode, string(respBody))
+	if result.ToolCalls != nil {
+		response.ToolCalls = result.ToolCalls
 	}
-	return resp, nil
-}
-
-func makeAPIRequestWithAuth(url, authHeader string, body io.Reader) (*http.Response, error) {
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
+	response.Truncated = truncationFor(dropped, finish)
+	response.Cached = cached
+	if clientPayload.N > 1 {
+		response.Choices = result.Choices
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", authHeader)
-	
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error making API request: %w", err)
+	if persist && wantsHistory(r, clientPayload) {
+		response.History = visibleHistory(history)
 	}
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		return nil, fmt.Errorf("API returned status code %d: %s", resp.StatusCode, string(respBody))
+	if echo != nil {
+		response.ProviderPayload = echo.calls()
 	}
-	return resp, nil
+	if raw != nil {
+		response.ProviderResponse = raw.bodies()
+		raw.archive(clientPayload.SessionID, clientPayload.ModelName)
+	}
+	if !clientPayload.Continue && !cached {
+		maybeShadow(clientPayload.ModelName, providerReq, result)
+	}
+	if wantsHTML(r) {
+		writeChatHTML(w, clientPayload.ModelName, aiText)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, response)
 }
 
-func makeAPIRequestWithAuthAndHeader(url, authHeaderName, authHeaderValue, otherHeaderName, otherHeaderValue string, body io.Reader) (*http.Response, error) {
-	req, err := http.NewRequest("POST", url, body)
+func makeAPIRequest(ctx context.Context, url string, body io.Reader) (*http.Response, error) {
+	return makeAPIRequestWithHeaders(ctx, url, nil, body)
+}
+
+func makeAPIRequestWithAuthAndHeader(ctx context.Context, url, authHeaderName, authHeaderValue, otherHeaderName, otherHeaderValue string, body io.Reader) (*http.Response, error) {
+	return makeAPIRequestWithHeaders(ctx, url, map[string]string{
+		authHeaderName:  authHeaderValue,
+		otherHeaderName: otherHeaderValue,
+	}, body)
+}
+
+// makeAPIRequestWithHeaders POSTs a JSON body with the given extra headers and
+// returns the response if the provider answered 200.
+func makeAPIRequestWithHeaders(ctx context.Context, url string, headers map[string]string, body io.Reader) (*http.Response, error) {
+	payload, err := io.ReadAll(body)
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set(authHeaderName, authHeaderValue)
-	req.Header.Set(otherHeaderName, otherHeaderValue)
-	
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error making API request: %w", err)
-	}
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		return nil, fmt.Errorf("API returned status code %d: %s", resp.StatusCode, string(respBody))
-	}
-	return resp, nil
+
+	client := &http.Client{Transport: providerTransport, Timeout: requestTimeout(ctx)}
+	return sendProviderRequest(ctx, client, url, headers, payload)
 }
 
 // getChatHistoryHandler retrieves the full conversation history for a given session ID.
 func getChatHistoryHandler(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Access-Control-Allow-Origin", "*")
-    w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-    w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-    if r.Method == "OPTIONS" {
-        w.WriteHeader(http.StatusOK)
-        return
-    }
-
     if r.Method != "GET" {
-        http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+        writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only GET requests are allowed")
         return
     }
 
     // 1. Get Session ID from query parameters
     sessionId := r.URL.Query().Get("sessionId")
     if sessionId == "" {
-        http.Error(w, "Missing sessionId query parameter", http.StatusBadRequest)
+        writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing sessionId query parameter")
+        return
+    }
+    if admitSessionRequest(w, r, sessionId) == nil {
         return
     }
 
     w.Header().Set("Content-Type", "application/json")
     
-    // 2. Retrieve history JSON string from Redis
-    historyJSON, err := redisClient.Get(ctx, sessionId).Result()
-    
-    if err == redis.Nil {
-        // 3a. Key not found (new session), return an empty array []
-        json.NewEncoder(w).Encode([]Message{}) 
-        return
-    } else if err != nil {
-        log.Printf("Redis error retrieving history for %s: %v", sessionId, err)
-        http.Error(w, "Internal server error retrieving history", http.StatusInternalServerError)
+    // 2. Retrieve the history the same way a chat turn does, so both see the
+    // same normalized messages (a missing key is an empty history)
+    history, err := getHistoryAllowStale(sessionId)
+    if err != nil {
+        slog.Error("Error retrieving history", "sessionId", sessionId, "error", err)
+        writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving history")
         return
     }
 
-    // 3b. Key found, return the history JSON directly
-    // Note: We don't unmarshal/re-marshal here for efficiency; we just pipe the JSON string
-    w.Write([]byte(historyJSON))
+    // 3. Return the messages clients may see
+    // Polling clients send back the ETag and get a 304 while nothing changed.
+    body, err := json.Marshal(visibleHistory(history))
+    if err != nil {
+        slog.Error("Error marshaling history", "sessionId", sessionId, "error", err)
+        writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving history")
+        return
+    }
+    body = styleResponseJSON(body)
+    etag := historyETag(body)
+    w.Header().Set("ETag", etag)
+    w.Header().Set("Cache-Control", "no-cache")
+    if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    w.Write(prettyRawJSON(r, body))
 }
 
 func main() {
+	InitLogging()
+	if defaultModel != "" {
+		if _, ok := providers[resolveModelAlias(defaultModel)]; !ok {
+			slog.Warn("DEFAULT_MODEL is not a registered model", "model", defaultModel)
+		}
+	}
 	InitRedis() // <-- Call the initialization function here. You need to call this function early in your main()
+	if providerWarmup {
+		go warmupProviders(warmupEndpoints())
+	}
+	if usageSinkTarget != "" {
+		if sink, err := newUsageSink(usageSinkTarget); err != nil {
+			slog.Error("Usage export disabled", "error", err)
+		} else {
+			startUsageExport(sink)
+		}
+	}
+	if webhookURL != "" {
+		webhooks = newWebhookEmitter(webhookURL, webhookWorkers, webhookQueueDepth)
+	}
 	
 	// POST handler for sending new messages
-	http.HandleFunc("/chat", chatHandler)
+	handleRoute("/chat", withAdmission(chatAdmission, chatHandler), "POST")
 	
 	// GET handler for retrieving history on refresh ---
-    http.HandleFunc("/chat/history", getChatHistoryHandler)
+    handleRoute("/chat/history", getChatHistoryHandler, "GET")
     
+	// GET handler downloading a session transcript (md, txt or html)
+	handleRoute("/chat/export", exportHandler, "GET")
+
+	// GET handler searching the messages of a session
+	handleRoute("/chat/search", searchHandler, "GET")
+
+	// GET/POST handler exporting a session as a portable bundle and, for
+	// admins, importing one
+	handleRoute("/chat/bundle", bundleHandler, "GET", "POST")
+
+	// Streaming variant of /chat, and the "stop" button for it
+	handleRoute("/chat/stream", withAdmission(chatAdmission, chatStreamHandler), "POST")
+	handleRoute("/chat/cancel", cancelStreamHandler, "POST")
+
+	// POST handler extending an AI reply cut off at the token limit
+	handleRoute("/chat/continue", withAdmission(chatAdmission, continueHandler), "POST")
+
+	// POST handlers sending one stateless conversation to several models, at
+	// once or streamed side by side
+	handleRoute("/chat/compare", withAdmission(chatAdmission, compareHandler), "POST")
+	handleRoute("/chat/compare/stream", withAdmission(chatAdmission, compareStreamHandler), "POST")
+
+	// GET handler listing the model names accepted in modelName
+	handleRoute("/models", modelsHandler, "GET")
+
+	// GET/POST handler for session metadata (owner, title, tags)
+	handleRoute("/session", sessionHandler, "GET", "POST")
+
+	// GET handler listing sessions by owner for the history sidebar
+	handleRoute("/sessions", listSessionsHandler, "GET")
+
+	// Admin-only raw view of what is stored for a session
+	handleRoute("/debug/session", debugSessionHandler, "GET")
+
+	// POST handler storing attachments referenced by ID from messages
+	handleRoute("/attachments", attachmentsHandler, "POST")
+
+	// Admin-only bulk deletion of sessions
+	handleRoute("/admin/flush", flushHandler, "POST")
+
+	// Admin-only lookup of sessions by a partial ID
+	handleRoute("/admin/sessions", lookupSessionsHandler, "GET")
+
+	// Prometheus metrics
+	handleRoute("/metrics", metricsHandler, "GET")
+
+	// Kubernetes liveness and readiness probes
+	handleRoute("/livez", livezHandler, "GET")
+	handleRoute("/readyz", readyzHandler, "GET")
+
 	port := "8080"
-	log.Printf("Server started on http://localhost:%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	slog.Info("Server started", "url", "http://localhost:"+port)
+	server := &http.Server{Addr: ":" + port, Handler: withCORS(http.DefaultServeMux)}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	shutdown(server)
 }
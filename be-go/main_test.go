@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	redis "github.com/redis/go-redis/v9"
+)
+
+// setupRedis points redisClient at an in-memory Redis for the test.
+func setupRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	setVar(t, &redisClient, redis.UniversalClient(client))
+	t.Cleanup(func() { client.Close() })
+	return mr
+}
+
+// pagedScans makes SCAN on redisClient page through the keys like Redis
+// does, count at a time. miniredis answers every SCAN with all the keys.
+func pagedScans(t *testing.T, mr *miniredis.Miniredis) {
+	t.Helper()
+	raw := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { raw.Close() })
+	redisClient.AddHook(scanPager{raw})
+}
+
+type scanPager struct{ raw *redis.Client }
+
+func (scanPager) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (scanPager) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func (p scanPager) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		scan, ok := cmd.(*redis.ScanCmd)
+		if !ok || cmd.Name() != "scan" {
+			return next(ctx, cmd)
+		}
+		args := cmd.Args()
+		cursor, _ := strconv.Atoi(fmt.Sprint(args[1]))
+		match, count := "*", 10
+		for i := 2; i+1 < len(args); i += 2 {
+			switch strings.ToLower(fmt.Sprint(args[i])) {
+			case "match":
+				match = fmt.Sprint(args[i+1])
+			case "count":
+				count, _ = strconv.Atoi(fmt.Sprint(args[i+1]))
+			}
+		}
+		keys, _, err := p.raw.Scan(ctx, 0, match, 0).Result()
+		if err != nil {
+			scan.SetErr(err)
+			return err
+		}
+		sort.Strings(keys)
+		end := min(cursor+count, len(keys))
+		next := uint64(end)
+		if end == len(keys) {
+			next = 0
+		}
+		scan.SetVal(keys[min(cursor, end):end], next)
+		return nil
+	}
+}
+
+// setVar sets a package variable for the duration of the test.
+func setVar[T any](t *testing.T, p *T, value T) {
+	t.Helper()
+	old := *p
+	*p = value
+	t.Cleanup(func() { *p = old })
+}
+
+// stubChat replaces the chat call of a model for the duration of the test.
+func stubChat(t *testing.T, model string, call chatFunc) {
+	t.Helper()
+	old, ok := providers[model]
+	providers[model] = call
+	t.Cleanup(func() {
+		if ok {
+			providers[model] = old
+		} else {
+			delete(providers, model)
+		}
+	})
+}
+
+// stubStream replaces the streaming call of a model for the duration of the
+// test.
+func stubStream(t *testing.T, model string, stream streamFunc) {
+	t.Helper()
+	old, ok := streamProviders[model]
+	streamProviders[model] = stream
+	t.Cleanup(func() {
+		if ok {
+			streamProviders[model] = old
+		} else {
+			delete(streamProviders, model)
+		}
+	})
+}
+
+// reply returns a chat call answering every request with text.
+func reply(text string) chatFunc {
+	return func(context.Context, ProviderRequest) (ProviderResponse, error) {
+		return ProviderResponse{Text: text, Choices: []string{text}}, nil
+	}
+}
+
+// fakeProviderAPI sends every provider request, whatever its host, to
+// handler over TLS, and returns the server.
+func fakeProviderAPI(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	addr := srv.Listener.Addr().String()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	transport.DialTLSContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&tls.Dialer{Config: &tls.Config{InsecureSkipVerify: true}}).DialContext(ctx, network, addr)
+	}
+	setVar(t, &providerTransport, transport)
+	setVar(t, &streamClient, &http.Client{Transport: transport})
+	return srv
+}
+
+// newJSONRequest builds a request with body encoded as JSON.
+func newJSONRequest(t *testing.T, method, target string, body interface{}) *http.Request {
+	t.Helper()
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(method, target, bytes.NewReader(encoded))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// postJSON serves a JSON POST to handler.
+func postJSON(t *testing.T, handler http.HandlerFunc, target string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, newJSONRequest(t, "POST", target, body))
+	return w
+}
+
+// decodeBody decodes a JSON response body into v.
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+}
+
+// decodeError decodes a JSON error envelope.
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) apiError {
+	t.Helper()
+	var body map[string]apiError
+	decodeBody(t, w, &body)
+	return body["error"]
+}
+
+// storedHistory returns the history saved for a session.
+func storedHistory(t *testing.T, sessionId string) []Message {
+	t.Helper()
+	history, err := getHistoryFromRedis(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return history
+}
+
+// withAdmin enables the admin endpoints for the test and authorizes r as an
+// admin request.
+func withAdmin(t *testing.T, r *http.Request) *http.Request {
+	t.Helper()
+	setVar(t, &adminToken, "test-admin-token")
+	r.Header.Set("Authorization", "Bearer test-admin-token")
+	return r
+}
+
+// userTurn returns Contents holding one user message.
+func userTurn(text string) []map[string]string {
+	return []map[string]string{{"role": "user", "text": text}}
+}
+
+// chatTurn posts payload to /chat and decodes the reply, failing the test
+// unless it is a 200.
+func chatTurn(t *testing.T, payload map[string]interface{}) ChatResponse {
+	t.Helper()
+	w := postJSON(t, chatHandler, "/chat", payload)
+	if w.Code != http.StatusOK {
+		t.Fatalf("chat status = %d, body %s", w.Code, w.Body)
+	}
+	var resp ChatResponse
+	decodeBody(t, w, &resp)
+	return resp
+}
+
+func TestStatelessChatSkipsRedis(t *testing.T) {
+	mr := setupRedis(t)
+	requests := recordRequests(t, "gemini", "Paris.")
+
+	resp := chatTurn(t, map[string]interface{}{
+		"sessionId": "stateless-1",
+		"modelName": "gemini",
+		"persist":   false,
+		"contents": []map[string]string{
+			{"role": "user", "text": "I'm planning a trip to France."},
+			{"role": "ai", "text": "Lovely!"},
+			{"role": "user", "text": "What's the capital?"},
+		},
+	})
+
+	if n := mr.CommandCount(); n != 0 {
+		t.Fatalf("Redis received %d commands, want none", n)
+	}
+	if resp.Text != "Paris." {
+		t.Fatalf("text = %q, want the provider's reply", resp.Text)
+	}
+	if sent := (*requests)[0].Messages; len(sent) != 3 || sent[0].Text != "I'm planning a trip to France." {
+		t.Fatalf("sent %+v, want the full conversation from contents", sent)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxTokensLimit is the output length of a model when a turn doesn't set
+// maxTokens (Default, 0 leaving it to the provider) and the most it accepts
+// (Ceiling, 0 for no known limit).
+type maxTokensLimit struct {
+	Default int
+	Ceiling int
+}
+
+// providerMaxTokens holds the documented output ceilings of the registered
+// models. Gemini and Claude need an explicit limit on every request, so they
+// default to their ceiling rather than a shared value that truncates one of
+// them; the OpenAI-compatible providers pick their own default.
+var providerMaxTokens = map[string]maxTokensLimit{
+	"gemini":  {Default: 8192, Ceiling: 8192},
+	"claude":  {Default: 4096, Ceiling: 4096},
+	"chatgpt": {Ceiling: 16384},
+	"llama":   {},
+	"mistral": {},
+}
+
+// maxTokensLimits are providerMaxTokens with the defaults overridden by
+// MAX_TOKENS_DEFAULTS, comma-separated model=tokens pairs. Overrides above a
+// model's ceiling are clamped to it:
+//
+//	MAX_TOKENS_DEFAULTS=claude=2048,chatgpt=8192
+var maxTokensLimits = loadMaxTokensLimits()
+
+func loadMaxTokensLimits() map[string]maxTokensLimit {
+	limits := make(map[string]maxTokensLimit, len(providerMaxTokens))
+	for model, limit := range providerMaxTokens {
+		limits[model] = limit
+	}
+	value := os.Getenv("MAX_TOKENS_DEFAULTS")
+	if value == "" {
+		return limits
+	}
+	for _, pair := range strings.Split(value, ",") {
+		model, tokens, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		n, err := strconv.Atoi(tokens)
+		limit, ok := limits[model]
+		if !ok || err != nil || n <= 0 {
+			warnConfig("Ignoring invalid MAX_TOKENS_DEFAULTS entry", "entry", pair)
+			continue
+		}
+		if limit.Ceiling > 0 && n > limit.Ceiling {
+			warnConfig("Clamping MAX_TOKENS_DEFAULTS entry to the model's ceiling", "model", model, "maxTokens", n, "ceiling", limit.Ceiling)
+			n = limit.Ceiling
+		}
+		limit.Default = n
+		limits[model] = limit
+	}
+	return limits
+}
+
+// validateMaxTokens rejects a requested maxTokens above the model's ceiling.
+func validateMaxTokens(modelName string, maxTokens int) error {
+	if ceiling := maxTokensLimits[modelName].Ceiling; ceiling > 0 && maxTokens > ceiling {
+		return fmt.Errorf("maxTokens %d exceeds the limit of %d for model %q", maxTokens, ceiling, modelName)
+	}
+	return nil
+}
+
+// maxTokensFor returns the output limit to send to a model: the requested
+// one, clamped to the ceiling, or the model's default when none was set.
+func maxTokensFor(modelName string, requested int) int {
+	limit := maxTokensLimits[modelName]
+	if requested <= 0 {
+		return limit.Default
+	}
+	if limit.Ceiling > 0 {
+		return min(requested, limit.Ceiling)
+	}
+	return requested
+}
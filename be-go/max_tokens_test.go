@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProviderMaxTokensDefaults(t *testing.T) {
+	req := ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}}
+	if got := geminiPayload(req).GenerationConfig["maxOutputTokens"]; got != 8192 {
+		t.Errorf("Gemini maxOutputTokens = %v, want 8192", got)
+	}
+	if got := claudePayload(req).MaxTokens; got != 4096 {
+		t.Errorf("Claude max_tokens = %d, want 4096", got)
+	}
+	if got := maxTokensFor("chatgpt", 0); got != 0 {
+		t.Errorf("ChatGPT default = %d, want it left to the provider", got)
+	}
+
+	req.MaxTokens = 100000
+	if got := claudePayload(req).MaxTokens; got != 4096 {
+		t.Errorf("Claude max_tokens over the ceiling = %d, want it clamped to 4096", got)
+	}
+	if got := maxTokensFor("llama", 100000); got != 100000 {
+		t.Errorf("llama without a ceiling = %d, want the request", got)
+	}
+}
+
+func TestMaxTokensOverCeilingRejected(t *testing.T) {
+	setupRedis(t)
+	requests := recordRequests(t, "claude", "unused")
+
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "ceiling-1", "modelName": "claude", "contents": userTurn("Hi"), "maxTokens": 5000})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400, body %s", w.Code, w.Body)
+	}
+	if len(*requests) != 0 {
+		t.Fatalf("provider calls = %d, want none", len(*requests))
+	}
+	chatTurn(t, map[string]interface{}{"sessionId": "ceiling-1", "modelName": "claude", "contents": userTurn("Hi"), "maxTokens": 4096})
+}
+
+func TestLoadMaxTokensDefaults(t *testing.T) {
+	setVar(t, &loggingReady, false)
+	t.Setenv("MAX_TOKENS_DEFAULTS", "claude=2048,gemini=99999,chatgpt=8192,unknown=5,llama=none")
+	limits := loadMaxTokensLimits()
+
+	want := map[string]maxTokensLimit{
+		"claude":  {Default: 2048, Ceiling: 4096},
+		"gemini":  {Default: 8192, Ceiling: 8192},
+		"chatgpt": {Default: 8192, Ceiling: 16384},
+		"llama":   {},
+	}
+	for model, limit := range want {
+		if limits[model] != limit {
+			t.Errorf("%s limit = %+v, want %+v", model, limits[model], limit)
+		}
+	}
+	if _, ok := limits["unknown"]; ok {
+		t.Error("an unknown model was added")
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// UnmarshalJSON decodes a stored message, tolerating a text that older
+// clients or migrations wrote as something other than a string: null becomes
+// "", numbers and booleans their literal form, and objects or arrays their
+// JSON. A single odd message would otherwise fail the whole history and
+// brick the session. Marshalling is unchanged.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type plainMessage Message
+	aux := struct {
+		*plainMessage
+		Text json.RawMessage `json:"text"`
+	}{plainMessage: (*plainMessage)(m)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m.Text = lenientText(aux.Text)
+	return nil
+}
+
+// lenientText turns any JSON value into message text.
+func lenientText(raw json.RawMessage) string {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return ""
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	return string(raw)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHistoryWithOddTextLoads(t *testing.T) {
+	mr := setupRedis(t)
+	mr.Set(historyKey("odd-text"), `[
+		{"role":"user","text":null},
+		{"role":"ai","text":42},
+		{"role":"user","text":true},
+		{"role":"ai","text":{"parts":["a"]}},
+		{"role":"user"},
+		{"role":"ai","text":"plain","createdAt":"2026-01-02T03:04:05Z"}
+	]`)
+
+	history := storedHistory(t, "odd-text")
+	want := []string{"", "42", "true", `{"parts":["a"]}`, "", "plain"}
+	if len(history) != len(want) {
+		t.Fatalf("history = %+v, want %d messages", history, len(want))
+	}
+	for i, m := range history {
+		if m.Text != want[i] {
+			t.Errorf("message %d text = %q, want %q", i, m.Text, want[i])
+		}
+	}
+	if last := history[5]; last.Role != "ai" || !last.CreatedAt.Equal(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("last message = %+v, want the other fields decoded", last)
+	}
+
+	// The session stays usable.
+	stubChat(t, "gemini", reply("Hello"))
+	chatTurn(t, map[string]interface{}{"sessionId": "odd-text", "modelName": "gemini", "contents": userTurn("Hi")})
+}
+
+func TestMessageMarshalUnchanged(t *testing.T) {
+	data, err := json.Marshal(Message{Role: "user", Text: "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["text"] != "42" {
+		t.Errorf("text = %#v, want the string kept a string", decoded["text"])
+	}
+
+	var m Message
+	if err := json.Unmarshal([]byte(`{"role":"user","text":`), &m); err == nil {
+		t.Error("malformed JSON decoded without an error")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Limits on the userId and metadata a request may forward to providers,
+// those of OpenAI's metadata field: at most 16 pairs, keys of up to 64 and
+// values of up to 512 characters.
+const (
+	maxUserIDChars        = 256
+	maxMetadataPairs      = 16
+	maxMetadataKeyChars   = 64
+	maxMetadataValueChars = 512
+)
+
+// validateUserMetadata checks a request's userId and metadata against the
+// limits above.
+func validateUserMetadata(clientPayload ClientRequestPayload) error {
+	if utf8.RuneCountInString(clientPayload.UserID) > maxUserIDChars {
+		return fmt.Errorf("userId must be at most %d characters", maxUserIDChars)
+	}
+	if len(clientPayload.Metadata) > maxMetadataPairs {
+		return fmt.Errorf("metadata must have at most %d entries", maxMetadataPairs)
+	}
+	for key, value := range clientPayload.Metadata {
+		if key == "" || utf8.RuneCountInString(key) > maxMetadataKeyChars {
+			return fmt.Errorf("metadata keys must be 1 to %d characters", maxMetadataKeyChars)
+		}
+		if utf8.RuneCountInString(value) > maxMetadataValueChars {
+			return fmt.Errorf("metadata value of %q must be at most %d characters", key, maxMetadataValueChars)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUserIDReachesOpenAI(t *testing.T) {
+	setupRedis(t)
+	var got OpenaiPayload
+	srv := fakeChatCompletions(t, chatGPTHello, func(_ *http.Request, payload OpenaiPayload) {
+		got = payload
+	})
+	setVar(t, &chatGPTProvider.URL, srv.URL)
+	setVar(t, &chatGPTProvider.APIKey, "test-key")
+
+	chatTurn(t, map[string]interface{}{
+		"sessionId": "user-1",
+		"modelName": "chatgpt",
+		"contents":  userTurn("Hi"),
+		"userId":    "user-hash-123",
+		"metadata":  map[string]string{"plan": "pro"},
+	})
+	if got.User != "user-hash-123" || got.Metadata["plan"] != "pro" {
+		t.Fatalf("OpenAI user %q, metadata %v; want the request's userId and metadata", got.User, got.Metadata)
+	}
+}
+
+func TestUserIDOnOtherProviders(t *testing.T) {
+	req := ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}, UserID: "user-hash-123", Metadata: map[string]string{"plan": "pro"}}
+	if payload := claudePayload(req); payload.Metadata == nil || payload.Metadata.UserID != "user-hash-123" {
+		t.Errorf("Claude metadata = %+v, want the user id", payload.Metadata)
+	}
+
+	var got OpenaiPayload
+	srv := fakeChatCompletions(t, chatGPTHello, func(_ *http.Request, payload OpenaiPayload) {
+		got = payload
+	})
+	mistral := *mistralProvider
+	mistral.URL = srv.URL
+	mistral.APIKey = "test-key"
+	if _, err := mistral.Chat(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if got.User != "" || got.Metadata != nil {
+		t.Errorf("Mistral user %q, metadata %v; want none for a strict endpoint", got.User, got.Metadata)
+	}
+}
+
+func TestUserMetadataValidation(t *testing.T) {
+	tooMany := make(map[string]string)
+	for i := 0; i <= maxMetadataPairs; i++ {
+		tooMany[strings.Repeat("k", i+1)] = "v"
+	}
+	tests := []struct {
+		name    string
+		payload ClientRequestPayload
+	}{
+		{"long userId", ClientRequestPayload{UserID: strings.Repeat("u", maxUserIDChars+1)}},
+		{"too many pairs", ClientRequestPayload{Metadata: tooMany}},
+		{"empty key", ClientRequestPayload{Metadata: map[string]string{"": "v"}}},
+		{"long value", ClientRequestPayload{Metadata: map[string]string{"k": strings.Repeat("v", maxMetadataValueChars+1)}}},
+	}
+	for _, tt := range tests {
+		if err := validateUserMetadata(tt.payload); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+	if err := validateUserMetadata(ClientRequestPayload{UserID: "u", Metadata: map[string]string{"k": "v"}}); err != nil {
+		t.Errorf("valid metadata rejected: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// modelAliases maps friendly model names clients may send ("opus", "flash")
+// onto registered models, so UIs can keep a stable name while the model
+// behind it is changed here. They are read from MODEL_ALIASES as
+// comma-separated alias=model pairs, e.g.
+// MODEL_ALIASES=gpt4=chatgpt,opus=claude,flash=gemini, and matched ignoring
+// case. A registered model name always means that model.
+var modelAliases = loadModelAliases()
+
+func loadModelAliases() map[string]string {
+	value := os.Getenv("MODEL_ALIASES")
+	if value == "" {
+		return nil
+	}
+	aliases := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		alias, model, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		alias, model = strings.ToLower(strings.TrimSpace(alias)), strings.TrimSpace(model)
+		if alias == "" || model == "" {
+			warnConfig("Ignoring invalid MODEL_ALIASES entry", "entry", pair)
+			continue
+		}
+		if _, ok := providers[model]; !ok && model != autoModelName {
+			warnConfig("Ignoring MODEL_ALIASES entry for an unregistered model", "alias", alias, "model", model)
+			continue
+		}
+		if _, ok := providers[alias]; ok {
+			warnConfig("Ignoring MODEL_ALIASES entry shadowing a registered model", "alias", alias)
+			continue
+		}
+		aliases[alias] = model
+	}
+	return aliases
+}
+
+// resolveModelAlias returns the model an alias stands for, and any other name
+// unchanged.
+func resolveModelAlias(name string) string {
+	if _, ok := providers[name]; ok {
+		return name
+	}
+	if model, ok := modelAliases[strings.ToLower(name)]; ok {
+		return model
+	}
+	return name
+}
+
+// invalidModelMessage is the message of a model_not_found error, listing the
+// aliases when there are any since a client sending an unknown one most
+// likely meant one of them.
+func invalidModelMessage(message string) string {
+	if len(modelAliases) == 0 {
+		return message
+	}
+	aliases := make([]string, 0, len(modelAliases))
+	for alias := range modelAliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return message + "; known aliases: " + strings.Join(aliases, ", ")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestModelAliasResolvesToProvider(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &modelAliases, map[string]string{"opus": "claude", "flash": "gemini"})
+	stubChat(t, "claude", reply("From claude"))
+	stubChat(t, "gemini", reply("From gemini"))
+
+	resp := chatTurn(t, map[string]interface{}{"sessionId": "alias-1", "modelName": "Opus", "contents": userTurn("Hello")})
+	if resp.Model != "claude" || resp.Text != "From claude" {
+		t.Fatalf("response = %+v, want claude's reply", resp)
+	}
+}
+
+func TestUnknownModelAliasListsAliases(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &modelAliases, map[string]string{"opus": "claude", "flash": "gemini"})
+
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "alias-2", "modelName": "gpt9", "contents": userTurn("Hello")})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+	e := decodeError(t, w)
+	if e.Code != codeModelNotFound || !strings.HasSuffix(e.Message, "known aliases: flash, opus") {
+		t.Fatalf("error = %+v, want model_not_found listing the aliases", e)
+	}
+}
+
+func TestDefaultModelAlias(t *testing.T) {
+	setVar(t, &modelAliases, map[string]string{"opus": "claude"})
+	setVar(t, &defaultModel, "opus")
+	if got := resolveModelName(""); got != "claude" {
+		t.Fatalf("resolveModelName(\"\") = %q, want claude", got)
+	}
+}
+
+func TestModelsListsAliases(t *testing.T) {
+	setVar(t, &modelAliases, map[string]string{"opus": "claude"})
+	w := httptest.NewRecorder()
+	modelsHandler(w, httptest.NewRequest("GET", "/models", nil))
+	var body struct {
+		Aliases map[string]string `json:"aliases"`
+	}
+	decodeBody(t, w, &body)
+	if !reflect.DeepEqual(body.Aliases, modelAliases) {
+		t.Fatalf("aliases = %v, want %v", body.Aliases, modelAliases)
+	}
+}
+
+func TestLoadModelAliases(t *testing.T) {
+	setVar(t, &loggingReady, false)
+	t.Setenv("MODEL_ALIASES", " Opus = claude ,flash=gemini,broken,gpt9=nowhere,claude=gemini")
+	want := map[string]string{"opus": "claude", "flash": "gemini"}
+	if got := loadModelAliases(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("loadModelAliases() = %v, want %v", got, want)
+	}
+}
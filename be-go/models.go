@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// defaultModel is used when a request omits modelName.
+var defaultModel = os.Getenv("DEFAULT_MODEL")
+
+// maxChoices caps the n request parameter.
+const maxChoices = 8
+
+// ProviderRequest is what a provider call receives: the conversation to send
+// and the per-request generation options.
+type ProviderRequest struct {
+	Messages []Message
+	// N is the number of alternative completions wanted; 0 or 1 means one.
+	N int
+	// MaxTokens caps the output length; 0 uses the model's default from
+	// maxTokensLimits.
+	MaxTokens int
+	// Temperature overrides the provider's sampling temperature when set.
+	Temperature *float64
+	// PresencePenalty and FrequencyPenalty are forwarded to OpenAI-style
+	// providers when set.
+	PresencePenalty  *float64
+	FrequencyPenalty *float64
+	// ReasoningEffort is forwarded to reasoning models when set.
+	ReasoningEffort string
+	// SystemPromptStrategy overrides SYSTEM_PROMPT_STRATEGY when set.
+	SystemPromptStrategy string
+	// SafetySettings overrides the default Gemini safety settings.
+	SafetySettings []GeminiSafetySetting
+	// UserID and Metadata are forwarded to the providers' abuse tracking
+	// and metadata fields where they have them.
+	UserID   string
+	Metadata map[string]string
+}
+
+// ProviderResponse is what a provider call returns.
+type ProviderResponse struct {
+	// Text is the first choice, the one that is stored in the history.
+	Text string
+	// Choices holds every returned completion, Text included.
+	Choices []string
+	// Citations holds the source URLs the provider cited for Text, if any.
+	Citations []string
+	// ToolCalls holds the tools the model asked to call.
+	ToolCalls []ToolCall
+}
+
+// chatFunc is a non-streaming provider call.
+type chatFunc func(ctx context.Context, req ProviderRequest) (ProviderResponse, error)
+
+// providers maps the modelName accepted from clients to its provider call.
+// Every call falls back to an inlined system prompt if the provider rejects
+// its native one, re-rolls empty answers when configured to, and its outcome
+// feeds the model's circuit breaker.
+var providers = map[string]chatFunc{
+	"gemini":  wrapChat("gemini", callGeminiAPI),
+	"llama":   wrapChat("llama", llamaProvider.Chat),
+	"claude":  wrapChat("claude", callClaudeAPI),
+	"chatgpt": wrapChat("chatgpt", chatGPTProvider.Chat),
+	"mistral": wrapChat("mistral", mistralProvider.Chat),
+}
+
+// streamProviders holds the models that can be used with /chat/stream.
+var streamProviders = map[string]streamFunc{
+	"gemini":  wrapStream("gemini", callGeminiAPIStream),
+	"llama":   wrapStream("llama", llamaProvider.Stream),
+	"claude":  wrapStream("claude", callClaudeAPIStream),
+	"chatgpt": wrapStream("chatgpt", chatGPTProvider.Stream),
+	"mistral": wrapStream("mistral", mistralProvider.Stream),
+}
+
+// STREAM_FALLBACK sets how /chat/stream treats models without a streaming
+// call: "error" (the default) rejects the request, "chat" makes a regular
+// call and sends the whole reply as a single delta, so clients can stream
+// from every model the same way.
+const (
+	streamFallbackError = "error"
+	streamFallbackChat  = "chat"
+)
+
+var streamFallback = loadStreamFallback()
+
+func loadStreamFallback() string {
+	switch fallback := os.Getenv("STREAM_FALLBACK"); fallback {
+	case "", streamFallbackError:
+		return streamFallbackError
+	case streamFallbackChat:
+		return fallback
+	default:
+		warnConfig("Ignoring invalid STREAM_FALLBACK", "fallback", fallback)
+		return streamFallbackError
+	}
+}
+
+// streamProviderFor returns the streaming call of a model, falling back to
+// its regular call under STREAM_FALLBACK=chat.
+func streamProviderFor(modelName string) (streamFunc, bool) {
+	if stream, ok := streamProviders[modelName]; ok {
+		return stream, true
+	}
+	if call, ok := providers[modelName]; ok && streamFallback == streamFallbackChat {
+		return chatAsStream(call), true
+	}
+	return nil, false
+}
+
+// chatAsStream adapts a regular call to a streamFunc that emits the reply as
+// one delta.
+func chatAsStream(call chatFunc) streamFunc {
+	return func(ctx context.Context, req ProviderRequest, onDelta func(string) error) (string, error) {
+		resp, err := call(ctx, req)
+		if err != nil {
+			return "", err
+		}
+		return resp.Text, onDelta(resp.Text)
+	}
+}
+
+// wrapChat applies the wrappers every registered provider call gets.
+func wrapChat(modelName string, call chatFunc) chatFunc {
+	return withBreaker(modelName, withEmptyRetry(modelName, withSystemPromptFallback(modelName, call)))
+}
+
+// wrapStream is wrapChat for streamed calls.
+func wrapStream(modelName string, stream streamFunc) streamFunc {
+	return withStreamBreaker(modelName, withStreamEmptyRetry(modelName, withStreamSystemPromptFallback(modelName, stream)))
+}
+
+// resolveModelName returns the requested model, or the configured default
+// when none was given, with aliases resolved. An empty result means neither
+// is set.
+func resolveModelName(requested string) string {
+	if requested == "" {
+		return resolveModelAlias(defaultModel)
+	}
+	return resolveModelAlias(requested)
+}
+
+// ModelInfo describes one entry of the /models response.
+type ModelInfo struct {
+	Name      string `json:"name"`
+	Streaming bool   `json:"streaming"`
+}
+
+// modelsHandler lists the registered models, sorted by name, and the model
+// aliases when there are any.
+func modelsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only GET requests are allowed")
+		return
+	}
+
+	models := make([]ModelInfo, 0, len(providers))
+	for name := range providers {
+		_, streaming := streamProviderFor(name)
+		models = append(models, ModelInfo{Name: name, Streaming: streaming})
+	}
+	if len(autoModelWeights) > 0 {
+		streaming := pickWeighted(autoModelWeights, func(name string) bool { _, ok := streamProviderFor(name); return ok }) != ""
+		models = append(models, ModelInfo{Name: autoModelName, Streaming: streaming})
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Name < models[j].Name })
+
+	response := map[string]interface{}{"models": models}
+	if len(modelAliases) > 0 {
+		response["aliases"] = modelAliases
+	}
+	writeJSON(w, r, http.StatusOK, response)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDefaultModelWhenModelNameOmitted(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &defaultModel, "claude")
+	called := false
+	stubChat(t, "claude", func(context.Context, ProviderRequest) (ProviderResponse, error) {
+		called = true
+		return ProviderResponse{Text: "From the default", Choices: []string{"From the default"}}, nil
+	})
+
+	resp := chatTurn(t, map[string]interface{}{"sessionId": "default-1", "contents": userTurn("Hello")})
+	if !called {
+		t.Fatal("the default model's provider was not called")
+	}
+	if resp.Model != "claude" || resp.Text != "From the default" {
+		t.Fatalf("response = %+v, want claude's reply", resp)
+	}
+}
+
+func TestMissingModelNameWithoutDefault(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &defaultModel, "")
+
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "default-2", "contents": userTurn("Hello")})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+}
+
+// batchOnlyModel is a mock provider with a regular call but no streaming one.
+const batchOnlyModel = "batch-only"
+
+func TestStreamFallbackError(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &streamFallback, streamFallbackError)
+	stubChat(t, batchOnlyModel, reply("Whole reply"))
+
+	w := postJSON(t, chatStreamHandler, "/chat/stream", map[string]interface{}{"sessionId": "fallback-1", "modelName": batchOnlyModel, "contents": userTurn("Hi")})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+	if e := decodeError(t, w); e.Code != codeModelNotFound {
+		t.Fatalf("error code = %q, want %q", e.Code, codeModelNotFound)
+	}
+}
+
+func TestStreamFallbackChat(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &streamFallback, streamFallbackChat)
+	stubChat(t, batchOnlyModel, reply("Whole reply"))
+
+	events := postStream(t, map[string]interface{}{"sessionId": "fallback-2", "modelName": batchOnlyModel, "contents": userTurn("Hi")})
+	var deltas []string
+	for _, e := range events {
+		if e.Name == "" {
+			deltas = append(deltas, e.Data["text"].(string))
+		}
+	}
+	if len(deltas) != 1 || deltas[0] != "Whole reply" {
+		t.Fatalf("deltas = %q, want the whole reply as one delta", deltas)
+	}
+	if done := events[len(events)-1]; done.Name != "done" || done.Data["text"] != "Whole reply" {
+		t.Fatalf("last event = %+v, want done with the reply", done)
+	}
+	if history := storedHistory(t, "fallback-2"); history[len(history)-1].Text != "Whole reply" {
+		t.Fatalf("stored reply = %+v", history[len(history)-1])
+	}
+}
+
+func TestModelsStreamingFlagFollowsFallback(t *testing.T) {
+	stubChat(t, batchOnlyModel, reply("unused"))
+	for _, tt := range []struct {
+		fallback string
+		want     bool
+	}{
+		{streamFallbackError, false},
+		{streamFallbackChat, true},
+	} {
+		setVar(t, &streamFallback, tt.fallback)
+		w := httptest.NewRecorder()
+		modelsHandler(w, httptest.NewRequest("GET", "/models", nil))
+		var resp struct {
+			Models []ModelInfo `json:"models"`
+		}
+		decodeBody(t, w, &resp)
+		found := false
+		for _, m := range resp.Models {
+			if m.Name == batchOnlyModel {
+				found = true
+				if m.Streaming != tt.want {
+					t.Errorf("%s: streaming = %v, want %v", tt.fallback, m.Streaming, tt.want)
+				}
+			}
+		}
+		if !found {
+			t.Fatalf("%s: %s not listed", tt.fallback, batchOnlyModel)
+		}
+	}
+}
+
+func TestLoadStreamFallback(t *testing.T) {
+	setVar(t, &loggingReady, false)
+	for value, want := range map[string]string{"": streamFallbackError, "error": streamFallbackError, "chat": streamFallbackChat, "bogus": streamFallbackError} {
+		t.Setenv("STREAM_FALLBACK", value)
+		if got := loadStreamFallback(); got != want {
+			t.Errorf("STREAM_FALLBACK=%q gives %q, want %q", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// OpenAICompatibleProvider talks to any endpoint that accepts the OpenAI chat
+// completions shape ({model, messages} in, choices[].message.content out).
+// OpenAI itself, Perplexity, Mistral and most local servers are instances.
+type OpenAICompatibleProvider struct {
+	// Name is used in error messages, e.g. "ChatGPT".
+	Name string
+	// Key is the model name it is registered under, e.g. "chatgpt", used to
+	// look up per-model configuration.
+	Key string
+	// URL is the full chat completions endpoint.
+	URL   string
+	Model string
+	// APIKey is the credential; APIKeyEnv names the variable it came from and,
+	// when set, makes an empty APIKey an error. Local servers usually leave
+	// both empty.
+	APIKey    string
+	APIKeyEnv string
+	// AuthHeader is empty for the usual "Authorization: Bearer <key>". Any
+	// other header name (e.g. Azure OpenAI's "api-key") gets the bare key.
+	AuthHeader string
+	// ReasoningEffort is set for endpoints accepting reasoning_effort.
+	ReasoningEffort bool
+	// UserMetadata is set for endpoints accepting user and metadata; strict
+	// ones reject unknown fields.
+	UserMetadata bool
+	// StreamUsage is set for endpoints that report a stream's usage only
+	// when asked through stream_options.
+	StreamUsage bool
+	// ToolMessages is set for endpoints accepting "tool" messages; for the
+	// others tool results are sent as user text.
+	ToolMessages bool
+}
+
+var llamaProvider = &OpenAICompatibleProvider{
+	Name:      "Llama",
+	Key:       "llama",
+	URL:       "https://api.perplexity.ai/chat/completions",
+	Model:     "llama-3-sonar-small-32k-online",
+	APIKey:    llamaAPIKey,
+	APIKeyEnv: "LLAMA_API_KEY",
+}
+
+var chatGPTProvider = &OpenAICompatibleProvider{
+	Name:      "ChatGPT",
+	Key:       "chatgpt",
+	URL:       "https://api.openai.com/v1/chat/completions",
+	Model:     "gpt-4o",
+	APIKey:    chatGPTAPIKey,
+	APIKeyEnv: "CHATGPT_API_KEY",
+
+	ReasoningEffort: true,
+	UserMetadata:    true,
+	StreamUsage:     true,
+	ToolMessages:    true,
+}
+
+var mistralProvider = &OpenAICompatibleProvider{
+	Name:      "Mistral",
+	Key:       "mistral",
+	URL:       "https://api.mistral.ai/v1/chat/completions",
+	Model:     "mistral-large-latest",
+	APIKey:    mistralAPIKey,
+	APIKeyEnv: "MISTRAL_API_KEY",
+
+	ToolMessages: true,
+}
+
+// headers returns the auth header for the configured style, or an error if a
+// required key is missing.
+func (p *OpenAICompatibleProvider) headers() (map[string]string, error) {
+	if p.APIKey == "" {
+		if p.APIKeyEnv != "" {
+			return nil, fmt.Errorf("%s environment variable not set", p.APIKeyEnv)
+		}
+		return nil, nil
+	}
+
+	if p.AuthHeader == "" {
+		return map[string]string{"Authorization": "Bearer " + p.APIKey}, nil
+	}
+	return map[string]string{p.AuthHeader: p.APIKey}, nil
+}
+
+// configured reports whether the provider's credentials are present.
+func (p *OpenAICompatibleProvider) configured() bool {
+	_, err := p.headers()
+	return err == nil
+}
+
+// Chat sends the conversation and returns the completion choices.
+func (p *OpenAICompatibleProvider) Chat(ctx context.Context, req ProviderRequest) (_ ProviderResponse, err error) {
+	defer wrapProviderError(&err, p.Name, p.Model)
+	headers, err := p.headers()
+	if err != nil {
+		return ProviderResponse{}, err
+	}
+
+	payload := OpenaiPayload{
+		Model:            p.Model,
+		Messages:         p.messages(req),
+		MaxTokens:        maxTokensFor(p.Key, req.MaxTokens),
+		Temperature:      req.Temperature,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		ReasoningEffort:  p.reasoningEffort(req),
+	}
+	payload.User, payload.Metadata = p.userMetadata(req)
+	if req.N > 1 {
+		payload.N = req.N
+	}
+
+	jsonPayload, _ := json.Marshal(payload)
+	resp, err := makeAPIRequestWithHeaders(ctx, p.URL, headers, bytes.NewBuffer(jsonPayload))
+	if err != nil {
+		return ProviderResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var result OpenaiResponse
+	if err := decodeProviderResponse(p.Name, resp.Body, &result); err != nil {
+		return ProviderResponse{}, err
+	}
+
+	// A content filter hit comes back as a choice with no content.
+	if len(result.Choices) > 0 && (result.Choices[0].Message.Content != "" || len(result.Choices[0].Message.ToolCalls) > 0) {
+		recordFinishReason(ctx, result.Choices[0].FinishReason)
+		if result.Usage != nil {
+			recordProviderUsage(ctx, result.Usage.PromptTokens, result.Usage.CompletionTokens, result.Usage.TotalTokens)
+		}
+		choices := make([]string, len(result.Choices))
+		for i, choice := range result.Choices {
+			choices[i] = choice.Message.Content
+		}
+		var toolCalls []ToolCall
+		for _, call := range result.Choices[0].Message.ToolCalls {
+			toolCalls = append(toolCalls, ToolCall{ID: call.ID, Name: call.Function.Name, Arguments: rawArguments(call.Function.Arguments)})
+		}
+		return ProviderResponse{Text: choices[0], Choices: choices, Citations: result.Citations, ToolCalls: toolCalls}, nil
+	}
+
+	reason := ""
+	if len(result.Choices) > 0 {
+		reason = result.Choices[0].FinishReason
+	}
+	return ProviderResponse{}, emptyResponseError(p.Name, reason)
+}
+
+// Stream is the streaming variant of Chat.
+func (p *OpenAICompatibleProvider) Stream(ctx context.Context, req ProviderRequest, onDelta func(string) error) (_ string, err error) {
+	defer wrapProviderError(&err, p.Name, p.Model)
+	headers, err := p.headers()
+	if err != nil {
+		return "", err
+	}
+
+	payload := OpenaiPayload{
+		Model:            p.Model,
+		Messages:         p.messages(req),
+		MaxTokens:        maxTokensFor(p.Key, req.MaxTokens),
+		Temperature:      req.Temperature,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		ReasoningEffort:  p.reasoningEffort(req),
+		Stream:           true,
+	}
+	payload.User, payload.Metadata = p.userMetadata(req)
+	if p.StreamUsage {
+		payload.StreamOptions = &OpenaiStreamOptions{IncludeUsage: true}
+	}
+
+	jsonPayload, _ := json.Marshal(payload)
+	return streamOpenaiStyle(ctx, p.Name, p.URL, headers, jsonPayload, onDelta)
+}
+
+// reasoningEffort returns the request's reasoning effort if the endpoint
+// accepts one.
+func (p *OpenAICompatibleProvider) reasoningEffort(req ProviderRequest) string {
+	if req.ReasoningEffort != "" && !p.ReasoningEffort {
+		slog.Debug("Provider does not support reasoning effort, ignoring it", "provider", p.Name)
+		return ""
+	}
+	return req.ReasoningEffort
+}
+
+// userMetadata returns the request's user id and metadata if the endpoint
+// accepts them.
+func (p *OpenAICompatibleProvider) userMetadata(req ProviderRequest) (string, map[string]string) {
+	if !p.UserMetadata {
+		if req.UserID != "" || len(req.Metadata) > 0 {
+			slog.Debug("Provider does not support user metadata, ignoring it", "provider", p.Name)
+		}
+		return "", nil
+	}
+	return req.UserID, req.Metadata
+}
+
+// messages applies the configured system prompt strategy and maps the result
+// onto OpenAI's chat roles. A native system prompt becomes a leading "system"
+// message.
+func (p *OpenAICompatibleProvider) messages(req ProviderRequest) []OpenaiMessage {
+	system, messages := applySystemPromptStrategy(req.Messages, req.systemPromptStrategy(p.Key))
+	openaiMessages := toOpenaiMessages(messages, p.ToolMessages)
+	if system != "" {
+		openaiMessages = append([]OpenaiMessage{{Role: "system", Content: system}}, openaiMessages...)
+	}
+	return openaiMessages
+}
+
+// toOpenaiMessages maps the stored history onto OpenAI's chat roles. Tool
+// results become "tool" messages when toolMessages is set and user messages
+// otherwise.
+func toOpenaiMessages(contents []Message, toolMessages bool) []OpenaiMessage {
+	openaiMessages := make([]OpenaiMessage, 0, len(contents))
+	for _, c := range contents {
+		role := ""
+		switch c.Role {
+		case "tool":
+			if toolMessages {
+				openaiMessages = append(openaiMessages, OpenaiMessage{Role: "tool", Content: c.Text, ToolCallID: c.ToolCallID})
+			} else {
+				openaiMessages = append(openaiMessages, OpenaiMessage{Role: "user", Content: toolResultText(c)})
+			}
+			continue
+		case "user":
+			role = "user"
+		case "ai":
+			role = "assistant"
+		case "system":
+			// Under the "user" system prompt strategy, map the system role
+			// to "user" so the LLM processes it as a context-setting
+			// instruction.
+			role = "user"
+		default:
+			// Skip any unknown roles
+			continue
+		}
+		message := OpenaiMessage{Role: role, Content: c.Text}
+		if toolMessages {
+			for _, call := range c.ToolCalls {
+				openaiCall := OpenaiToolCall{ID: call.ID, Type: "function"}
+				openaiCall.Function.Name = call.Name
+				openaiCall.Function.Arguments = toolCallArguments(call.Arguments)
+				message.ToolCalls = append(message.ToolCalls, openaiCall)
+			}
+		}
+		openaiMessages = append(openaiMessages, message)
+	}
+	return openaiMessages
+}
+
+// toolCallArguments encodes stored tool call arguments the way OpenAI sends
+// them, as a string of JSON. It undoes rawArguments.
+func toolCallArguments(arguments json.RawMessage) string {
+	var quoted string
+	if json.Unmarshal(arguments, &quoted) == nil {
+		return quoted
+	}
+	if len(arguments) == 0 {
+		return "{}"
+	}
+	return string(arguments)
+}
+
+// rawArguments returns OpenAI's JSON-encoded tool call arguments as raw
+// JSON, or as a JSON string when the model produced invalid JSON.
+func rawArguments(arguments string) json.RawMessage {
+	if json.Valid([]byte(arguments)) {
+		return json.RawMessage(arguments)
+	}
+	quoted, _ := json.Marshal(arguments)
+	return quoted
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeChatCompletions serves an OpenAI-style chat completions endpoint that
+// answers every request with response and hands the decoded request to
+// inspect.
+func fakeChatCompletions(t *testing.T, response string, inspect func(*http.Request, OpenaiPayload)) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload OpenaiPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding provider request: %v", err)
+		}
+		if inspect != nil {
+			inspect(r, payload)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMistralProvider(t *testing.T) {
+	srv := fakeChatCompletions(t, `{"choices":[{"message":{"role":"assistant","content":"Bonjour"},"finish_reason":"stop"}]}`, func(r *http.Request, payload OpenaiPayload) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("path = %q, want /v1/chat/completions", r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer mistral-key" {
+			t.Errorf("Authorization = %q, want the Mistral key", got)
+		}
+		if payload.Model != mistralProvider.Model {
+			t.Errorf("model = %q, want %q", payload.Model, mistralProvider.Model)
+		}
+	})
+	mistral := *mistralProvider
+	mistral.URL = srv.URL + "/v1/chat/completions"
+	mistral.APIKey = "mistral-key"
+
+	resp, err := mistral.Chat(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Salut"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "Bonjour" {
+		t.Fatalf("text = %q, want Bonjour", resp.Text)
+	}
+}
+
+func TestMistralRegistered(t *testing.T) {
+	if _, ok := providers["mistral"]; !ok {
+		t.Fatal("mistral is not a registered provider")
+	}
+	w := httptest.NewRecorder()
+	modelsHandler(w, httptest.NewRequest("GET", "/models", nil))
+	var body struct {
+		Models []ModelInfo `json:"models"`
+	}
+	decodeBody(t, w, &body)
+	for _, m := range body.Models {
+		if m.Name == "mistral" {
+			return
+		}
+	}
+	t.Fatalf("/models = %+v, want mistral listed", body.Models)
+}
+
+func TestMistralMissingKey(t *testing.T) {
+	mistral := *mistralProvider
+	mistral.APIKey = ""
+	if _, err := mistral.Chat(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Salut"}}}); err == nil {
+		t.Fatal("Chat without MISTRAL_API_KEY succeeded, want an error")
+	}
+}
+
+func TestOpenAICompatibleEndpoints(t *testing.T) {
+	conversation := []Message{
+		{Role: "system", Text: "Be brief."},
+		{Role: "user", Text: "Hi"},
+		{Role: "ai", Text: "Hello!"},
+		{Role: "robot", Text: "ignored"},
+		{Role: "user", Text: "How are you?"},
+	}
+	wantRoles := []string{"user", "user", "assistant", "user"}
+
+	tests := []struct {
+		name       string
+		provider   OpenAICompatibleProvider
+		wantHeader string
+		wantValue  string
+		response   string
+		wantText   string
+	}{
+		{
+			name:       "bearer",
+			provider:   OpenAICompatibleProvider{Name: "Hosted", Key: "hosted", Model: "hosted-1", APIKey: "secret", APIKeyEnv: "HOSTED_API_KEY"},
+			wantHeader: "Authorization",
+			wantValue:  "Bearer secret",
+			response:   `{"choices":[{"message":{"role":"assistant","content":"Fine, thanks"},"finish_reason":"stop"}]}`,
+			wantText:   "Fine, thanks",
+		},
+		{
+			name:       "api-key header",
+			provider:   OpenAICompatibleProvider{Name: "Azure", Key: "azure", Model: "gpt-4o-deploy", APIKey: "azure-secret", AuthHeader: "api-key"},
+			wantHeader: "api-key",
+			wantValue:  "azure-secret",
+			response:   `{"choices":[{"message":{"role":"assistant","content":"All good"},"finish_reason":"stop"},{"message":{"role":"assistant","content":"Other"}}]}`,
+			wantText:   "All good",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fakeChatCompletions(t, tt.response, func(r *http.Request, payload OpenaiPayload) {
+				if got := r.Header.Get(tt.wantHeader); got != tt.wantValue {
+					t.Errorf("%s = %q, want %q", tt.wantHeader, got, tt.wantValue)
+				}
+				if payload.Model != tt.provider.Model {
+					t.Errorf("model = %q, want %q", payload.Model, tt.provider.Model)
+				}
+				var roles []string
+				for _, m := range payload.Messages {
+					roles = append(roles, m.Role)
+				}
+				if len(roles) != len(wantRoles) {
+					t.Fatalf("roles = %v, want %v", roles, wantRoles)
+				}
+				for i := range roles {
+					if roles[i] != wantRoles[i] {
+						t.Fatalf("roles = %v, want %v", roles, wantRoles)
+					}
+				}
+			})
+			provider := tt.provider
+			provider.URL = srv.URL
+
+			resp, err := provider.Chat(context.Background(), ProviderRequest{Messages: conversation})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Text != tt.wantText {
+				t.Errorf("text = %q, want %q", resp.Text, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestOpenAICompatibleNativeSystemPrompt(t *testing.T) {
+	var got []OpenaiMessage
+	srv := fakeChatCompletions(t, `{"choices":[{"message":{"content":"ok"}}]}`, func(_ *http.Request, payload OpenaiPayload) {
+		got = payload.Messages
+	})
+	provider := OpenAICompatibleProvider{Name: "Local", Key: "local", URL: srv.URL, Model: "local"}
+
+	_, err := provider.Chat(context.Background(), ProviderRequest{
+		Messages:             []Message{{Role: "system", Text: "Be brief."}, {Role: "user", Text: "Hi"}},
+		SystemPromptStrategy: systemPromptNative,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Role != "system" || got[0].Content != "Be brief." || got[1].Role != "user" {
+		t.Fatalf("messages = %+v, want the system prompt first", got)
+	}
+}
+
+func TestPenaltiesInOpenAIPayload(t *testing.T) {
+	setupRedis(t)
+	var got OpenaiPayload
+	srv := fakeChatCompletions(t, `{"choices":[{"message":{"role":"assistant","content":"Hi"},"finish_reason":"stop"}]}`, func(_ *http.Request, payload OpenaiPayload) {
+		got = payload
+	})
+	setVar(t, &chatGPTProvider.URL, srv.URL)
+	setVar(t, &chatGPTProvider.APIKey, "test-key")
+
+	chatTurn(t, map[string]interface{}{
+		"sessionId":        "penalties-1",
+		"modelName":        "chatgpt",
+		"contents":         userTurn("Hi"),
+		"presencePenalty":  0.5,
+		"frequencyPenalty": -1.25,
+	})
+	if got.PresencePenalty == nil || *got.PresencePenalty != 0.5 {
+		t.Errorf("presence_penalty = %v, want 0.5", got.PresencePenalty)
+	}
+	if got.FrequencyPenalty == nil || *got.FrequencyPenalty != -1.25 {
+		t.Errorf("frequency_penalty = %v, want -1.25", got.FrequencyPenalty)
+	}
+
+	// Unset penalties are left out rather than sent as 0.
+	chatTurn(t, map[string]interface{}{"sessionId": "penalties-2", "modelName": "chatgpt", "contents": userTurn("Hi")})
+	if got.PresencePenalty != nil || got.FrequencyPenalty != nil {
+		t.Errorf("penalties = %v, %v; want them omitted", got.PresencePenalty, got.FrequencyPenalty)
+	}
+}
+
+func TestPenaltyRangeValidated(t *testing.T) {
+	setupRedis(t)
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{
+		"sessionId":       "penalties-bad",
+		"modelName":       "chatgpt",
+		"contents":        userTurn("Hi"),
+		"presencePenalty": 2.5,
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400 for a penalty above 2", w.Code)
+	}
+}
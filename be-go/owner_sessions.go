@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// Session caps per owner: POST /session refuses to give an owner more than
+// maxSessionsPerOwner active sessions. Under sessionCapPolicy "reject" (the
+// default) it answers 429; under "evict_oldest" the owner's oldest sessions
+// are deleted to make room. 0 disables the cap.
+var (
+	maxSessionsPerOwner = envInt("MAX_SESSIONS_PER_OWNER", 0)
+	sessionCapPolicy    = loadSessionCapPolicy()
+)
+
+const (
+	sessionCapReject      = "reject"
+	sessionCapEvictOldest = "evict_oldest"
+)
+
+var errSessionCapReached = errors.New("owner has reached the maximum number of sessions")
+
+func loadSessionCapPolicy() string {
+	switch policy := os.Getenv("SESSION_CAP_POLICY"); policy {
+	case "", sessionCapReject:
+		return sessionCapReject
+	case sessionCapEvictOldest:
+		return policy
+	default:
+		warnConfig("Ignoring invalid SESSION_CAP_POLICY", "policy", policy)
+		return sessionCapReject
+	}
+}
+
+// ownerSessionsKey is the Redis sorted set of an owner's session ids, scored
+// by when the owner claimed them.
+func ownerSessionsKey(owner string) string {
+	return "owner-sessions:" + owner
+}
+
+// activeOwnerSessions returns the owner's sessions, oldest first, after
+// removing those whose metadata has expired.
+func activeOwnerSessions(owner string) ([]string, error) {
+	key := ownerSessionsKey(owner)
+	ids, err := redisClient.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis error retrieving owner sessions: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	pipe := redisClient.Pipeline()
+	exists := make([]*redis.IntCmd, len(ids))
+	for i, id := range ids {
+		exists[i] = pipe.Exists(ctx, sessionMetaKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("redis error checking owner sessions: %w", err)
+	}
+
+	active := make([]string, 0, len(ids))
+	var expired []interface{}
+	for i, id := range ids {
+		if exists[i].Val() == 0 {
+			expired = append(expired, id)
+			continue
+		}
+		active = append(active, id)
+	}
+	if len(expired) > 0 {
+		if err := redisClient.ZRem(ctx, key, expired...).Err(); err != nil {
+			return nil, fmt.Errorf("redis error pruning owner sessions: %w", err)
+		}
+	}
+	return active, nil
+}
+
+// claimOwnerSession records sessionId as one of owner's sessions, applying
+// the session cap. It releases the session from previousOwner, if any.
+func claimOwnerSession(owner, previousOwner, sessionId string) error {
+	if owner == previousOwner {
+		return nil
+	}
+	if owner != "" && maxSessionsPerOwner > 0 {
+		active, err := activeOwnerSessions(owner)
+		if err != nil {
+			return err
+		}
+		if excess := len(active) - maxSessionsPerOwner + 1; excess > 0 {
+			if sessionCapPolicy != sessionCapEvictOldest {
+				return errSessionCapReached
+			}
+			for _, id := range active[:excess] {
+				slog.Info("Evicting oldest session of owner at session cap", "owner", owner, "sessionId", id)
+				if err := deleteSession(owner, id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	pipe := redisTxPipeline()
+	if previousOwner != "" {
+		pipe.ZRem(ctx, ownerSessionsKey(previousOwner), sessionId)
+	}
+	if owner != "" {
+		pipe.ZAdd(ctx, ownerSessionsKey(owner), redis.Z{Score: float64(time.Now().UnixNano()), Member: sessionId})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("redis error recording owner session: %w", err)
+	}
+	return nil
+}
+
+// deleteSession removes a session's history, under its key or the legacy
+// bare one, and metadata and drops it from its owner's set. Each key gets its
+// own DEL, as the keys may be in different cluster slots.
+func deleteSession(owner, sessionId string) error {
+	pipe := redisTxPipeline()
+	pipe.Del(ctx, historyKey(sessionId))
+	if !isInternalKey(sessionId) {
+		pipe.Del(ctx, sessionId)
+	}
+	pipe.Del(ctx, sessionMetaKey(sessionId))
+	pipe.ZRem(ctx, ownerSessionsKey(owner), sessionId)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("redis error deleting session: %w", err)
+	}
+	historyCache.forget(sessionId)
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// claimSession posts an owner for sessionId to /session.
+func claimSession(t *testing.T, owner, sessionId string) int {
+	t.Helper()
+	return postJSON(t, sessionHandler, "/session", map[string]string{"sessionId": sessionId, "owner": owner}).Code
+}
+
+func TestSessionCapRejects(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &maxSessionsPerOwner, 2)
+	setVar(t, &sessionCapPolicy, sessionCapReject)
+
+	for _, id := range []string{"cap-1", "cap-2"} {
+		if code := claimSession(t, "alice", id); code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200 under the cap", id, code)
+		}
+	}
+	if code := claimSession(t, "alice", "cap-2"); code != http.StatusOK {
+		t.Errorf("reclaiming an owned session: status = %d, want 200", code)
+	}
+	w := postJSON(t, sessionHandler, "/session", map[string]string{"sessionId": "cap-3", "owner": "alice"})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("over the cap: status = %d, want 429", w.Code)
+	}
+	if e := decodeError(t, w); e.Code != codeSessionLimit {
+		t.Errorf("error code = %q, want %q", e.Code, codeSessionLimit)
+	}
+	if code := claimSession(t, "bob", "cap-3"); code != http.StatusOK {
+		t.Errorf("another owner: status = %d, want 200", code)
+	}
+
+	// An expired session no longer counts against the cap.
+	mr.Del(sessionMetaKey("cap-1"))
+	if code := claimSession(t, "alice", "cap-4"); code != http.StatusOK {
+		t.Errorf("after an expiry: status = %d, want 200", code)
+	}
+}
+
+func TestSessionCapEvictsOldest(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &maxSessionsPerOwner, 2)
+	setVar(t, &sessionCapPolicy, sessionCapEvictOldest)
+
+	for _, id := range []string{"evict-1", "evict-2"} {
+		if code := claimSession(t, "alice", id); code != http.StatusOK {
+			t.Fatalf("%s: status = %d", id, code)
+		}
+		if err := saveHistoryToRedis(id, []Message{{Role: "user", Text: "Hi"}}, defaultTenant); err != nil {
+			t.Fatal(err)
+		}
+		// Sessions are ordered by when they were claimed.
+		time.Sleep(time.Millisecond)
+	}
+	if code := claimSession(t, "alice", "evict-3"); code != http.StatusOK {
+		t.Fatalf("over the cap: status = %d, want 200 with eviction", code)
+	}
+
+	if mr.Exists(historyKey("evict-1")) || mr.Exists(sessionMetaKey("evict-1")) {
+		t.Error("the oldest session was not deleted")
+	}
+	if !mr.Exists(historyKey("evict-2")) {
+		t.Error("a newer session was deleted")
+	}
+	active, err := activeOwnerSessions("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 2 || active[0] != "evict-2" || active[1] != "evict-3" {
+		t.Errorf("active sessions = %v, want evict-2 and evict-3", active)
+	}
+}
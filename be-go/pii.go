@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// redactPIIEnabled replaces emails, phone numbers and card numbers in user
+// messages before they are stored. With redactOnlyStorage the provider still
+// receives the original text (kept in memory only); otherwise it gets the
+// redacted text too.
+var (
+	redactPIIEnabled  = os.Getenv("REDACT_PII") == "true"
+	redactOnlyStorage = os.Getenv("REDACT_ONLY_STORAGE") == "true"
+)
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	// Card-like runs of 13-19 digits, optionally grouped by spaces or dashes.
+	// Matches are confirmed with a Luhn check to avoid redacting arbitrary
+	// numbers.
+	cardPattern = regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`)
+	// Phone numbers: an optional +country code, an area code (in parentheses
+	// or followed by a separator), then two groups of 3-4 digits. Requiring
+	// the separator keeps dates and plain long numbers out.
+	phonePattern = regexp.MustCompile(`(?:\+\d{1,3}[ .\-]?)?(?:\(\d{2,4}\)[ .\-]?|\b\d{2,4}[ .\-])\d{3,4}[ .\-]?\d{3,4}\b`)
+)
+
+// redactPII replaces detected PII with placeholders. It reports whether
+// anything was replaced.
+func redactPII(text string) (string, bool) {
+	found := false
+	text = emailPattern.ReplaceAllStringFunc(text, func(string) string {
+		found = true
+		return "[REDACTED_EMAIL]"
+	})
+	text = cardPattern.ReplaceAllStringFunc(text, func(match string) string {
+		if !luhnValid(match) {
+			return match
+		}
+		found = true
+		return "[REDACTED_CARD]"
+	})
+	text = phonePattern.ReplaceAllStringFunc(text, func(match string) string {
+		if countDigits(match) < 7 {
+			return match
+		}
+		found = true
+		return "[REDACTED_PHONE]"
+	})
+	return text, found
+}
+
+func countDigits(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			n++
+		}
+	}
+	return n
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum used by
+// payment card numbers.
+func luhnValid(s string) bool {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return len(digits) >= 13 && sum%10 == 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStoredMessageRedacted(t *testing.T) {
+	for _, onlyStorage := range []bool{false, true} {
+		name := "redact everywhere"
+		if onlyStorage {
+			name = "redact only storage"
+		}
+		t.Run(name, func(t *testing.T) {
+			setupRedis(t)
+			setVar(t, &redactPIIEnabled, true)
+			setVar(t, &redactOnlyStorage, onlyStorage)
+			requests := recordRequests(t, "gemini", "Noted.")
+
+			chatTurn(t, map[string]interface{}{"sessionId": "pii-1", "modelName": "gemini", "contents": userTurn("Write to jane.doe@example.com please")})
+
+			stored := storedHistory(t, "pii-1")
+			var user Message
+			for _, m := range stored {
+				if m.Role == "user" {
+					user = m
+				}
+			}
+			if strings.Contains(user.Text, "jane.doe@example.com") || !strings.Contains(user.Text, "[REDACTED_EMAIL]") {
+				t.Errorf("stored text = %q, want the email redacted", user.Text)
+			}
+
+			sent := (*requests)[0].Messages
+			gotOriginal := strings.Contains(sent[len(sent)-1].Text, "jane.doe@example.com")
+			if gotOriginal != onlyStorage {
+				t.Errorf("provider got %q, want the original only with REDACT_ONLY_STORAGE", sent[len(sent)-1].Text)
+			}
+		})
+	}
+}
+
+func TestRedactPII(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"mail me at a.b@example.org", "mail me at [REDACTED_EMAIL]"},
+		{"card 4111 1111 1111 1111 ok", "card [REDACTED_CARD] ok"},
+		{"call +1 415-555-0100 now", "call [REDACTED_PHONE] now"},
+		{"order 1234567812345678 is not a card", "order 1234567812345678 is not a card"},
+		{"meet on 2024-05-01", "meet on 2024-05-01"},
+	}
+	for _, tt := range tests {
+		if got, _ := redactPII(tt.in); got != tt.want {
+			t.Errorf("redactPII(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "os"
+
+// userPromptPrefix and userPromptSuffix wrap every user message sent to a
+// provider, e.g. a standard safety instruction or a compliance disclaimer,
+// separated from the message by a blank line. With wrapStoredPrompts the
+// wrapped text is also what is stored in the history; otherwise the history
+// keeps the text as the user wrote it.
+var (
+	userPromptPrefix  = os.Getenv("USER_PROMPT_PREFIX")
+	userPromptSuffix  = os.Getenv("USER_PROMPT_SUFFIX")
+	wrapStoredPrompts = os.Getenv("USER_PROMPT_WRAP_STORAGE") == "true"
+)
+
+// wrapUserPrompt adds the configured prefix and suffix to a user message.
+func wrapUserPrompt(text string) string {
+	if userPromptPrefix != "" {
+		text = userPromptPrefix + "\n\n" + text
+	}
+	if userPromptSuffix != "" {
+		text = text + "\n\n" + userPromptSuffix
+	}
+	return text
+}
+
+// userPromptWrapping reports whether a prefix or suffix is configured.
+func userPromptWrapping() bool {
+	return userPromptPrefix != "" || userPromptSuffix != ""
+}
+
+// wrapUserMessages returns messages with every user message wrapped. The
+// input is not modified.
+func wrapUserMessages(messages []Message) []Message {
+	if !userPromptWrapping() {
+		return messages
+	}
+	wrapped := make([]Message, len(messages))
+	for i, m := range messages {
+		if m.Role == "user" {
+			m.Text = wrapUserPrompt(m.Text)
+		}
+		wrapped[i] = m
+	}
+	return wrapped
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+const (
+	testPromptPrefix = "Follow the safety policy."
+	testPromptSuffix = "Replies are not financial advice."
+)
+
+func lastUserText(messages []Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return messages[i].Text
+		}
+	}
+	return ""
+}
+
+func TestUserPromptPrefixAndSuffix(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &userPromptPrefix, testPromptPrefix)
+	setVar(t, &userPromptSuffix, testPromptSuffix)
+	requests := recordRequests(t, "gemini", "Noted.")
+
+	chatTurn(t, map[string]interface{}{"sessionId": "wrap-1", "modelName": "gemini", "contents": userTurn("Should I buy shares?")})
+	chatTurn(t, map[string]interface{}{"sessionId": "wrap-1", "modelName": "gemini", "contents": userTurn("And bonds?")})
+
+	wrapped := func(text string) string { return testPromptPrefix + "\n\n" + text + "\n\n" + testPromptSuffix }
+	var sent []string
+	for _, m := range (*requests)[1].Messages {
+		if m.Role == "user" {
+			sent = append(sent, m.Text)
+		}
+	}
+	// Earlier turns from the history are wrapped once too.
+	if len(sent) != 2 || sent[0] != wrapped("Should I buy shares?") || sent[1] != wrapped("And bonds?") {
+		t.Errorf("provider-bound user texts = %q, want both wrapped once", sent)
+	}
+	if got := lastUserText(storedHistory(t, "wrap-1")); got != "And bonds?" {
+		t.Errorf("stored text = %q, want the text as written", got)
+	}
+}
+
+func TestUserPromptWrapStorage(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &userPromptSuffix, testPromptSuffix)
+	setVar(t, &wrapStoredPrompts, true)
+	requests := recordRequests(t, "gemini", "Noted.")
+
+	chatTurn(t, map[string]interface{}{"sessionId": "wrap-2", "modelName": "gemini", "contents": userTurn("Hi")})
+	chatTurn(t, map[string]interface{}{"sessionId": "wrap-2", "modelName": "gemini", "contents": userTurn("Bye")})
+
+	want := "Hi\n\n" + testPromptSuffix
+	for _, m := range (*requests)[1].Messages {
+		if m.Role == "user" && m.Text != want && m.Text != "Bye\n\n"+testPromptSuffix {
+			t.Errorf("provider-bound text = %q, want the suffix added once", m.Text)
+		}
+	}
+	if got := storedHistory(t, "wrap-2"); lastUserText(got[:len(got)-2]) != want {
+		t.Errorf("stored history = %+v, want the wrapped text stored", got)
+	}
+}
+
+func TestUserPromptWrapOffByDefault(t *testing.T) {
+	if userPromptWrapping() {
+		t.Skip("USER_PROMPT_PREFIX or USER_PROMPT_SUFFIX is set")
+	}
+	if got := wrapUserPrompt("Hi"); got != "Hi" {
+		t.Errorf("wrapUserPrompt = %q, want it unchanged", got)
+	}
+}
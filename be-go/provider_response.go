@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// maxLoggedBodyBytes caps how much of an unparseable provider body is logged.
+const maxLoggedBodyBytes = 2048
+
+// errEmptyResponse means the provider answered in the expected shape but with
+// no content and no sign of a block: a fluke a re-roll usually fixes.
+var errEmptyResponse = errors.New("provider returned no content")
+
+// errContentBlocked means the provider returned no content because a safety
+// filter blocked the prompt or the reply. Retrying gives the same result.
+var errContentBlocked = errors.New("provider blocked the content")
+
+// blockReasons are the finish, stop and block reasons, across providers,
+// that mean the content was filtered.
+var blockReasons = map[string]bool{
+	// Gemini finishReason and promptFeedback.blockReason
+	"SAFETY":             true,
+	"RECITATION":         true,
+	"BLOCKLIST":          true,
+	"PROHIBITED_CONTENT": true,
+	"SPII":               true,
+	"IMAGE_SAFETY":       true,
+	// OpenAI finish_reason
+	"content_filter": true,
+	// Anthropic stop_reason
+	"refusal": true,
+}
+
+// errMalformedResponse means the provider body did not match the expected
+// schema, e.g. an error object sent with a 200 or a changed response format.
+var errMalformedResponse = errors.New("provider response did not match the expected schema")
+
+// providerResult is implemented by the provider response structs. wellFormed
+// reports whether the fields that distinguish the schema were present.
+type providerResult interface {
+	wellFormed() bool
+}
+
+// decodeProviderResponse reads and decodes a provider body into v. Bodies that
+// fail to decode or lack the expected fields wrap errMalformedResponse and are
+// logged, redacted and truncated, at debug level.
+func decodeProviderResponse(name string, body io.Reader, v providerResult) error {
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("error reading %s response: %w", name, err)
+	}
+
+	err = json.Unmarshal(raw, v)
+	if err == nil && v.wellFormed() {
+		return nil
+	}
+
+	logged := raw
+	if len(logged) > maxLoggedBodyBytes {
+		logged = logged[:maxLoggedBodyBytes]
+	}
+	redacted, _ := redactPII(string(logged))
+	slog.Debug("Unparseable provider response", "provider", name, "error", err, "body", redacted)
+
+	if err != nil {
+		return fmt.Errorf("error parsing %s response: %w: %v", name, errMalformedResponse, err)
+	}
+	return fmt.Errorf("error parsing %s response: %w", name, errMalformedResponse)
+}
+
+// providerError records which provider and model a failed call went to, so
+// the error stays attributable once fallbacks and "auto" are involved.
+type providerError struct {
+	Provider string
+	Model    string
+	Err      error
+}
+
+func (e *providerError) Error() string {
+	return fmt.Sprintf("provider %s (%s): %v", e.Provider, e.Model, e.Err)
+}
+
+func (e *providerError) Unwrap() error { return e.Err }
+
+// wrapProviderError is deferred by provider calls to attribute the error they
+// return, if any, to the provider and model.
+func wrapProviderError(err *error, provider, model string) {
+	var already *providerError
+	if *err == nil || errors.As(*err, &already) {
+		return
+	}
+	*err = &providerError{Provider: provider, Model: model, Err: *err}
+}
+
+// emptyResponseError describes an answer without content: errContentBlocked
+// when the provider's stated reason is a block, errEmptyResponse otherwise.
+func emptyResponseError(name, reason string) error {
+	sentinel := errEmptyResponse
+	if blockReasons[reason] {
+		sentinel = errContentBlocked
+	}
+	if reason == "" {
+		return fmt.Errorf("%s: %w", name, sentinel)
+	}
+	return fmt.Errorf("%s: %w (%s)", name, sentinel, reason)
+}
+
+// A Gemini body must carry candidates or, when the prompt itself was blocked,
+// promptFeedback.
+func (r *GeminiResponse) wellFormed() bool {
+	return r.Candidates != nil || r.PromptFeedback != nil
+}
+
+func (r *OpenaiResponse) wellFormed() bool {
+	return r.Choices != nil
+}
+
+func (r *AnthropicResponse) wellFormed() bool {
+	return r.Content != nil
+}
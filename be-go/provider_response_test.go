@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestMalformedProviderResponse(t *testing.T) {
+	for _, body := range []string{
+		`<html>Bad gateway</html>`,
+		`{"error":{"message":"quota exceeded for jane@example.com"}}`,
+	} {
+		logs := captureLogs(t, slog.LevelDebug)
+		var result GeminiResponse
+		err := decodeProviderResponse("Gemini", strings.NewReader(body), &result)
+		if !errors.Is(err, errMalformedResponse) {
+			t.Errorf("decoding %s: err = %v, want errMalformedResponse", body, err)
+		}
+		if !strings.Contains(logs.String(), "Unparseable provider response") {
+			t.Errorf("no debug log for %s", body)
+		}
+		if strings.Contains(logs.String(), "jane@example.com") {
+			t.Errorf("logged body was not redacted: %s", logs)
+		}
+	}
+}
+
+func TestEmptyProviderResponseIsNotMalformed(t *testing.T) {
+	fakeGeminiAPI(t, `{"candidates":[],"promptFeedback":{"blockReason":"SAFETY"}}`)
+	_, err := callGeminiAPI(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}})
+	if !errors.Is(err, errContentBlocked) || errors.Is(err, errMalformedResponse) {
+		t.Fatalf("blocked prompt: err = %v, want errContentBlocked", err)
+	}
+
+	fakeGeminiAPI(t, `{"candidates":[{"content":{"role":"model","parts":[]},"finishReason":"STOP"}]}`)
+	_, err = callGeminiAPI(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}})
+	if !errors.Is(err, errEmptyResponse) || errors.Is(err, errMalformedResponse) {
+		t.Fatalf("empty candidate: err = %v, want errEmptyResponse", err)
+	}
+
+	fakeGeminiAPI(t, `{"unexpected":true}`)
+	_, err = callGeminiAPI(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}})
+	if !errors.Is(err, errMalformedResponse) {
+		t.Fatalf("changed schema: err = %v, want errMalformedResponse", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// providerTransport carries every provider call. It goes through
+// PROVIDER_PROXY_URL when set, and otherwise honors the usual HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY variables, so egress can be routed through a proxy
+// for provider calls alone.
+var providerTransport = newProviderTransport(os.Getenv("PROVIDER_PROXY_URL"))
+
+// Provider connections negotiate at least PROVIDER_TLS_MIN_VERSION (1.0 to
+// 1.3, default 1.2). Connecting and the TLS handshake have their own limits,
+// PROVIDER_CONNECT_TIMEOUT and PROVIDER_TLS_HANDSHAKE_TIMEOUT, so a slow one
+// fails fast instead of using up the request timeout.
+var (
+	providerTLSMinVersion       = loadTLSMinVersion()
+	providerConnectTimeout      = envDuration("PROVIDER_CONNECT_TIMEOUT", 10*time.Second)
+	providerTLSHandshakeTimeout = envDuration("PROVIDER_TLS_HANDSHAKE_TIMEOUT", 10*time.Second)
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func loadTLSMinVersion() uint16 {
+	value := os.Getenv("PROVIDER_TLS_MIN_VERSION")
+	if value == "" {
+		return tls.VersionTLS12
+	}
+	version, ok := tlsVersions[value]
+	if !ok {
+		warnConfig("Ignoring invalid PROVIDER_TLS_MIN_VERSION, using 1.2", "value", value)
+		return tls.VersionTLS12
+	}
+	return version
+}
+
+func newProviderTransport(proxyURL string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.DialContext = (&net.Dialer{Timeout: providerConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = providerTLSHandshakeTimeout
+	transport.TLSClientConfig = &tls.Config{MinVersion: providerTLSMinVersion}
+	if proxyURL == "" {
+		return transport
+	}
+	// The URL may hold proxy credentials, so it is never logged.
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Host == "" {
+		warnConfig("Ignoring invalid PROVIDER_PROXY_URL")
+		return transport
+	}
+	transport.Proxy = http.ProxyURL(u)
+	return transport
+}
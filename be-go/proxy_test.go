@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// stubProxy records the CONNECT targets it is asked for and refuses them.
+func stubProxy(t *testing.T) (*httptest.Server, *[]string) {
+	t.Helper()
+	var targets []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			targets = append(targets, r.Host)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &targets
+}
+
+func TestProviderCallsUseProxyURL(t *testing.T) {
+	proxy, targets := stubProxy(t)
+	setVar(t, &claudeAPIKey, "test-key")
+	setVar(t, &providerTransport, newProviderTransport(proxy.URL))
+
+	_, err := callClaudeAPI(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}})
+	if err == nil {
+		t.Fatal("call succeeded, want the refused proxy tunnel to fail it")
+	}
+	if len(*targets) != 1 || (*targets)[0] != "api.anthropic.com:443" {
+		t.Fatalf("proxy CONNECT targets = %v, want api.anthropic.com:443", *targets)
+	}
+}
+
+// proxyName is the proxy URL a request goes through, empty when it goes
+// direct.
+func proxyName(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.String()
+}
+
+func TestProviderTransportProxy(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://api.anthropic.com/v1/messages", nil)
+	envProxy, _ := http.ProxyFromEnvironment(req)
+
+	tests := []struct {
+		name     string
+		proxyURL string
+		want     string
+	}{
+		{"configured", "http://proxy.internal:3128", "http://proxy.internal:3128"},
+		{"invalid falls back to env", "://bad", proxyName(envProxy)},
+		{"unset uses env", "", proxyName(envProxy)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newProviderTransport(tt.proxyURL).Proxy(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if proxyName(got) != tt.want {
+				t.Fatalf("proxy = %q, want %q", proxyName(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestProviderTransportTLSMinVersion(t *testing.T) {
+	setVar(t, &loggingReady, false)
+	for value, want := range map[string]uint16{"": tls.VersionTLS12, "1.3": tls.VersionTLS13, "1.0": tls.VersionTLS10, "1.4": tls.VersionTLS12} {
+		t.Setenv("PROVIDER_TLS_MIN_VERSION", value)
+		setVar(t, &providerTLSMinVersion, loadTLSMinVersion())
+		if got := newProviderTransport("").TLSClientConfig.MinVersion; got != want {
+			t.Errorf("PROVIDER_TLS_MIN_VERSION=%q: MinVersion = %x, want %x", value, got, want)
+		}
+	}
+}
+
+func TestProviderTransportTimeouts(t *testing.T) {
+	setVar(t, &providerTLSHandshakeTimeout, 3*time.Second)
+	if got := newProviderTransport("").TLSHandshakeTimeout; got != 3*time.Second {
+		t.Errorf("TLSHandshakeTimeout = %v, want PROVIDER_TLS_HANDSHAKE_TIMEOUT", got)
+	}
+
+	// A server that accepts connections but never answers the handshake
+	// fails the request after the handshake timeout, whatever the client's
+	// overall timeout.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	setVar(t, &providerTLSHandshakeTimeout, 50*time.Millisecond)
+	transport := newProviderTransport("")
+	transport.Proxy = nil
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+	start := time.Now()
+	if _, err := client.Get("https://" + ln.Addr().String()); err == nil {
+		t.Fatal("request succeeded without a handshake")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request failed after %v, want the handshake timeout", elapsed)
+	}
+}
+
+func TestProviderTransportRefusesOldTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	for _, tt := range []struct {
+		min    uint16
+		wantOK bool
+	}{
+		{tls.VersionTLS12, true},
+		{tls.VersionTLS13, false},
+	} {
+		setVar(t, &providerTLSMinVersion, tt.min)
+		transport := newProviderTransport("")
+		transport.Proxy = nil
+		transport.TLSClientConfig.RootCAs = roots
+		resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tt.wantOK {
+			t.Errorf("MinVersion %x against a TLS 1.2 server: err = %v, want success %v", tt.min, err, tt.wantOK)
+		}
+	}
+}
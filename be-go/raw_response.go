@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rawAuditTTL keeps the raw provider responses of /chat?raw=1 requests under
+// audit:raw:<sessionId>:<time> for auditors, with a retention of its own.
+// 0 (the default) only returns them.
+var rawAuditTTL = envDuration("RAW_AUDIT_TTL", 0)
+
+// rawResponses collects the verbatim provider response bodies read under a
+// context.
+type rawResponses struct {
+	mu       sync.Mutex
+	recorded []json.RawMessage
+}
+
+type rawResponsesKey struct{}
+
+// withRawResponses returns a context whose provider response bodies are
+// recorded in the returned rawResponses.
+func withRawResponses(parent context.Context) (context.Context, *rawResponses) {
+	raw := &rawResponses{}
+	return context.WithValue(parent, rawResponsesKey{}, raw), raw
+}
+
+// rawCapture records what is read from a provider response body when it is
+// closed.
+type rawCapture struct {
+	io.ReadCloser
+	buf bytes.Buffer
+	raw *rawResponses
+}
+
+func (c *rawCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.buf.Write(p[:n])
+	return n, err
+}
+
+func (c *rawCapture) Close() error {
+	c.raw.record(c.buf.Bytes())
+	return c.ReadCloser.Close()
+}
+
+// captureRawResponse makes resp record its body if ctx asks for it.
+func captureRawResponse(ctx context.Context, resp *http.Response) {
+	if raw, ok := ctx.Value(rawResponsesKey{}).(*rawResponses); ok {
+		resp.Body = &rawCapture{ReadCloser: resp.Body, raw: raw}
+	}
+}
+
+// record stores a body with any configured provider key redacted. Bodies
+// that are not JSON are kept as a JSON string.
+func (r *rawResponses) record(body []byte) {
+	text := string(body)
+	for _, key := range []string{geminiAPIKey, llamaAPIKey, claudeAPIKey, chatGPTAPIKey, mistralAPIKey} {
+		if key != "" {
+			text = strings.ReplaceAll(text, key, "REDACTED")
+		}
+	}
+	recorded := json.RawMessage(text)
+	if !json.Valid(recorded) {
+		recorded, _ = json.Marshal(text)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recorded = append(r.recorded, recorded)
+}
+
+// bodies returns the recorded response bodies.
+func (r *rawResponses) bodies() []json.RawMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]json.RawMessage{}, r.recorded...)
+}
+
+// archive stores the recorded bodies under an audit key when RAW_AUDIT_TTL
+// is set. Failures are only logged.
+func (r *rawResponses) archive(sessionId, modelName string) {
+	if rawAuditTTL <= 0 || redisClient == nil {
+		return
+	}
+	now := time.Now().UTC()
+	record, err := json.Marshal(map[string]interface{}{
+		"sessionId": sessionId,
+		"model":     modelName,
+		"time":      now,
+		"responses": r.bodies(),
+	})
+	if err != nil {
+		slog.Error("Error marshaling raw audit record", "error", err)
+		return
+	}
+	key := fmt.Sprintf("audit:raw:%s:%d", sessionId, now.UnixNano())
+	if err := redisClient.Set(ctx, key, record, rawAuditTTL).Err(); err != nil {
+		slog.Error("Error archiving raw provider responses", "sessionId", sessionId, "error", err)
+	}
+}
+
+// wantsRawResponse reports whether a /chat request asked for ?raw=1. Only
+// admins may see it; for anyone else it writes a 401 and ok is false.
+func wantsRawResponse(w http.ResponseWriter, r *http.Request) (raw bool, ok bool) {
+	switch r.URL.Query().Get("raw") {
+	case "", "0", "false":
+		return false, true
+	}
+	return true, requireAdmin(w, r)
+}
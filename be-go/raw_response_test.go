@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// claudeEchoingKey is a Claude reply whose body happens to hold the API key
+// fakeClaudeAPI configures.
+const claudeEchoingKey = `{"content":[{"type":"text","text":"Hello"}],"stop_reason":"end_turn","usage":{"input_tokens":3,"output_tokens":1},"debug":"key test-key"}`
+
+func rawChat(t *testing.T, target string, admin bool) *httptest.ResponseRecorder {
+	t.Helper()
+	r := newJSONRequest(t, "POST", target, map[string]interface{}{"sessionId": "raw-1", "modelName": "claude", "contents": userTurn("Hi")})
+	if admin {
+		withAdmin(t, r)
+	}
+	w := httptest.NewRecorder()
+	chatHandler(w, r)
+	return w
+}
+
+func TestRawProviderResponse(t *testing.T) {
+	setupRedis(t)
+	fakeClaudeAPI(t, claudeEchoingKey)
+
+	w := rawChat(t, "/chat?raw=1", true)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var resp ChatResponse
+	decodeBody(t, w, &resp)
+	if len(resp.ProviderResponse) != 1 {
+		t.Fatalf("providerResponse = %s, want the one provider body", resp.ProviderResponse)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(resp.ProviderResponse[0], &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["stop_reason"] != "end_turn" || body["debug"] != "key REDACTED" {
+		t.Errorf("providerResponse = %s, want the verbatim body with the key redacted", resp.ProviderResponse[0])
+	}
+
+	w = rawChat(t, "/chat", true)
+	if strings.Contains(w.Body.String(), "providerResponse") {
+		t.Errorf("body = %s, want no providerResponse without ?raw=1", w.Body)
+	}
+	if w := rawChat(t, "/chat?raw=1", false); w.Code != http.StatusUnauthorized {
+		t.Errorf("raw=1 without admin auth: status = %d, want 401", w.Code)
+	}
+}
+
+func TestRawProviderResponseArchived(t *testing.T) {
+	mr := setupRedis(t)
+	fakeClaudeAPI(t, claudeHello)
+	setVar(t, &rawAuditTTL, time.Hour)
+
+	if w := rawChat(t, "/chat?raw=1", true); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	keys := mr.Keys()
+	var archived []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, "audit:raw:raw-1:") {
+			archived = append(archived, key)
+		}
+	}
+	if len(archived) != 1 {
+		t.Fatalf("audit keys = %v, want one", archived)
+	}
+	if ttl := mr.TTL(archived[0]); ttl != time.Hour {
+		t.Errorf("audit TTL = %v, want RAW_AUDIT_TTL", ttl)
+	}
+	record, _ := mr.Get(archived[0])
+	if !strings.Contains(record, `"stop_reason":"end_turn"`) {
+		t.Errorf("audit record = %s, want the raw provider body", record)
+	}
+}
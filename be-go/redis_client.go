@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// Redis is configured with REDIS_ADDR, a host:port or, with
+// REDIS_CLUSTER=true, a comma-separated list of cluster nodes to discover the
+// cluster from. REDIS_DB selects the database of a single node; clusters only
+// have database 0.
+var redisCluster = os.Getenv("REDIS_CLUSTER") == "true"
+
+// redisOptions builds the client options from the environment. It returns
+// nil when REDIS_ADDR is unset.
+func redisOptions() *redis.UniversalOptions {
+	value := os.Getenv("REDIS_ADDR")
+	if value == "" {
+		return nil
+	}
+	var addrs []string
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	opts := &redis.UniversalOptions{
+		Addrs:    addrs,
+		Password: "", // No password set in our docker-compose for now
+		DB:       envInt("REDIS_DB", 0),
+	}
+	if redisCluster && opts.DB != 0 {
+		slog.Warn("Ignoring REDIS_DB, Redis Cluster only has database 0", "db", opts.DB)
+		opts.DB = 0
+	}
+	return opts
+}
+
+// newRedisClient returns a cluster client under REDIS_CLUSTER and a
+// single-node client otherwise.
+func newRedisClient(opts *redis.UniversalOptions) redis.UniversalClient {
+	if redisCluster {
+		return redis.NewClusterClient(opts.Cluster())
+	}
+	return redis.NewClient(opts.Simple())
+}
+
+// redisTxPipeline returns a MULTI/EXEC pipeline. A cluster can't run a
+// transaction over keys in different slots, so there it is a plain
+// pipeline: the commands are still sent together, but not atomically.
+func redisTxPipeline() redis.Pipeliner {
+	if redisCluster {
+		return redisClient.Pipeline()
+	}
+	return redisClient.TxPipeline()
+}
+
+// redisGetMany returns the values of keys like MGET, nil for missing ones. A
+// cluster rejects MGET across slots, so there the keys are read with one
+// pipelined GET each.
+func redisGetMany(keys ...string) ([]interface{}, error) {
+	if !redisCluster {
+		return redisClient.MGet(ctx, keys...).Result()
+	}
+	pipe := redisClient.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Get(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(keys))
+	for i, cmd := range cmds {
+		if cmd.Err() == nil {
+			values[i] = cmd.Val()
+		}
+	}
+	return values, nil
+}
+
+// clusterNodeShift places the index of the cluster master being scanned above
+// the node's own SCAN cursor in the cursors redisScan returns.
+const clusterNodeShift = 48
+
+// redisScan runs one SCAN step like Client.Scan. On a cluster, where SCAN
+// only sees the keys of one node, it walks every master in turn, the cursor
+// carrying which one it is on.
+func redisScan(cursor uint64, match string, count int64) ([]string, uint64, error) {
+	cluster, ok := redisClient.(*redis.ClusterClient)
+	if !ok {
+		return redisClient.Scan(ctx, cursor, match, count).Result()
+	}
+	masters, err := clusterMasters(cluster)
+	if err != nil {
+		return nil, 0, err
+	}
+	node, nodeCursor := int(cursor>>clusterNodeShift), cursor&(1<<clusterNodeShift-1)
+	if node >= len(masters) {
+		return nil, 0, fmt.Errorf("invalid cluster scan cursor %d", cursor)
+	}
+	keys, next, err := masters[node].Scan(ctx, nodeCursor, match, count).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	if next == 0 {
+		if node++; node == len(masters) {
+			return keys, 0, nil
+		}
+	}
+	return keys, uint64(node)<<clusterNodeShift | next, nil
+}
+
+// clusterMasters returns the clients of the cluster's masters, ordered by
+// address so scan cursors stay valid between calls.
+func clusterMasters(cluster *redis.ClusterClient) ([]*redis.Client, error) {
+	var mu sync.Mutex
+	var masters []*redis.Client
+	err := cluster.ForEachMaster(ctx, func(_ context.Context, client *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		masters = append(masters, client)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("redis error listing cluster masters: %w", err)
+	}
+	slices.SortFunc(masters, func(a, b *redis.Client) int { return strings.Compare(a.Options().Addr, b.Options().Addr) })
+	return masters, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+func TestRedisClusterOptions(t *testing.T) {
+	setVar(t, &redisCluster, true)
+	logs := captureLogs(t, slog.LevelWarn)
+	t.Setenv("REDIS_ADDR", "10.0.0.1:7000, 10.0.0.2:7000,,10.0.0.3:7000")
+	t.Setenv("REDIS_DB", "2")
+
+	opts := redisOptions()
+	cluster := opts.Cluster()
+	want := []string{"10.0.0.1:7000", "10.0.0.2:7000", "10.0.0.3:7000"}
+	if len(cluster.Addrs) != len(want) {
+		t.Fatalf("cluster addrs = %v, want %v", cluster.Addrs, want)
+	}
+	for i, addr := range want {
+		if cluster.Addrs[i] != addr {
+			t.Errorf("cluster addrs = %v, want %v", cluster.Addrs, want)
+		}
+	}
+	if opts.DB != 0 {
+		t.Errorf("cluster DB = %d, want REDIS_DB ignored", opts.DB)
+	}
+	if !strings.Contains(logs.String(), "Ignoring REDIS_DB") {
+		t.Errorf("logs = %q, want a warning for REDIS_DB", logs)
+	}
+
+	// Building the client doesn't connect, so no cluster is needed.
+	client := newRedisClient(opts)
+	defer client.Close()
+	if _, ok := client.(*redis.ClusterClient); !ok {
+		t.Fatalf("client is %T, want a cluster client", client)
+	}
+}
+
+func TestRedisSingleNodeOptions(t *testing.T) {
+	setVar(t, &redisCluster, false)
+	t.Setenv("REDIS_ADDR", "localhost:6379")
+	t.Setenv("REDIS_DB", "3")
+
+	opts := redisOptions().Simple()
+	if opts.Addr != "localhost:6379" || opts.DB != 3 {
+		t.Fatalf("options = addr %q db %d, want localhost:6379 db 3", opts.Addr, opts.DB)
+	}
+	client := newRedisClient(redisOptions())
+	defer client.Close()
+	if _, ok := client.(*redis.Client); !ok {
+		t.Fatalf("client is %T, want a single-node client", client)
+	}
+
+	t.Setenv("REDIS_ADDR", "")
+	if redisOptions() != nil {
+		t.Error("options without REDIS_ADDR, want stateless mode")
+	}
+}
+
+func TestClusterModeHelpers(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &redisCluster, true)
+	mr.Set("a", "1")
+	mr.Set("c", "3")
+
+	values, err := redisGetMany("a", "b", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || values[0] != "1" || values[1] != nil || values[2] != "3" {
+		t.Fatalf("values = %v, want [1 <nil> 3]", values)
+	}
+}
+
+func TestDeleteSessionRemovesEveryKey(t *testing.T) {
+	for _, cluster := range []bool{false, true} {
+		mr := setupRedis(t)
+		setVar(t, &redisCluster, cluster)
+		mr.Set(historyKey("doomed"), "[]")
+		mr.Set("doomed", "[]")
+		mr.Set(sessionMetaKey("doomed"), "{}")
+		mr.ZAdd(ownerSessionsKey("alice"), 1, "doomed")
+
+		if err := deleteSession("alice", "doomed"); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{historyKey("doomed"), "doomed", sessionMetaKey("doomed")} {
+			if mr.Exists(key) {
+				t.Errorf("cluster %v: %s left after delete", cluster, key)
+			}
+		}
+		if members, _ := mr.ZMembers(ownerSessionsKey("alice")); len(members) != 0 {
+			t.Errorf("cluster %v: owner set = %v, want the session removed", cluster, members)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// responseCacheTTL caches the replies to stateless /chat requests in Redis
+// for that long, and coalesces identical requests arriving while the first
+// is still waiting on the provider. 0 (the default) disables both.
+var responseCacheTTL = envDuration("RESPONSE_CACHE_TTL", 0)
+
+// cachedResponse is a cached provider reply.
+type cachedResponse struct {
+	Text         string     `json:"text"`
+	Choices      []string   `json:"choices"`
+	Citations    []string   `json:"citations,omitempty"`
+	ToolCalls    []ToolCall `json:"toolCalls,omitempty"`
+	FinishReason string     `json:"finishReason,omitempty"`
+}
+
+func (c cachedResponse) providerResponse() ProviderResponse {
+	return ProviderResponse{Text: c.Text, Choices: c.Choices, Citations: c.Citations, ToolCalls: c.ToolCalls}
+}
+
+// inflightCall is a provider call that identical requests wait on.
+type inflightCall struct {
+	done     chan struct{}
+	response cachedResponse
+	err      error
+}
+
+var (
+	inflightMu    sync.Mutex
+	inflightCalls = map[string]*inflightCall{}
+)
+
+// responseCacheKey identifies a provider request for the cache. Differences
+// that can't change the reply are normalized away: surrounding whitespace in
+// messages, role casing, the order of safety settings, and the fields that
+// are only passed through, such as message IDs, timestamps and user metadata.
+func responseCacheKey(modelName string, req ProviderRequest) string {
+	messages := make([]Message, len(req.Messages))
+	for i, m := range req.Messages {
+		messages[i] = Message{Role: strings.ToLower(strings.TrimSpace(m.Role)), Text: strings.TrimSpace(m.Text)}
+	}
+	req.Messages = messages
+	req.UserID, req.Metadata = "", nil
+	req.SafetySettings = slices.Clone(req.SafetySettings)
+	slices.SortFunc(req.SafetySettings, func(a, b GeminiSafetySetting) int { return strings.Compare(a.Category, b.Category) })
+
+	key, _ := json.Marshal(struct {
+		Model string
+		ProviderRequest
+	}{modelName, req})
+	sum := sha256.Sum256(key)
+	return "response-cache:" + hex.EncodeToString(sum[:])
+}
+
+// cachedCall answers req from the response cache when RESPONSE_CACHE_TTL is
+// set, otherwise making the call and caching a successful reply. A request
+// identical to one in flight waits for its outcome instead of calling the
+// provider again. cached reports whether the reply came from another call.
+func cachedCall(ctx context.Context, modelName string, call chatFunc, req ProviderRequest) (_ ProviderResponse, cached bool, _ error) {
+	if responseCacheTTL <= 0 || redisClient == nil {
+		resp, err := call(ctx, req)
+		return resp, false, err
+	}
+	key := responseCacheKey(modelName, req)
+
+	if value, err := redisClient.Get(ctx, key).Result(); err == nil {
+		var hit cachedResponse
+		if err := json.Unmarshal([]byte(value), &hit); err == nil {
+			recordFinishReason(ctx, hit.FinishReason)
+			return hit.providerResponse(), true, nil
+		}
+		slog.Warn("Ignoring unreadable cached response", "key", key)
+	} else if err != redis.Nil {
+		slog.Warn("Error reading response cache", "error", err)
+	}
+
+	inflightMu.Lock()
+	if inflight, ok := inflightCalls[key]; ok {
+		inflightMu.Unlock()
+		select {
+		case <-inflight.done:
+		case <-ctx.Done():
+			return ProviderResponse{}, false, ctx.Err()
+		}
+		if inflight.err != nil {
+			return ProviderResponse{}, false, inflight.err
+		}
+		recordFinishReason(ctx, inflight.response.FinishReason)
+		return inflight.response.providerResponse(), true, nil
+	}
+	inflight := &inflightCall{done: make(chan struct{})}
+	inflightCalls[key] = inflight
+	inflightMu.Unlock()
+
+	defer func() {
+		inflightMu.Lock()
+		delete(inflightCalls, key)
+		inflightMu.Unlock()
+		close(inflight.done)
+	}()
+
+	callCtx, finish := withFinishReason(ctx)
+	resp, err := call(callCtx, req)
+	recordFinishReason(ctx, finish.reason)
+	if err != nil {
+		inflight.err = err
+		return resp, false, err
+	}
+	inflight.response = cachedResponse{Text: resp.Text, Choices: resp.Choices, Citations: resp.Citations, ToolCalls: resp.ToolCalls, FinishReason: finish.reason}
+
+	value, err := json.Marshal(inflight.response)
+	if err == nil {
+		err = redisClient.Set(ctx, key, value, responseCacheTTL).Err()
+	}
+	if err != nil {
+		slog.Warn("Error caching response", "error", err)
+	}
+	return resp, false, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheKeyNormalizes(t *testing.T) {
+	base := ProviderRequest{Messages: []Message{{Role: "system", Text: "Be brief."}, {Role: "user", Text: "Capital of France?"}}}
+	key := responseCacheKey("gemini", base)
+
+	same := []ProviderRequest{
+		{Messages: []Message{{Role: "system", Text: "Be brief."}, {Role: "user", Text: "Capital of France?  \n"}}},
+		{Messages: []Message{{Role: "System", Text: " Be brief."}, {Role: "user", Text: "Capital of France?"}}},
+		{Messages: []Message{{Role: "system", Text: "Be brief.", ID: "m1", CreatedAt: time.Now()}, {Role: "user", Text: "Capital of France?"}}, UserID: "user-1", Metadata: map[string]string{"plan": "pro"}},
+	}
+	for i, req := range same {
+		if got := responseCacheKey("gemini", req); got != key {
+			t.Errorf("request %d got key %s, want the same key %s", i, got, key)
+		}
+	}
+
+	different := []struct {
+		model string
+		req   ProviderRequest
+	}{
+		{"gemini", ProviderRequest{Messages: []Message{{Role: "system", Text: "Be brief."}, {Role: "user", Text: "Capital of Spain?"}}}},
+		{"claude", base},
+	}
+	for i, d := range different {
+		if got := responseCacheKey(d.model, d.req); got == key {
+			t.Errorf("different request %d shares the key", i)
+		}
+	}
+}
+
+func TestResponseCacheHitsAcrossWhitespace(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &responseCacheTTL, time.Minute)
+	calls := countingReply(t, "gemini")
+
+	for _, text := range []string{"Capital of France?", "Capital of France?   "} {
+		resp := chatTurn(t, map[string]interface{}{"sessionId": "cache-1", "modelName": "gemini", "persist": false, "contents": userTurn(text)})
+		if resp.Text == "" {
+			t.Fatal("empty reply")
+		}
+	}
+	if *calls != 1 {
+		t.Errorf("provider calls = %d, want the second request served from the cache", *calls)
+	}
+	found := false
+	for _, key := range mr.Keys() {
+		if !strings.HasPrefix(key, "response-cache:") {
+			continue
+		}
+		found = true
+		if mr.TTL(key) != time.Minute {
+			t.Errorf("cache TTL = %v, want RESPONSE_CACHE_TTL", mr.TTL(key))
+		}
+	}
+	if !found {
+		t.Error("no response-cache key stored")
+	}
+}
+
+func TestResponseCacheCoalescesInflightCalls(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &responseCacheTTL, time.Minute)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := 0
+	call := func(context.Context, ProviderRequest) (ProviderResponse, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return ProviderResponse{Text: "Paris", Choices: []string{"Paris"}}, nil
+	}
+	req := ProviderRequest{Messages: []Message{{Role: "user", Text: "Capital of France?"}}}
+
+	var wg sync.WaitGroup
+	cached := make([]bool, 3)
+	for i := range cached {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, hit, err := cachedCall(context.Background(), "gemini", call, req)
+			if err != nil || resp.Text != "Paris" {
+				t.Errorf("call %d = %+v, %v", i, resp, err)
+			}
+			cached[i] = hit
+		}()
+	}
+	// Give the waiting calls time to find the one in flight.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("provider calls = %d, want identical requests coalesced", calls)
+	}
+	hits := 0
+	for _, hit := range cached {
+		if hit {
+			hits++
+		}
+	}
+	if hits != 2 {
+		t.Errorf("cached replies = %d, want 2", hits)
+	}
+}
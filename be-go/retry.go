@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An overloaded provider (Anthropic's 529, a 503, or an "overloaded_error"
+// body) is retried up to overloadRetries times, waiting overloadBackoff,
+// then twice that, and so on. Each retry draws from the attempt budget.
+var (
+	overloadRetries = envInt("OVERLOAD_RETRIES", 2)
+	overloadBackoff = envDuration("OVERLOAD_BACKOFF", 500*time.Millisecond)
+)
+
+// An empty answer that was not blocked is re-rolled up to emptyResponseRetries
+// times before it fails the request. Off by default; blocked answers are never
+// retried since the filter would block them again.
+var emptyResponseRetries = envInt("EMPTY_RESPONSE_RETRIES", 0)
+
+// statusOverloaded is Anthropic's non-standard "overloaded" status.
+const statusOverloaded = 529
+
+// errProviderOverloaded marks a provider refusing work because it is out of
+// capacity. It is transient and retried.
+var errProviderOverloaded = errors.New("provider is overloaded")
+
+// errProviderRateLimited marks a 429: our own quota is used up, so retrying
+// right away does not help and it is not retried.
+var errProviderRateLimited = errors.New("provider rate limit exceeded")
+
+// providerStatusError is a non-200 provider answer.
+type providerStatusError struct {
+	Status int
+	Body   string
+}
+
+func (e *providerStatusError) Error() string {
+	return fmt.Sprintf("API returned status code %d: %s", e.Status, e.Body)
+}
+
+// statusError describes a non-200 provider answer, wrapping
+// errProviderOverloaded or errProviderRateLimited where they apply.
+func statusError(status int, body []byte) error {
+	err := &providerStatusError{Status: status, Body: string(body)}
+	switch {
+	case status == statusOverloaded || status == http.StatusServiceUnavailable || bytes.Contains(body, []byte(`"overloaded_error"`)):
+		return fmt.Errorf("%w: %w", errProviderOverloaded, err)
+	case status == http.StatusTooManyRequests:
+		return fmt.Errorf("%w: %w", errProviderRateLimited, err)
+	}
+	return err
+}
+
+// sendProviderRequest POSTs a JSON payload with the given headers and returns
+// the response if the provider answered 200, retrying while it is overloaded.
+// The caller closes the body.
+func sendProviderRequest(ctx context.Context, client *http.Client, url string, headers map[string]string, payload []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		if budgetErr := consumeAttempt(ctx); budgetErr != nil {
+			return nil, budgetErr
+		}
+		recordPayload(ctx, url, headers, payload)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("error making API request: %w", err)
+		}
+		if resp.StatusCode == http.StatusOK {
+			captureRawResponse(ctx, resp)
+			return resp, nil
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		err = statusError(resp.StatusCode, respBody)
+		if !errors.Is(err, errProviderOverloaded) {
+			return nil, err
+		}
+		if attempt >= overloadRetries {
+			return nil, fmt.Errorf("gave up after %d attempts: %w", attempt+1, err)
+		}
+
+		delay := overloadBackoff << attempt
+		slog.Warn("Provider overloaded, retrying", "url", redactURL(url), "attempt", attempt+1, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// withEmptyRetry wraps a provider call so that an empty, unblocked answer is
+// retried up to emptyResponseRetries times.
+func withEmptyRetry(modelName string, call chatFunc) chatFunc {
+	return func(ctx context.Context, req ProviderRequest) (ProviderResponse, error) {
+		result, err := call(ctx, req)
+		for attempt := 0; attempt < emptyResponseRetries && errors.Is(err, errEmptyResponse); attempt++ {
+			slog.Warn("Provider returned an empty response, retrying", "model", modelName, "attempt", attempt+1)
+			result, err = call(ctx, req)
+		}
+		return result, err
+	}
+}
+
+// withStreamEmptyRetry is withEmptyRetry for streamed calls. An empty stream
+// emitted no deltas, so nothing is sent twice.
+func withStreamEmptyRetry(modelName string, stream streamFunc) streamFunc {
+	return func(ctx context.Context, req ProviderRequest, onDelta func(string) error) (string, error) {
+		text, err := stream(ctx, req, onDelta)
+		for attempt := 0; attempt < emptyResponseRetries && errors.Is(err, errEmptyResponse); attempt++ {
+			slog.Warn("Provider returned an empty stream, retrying", "model", modelName, "attempt", attempt+1)
+			text, err = stream(ctx, req, onDelta)
+		}
+		return text, err
+	}
+}
+
+// redactURL strips the query string, which may carry an API key (Gemini's
+// ?key=), before a URL is logged.
+func redactURL(url string) string {
+	base, _, _ := strings.Cut(url, "?")
+	return base
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyClaudeAPI answers the first len(statuses) Claude calls with those
+// statuses and later ones with claudeHello. It returns the call count.
+func flakyClaudeAPI(t *testing.T, statuses ...int) *int {
+	t.Helper()
+	setVar(t, &claudeAPIKey, "test-key")
+	setVar(t, &overloadBackoff, time.Millisecond)
+	calls := 0
+	fakeProviderAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= len(statuses) {
+			errorType := "overloaded_error"
+			if statuses[calls-1] == http.StatusTooManyRequests {
+				errorType = "rate_limit_error"
+			}
+			w.WriteHeader(statuses[calls-1])
+			fmt.Fprintf(w, `{"type":"error","error":{"type":%q}}`, errorType)
+			return
+		}
+		io.WriteString(w, claudeHello)
+	})
+	return &calls
+}
+
+func TestOverloadedProviderRecovers(t *testing.T) {
+	setVar(t, &overloadRetries, 2)
+	calls := flakyClaudeAPI(t, statusOverloaded)
+
+	resp, err := callClaudeAPI(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}})
+	if err != nil || resp.Text != "Hello" {
+		t.Fatalf("call = %+v, %v; want the reply after a retry", resp, err)
+	}
+	if *calls != 2 {
+		t.Errorf("provider called %d times, want 2", *calls)
+	}
+}
+
+func TestOverloadRetriesExhausted(t *testing.T) {
+	setVar(t, &overloadRetries, 1)
+	calls := flakyClaudeAPI(t, statusOverloaded, statusOverloaded, statusOverloaded)
+
+	_, err := callClaudeAPI(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}})
+	if !errors.Is(err, errProviderOverloaded) {
+		t.Fatalf("err = %v, want errProviderOverloaded", err)
+	}
+	if !strings.Contains(err.Error(), "gave up after 2 attempts") {
+		t.Errorf("err = %q, want it to say the retries were exhausted", err)
+	}
+	if *calls != 2 {
+		t.Errorf("provider called %d times, want 2", *calls)
+	}
+	if status, code := providerErrorCode(err); status != http.StatusServiceUnavailable || code == "" {
+		t.Errorf("error maps to %d %q, want a 503", status, code)
+	}
+}
+
+func TestRateLimitIsNotRetried(t *testing.T) {
+	setVar(t, &overloadRetries, 2)
+	calls := flakyClaudeAPI(t, http.StatusTooManyRequests)
+
+	_, err := callClaudeAPI(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}})
+	if !errors.Is(err, errProviderRateLimited) || errors.Is(err, errProviderOverloaded) {
+		t.Fatalf("err = %v, want errProviderRateLimited", err)
+	}
+	if *calls != 1 {
+		t.Errorf("provider called %d times, want 1", *calls)
+	}
+}
+
+// scriptedGeminiAPI answers Gemini calls with the given bodies in turn,
+// repeating the last one. It returns the call count.
+func scriptedGeminiAPI(t *testing.T, bodies ...string) *int {
+	t.Helper()
+	setVar(t, &geminiAPIKey, "test-key")
+	calls := 0
+	fakeProviderAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		body := bodies[min(calls, len(bodies)-1)]
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	})
+	return &calls
+}
+
+const (
+	geminiEmpty   = `{"candidates":[{"content":{"role":"model","parts":[]},"finishReason":"STOP"}]}`
+	geminiBlocked = `{"candidates":[],"promptFeedback":{"blockReason":"SAFETY"}}`
+)
+
+func TestEmptyResponseRetried(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &emptyResponseRetries, 2)
+	calls := scriptedGeminiAPI(t, geminiEmpty, geminiHello)
+
+	resp := chatTurn(t, map[string]interface{}{"sessionId": "empty-1", "modelName": "gemini", "contents": userTurn("Hi")})
+	if resp.Text == "" {
+		t.Fatal("reply is empty, want the re-rolled answer")
+	}
+	if *calls != 2 {
+		t.Errorf("provider called %d times, want 2", *calls)
+	}
+}
+
+func TestEmptyResponseRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries int
+		body    string
+		want    error
+		calls   int
+	}{
+		{"disabled", 0, geminiEmpty, errEmptyResponse, 1},
+		{"exhausted", 2, geminiEmpty, errEmptyResponse, 3},
+		{"blocked", 2, geminiBlocked, errContentBlocked, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setVar(t, &emptyResponseRetries, tt.retries)
+			calls := scriptedGeminiAPI(t, tt.body)
+
+			_, err := withEmptyRetry("gemini", callGeminiAPI)(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if *calls != tt.calls {
+				t.Errorf("provider called %d times, want %d", *calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestEmptyStreamRetried(t *testing.T) {
+	setVar(t, &emptyResponseRetries, 1)
+	calls := 0
+	stream := withStreamEmptyRetry("gemini", func(_ context.Context, _ ProviderRequest, onDelta func(string) error) (string, error) {
+		calls++
+		if calls == 1 {
+			return "", fmt.Errorf("gemini: %w", errEmptyResponse)
+		}
+		return "Hello", onDelta("Hello")
+	})
+
+	var deltas []string
+	text, err := stream(context.Background(), ProviderRequest{}, func(d string) error {
+		deltas = append(deltas, d)
+		return nil
+	})
+	if err != nil || text != "Hello" || len(deltas) != 1 {
+		t.Fatalf("stream = %q, %v with deltas %q; want Hello once", text, err, deltas)
+	}
+}
+
+// scriptedMistralStream returns a Mistral provider whose streaming endpoint
+// answers successive calls with bodies, repeating the last one, and the call
+// count.
+func scriptedMistralStream(t *testing.T, bodies ...string) (*OpenAICompatibleProvider, *int) {
+	t.Helper()
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := bodies[min(calls, len(bodies)-1)]
+		calls++
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	mistral := *mistralProvider
+	mistral.URL = srv.URL
+	mistral.APIKey = "mistral-key"
+	return &mistral, &calls
+}
+
+const (
+	openaiEmptyStream = "data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n"
+	openaiHelloStream = "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\ndata: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n"
+)
+
+func TestEmptyOpenAIStyleStreamRetried(t *testing.T) {
+	setVar(t, &emptyResponseRetries, 1)
+	mistral, calls := scriptedMistralStream(t, openaiEmptyStream, openaiHelloStream)
+
+	var deltas []string
+	text, err := withStreamEmptyRetry("mistral", mistral.Stream)(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}}, func(d string) error {
+		deltas = append(deltas, d)
+		return nil
+	})
+	if err != nil || text != "Hello" || strings.Join(deltas, "") != "Hello" {
+		t.Fatalf("stream = %q, %v with deltas %q; want Hello", text, err, deltas)
+	}
+	if *calls != 2 {
+		t.Errorf("calls = %d, want the empty stream retried once", *calls)
+	}
+}
+
+func TestFilteredOpenAIStyleStreamNotRetried(t *testing.T) {
+	setVar(t, &emptyResponseRetries, 2)
+	mistral, calls := scriptedMistralStream(t, "data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"content_filter\"}]}\n\ndata: [DONE]\n\n")
+
+	_, err := withStreamEmptyRetry("mistral", mistral.Stream)(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}}, func(string) error { return nil })
+	if !errors.Is(err, errContentBlocked) {
+		t.Fatalf("err = %v, want %v", err, errContentBlocked)
+	}
+	if *calls != 1 {
+		t.Errorf("calls = %d, want a blocked stream not retried", *calls)
+	}
+}
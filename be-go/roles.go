@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// roleAliases maps role spellings found in older histories (provider roles
+// written back by mistake, and the "asssitant" typo an earlier Claude mapper
+// produced) and the "function" role of older tool-calling clients onto the
+// internal roles. More can be added with ROLE_ALIASES as
+// comma-separated alias=role pairs, e.g. ROLE_ALIASES=bot=ai,human=user.
+var roleAliases = loadRoleAliases()
+
+func loadRoleAliases() map[string]string {
+	aliases := map[string]string{
+		"model":     "ai",
+		"assistant": "ai",
+		"asssitant": "ai",
+		"function":  "tool",
+	}
+	value := os.Getenv("ROLE_ALIASES")
+	if value == "" {
+		return aliases
+	}
+	for _, pair := range strings.Split(value, ",") {
+		alias, role, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		switch role {
+		case "user", "ai", "system", "tool":
+			aliases[strings.ToLower(alias)] = role
+		default:
+			warnConfig("Ignoring invalid ROLE_ALIASES entry", "entry", pair)
+		}
+	}
+	return aliases
+}
+
+// normalizeRole returns the internal role for a stored role spelling. The
+// internal roles themselves and unknown spellings are returned unchanged, so
+// normalizing twice is the same as normalizing once.
+func normalizeRole(role string) string {
+	switch role {
+	case "user", "ai", "system", "tool":
+		return role
+	}
+	if canonical, ok := roleAliases[strings.ToLower(strings.TrimSpace(role))]; ok {
+		return canonical
+	}
+	return role
+}
+
+// normalizeRoles rewrites the roles of history in place and reports whether
+// any changed.
+func normalizeRoles(history []Message) bool {
+	changed := false
+	for i := range history {
+		if role := normalizeRole(history[i].Role); role != history[i].Role {
+			history[i].Role = role
+			changed = true
+		}
+	}
+	return changed
+}
+
+// toolResultText renders a tool message as plain text, for providers without
+// a tool role.
+func toolResultText(m Message) string {
+	name := m.ToolName
+	if name == "" {
+		name = m.ToolCallID
+	}
+	return "Result of tool call " + name + ":\n" + m.Text
+}
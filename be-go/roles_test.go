@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestLegacyRolesNormalizedOnLoad(t *testing.T) {
+	mr := setupRedis(t)
+	mr.Set(historyKey("roles-1"), `[
+		{"role":"system","text":"Be brief."},
+		{"role":"user","text":"Hi"},
+		{"role":"asssitant","text":"Hello"},
+		{"role":"user","text":"Again"},
+		{"role":"model","text":"Hi again"},
+		{"role":"user","text":"Once more"},
+		{"role":"Assistant","text":"Sure"},
+		{"role":"function","text":"42","toolName":"answer"}
+	]`)
+
+	history := storedHistory(t, "roles-1")
+	want := []string{"system", "user", "ai", "user", "ai", "user", "ai", "tool"}
+	if len(history) != len(want) {
+		t.Fatalf("history has %d messages, want %d", len(history), len(want))
+	}
+	for i, m := range history {
+		if m.Role != want[i] {
+			t.Errorf("message %d role = %q, want %q", i, m.Role, want[i])
+		}
+	}
+}
+
+func TestNormalizeRolesIdempotent(t *testing.T) {
+	history := []Message{{Role: "asssitant"}, {Role: "user"}, {Role: "narrator"}}
+	if !normalizeRoles(history) {
+		t.Fatal("normalizeRoles reported no change")
+	}
+	if normalizeRoles(history) {
+		t.Error("second pass changed roles again")
+	}
+	if history[0].Role != "ai" || history[2].Role != "narrator" {
+		t.Errorf("roles = %q, %q; want ai and the unknown role unchanged", history[0].Role, history[2].Role)
+	}
+}
+
+func TestRoleAliasesFromEnv(t *testing.T) {
+	t.Setenv("ROLE_ALIASES", "bot=ai, Human=user, x=wizard")
+	aliases := loadRoleAliases()
+	if aliases["bot"] != "ai" || aliases["human"] != "user" || aliases["asssitant"] != "ai" {
+		t.Errorf("aliases = %v", aliases)
+	}
+	if _, ok := aliases["x"]; ok {
+		t.Error("alias to an unknown role was accepted")
+	}
+}
+
+func TestHistoryEndpointNormalizesRolesLikeChat(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &hideSystemInHistory, false)
+	legacy := `[
+		{"role":"system","text":"Be brief."},
+		{"role":"user","text":"Hi"},
+		{"role":"assistant","text":"Hello"},
+		{"role":"model","text":"Hi again"}
+	]`
+	mr.Set(historyKey("roles-view"), legacy)
+	mr.Set(historyKey("roles-chat"), legacy)
+
+	var served []Message
+	decodeBody(t, getHistory(t, "roles-view", ""), &served)
+
+	requests := recordRequests(t, "gemini", "Fine")
+	chatTurn(t, map[string]interface{}{"sessionId": "roles-chat", "modelName": "gemini", "contents": userTurn("How are you?")})
+	sent := (*requests)[0].Messages
+
+	if len(served) != 4 || len(sent) < 4 {
+		t.Fatalf("served %d and sent %d messages, want 4 and at least 4", len(served), len(sent))
+	}
+	for i, m := range served {
+		if m.Role != sent[i].Role {
+			t.Errorf("message %d: history role %q, chat role %q", i, m.Role, sent[i].Role)
+		}
+	}
+	if served[2].Role != "ai" || served[3].Role != "ai" {
+		t.Errorf("history roles = %q, %q; want ai", served[2].Role, served[3].Role)
+	}
+}
+
+// storeToolTurn stores a turn whose AI message calls the weather tool, then
+// sends the tool's result through /chat, and returns the stored history.
+func storeToolTurn(t *testing.T, sessionId string) []Message {
+	t.Helper()
+	mr := setupRedis(t)
+	stubChat(t, "gemini", reply("It is 18 degrees."))
+	mr.Set(historyKey(sessionId), `[
+		{"role":"system","text":"Be brief."},
+		{"role":"user","text":"Weather in Paris?"},
+		{"role":"ai","text":"","toolCalls":[{"id":"call-1","name":"weather","arguments":{"city":"Paris"}}]}
+	]`)
+	chatTurn(t, map[string]interface{}{
+		"sessionId": sessionId,
+		"modelName": "gemini",
+		"contents":  []map[string]string{{"role": "tool", "text": `{"temp":18}`, "toolCallId": "call-1", "toolName": "weather"}},
+	})
+	return storedHistory(t, sessionId)
+}
+
+func TestToolResultRoundTrip(t *testing.T) {
+	history := storeToolTurn(t, "tools-1")
+	if len(history) != 5 {
+		t.Fatalf("history = %+v, want the tool result and the reply appended", history)
+	}
+	if call := history[2].ToolCalls; len(call) != 1 || call[0].ID != "call-1" || call[0].Name != "weather" || string(call[0].Arguments) != `{"city":"Paris"}` {
+		t.Errorf("stored tool call = %+v", call)
+	}
+	if result := history[3]; result.Role != "tool" || result.ToolCallID != "call-1" || result.ToolName != "weather" || result.Text != `{"temp":18}` {
+		t.Errorf("stored tool result = %+v", result)
+	}
+}
+
+func TestToolResultOpenAIMapping(t *testing.T) {
+	history := storeToolTurn(t, "tools-openai")[1:4]
+
+	messages := toOpenaiMessages(history, true)
+	if call := messages[1]; call.Role != "assistant" || len(call.ToolCalls) != 1 || call.ToolCalls[0].ID != "call-1" || call.ToolCalls[0].Function.Name != "weather" {
+		t.Errorf("assistant message = %+v, want the tool call", call)
+	}
+	if result := messages[2]; result.Role != "tool" || result.ToolCallID != "call-1" || result.Content != `{"temp":18}` {
+		t.Errorf("tool message = %+v, want role tool with tool_call_id", result)
+	}
+
+	// Endpoints without tool messages get the result as a user turn.
+	messages = toOpenaiMessages(history, false)
+	if result := messages[2]; result.Role != "user" || result.Content != "Result of tool call weather:\n{\"temp\":18}" {
+		t.Errorf("tool message without tool support = %+v", result)
+	}
+}
+
+func TestToolResultAnthropicMapping(t *testing.T) {
+	history := storeToolTurn(t, "tools-claude")[1:4]
+
+	body, err := json.Marshal(toAnthropicMessages(history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(body, &messages); err != nil {
+		t.Fatalf("decoding %s: %v", body, err)
+	}
+	blocks := func(i int) []AnthropicContentBlock {
+		var blocks []AnthropicContentBlock
+		if err := json.Unmarshal(messages[i].Content, &blocks); err != nil || len(blocks) == 0 {
+			t.Fatalf("message %d content = %s, want content blocks", i, messages[i].Content)
+		}
+		return blocks
+	}
+	if use := blocks(1)[0]; messages[1].Role != "assistant" || use.Type != "tool_use" || use.ID != "call-1" || use.Name != "weather" {
+		t.Errorf("assistant block = %+v, want a tool_use block", use)
+	}
+	if result := blocks(2)[0]; messages[2].Role != "user" || result.Type != "tool_result" || result.ToolUseID != "call-1" || result.Content != `{"temp":18}` {
+		t.Errorf("tool block = %+v, want a tool_result block in a user turn", result)
+	}
+}
+
+func TestToolResultGeminiMapping(t *testing.T) {
+	history := storeToolTurn(t, "tools-gemini")[1:4]
+	// A result stored without its tool name takes the call's.
+	history[2].ToolName = ""
+
+	contents := toGeminiContents(history)
+	if call := contents[1].Parts[0].FunctionCall; contents[1].Role != "model" || call == nil || call.ID != "call-1" || call.Name != "weather" {
+		t.Errorf("model content = %+v, want the functionCall", contents[1])
+	}
+	response := contents[2].Parts[0].FunctionResponse
+	if contents[2].Role != "user" || response == nil || response.ID != "call-1" || response.Name != "weather" || string(response.Response) != `{"temp":18}` {
+		t.Errorf("tool content = %+v, want a functionResponse", contents[2])
+	}
+
+	// Results that aren't JSON objects are wrapped in one.
+	if got := geminiFunctionResponse(Message{Role: "tool", Text: "sunny", ToolCallID: "call-2"}); string(got.Response) != `{"content":"sunny"}` || got.Name != "call-2" {
+		t.Errorf("plain text response = %+v", got)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// searchMaxResults caps the matches GET /chat/search returns.
+var searchMaxResults = envInt("SEARCH_MAX_RESULTS", 50)
+
+// searchSnippetContext is how many characters of context a snippet keeps on
+// each side of the match.
+const searchSnippetContext = 40
+
+// SearchResult is a message matching a search. Index is the message's
+// position in the stored history, as GET /chat/history returns it when system
+// messages are shown.
+type SearchResult struct {
+	Index     int       `json:"index"`
+	Role      string    `json:"role"`
+	Snippet   string    `json:"snippet"`
+	Matches   int       `json:"matches"`
+	CreatedAt time.Time `json:"createdAt,omitzero"`
+}
+
+// searchMessages returns the messages of history containing query, ignoring
+// case, in conversation order and at most limit of them. more reports whether
+// further messages matched.
+func searchMessages(history []Message, query string, limit int) (results []SearchResult, more bool) {
+	needle := strings.Map(unicode.ToLower, query)
+	results = []SearchResult{}
+	for i, m := range history {
+		if m.Role == "system" && hideSystemInHistory {
+			continue
+		}
+		// Lowercasing rune by rune keeps the rune offsets of text, so a
+		// match in it is also a match in the original.
+		text := strings.Map(unicode.ToLower, m.Text)
+		at := strings.Index(text, needle)
+		if at < 0 {
+			continue
+		}
+		if len(results) == limit {
+			return results, true
+		}
+		start := utf8.RuneCountInString(text[:at])
+		results = append(results, SearchResult{
+			Index:     i,
+			Role:      m.Role,
+			Snippet:   snippet(m.Text, start, utf8.RuneCountInString(needle)),
+			Matches:   strings.Count(text, needle),
+			CreatedAt: m.CreatedAt,
+		})
+	}
+	return results, false
+}
+
+// snippet returns the n characters of text from start with some context
+// around them, marking cut ends with an ellipsis.
+func snippet(text string, start, n int) string {
+	runes := []rune(text)
+	from := max(start-searchSnippetContext, 0)
+	to := min(start+n+searchSnippetContext, len(runes))
+	s := strings.Join(strings.Fields(string(runes[from:to])), " ")
+	if from > 0 {
+		s = "…" + s
+	}
+	if to < len(runes) {
+		s += "…"
+	}
+	return s
+}
+
+// searchHandler serves GET /chat/search?sessionId=...&q=..., the messages of
+// a session containing q.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only GET requests are allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	sessionId := query.Get("sessionId")
+	if sessionId == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing sessionId query parameter")
+		return
+	}
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing q query parameter")
+		return
+	}
+	if admitSessionRequest(w, r, sessionId) == nil {
+		return
+	}
+
+	history, err := getHistoryAllowStale(sessionId)
+	if err != nil {
+		slog.Error("Error retrieving history for search", "sessionId", sessionId, "error", err)
+		writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving history")
+		return
+	}
+
+	results, more := searchMessages(history, q, max(searchMaxResults, 1))
+	response := map[string]interface{}{"results": results}
+	if more {
+		response["more"] = true
+	}
+	writeJSON(w, r, http.StatusOK, response)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var searchHistory = []Message{
+	{Role: "system", Text: "You know a lot about Paris."},
+	{Role: "user", Text: "What should I see in Paris?"},
+	{Role: "ai", Text: "The Louvre, the Eiffel Tower and Montmartre."},
+	{Role: "user", Text: "How tall is the Eiffel tower?"},
+	{Role: "ai", Text: "It is 330 metres tall, the tallest structure in PARIS. " + strings.Repeat("More detail. ", 10) + "Paris again."},
+}
+
+type searchResponse struct {
+	Results []SearchResult `json:"results"`
+	More    bool           `json:"more"`
+}
+
+// searchSession runs GET /chat/search with q on sessionId.
+func searchSession(t *testing.T, sessionId, q string) searchResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/chat/search?sessionId="+sessionId+"&q="+url.QueryEscape(q), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("search status = %d, body %s", w.Code, w.Body)
+	}
+	var resp searchResponse
+	decodeBody(t, w, &resp)
+	return resp
+}
+
+func resultIndices(results []SearchResult) []int {
+	indices := make([]int, len(results))
+	for i, r := range results {
+		indices[i] = r.Index
+	}
+	return indices
+}
+
+func TestSearchSession(t *testing.T) {
+	setupRedis(t)
+	if err := saveHistoryToRedis("search-1", searchHistory, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := searchSession(t, "search-1", "paris")
+	if got := resultIndices(resp.Results); len(got) != 2 || got[0] != 1 || got[1] != 4 {
+		t.Fatalf("matches = %v, want messages 1 and 4 (the system prompt hidden)", got)
+	}
+	if r := resp.Results[0]; r.Role != "user" || r.Snippet != "What should I see in Paris?" || r.Matches != 1 {
+		t.Errorf("first match = %+v", r)
+	}
+	long := resp.Results[1]
+	if long.Matches != 2 || !strings.Contains(long.Snippet, "PARIS") || !strings.HasSuffix(long.Snippet, "…") || !strings.HasPrefix(long.Snippet, "…") {
+		t.Errorf("long match = %+v, want both matches counted and a cut snippet", long)
+	}
+	if resp.More {
+		t.Error("more = true under the result cap")
+	}
+
+	if got := resultIndices(searchSession(t, "search-1", "EIFFEL TOWER").Results); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Errorf("eiffel matches = %v, want [2 3]", got)
+	}
+	if got := searchSession(t, "search-1", "London").Results; len(got) != 0 {
+		t.Errorf("london matches = %+v, want none", got)
+	}
+}
+
+func TestSearchShowsSystemMessages(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &hideSystemInHistory, false)
+	if err := saveHistoryToRedis("search-2", searchHistory, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+	if got := resultIndices(searchSession(t, "search-2", "paris").Results); len(got) != 3 || got[0] != 0 {
+		t.Fatalf("matches = %v, want the system prompt included", got)
+	}
+}
+
+func TestSearchResultCap(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &searchMaxResults, 1)
+	if err := saveHistoryToRedis("search-3", searchHistory, defaultTenant); err != nil {
+		t.Fatal(err)
+	}
+	resp := searchSession(t, "search-3", "tall")
+	if got := resultIndices(resp.Results); len(got) != 1 || got[0] != 3 || !resp.More {
+		t.Fatalf("results = %v, more = %v, want the first match and more", got, resp.More)
+	}
+}
+
+func TestSearchRequiresParameters(t *testing.T) {
+	setupRedis(t)
+	for _, target := range []string{"/chat/search?q=paris", "/chat/search?sessionId=search-4", "/chat/search?sessionId=search-4&q=%20"} {
+		w := httptest.NewRecorder()
+		searchHandler(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", target, w.Code)
+		}
+	}
+}
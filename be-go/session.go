@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// maxTitleLength is the length (in characters) of auto-generated titles.
+const maxTitleLength = 60
+
+// Page sizes for GET /sessions.
+const (
+	defaultSessionPageSize = 20
+	maxSessionPageSize     = 100
+)
+
+// SessionMeta is stored alongside a session's history under session-meta:<id>.
+type SessionMeta struct {
+	SessionID string `json:"sessionId"`
+	Owner     string `json:"owner,omitempty"`
+	Title     string `json:"title,omitempty"`
+	// AutoTitle is set while the title is generated rather than chosen by
+	// the client, so a better generated title may replace it.
+	AutoTitle bool     `json:"autoTitle,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	// Generation holds the default generation settings of every turn.
+	Generation *GenerationSettings `json:"generation,omitempty"`
+	// Summary folds the turns up to SummaryThrough, written when the
+	// session resumed after an idle gap.
+	Summary        string    `json:"summary,omitempty"`
+	SummaryThrough time.Time `json:"summaryThrough,omitzero"`
+	// Tenant names the tenant whose TTL and limits apply to the session.
+	Tenant    string    `json:"tenant,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// sessionMetaKey is the Redis key holding the metadata of a session.
+func sessionMetaKey(sessionId string) string {
+	return "session-meta:" + sessionId
+}
+
+// getSessionMeta loads the metadata of a session. It returns nil (and no
+// error) when the session has none yet.
+func getSessionMeta(sessionId string) (*SessionMeta, error) {
+	if redisClient == nil {
+		return nil, fmt.Errorf("Redis client is not initialized")
+	}
+
+	metaJSON, err := redisClient.Get(ctx, sessionMetaKey(sessionId)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis error retrieving session metadata: %w", err)
+	}
+
+	var meta SessionMeta
+	if err := json.Unmarshal([]byte(metaJSON), &meta); err != nil {
+		return nil, fmt.Errorf("error unmarshaling session metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+// saveSessionMeta stores the metadata with the same TTL as the history (that
+// of the session's tenant) so both expire together.
+func saveSessionMeta(meta *SessionMeta) error {
+	if redisClient == nil {
+		return fmt.Errorf("Redis client is not initialized")
+	}
+
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("error marshaling session metadata: %w", err)
+	}
+
+	if err := redisClient.Set(ctx, sessionMetaKey(meta.SessionID), metaJSON, tenantNamed(meta.Tenant).TTL).Err(); err != nil {
+		return fmt.Errorf("redis error saving session metadata: %w", err)
+	}
+	return nil
+}
+
+// titleFromMessage derives a display title from the first user message:
+// whitespace is collapsed and long text is cut at a word boundary.
+func titleFromMessage(text string) string {
+	title := strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(title) <= maxTitleLength {
+		return title
+	}
+
+	runes := []rune(title)[:maxTitleLength]
+	cut := string(runes)
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+// touchSessionMeta creates or updates the metadata after a chat turn, setting
+// the title from the first user message if none has been set.
+func touchSessionMeta(tenant *Tenant, sessionId string, history []Message) error {
+	meta, err := getSessionMeta(sessionId)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if meta == nil {
+		meta = &SessionMeta{SessionID: sessionId, CreatedAt: now}
+	}
+	meta.UpdatedAt = now
+	if tenant != defaultTenant {
+		meta.Tenant = tenant.Name
+	}
+
+	if meta.Title == "" {
+		for _, m := range history {
+			if m.Role == "user" {
+				meta.Title = titleFromMessage(m.Text)
+				meta.AutoTitle = true
+				break
+			}
+		}
+	}
+	return saveSessionMeta(meta)
+}
+
+// recordTurn persists the history after a completed turn and updates the
+// session metadata. Failures are only logged: the user already has the answer.
+func recordTurn(tenant *Tenant, sessionId string, history []Message) {
+	if err := saveHistoryToRedis(sessionId, history, tenant); err != nil {
+		slog.Error("Error in saveHistoryToRedis", "error", err)
+		return
+	}
+	if err := touchSessionMeta(tenant, sessionId, history); err != nil {
+		slog.Error("Error updating session metadata", "sessionId", sessionId, "error", err)
+	}
+}
+
+// storedTurn returns the history to store for a turn, given the history with
+// the new message and the AI reply appended: without the parts the request
+// asked not to persist.
+func storedTurn(clientPayload ClientRequestPayload, history []Message) []Message {
+	keepUser, keepAI := clientPayload.persistsUserMessage(), clientPayload.persistsAIMessage()
+	if (keepUser && keepAI) || clientPayload.Continue || len(history) < 2 {
+		return history
+	}
+	stored := slices.Clone(history[:len(history)-2])
+	if keepUser {
+		message := history[len(history)-2]
+		message.ReplyOmitted = !keepAI
+		stored = append(stored, message)
+	}
+	if keepAI {
+		stored = append(stored, history[len(history)-1])
+	}
+	return stored
+}
+
+// sessionHandler reads (GET ?sessionId=...) or sets (POST) session metadata.
+// A POST only overwrites the fields it supplies.
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		sessionId := r.URL.Query().Get("sessionId")
+		if sessionId == "" {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing sessionId query parameter")
+			return
+		}
+		if admitSessionRequest(w, r, sessionId) == nil {
+			return
+		}
+
+		meta, err := getSessionMeta(sessionId)
+		if err != nil {
+			slog.Error("Error in getSessionMeta", "sessionId", sessionId, "error", err)
+			writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving session")
+			return
+		}
+		if meta == nil {
+			writeError(w, http.StatusNotFound, codeNotFound, "Session not found")
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, meta)
+	case "POST":
+		if !requireJSON(w, r) {
+			return
+		}
+		var update struct {
+			SessionID  string              `json:"sessionId"`
+			Owner      *string             `json:"owner"`
+			Title      *string             `json:"title"`
+			Tags       *[]string           `json:"tags"`
+			Generation *GenerationSettings `json:"generation"`
+		}
+		if err := decodeJSON(r.Body, &update); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+			return
+		}
+		if update.SessionID == "" {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing sessionId")
+			return
+		}
+		if admitSessionRequest(w, r, update.SessionID) == nil {
+			return
+		}
+		if update.Generation != nil {
+			if err := update.Generation.validate(); err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+				return
+			}
+		}
+
+		meta, err := getSessionMeta(update.SessionID)
+		if err != nil {
+			slog.Error("Error in getSessionMeta", "sessionId", update.SessionID, "error", err)
+			writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving session")
+			return
+		}
+
+		now := time.Now().UTC()
+		if meta == nil {
+			meta = &SessionMeta{SessionID: update.SessionID, CreatedAt: now}
+		}
+		meta.UpdatedAt = now
+		if update.Owner != nil {
+			err := claimOwnerSession(*update.Owner, meta.Owner, meta.SessionID)
+			if errors.Is(err, errSessionCapReached) {
+				writeError(w, http.StatusTooManyRequests, codeSessionLimit, fmt.Sprintf("Owner already has the maximum of %d sessions", maxSessionsPerOwner))
+				return
+			}
+			if err != nil {
+				slog.Error("Error applying the owner session cap", "sessionId", meta.SessionID, "error", err)
+				writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error saving session")
+				return
+			}
+			meta.Owner = *update.Owner
+		}
+		if update.Title != nil {
+			meta.Title = *update.Title
+			meta.AutoTitle = false
+		}
+		if update.Tags != nil {
+			meta.Tags = *update.Tags
+		}
+		if update.Generation != nil {
+			meta.Generation = update.Generation
+		}
+
+		if err := saveSessionMeta(meta); err != nil {
+			slog.Error("Error in saveSessionMeta", "sessionId", meta.SessionID, "error", err)
+			writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error saving session")
+			return
+		}
+
+		writeJSON(w, r, http.StatusOK, meta)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only GET and POST requests are allowed")
+	}
+}
+
+// listSessionsPage scans session-meta records starting at cursor and returns
+// those owned by owner (all of them when owner is empty) whose ID starts with
+// prefix, newest first. SCAN
+// is used rather than KEYS so large keyspaces don't block Redis. Whole SCAN
+// batches are consumed, so a page can hold slightly more than limit entries;
+// the returned cursor is 0 once the scan is complete.
+func listSessionsPage(owner, prefix string, cursor uint64, limit int) ([]SessionMeta, uint64, error) {
+	if redisClient == nil {
+		return nil, 0, fmt.Errorf("Redis client is not initialized")
+	}
+
+	sessions := []SessionMeta{}
+	for {
+		keys, next, err := redisScan(cursor, sessionMetaKey(globEscaper.Replace(prefix)+"*"), int64(limit))
+		if err != nil {
+			return nil, 0, fmt.Errorf("redis error scanning sessions: %w", err)
+		}
+		cursor = next
+
+		if len(keys) > 0 {
+			values, err := redisGetMany(keys...)
+			if err != nil {
+				return nil, 0, fmt.Errorf("redis error retrieving sessions: %w", err)
+			}
+			for _, v := range values {
+				metaJSON, ok := v.(string)
+				if !ok {
+					// Expired between SCAN and MGET
+					continue
+				}
+				var meta SessionMeta
+				if err := json.Unmarshal([]byte(metaJSON), &meta); err != nil {
+					slog.Warn("Skipping unreadable session metadata", "error", err)
+					continue
+				}
+				if owner == "" || meta.Owner == owner {
+					sessions = append(sessions, meta)
+				}
+			}
+		}
+
+		if cursor == 0 || len(sessions) >= limit {
+			break
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].UpdatedAt.After(sessions[j].UpdatedAt) })
+	return sessions, cursor, nil
+}
+
+// listSessionsHandler serves GET /sessions?owner=...&cursor=...&limit=...
+// for a history sidebar. Listing without an owner filter requires admin auth.
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only GET requests are allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	owner := query.Get("owner")
+	if owner == "" && !requireAdmin(w, r) {
+		return
+	}
+	// Owner listings only show the sessions the caller's API key may use.
+	var tenant *Tenant
+	if owner != "" {
+		if tenant = admitSessionRequest(w, r, ""); tenant == nil {
+			return
+		}
+	}
+
+	cursor, limit, ok := sessionPageParams(w, query)
+	if !ok {
+		return
+	}
+
+	sessions, next, err := listSessionsPage(owner, "", cursor, limit)
+	if err != nil {
+		slog.Error("Error in listSessionsPage", "error", err)
+		writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error listing sessions")
+		return
+	}
+
+	if tenant != nil {
+		sessions = slices.DeleteFunc(sessions, func(meta SessionMeta) bool {
+			return !tenant.allowsSession(meta.SessionID)
+		})
+	}
+
+	writeSessionPage(w, r, sessions, next)
+}
+
+// sessionPageParams reads the cursor and limit query parameters of a session
+// listing. On invalid values it writes a 400 and ok is false.
+func sessionPageParams(w http.ResponseWriter, query url.Values) (cursor uint64, limit int, ok bool) {
+	if c := query.Get("cursor"); c != "" {
+		parsed, err := strconv.ParseUint(c, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid cursor")
+			return 0, 0, false
+		}
+		cursor = parsed
+	}
+
+	limit = defaultSessionPageSize
+	if l := query.Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed < 1 || parsed > maxSessionPageSize {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxSessionPageSize))
+			return 0, 0, false
+		}
+		limit = parsed
+	}
+	return cursor, limit, true
+}
+
+// writeSessionPage writes a page of a session listing.
+func writeSessionPage(w http.ResponseWriter, r *http.Request, sessions []SessionMeta, next uint64) {
+	// An empty nextCursor means there are no more pages.
+	nextCursor := ""
+	if next != 0 {
+		nextCursor = strconv.FormatUint(next, 10)
+	}
+
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"sessions":   sessions,
+		"nextCursor": nextCursor,
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// Per-session serialization, opt-in with SESSION_LOCK=true: a request that
+// appends to a session's history holds a Redis lock on the session from
+// reading the history to saving it, so two concurrent turns can't both build
+// on the same history and one overwrite the other. A request waits up to
+// SESSION_LOCK_WAIT for the lock and is refused with 409 after that. The lock
+// expires after SESSION_LOCK_TTL unless its request, still running, renews
+// it, so a lock left behind by a crashed instance frees itself.
+var (
+	sessionLockEnabled = os.Getenv("SESSION_LOCK") == "true"
+	sessionLockTTL     = envPositiveDuration("SESSION_LOCK_TTL", 30*time.Second)
+	sessionLockWait    = envPositiveDuration("SESSION_LOCK_WAIT", 10*time.Second)
+)
+
+// sessionLockRetry is how often a waiting request tries to take the lock.
+const sessionLockRetry = 50 * time.Millisecond
+
+var errSessionBusy = errors.New("session is busy with another request")
+
+// sessionLockKey is the Redis key of a session's lock.
+func sessionLockKey(sessionId string) string {
+	return "lock:session:" + sessionId
+}
+
+// The lock holds a random token, so only its holder renews or deletes it, not
+// a request that took it over after it expired.
+var (
+	renewLockScript  = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`)
+	unlockLockScript = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`)
+)
+
+// sessionLock is a held session lock.
+type sessionLock struct {
+	key   string
+	token string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// lockSession takes the lock of a session, waiting up to SESSION_LOCK_WAIT,
+// and returns errSessionBusy when it stays taken. The lock is nil when
+// locking is off; release works on it all the same.
+func lockSession(reqCtx context.Context, sessionId string) (*sessionLock, error) {
+	if !sessionLockEnabled || redisClient == nil {
+		return nil, nil
+	}
+	lock := &sessionLock{key: sessionLockKey(sessionId), token: newRequestID()}
+	deadline := time.Now().Add(sessionLockWait)
+	for {
+		ok, err := redisClient.SetNX(reqCtx, lock.key, lock.token, sessionLockTTL).Result()
+		if err != nil {
+			return nil, fmt.Errorf("redis error locking session: %w", err)
+		}
+		if ok {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			return nil, errSessionBusy
+		}
+		select {
+		case <-time.After(min(sessionLockRetry, time.Until(deadline))):
+		case <-reqCtx.Done():
+			return nil, reqCtx.Err()
+		}
+	}
+	lock.stop, lock.done = make(chan struct{}), make(chan struct{})
+	go lock.renew()
+	return lock, nil
+}
+
+// renew extends the lock's expiry every third of the TTL until released.
+func (l *sessionLock) renew() {
+	defer close(l.done)
+	ticker := time.NewTicker(max(sessionLockTTL/3, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		renewed, err := renewLockScript.Run(ctx, redisClient, []string{l.key}, l.token, sessionLockTTL.Milliseconds()).Int()
+		if err != nil {
+			slog.Warn("Error renewing session lock", "key", l.key, "error", err)
+		} else if renewed == 0 {
+			slog.Warn("Session lock expired while held", "key", l.key)
+		}
+	}
+}
+
+// release gives the lock up. It is a no-op on a nil lock.
+func (l *sessionLock) release() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	if err := unlockLockScript.Run(ctx, redisClient, []string{l.key}, l.token).Err(); err != nil {
+		slog.Error("Error releasing session lock", "key", l.key, "error", err)
+	}
+}
+
+// admitSessionLock takes the lock of a session for a request. It writes the
+// error response and reports false when the lock can't be had; otherwise the
+// caller must release the lock, which may be nil.
+func admitSessionLock(w http.ResponseWriter, r *http.Request, sessionId string) (*sessionLock, bool) {
+	lock, err := lockSession(r.Context(), sessionId)
+	if errors.Is(err, errSessionBusy) {
+		writeError(w, http.StatusConflict, codeSessionBusy, "Another request is in progress for this session, please retry later")
+		return nil, false
+	}
+	if err != nil {
+		slog.Error("Error locking session", "sessionId", sessionId, "error", err)
+		writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error locking session")
+		return nil, false
+	}
+	return lock, true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStaleSessionLockExpires(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &sessionLockEnabled, true)
+	setVar(t, &sessionLockTTL, 30*time.Second)
+	setVar(t, &sessionLockWait, 5*time.Second)
+	stubChat(t, "gemini", reply("Hi there"))
+	// A lock left behind by a request that crashed.
+	mr.Set(sessionLockKey("lock-1"), "crashed")
+	mr.SetTTL(sessionLockKey("lock-1"), sessionLockTTL)
+
+	codes := make(chan int, 1)
+	go func() {
+		w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "lock-1", "modelName": "gemini", "contents": userTurn("Hello")})
+		codes <- w.Code
+	}()
+	select {
+	case code := <-codes:
+		t.Fatalf("request finished with %d while the session was locked", code)
+	case <-time.After(3 * sessionLockRetry):
+	}
+
+	mr.FastForward(sessionLockTTL)
+	select {
+	case code := <-codes:
+		if code != http.StatusOK {
+			t.Fatalf("status = %d, want 200 once the lock expired", code)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request still waiting after the lock expired")
+	}
+	if mr.Exists(sessionLockKey("lock-1")) {
+		t.Error("lock not released after the turn")
+	}
+	if turns := conversationTurns(t, "lock-1"); turns != 2 {
+		t.Errorf("stored %d messages, want the turn", turns)
+	}
+}
+
+func TestSessionLockWaitExceeded(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &sessionLockEnabled, true)
+	setVar(t, &sessionLockWait, 100*time.Millisecond)
+	stubChat(t, "gemini", reply("Hi there"))
+	mr.Set(sessionLockKey("lock-2"), "other")
+
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "lock-2", "modelName": "gemini", "contents": userTurn("Hello")})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want 409", w.Code)
+	}
+	if e := decodeError(t, w); e.Code != codeSessionBusy {
+		t.Fatalf("error code = %q, want %q", e.Code, codeSessionBusy)
+	}
+	if got, _ := mr.Get(sessionLockKey("lock-2")); got != "other" {
+		t.Errorf("lock = %q, want the other request's lock left alone", got)
+	}
+}
+
+func TestSessionLockRenewedWhileHeld(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &sessionLockEnabled, true)
+	setVar(t, &sessionLockTTL, 30*time.Millisecond)
+
+	lock, err := lockSession(t.Context(), "lock-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		// Let a renewal run, then move Redis' clock past most of the TTL.
+		time.Sleep(2 * sessionLockTTL / 3)
+		mr.FastForward(2 * sessionLockTTL / 3)
+		if !mr.Exists(sessionLockKey("lock-3")) {
+			t.Fatal("held lock expired")
+		}
+	}
+	lock.release()
+	if mr.Exists(sessionLockKey("lock-3")) {
+		t.Fatal("lock not deleted on release")
+	}
+}
+
+func TestReleaseLeavesTakenOverLock(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &sessionLockEnabled, true)
+	lock, err := lockSession(t.Context(), "lock-4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lock expired and another request took it.
+	mr.Set(sessionLockKey("lock-4"), "other")
+	lock.release()
+	if got, _ := mr.Get(sessionLockKey("lock-4")); got != "other" {
+		t.Errorf("lock = %q, want the other request's lock left alone", got)
+	}
+}
+
+func TestSessionLockDisabled(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &sessionLockEnabled, false)
+	mr.Set(sessionLockKey("lock-5"), "other")
+	stubChat(t, "gemini", reply("Hi there"))
+	chatTurn(t, map[string]interface{}{"sessionId": "lock-5", "modelName": "gemini", "contents": userTurn("Hello")})
+}
+
+func TestNonPositiveSessionLockSettings(t *testing.T) {
+	setVar(t, &loggingReady, false)
+	for _, value := range []string{"0s", "-5s"} {
+		t.Setenv("SESSION_LOCK_TTL", value)
+		if got := envPositiveDuration("SESSION_LOCK_TTL", 30*time.Second); got != 30*time.Second {
+			t.Errorf("SESSION_LOCK_TTL=%s gives %v, want the 30s default", value, got)
+		}
+	}
+	t.Setenv("SESSION_LOCK_TTL", "5s")
+	if got := envPositiveDuration("SESSION_LOCK_TTL", 30*time.Second); got != 5*time.Second {
+		t.Errorf("SESSION_LOCK_TTL=5s gives %v", got)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// maxSessionBytes caps the serialized size of a stored history. Unlike
+// CONTEXT_WINDOW_MESSAGES, which only limits what is sent to the provider,
+// this trims what is stored: the oldest messages after the leading system
+// prompt are dropped until the history fits. 0 disables it.
+var maxSessionBytes = envInt("MAX_SESSION_BYTES", 0)
+
+var (
+	sessionBytes = newHistogram("maya_session_bytes", "Serialized size of session histories as saved to Redis.",
+		[]float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20})
+	sessionTrimmedMessages = newCounter("maya_session_trimmed_messages_total", "Messages dropped from stored histories to stay under MAX_SESSION_BYTES.")
+)
+
+// marshalHistory serializes a history for storage, trimming it to
+// maxSessionBytes, and records its size.
+func marshalHistory(sessionId string, history []Message) ([]byte, error) {
+	historyJSON, err := json.Marshal(history)
+	if err != nil {
+		return nil, err
+	}
+	if maxSessionBytes > 0 && len(historyJSON) > maxSessionBytes {
+		historyJSON, err = trimToBytes(sessionId, history, maxSessionBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sessionBytes.Observe(float64(len(historyJSON)))
+	return historyJSON, nil
+}
+
+// trimToBytes drops the oldest non-system messages until the serialized
+// history is at most limit bytes. The system messages are kept even if they
+// alone are over the limit.
+func trimToBytes(sessionId string, history []Message, limit int) ([]byte, error) {
+	// A JSON array of n elements is 2 bytes of brackets, the elements and
+	// n-1 commas.
+	sizes := make([]int, len(history))
+	total := 2
+	for i, m := range history {
+		encoded, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = len(encoded)
+		total += sizes[i] + 1
+	}
+	total--
+
+	pinned := 0
+	for pinned < len(history) && history[pinned].Role == "system" {
+		pinned++
+	}
+	drop := pinned
+	for total > limit && drop < len(history) {
+		total -= sizes[drop] + 1
+		drop++
+	}
+	if total > limit {
+		slog.Warn("Session system prompt alone exceeds MAX_SESSION_BYTES", "sessionId", sessionId, "bytes", total)
+	}
+
+	dropped := drop - pinned
+	sessionTrimmedMessages.Add(int64(dropped))
+	slog.Info("Trimmed stored history to MAX_SESSION_BYTES", "sessionId", sessionId, "dropped", dropped, "limit", limit)
+
+	trimmed := append(append([]Message(nil), history[:pinned]...), history[drop:]...)
+	historyJSON, err := json.Marshal(trimmed)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling trimmed history: %w", err)
+	}
+	return historyJSON, nil
+}
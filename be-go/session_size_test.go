@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStoredHistoryStaysUnderByteCap(t *testing.T) {
+	mr := setupRedis(t)
+	setVar(t, &maxSessionBytes, 4000)
+	stubChat(t, "gemini", reply(strings.Repeat("A long answer. ", 40)))
+
+	for i := 0; i < 6; i++ {
+		text := fmt.Sprintf("Question %d: %s", i, strings.Repeat("padding ", 50))
+		chatTurn(t, map[string]interface{}{"sessionId": "size-1", "modelName": "gemini", "contents": userTurn(text)})
+
+		raw, err := mr.Get(historyKey("size-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(raw) > maxSessionBytes {
+			t.Fatalf("turn %d: stored %d bytes, want at most %d", i, len(raw), maxSessionBytes)
+		}
+	}
+
+	history := storedHistory(t, "size-1")
+	if history[0].Role != "system" {
+		t.Errorf("first stored message is %q, want the system prompt kept", history[0].Role)
+	}
+	if last := lastUserText(history); !strings.HasPrefix(last, "Question 5:") {
+		t.Errorf("last user message = %.20q, want the newest turn kept", last)
+	}
+	if conversationTurns(t, "size-1") >= 12 {
+		t.Error("no messages were trimmed")
+	}
+}
+
+func TestTrimToBytesKeepsSystemPrompt(t *testing.T) {
+	history := []Message{{Role: "system", Text: "Be brief."}}
+	for i := 0; i < 10; i++ {
+		history = append(history, Message{Role: "user", Text: strings.Repeat("x", 100)})
+	}
+	full, _ := json.Marshal(history)
+
+	trimmed, err := trimToBytes("size-2", history, len(full)/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trimmed) > len(full)/2 {
+		t.Errorf("trimmed to %d bytes, want at most %d", len(trimmed), len(full)/2)
+	}
+	var got []Message
+	if err := json.Unmarshal(trimmed, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got[0].Role != "system" || len(got) < 2 {
+		t.Errorf("trimmed history = %+v, want the system prompt and the newest messages", got)
+	}
+
+	// The system prompt stays even when it alone is over the limit.
+	trimmed, _ = trimToBytes("size-2", history, 10)
+	if err := json.Unmarshal(trimmed, &got); err != nil || len(got) != 1 || got[0].Role != "system" {
+		t.Errorf("trimmed history = %s, want only the system prompt", trimmed)
+	}
+}
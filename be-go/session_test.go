@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSessionMetadataSetAndGet(t *testing.T) {
+	setupRedis(t)
+
+	w := postJSON(t, sessionHandler, "/session", map[string]interface{}{
+		"sessionId": "meta-1",
+		"owner":     "alice",
+		"title":     "Trip planning",
+		"tags":      []string{"travel", "japan"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST status = %d, body %s", w.Code, w.Body)
+	}
+
+	// A later update only changes the fields it names.
+	w = postJSON(t, sessionHandler, "/session", map[string]interface{}{"sessionId": "meta-1", "tags": []string{"travel"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("second POST status = %d, body %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	sessionHandler(w, httptest.NewRequest("GET", "/session?sessionId=meta-1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET status = %d, body %s", w.Code, w.Body)
+	}
+	var meta SessionMeta
+	decodeBody(t, w, &meta)
+	if meta.Owner != "alice" || meta.Title != "Trip planning" || meta.AutoTitle {
+		t.Errorf("meta = %+v, want owner alice and the chosen title", meta)
+	}
+	if len(meta.Tags) != 1 || meta.Tags[0] != "travel" {
+		t.Errorf("tags = %v, want [travel]", meta.Tags)
+	}
+}
+
+func TestSessionMetadataNotFound(t *testing.T) {
+	setupRedis(t)
+	w := httptest.NewRecorder()
+	sessionHandler(w, httptest.NewRequest("GET", "/session?sessionId=missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", w.Code)
+	}
+}
+
+func TestAutoTitleFromFirstTurn(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Sure."))
+	first := "Can you help me plan a two week trip around Japan in the spring, with a focus on gardens and temples?"
+
+	for _, text := range []string{first, "Make it one week instead"} {
+		w := postJSON(t, chatHandler, "/chat", map[string]interface{}{
+			"sessionId": "title-1",
+			"modelName": "gemini",
+			"contents":  []map[string]string{{"role": "user", "text": text}},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("chat status = %d, body %s", w.Code, w.Body)
+		}
+	}
+
+	meta, err := getSessionMeta("title-1")
+	if err != nil || meta == nil {
+		t.Fatalf("getSessionMeta = %v, %v", meta, err)
+	}
+	if !meta.AutoTitle || !strings.HasSuffix(meta.Title, "…") || !strings.HasPrefix(first, strings.TrimSuffix(meta.Title, "…")) {
+		t.Errorf("title = %q (auto %v), want the truncated first message", meta.Title, meta.AutoTitle)
+	}
+	if n := len([]rune(meta.Title)); n > maxTitleLength+1 {
+		t.Errorf("title has %d characters, want at most %d", n, maxTitleLength+1)
+	}
+}
+
+func TestTitleFromMessage(t *testing.T) {
+	if got := titleFromMessage("  Hello\n  there  "); got != "Hello there" {
+		t.Errorf("titleFromMessage = %q, want whitespace collapsed", got)
+	}
+	long := strings.Repeat("word ", 30)
+	got := titleFromMessage(long)
+	if !strings.HasSuffix(got, "word…") {
+		t.Errorf("titleFromMessage = %q, want a cut at a word boundary", got)
+	}
+}
+
+// listSessionPages follows a session listing of handler from target through
+// every page and returns the session IDs in the order they came and the page
+// count.
+func listSessionPages(t *testing.T, handler http.HandlerFunc, target string, admin bool) ([]string, int) {
+	t.Helper()
+	var ids []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 50 {
+			t.Fatal("listing never ended")
+		}
+		r := httptest.NewRequest("GET", target+"&cursor="+cursor, nil)
+		if admin {
+			r = withAdmin(t, r)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", w.Code, w.Body)
+		}
+		var page struct {
+			Sessions   []SessionMeta `json:"sessions"`
+			NextCursor string        `json:"nextCursor"`
+		}
+		decodeBody(t, w, &page)
+		for _, meta := range page.Sessions {
+			ids = append(ids, meta.SessionID)
+		}
+		if page.NextCursor == "" {
+			return ids, pages + 1
+		}
+		cursor = page.NextCursor
+	}
+}
+
+func TestListSessionsPaginates(t *testing.T) {
+	pagedScans(t, setupRedis(t))
+	for i := 0; i < 7; i++ {
+		owner := "alice"
+		if i >= 5 {
+			owner = "bob"
+		}
+		id := "list-" + strconv.Itoa(i)
+		if err := saveSessionMeta(&SessionMeta{SessionID: id, Owner: owner, Title: "Session " + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids, pages := listSessionPages(t, listSessionsHandler, "/sessions?owner=alice&limit=2", false)
+	if pages < 2 {
+		t.Errorf("listing took %d page, want several", pages)
+	}
+	slices.Sort(ids)
+	if want := []string{"list-0", "list-1", "list-2", "list-3", "list-4"}; !slices.Equal(ids, want) {
+		t.Fatalf("alice's sessions = %v, want %v", ids, want)
+	}
+
+	if all, _ := listSessionPages(t, listSessionsHandler, "/sessions?limit=3", true); len(all) != 7 {
+		t.Fatalf("admin listing has %d sessions, want 7: %v", len(all), all)
+	}
+}
+
+func TestListSessionsWithoutOwnerNeedsAdmin(t *testing.T) {
+	setupRedis(t)
+	w := httptest.NewRecorder()
+	listSessionsHandler(w, httptest.NewRequest("GET", "/sessions", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", w.Code)
+	}
+}
+
+func TestListSessionsRejectsBadLimit(t *testing.T) {
+	setupRedis(t)
+	w := httptest.NewRecorder()
+	listSessionsHandler(w, httptest.NewRequest("GET", "/sessions?owner=alice&limit=1000", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+}
+
+func TestPersistAiMessageFalse(t *testing.T) {
+	setupRedis(t)
+	countingReply(t, "gemini")
+
+	resp := chatTurn(t, map[string]interface{}{"sessionId": "partial-1", "modelName": "gemini", "persistAiMessage": false, "contents": userTurn("My secret question")})
+	if resp.Text != "reply 1" {
+		t.Fatalf("reply = %q, want it returned even though it isn't stored", resp.Text)
+	}
+	history := storedHistory(t, "partial-1")
+	last := history[len(history)-1]
+	if last.Role != "user" || last.Text != "My secret question" || !last.ReplyOmitted {
+		t.Fatalf("last stored message = %+v, want the user message marked replyOmitted", last)
+	}
+	for _, m := range history {
+		if m.Role == "ai" {
+			t.Fatalf("AI reply stored: %+v", m)
+		}
+	}
+
+	// The next turn keeps the message rather than taking it for a failed
+	// turn.
+	chatTurn(t, map[string]interface{}{"sessionId": "partial-1", "modelName": "gemini", "contents": userTurn("Another question")})
+	var got []string
+	for _, m := range storedHistory(t, "partial-1") {
+		if m.Role != "system" {
+			got = append(got, m.Role+":"+m.Text)
+		}
+	}
+	if want := []string{"user:My secret question", "user:Another question", "ai:reply 2"}; !slices.Equal(got, want) {
+		t.Fatalf("history = %v, want %v", got, want)
+	}
+}
+
+func TestPersistUserMessageFalse(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Public answer"))
+
+	chatTurn(t, map[string]interface{}{"sessionId": "partial-2", "modelName": "gemini", "persistUserMessage": false, "contents": userTurn("Sensitive question")})
+	for _, m := range storedHistory(t, "partial-2") {
+		if m.Role == "user" {
+			t.Fatalf("user message stored: %+v", m)
+		}
+	}
+	if history := storedHistory(t, "partial-2"); history[len(history)-1].Text != "Public answer" {
+		t.Fatalf("history = %+v, want the AI reply stored", history)
+	}
+}
+
+func TestPersistAiMessageFalseOnStream(t *testing.T) {
+	setupRedis(t)
+	stubStream(t, "gemini", streamDeltas(nil, "Streamed ", "reply"))
+
+	postStream(t, map[string]interface{}{"sessionId": "partial-3", "modelName": "gemini", "persistAiMessage": false, "contents": userTurn("Hi")})
+	history := storedHistory(t, "partial-3")
+	if last := history[len(history)-1]; last.Role != "user" || !last.ReplyOmitted {
+		t.Fatalf("last stored message = %+v, want the user message without its reply", last)
+	}
+}
+
+func TestContinueNeedsPersistedReply(t *testing.T) {
+	setupRedis(t)
+	saveTruncatedTurn(t, "partial-4", "claude")
+
+	w := postJSON(t, chatHandler, "/chat", map[string]interface{}{"sessionId": "partial-4", "modelName": "claude", "continue": true, "persistAiMessage": false, "contents": userTurn("")})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400, body %s", w.Code, w.Body)
+	}
+}
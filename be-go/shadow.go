@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"time"
+)
+
+// Shadow traffic mirrors a sample of chat requests to a candidate model so it
+// can be compared with the live one before switching. SHADOW_SAMPLE_RATE (0 to
+// 1) of the requests are also sent to SHADOW_MODEL after the client has been
+// answered, and both replies are logged. The shadow reply is never returned,
+// stored or waited for.
+var (
+	shadowModel      = os.Getenv("SHADOW_MODEL")
+	shadowSampleRate = envFloat("SHADOW_SAMPLE_RATE", 0)
+)
+
+// shadowTimeout bounds a shadow call, which has no client waiting on it.
+const shadowTimeout = 60 * time.Second
+
+// shadowSampled decides whether a request is mirrored.
+var shadowSampled = func() bool {
+	return shadowSampleRate > 0 && rand.Float64() < shadowSampleRate
+}
+
+// maybeShadow mirrors a sampled request to the shadow model in the
+// background and logs its reply next to the primary one.
+func maybeShadow(primaryModel string, req ProviderRequest, primary ProviderResponse) {
+	if shadowModel == "" || shadowModel == primaryModel || !shadowSampled() {
+		return
+	}
+	model := shadowModel
+	call, ok := providers[model]
+	if !ok {
+		slog.Warn("SHADOW_MODEL is not a registered model", "model", model)
+		return
+	}
+
+	go func() {
+		shadowCtx, cancel := context.WithTimeout(withProviderTimeout(withAttemptBudget(context.Background(), 1), model), shadowTimeout)
+		defer cancel()
+
+		start := time.Now()
+		shadow, err := call(shadowCtx, req)
+		latency := time.Since(start)
+
+		primaryTokenizer, shadowTokenizer := tokenizerFor(primaryModel), tokenizerFor(model)
+		attrs := []any{
+			"primaryModel", primaryModel,
+			"primaryText", primary.Text,
+			"primaryPromptTokens", countMessageTokens(primaryTokenizer, req.Messages),
+			"primaryCompletionTokens", primaryTokenizer.CountTokens(primary.Text),
+			"shadowModel", model,
+			"shadowLatency", latency,
+			"shadowPromptTokens", countMessageTokens(shadowTokenizer, req.Messages),
+		}
+		if err != nil {
+			slog.Warn("Shadow request failed", append(attrs, "error", err)...)
+			return
+		}
+		slog.Info("Shadow comparison", append(attrs,
+			"shadowText", shadow.Text,
+			"shadowCompletionTokens", shadowTokenizer.CountTokens(shadow.Text))...)
+	}()
+}
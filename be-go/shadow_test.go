@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// shadowCalls points SHADOW_MODEL at a stubbed claude and returns the
+// requests it receives. The stub holds each call until release is closed.
+func shadowCalls(t *testing.T, sampled bool) (calls chan ProviderRequest, release chan struct{}) {
+	t.Helper()
+	setVar(t, &shadowModel, "claude")
+	setVar(t, &shadowSampled, func() bool { return sampled })
+	calls = make(chan ProviderRequest, 1)
+	release = make(chan struct{})
+	stubChat(t, "claude", func(_ context.Context, req ProviderRequest) (ProviderResponse, error) {
+		calls <- req
+		<-release
+		return ProviderResponse{Text: "Shadow reply"}, nil
+	})
+	return calls, release
+}
+
+func TestShadowCallForSampledRequest(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Primary reply"))
+	calls, release := shadowCalls(t, true)
+	defer close(release)
+
+	// The shadow call is still blocked, so the client was not kept waiting.
+	resp := chatTurn(t, map[string]interface{}{"sessionId": "shadow-1", "modelName": "gemini", "contents": userTurn("Hi")})
+	if resp.Text != "Primary reply" || resp.Model != "gemini" {
+		t.Errorf("response = %q from %s, want the primary reply", resp.Text, resp.Model)
+	}
+
+	select {
+	case req := <-calls:
+		if lastUserText(req.Messages) != "Hi" {
+			t.Errorf("shadow prompt = %+v, want the primary's messages", req.Messages)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no shadow call for a sampled request")
+	}
+	for _, m := range storedHistory(t, "shadow-1") {
+		if m.Text == "Shadow reply" {
+			t.Error("shadow reply was stored")
+		}
+	}
+}
+
+func TestNoShadowCallForUnsampledRequest(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Primary reply"))
+	calls, release := shadowCalls(t, false)
+	defer close(release)
+
+	chatTurn(t, map[string]interface{}{"sessionId": "shadow-2", "modelName": "gemini", "contents": userTurn("Hi")})
+	select {
+	case <-calls:
+		t.Fatal("shadow call for an unsampled request")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// On SIGINT or SIGTERM the server stops accepting connections and waits up to
+// SHUTDOWN_TIMEOUT for in-flight requests. Open streams get
+// STREAM_DRAIN_GRACE of that to finish on their own before they are ended
+// with a done event carrying "shutdown": true.
+var (
+	shutdownTimeout  = envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	streamDrainGrace = envDuration("STREAM_DRAIN_GRACE", 10*time.Second)
+)
+
+// errServerShutdown is the cancellation cause of streams closed on shutdown.
+var errServerShutdown = errors.New("server shutting down")
+
+// shutdown stops server gracefully, draining open streams.
+func shutdown(server *http.Server) {
+	slog.Info("Shutting down", "timeout", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// Shutdown closes the listeners at once and then waits for the
+	// handlers, streams included, which drain ends in time.
+	go activeStreams.drain(shutdownCtx, streamDrainGrace)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Shutdown did not complete", "error", err)
+		return
+	}
+	slog.Info("Server stopped")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamServer serves /chat/stream with a fresh stream registry, so the
+// draining a shutdown starts doesn't outlive the test.
+func streamServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	setVar(t, &activeStreams, &streamRegistry{cancels: make(map[string]context.CancelCauseFunc)})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chat/stream", chatStreamHandler)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// startStream starts a stream on srv and returns the response once the
+// provider call is under way.
+func startStream(t *testing.T, srv *httptest.Server, sessionId string, started chan struct{}) *http.Response {
+	t.Helper()
+	payload := `{"sessionId":"` + sessionId + `","modelName":"gemini","contents":[{"role":"user","text":"Tell me a story"}]}`
+	resp, err := http.Post(srv.URL+"/chat/stream", "application/json", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	<-started
+	return resp
+}
+
+func TestShutdownEndsOpenStreams(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &streamDrainGrace, 50*time.Millisecond)
+	setVar(t, &shutdownTimeout, 5*time.Second)
+	started := make(chan struct{})
+	stubStream(t, "gemini", func(ctx context.Context, req ProviderRequest, onDelta func(string) error) (string, error) {
+		if err := onDelta("Once upon"); err != nil {
+			return "", err
+		}
+		close(started)
+		select {
+		case <-ctx.Done():
+			return "Once upon", ctx.Err()
+		case <-time.After(5 * time.Second):
+			return "Once upon a time", nil
+		}
+	})
+	srv := streamServer(t)
+	resp := startStream(t, srv, "shutdown-1", started)
+
+	stopped := make(chan struct{})
+	go func() {
+		shutdown(srv.Config)
+		close(stopped)
+	}()
+
+	events := readSSE(t, bufio.NewReader(resp.Body))
+	last := events[len(events)-1]
+	if last.Name != "done" || last.Data["shutdown"] != true || last.Data["text"] != "Once upon" {
+		t.Fatalf("last event = %+v, want a done event marked shutdown", last)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown did not return once the stream ended")
+	}
+
+	// No stream is started once draining.
+	w := postJSON(t, chatStreamHandler, "/chat/stream", map[string]interface{}{"sessionId": "shutdown-2", "modelName": "gemini", "contents": userTurn("Hi")})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("stream during shutdown status = %d, want 503", w.Code)
+	}
+	if e := decodeError(t, w); e.Code != codeOverloaded {
+		t.Fatalf("error code = %q, want %q", e.Code, codeOverloaded)
+	}
+}
+
+func TestShutdownLetsStreamsFinish(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &streamDrainGrace, 2*time.Second)
+	setVar(t, &shutdownTimeout, 5*time.Second)
+	started := make(chan struct{})
+	stubStream(t, "gemini", func(ctx context.Context, req ProviderRequest, onDelta func(string) error) (string, error) {
+		onDelta("Once upon")
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		if err := onDelta(" a time"); err != nil {
+			return "Once upon", err
+		}
+		return "Once upon a time", nil
+	})
+	srv := streamServer(t)
+	resp := startStream(t, srv, "shutdown-3", started)
+
+	go shutdown(srv.Config)
+	events := readSSE(t, bufio.NewReader(resp.Body))
+	last := events[len(events)-1]
+	if last.Name != "done" || last.Data["text"] != "Once upon a time" || last.Data["shutdown"] != nil {
+		t.Fatalf("last event = %+v, want the stream to finish within the grace period", last)
+	}
+}
+
+func TestDrainWithoutStreams(t *testing.T) {
+	registry := &streamRegistry{cancels: make(map[string]context.CancelCauseFunc)}
+	start := time.Now()
+	registry.drain(context.Background(), time.Minute)
+	if time.Since(start) > time.Second {
+		t.Fatal("drain waited with no open streams")
+	}
+	if registry.add("late", func(error) {}) {
+		t.Fatal("stream registered after draining started")
+	}
+}
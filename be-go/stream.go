@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// persistPartialStreams controls whether the text generated so far is saved to
+// the session history when a stream is cancelled or stalls before it
+// completes.
+var persistPartialStreams = os.Getenv("PERSIST_PARTIAL_STREAMS") == "true"
+
+// streamStartEvent sends an "event: start" with the request id and model
+// before the provider is called, so clients can show a "thinking" state
+// until the first delta. STREAM_START_EVENT=false turns it off.
+var streamStartEvent = os.Getenv("STREAM_START_EVENT") != "false"
+
+// Streamed replies are checkpointed to Redis every streamCheckpointInterval or
+// every streamCheckpointDeltas deltas, whichever comes first, so a crash
+// mid-stream leaves the partial answer in the history. 0 disables either
+// trigger.
+var (
+	streamCheckpointInterval = envDuration("STREAM_CHECKPOINT_INTERVAL", 0)
+	streamCheckpointDeltas   = envInt("STREAM_CHECKPOINT_DELTAS", 0)
+)
+
+// streamClient is used for streamed provider calls. It has no overall timeout
+// because a stream legitimately stays open for as long as the model generates;
+// it is bounded by the request context instead (client disconnect or cancel).
+var streamClient = &http.Client{Transport: providerTransport}
+
+// streamIdleTimeout aborts a stream that receives no data for that long, so a
+// provider stalling mid-answer doesn't hold the request open. 0 (the default)
+// uses the model's provider timeout, see timeoutFor; a negative value
+// disables it.
+var streamIdleTimeout = envDuration("STREAM_IDLE_TIMEOUT", 0)
+
+// errStreamIdle is returned when a stream was aborted by the idle timeout.
+var errStreamIdle = errors.New("provider stream stalled")
+
+// idleTimeoutFor returns the idle timeout of a stream opened under ctx, 0 for
+// none.
+func idleTimeoutFor(ctx context.Context) time.Duration {
+	if streamIdleTimeout != 0 {
+		return max(streamIdleTimeout, 0)
+	}
+	return requestTimeout(ctx)
+}
+
+// idleTimeoutBody closes a stream body that yields no data within timeout;
+// the pending read then fails with errStreamIdle.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	idle    atomic.Bool
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, timeout: timeout}
+	b.timer = time.AfterFunc(timeout, func() {
+		b.idle.Store(true)
+		body.Close()
+	})
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.idle.Load() {
+		return n, fmt.Errorf("%w: no data for %s", errStreamIdle, b.timeout)
+	}
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
+
+// streamFunc is a provider call that reports text deltas as they arrive and
+// returns the full accumulated text.
+type streamFunc func(ctx context.Context, req ProviderRequest, onDelta func(string) error) (string, error)
+
+// streamRegistry tracks the cancel functions of in-flight streams by request ID
+// so that POST /chat/cancel can stop them, and so they can be drained on
+// shutdown.
+type streamRegistry struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelCauseFunc
+	// draining is set on shutdown; no stream is added after it.
+	draining bool
+	// idle is closed when the registry empties while draining.
+	idle chan struct{}
+}
+
+var activeStreams = &streamRegistry{cancels: make(map[string]context.CancelCauseFunc)}
+
+// add registers a stream. It reports false, registering nothing, once the
+// server is shutting down.
+func (s *streamRegistry) add(requestID string, cancel context.CancelCauseFunc) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.cancels[requestID] = cancel
+	return true
+}
+
+func (s *streamRegistry) remove(requestID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cancels, requestID)
+	if s.draining && len(s.cancels) == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+// drain stops new streams and gives the open ones grace to finish. Those
+// still open after it are cancelled with errServerShutdown, which ends them
+// with a done event. drain returns once they are all gone or ctx is done.
+func (s *streamRegistry) drain(ctx context.Context, grace time.Duration) {
+	s.mu.Lock()
+	s.draining = true
+	open := len(s.cancels)
+	idle := make(chan struct{})
+	if open == 0 {
+		close(idle)
+	} else {
+		s.idle = idle
+	}
+	s.mu.Unlock()
+	if open == 0 {
+		return
+	}
+	slog.Info("Draining streams", "open", open, "grace", grace)
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+
+	s.mu.Lock()
+	slog.Info("Closing streams still open after the grace period", "open", len(s.cancels))
+	for _, cancel := range s.cancels {
+		cancel(errServerShutdown)
+	}
+	s.mu.Unlock()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+	}
+}
+
+// cancel stops the stream with the given request ID. It reports whether such a
+// stream was in flight.
+func (s *streamRegistry) cancel(requestID string) bool {
+	s.mu.Lock()
+	cancel, ok := s.cancels[requestID]
+	s.mu.Unlock()
+	if ok {
+		cancel(nil)
+	}
+	return ok
+}
+
+// newRequestID returns a random identifier for a stream.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// streamCheckpointer saves the partial reply of a stream as it grows.
+type streamCheckpointer struct {
+	sessionID string
+	model     string
+	tenant    *Tenant
+	// history is the conversation up to and including the user message.
+	history  []Message
+	lastSave time.Time
+	pending  int
+	// saved is set once a checkpoint has been written.
+	saved bool
+}
+
+func newStreamCheckpointer(tenant *Tenant, sessionID, model string, history []Message) *streamCheckpointer {
+	return &streamCheckpointer{sessionID: sessionID, model: model, tenant: tenant, history: history, lastSave: time.Now()}
+}
+
+// observe is called after each delta with the text received so far and
+// writes a checkpoint when one of the triggers is due.
+func (c *streamCheckpointer) observe(partial string) {
+	if streamCheckpointInterval <= 0 && streamCheckpointDeltas <= 0 {
+		return
+	}
+	c.pending++
+	due := (streamCheckpointDeltas > 0 && c.pending >= streamCheckpointDeltas) ||
+		(streamCheckpointInterval > 0 && time.Since(c.lastSave) >= streamCheckpointInterval)
+	if !due {
+		return
+	}
+
+	checkpoint := append(append([]Message(nil), c.history...), Message{Role: "ai", Text: partial, Partial: true, Model: c.model, CreatedAt: time.Now().UTC()})
+	if err := saveHistoryToRedis(c.sessionID, checkpoint, c.tenant); err != nil {
+		slog.Error("Error checkpointing stream", "sessionId", c.sessionID, "error", err)
+		return
+	}
+	c.saved = true
+	c.pending = 0
+	c.lastSave = time.Now()
+}
+
+// discard removes a checkpoint written for a stream whose reply is not kept.
+func (c *streamCheckpointer) discard() {
+	if !c.saved {
+		return
+	}
+	if err := saveHistoryToRedis(c.sessionID, c.history, c.tenant); err != nil {
+		slog.Error("Error removing stream checkpoint", "sessionId", c.sessionID, "error", err)
+	}
+}
+
+// writeSSE writes a single server-sent event and flushes it to the client.
+func writeSSE(w http.ResponseWriter, event string, data interface{}) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	jsonData = styleResponseJSON(jsonData)
+	if event != "" {
+		if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", jsonData); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// chatStreamHandler is the streaming variant of chatHandler. It answers with a
+// text/event-stream of `data: {"text": "<delta>"}` events followed by a final
+// `event: done` carrying the full text. The X-Request-Id response header holds
+// the ID to pass to /chat/cancel to stop generation.
+func chatStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only POST requests are allowed")
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+
+	tenant := admitTenant(w, r)
+	if tenant == nil {
+		return
+	}
+
+	var clientPayload ClientRequestPayload
+	if err := decodeJSON(r.Body, &clientPayload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+	if err := applyAPIVersion(&clientPayload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	persist := clientPayload.persistEnabled()
+	if (persist && clientPayload.SessionID == "") || len(clientPayload.Contents) == 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing sessionId or message content")
+		return
+	}
+	if persist && !admitSession(w, tenant, clientPayload.SessionID) {
+		return
+	}
+
+	clientPayload.ModelName = resolveModelName(clientPayload.ModelName)
+	if clientPayload.ModelName == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing modelName and no DEFAULT_MODEL configured")
+		return
+	}
+	if clientPayload.ModelName == autoModelName {
+		model, err := resolveAutoModel(clientPayload, func(name string) bool { _, ok := streamProviderFor(name); return ok })
+		if err != nil {
+			writeAutoModelError(w, err)
+			return
+		}
+		clientPayload.ModelName = model
+	}
+	stream, ok := streamProviderFor(clientPayload.ModelName)
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeModelNotFound, invalidModelMessage("Invalid model name or model does not support streaming"))
+		return
+	}
+	if err := validateMaxTokens(clientPayload.ModelName, clientPayload.MaxTokens); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := validateContinuation(&clientPayload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if clientPayload.Continue {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "continue is only supported on /chat")
+		return
+	}
+
+	if clientPayload.N > 1 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "n is not supported when streaming")
+		return
+	}
+
+	if err := validateSafetySettings(clientPayload.SafetySettings); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := clientPayload.GenerationSettings.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := validateSystemPrompts(clientPayload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+	if err := validateUserMetadata(clientPayload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+		return
+	}
+
+	var history, messages []Message
+	var dropped int
+	// Every upstream call made for this request draws from one shared budget.
+	requestCtx := withAttemptBudget(r.Context(), maxAttempts)
+	var compact func()
+	var err error
+	if persist {
+		// The session stays locked for the whole stream.
+		lock, ok := admitSessionLock(w, r, clientPayload.SessionID)
+		if !ok {
+			return
+		}
+		defer lock.release()
+
+		history, err = prepareHistory(clientPayload)
+		if errors.Is(err, errConversationTooOld) {
+			writeError(w, http.StatusGone, codeConversationExpired, err.Error())
+			return
+		}
+		if isSystemPromptLimit(err) {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, err.Error())
+			return
+		}
+		if err != nil {
+			slog.Error("Error in getHistoryFromRedis", "error", err)
+			writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error retrieving history")
+			return
+		}
+		if reply, ok := duplicateReply(clientPayload, history); ok {
+			// Replay the stored answer as a one-delta stream.
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			writeSSE(w, "", map[string]string{"text": reply.Text})
+			writeSSE(w, "done", map[string]interface{}{"text": reply.Text, "cancelled": false, "duplicate": true})
+			return
+		}
+		compact = idleCompaction(requestCtx, clientPayload.SessionID, clientPayload.ModelName, history)
+		messages, dropped, err = providerMessages(clientPayload, history)
+	} else {
+		messages, dropped, err = statelessMessages(clientPayload)
+	}
+	if err != nil {
+		writeMessagesError(w, err)
+		return
+	}
+
+	// Register the stream so it can be stopped from /chat/cancel. The context
+	// is also cancelled if the client goes away.
+	requestID := newRequestID()
+	streamCtx, cancel := context.WithCancelCause(withProviderTimeout(requestCtx, clientPayload.ModelName))
+	defer cancel(nil)
+	streamCtx, finish := withFinishReason(streamCtx)
+	streamCtx, reported := withProviderUsage(streamCtx)
+	if !activeStreams.add(requestID, cancel) {
+		writeError(w, http.StatusServiceUnavailable, codeOverloaded, "Server is shutting down, please retry later")
+		return
+	}
+	defer activeStreams.remove(requestID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Request-Id", requestID)
+	w.WriteHeader(http.StatusOK)
+	if streamStartEvent {
+		// Sent before the provider is called, so the client can show that
+		// the answer is on its way.
+		writeSSE(w, "start", map[string]string{"requestId": requestID, "model": clientPayload.ModelName})
+	} else if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	checkpointer := newStreamCheckpointer(tenant, clientPayload.SessionID, clientPayload.ModelName, history)
+	var partial strings.Builder
+	generation := generationFor(clientPayload)
+	aiText, err := stream(streamCtx, ProviderRequest{
+		Messages:         messages,
+		MaxTokens:        generation.MaxTokens,
+		Temperature:      generation.Temperature,
+		PresencePenalty:  generation.PresencePenalty,
+		FrequencyPenalty: generation.FrequencyPenalty,
+		ReasoningEffort:  generation.ReasoningEffort,
+		SafetySettings:   clientPayload.SafetySettings,
+		UserID:           clientPayload.UserID,
+		Metadata:         clientPayload.Metadata,
+	}, func(delta string) error {
+		partial.WriteString(delta)
+		// A checkpoint stores the whole turn, so it is skipped for turns
+		// stored only in part.
+		if persist && clientPayload.persistsUserMessage() && clientPayload.persistsAIMessage() {
+			checkpointer.observe(partial.String())
+		}
+		return writeSSE(w, "", map[string]string{"text": delta})
+	})
+
+	cancelled := errors.Is(err, context.Canceled)
+	if err != nil && !cancelled {
+		// Any checkpoint is left in place so the partial answer survives,
+		// and a stalled stream's text is kept if partial streams are.
+		slog.Error("Stream failed", "requestId", requestID, "error", err)
+		if persist && persistPartialStreams && errors.Is(err, errStreamIdle) && aiText != "" {
+			history = append(history, Message{Role: "ai", Text: aiText, Model: clientPayload.ModelName, CreatedAt: time.Now().UTC()})
+			recordTurn(tenant, clientPayload.SessionID, storedTurn(clientPayload, history))
+		}
+		_, code := providerErrorCode(err)
+		event := map[string]string{"error": err.Error(), "code": code}
+		var provErr *providerError
+		if errors.As(err, &provErr) {
+			event["provider"], event["model"] = provErr.Provider, provErr.Model
+		}
+		writeSSE(w, "error", event)
+		return
+	}
+	usage := reported.or(estimateUsage(clientPayload.ModelName, messages, aiText))
+	recordUsage(tenant, clientPayload.SessionID, clientPayload.ModelName, usage)
+
+	if persist {
+		if !cancelled || (persistPartialStreams && aiText != "") {
+			// The final text replaces any checkpoint.
+			history = append(history, Message{Role: "ai", Text: aiText, Model: clientPayload.ModelName, FinishReason: finish.stored(), CreatedAt: time.Now().UTC()})
+			history = storedTurn(clientPayload, history)
+			recordTurn(tenant, clientPayload.SessionID, history)
+			maybeGenerateTitle(clientPayload.SessionID, clientPayload.ModelName, history)
+			emitTurnEvent(tenant, clientPayload.SessionID, clientPayload.ModelName, history)
+			if compact != nil {
+				go compact()
+			}
+		} else {
+			checkpointer.discard()
+		}
+	}
+
+	done := map[string]interface{}{
+		"text":      aiText,
+		"cancelled": cancelled,
+		"model":     clientPayload.ModelName,
+		"usage":     usage,
+	}
+	// The same "truncated" value as a /chat response.
+	if truncated := truncationFor(dropped, finish); truncated != nil {
+		done["truncated"] = truncated
+	}
+	if context.Cause(streamCtx) == errServerShutdown {
+		done["shutdown"] = true
+	}
+	writeSSE(w, "done", done)
+}
+
+// cancelStreamHandler stops an in-flight stream started by chatStreamHandler.
+func cancelStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "Only POST requests are allowed")
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+
+	var body struct {
+		RequestID string `json:"requestId"`
+	}
+	if err := decodeJSON(r.Body, &body); err != nil || body.RequestID == "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Missing requestId")
+		return
+	}
+
+	if !activeStreams.cancel(body.RequestID) {
+		writeError(w, http.StatusNotFound, codeNotFound, "No active stream with that requestId")
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, map[string]bool{"cancelled": true})
+}
+
+// streamOpenaiStyle posts a streaming chat completion request and forwards the
+// content deltas of the `data:` events until `data: [DONE]`. On cancellation it
+// returns the text received so far together with the context error. A stream
+// without content is an emptyResponseError of the provider name.
+func streamOpenaiStyle(ctx context.Context, name, url string, headers map[string]string, jsonPayload []byte, onDelta func(string) error) (string, error) {
+	resp, err := openStream(ctx, url, headers, jsonPayload, "text/event-stream")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// full keeps the raw bytes, so characters split across deltas come
+	// out whole; joiner does the same for the deltas passed on.
+	var full strings.Builder
+	var joiner utf8Joiner
+	text := func() string { return strings.ToValidUTF8(full.String(), "\uFFFD") }
+	reason := ""
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+		protected := false
+		if streamUTF8Buffering {
+			data, protected = protectInvalidUTF8(data)
+		}
+
+		var chunk OpenaiStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return text(), fmt.Errorf("error parsing stream chunk: %w", err)
+		}
+		if chunk.Usage != nil {
+			recordProviderUsage(ctx, chunk.Usage.PromptTokens, chunk.Usage.CompletionTokens, chunk.Usage.TotalTokens)
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].FinishReason != "" {
+			reason = chunk.Choices[0].FinishReason
+			recordFinishReason(ctx, reason)
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		delta := chunk.Choices[0].Delta.Content
+		if protected {
+			delta = restoreInvalidUTF8(delta)
+		}
+		full.WriteString(delta)
+		if complete := joiner.push(delta); complete != "" {
+			if err := onDelta(complete); err != nil {
+				return text(), err
+			}
+		}
+	}
+
+	// A cancelled context surfaces as a read error on the body.
+	if ctx.Err() != nil {
+		return text(), ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return text(), fmt.Errorf("error reading stream: %w", err)
+	}
+	if full.Len() == 0 {
+		return "", emptyResponseError(name, reason)
+	}
+	if rest := joiner.flush(); rest != "" {
+		if err := onDelta(rest); err != nil {
+			return text(), err
+		}
+	}
+	return text(), nil
+}
+
+// openStream POSTs a streaming request on streamClient and returns the
+// response if the provider answered 200, its body subject to the idle
+// timeout. The caller closes the body.
+func openStream(ctx context.Context, url string, headers map[string]string, jsonPayload []byte, accept string) (*http.Response, error) {
+	streamHeaders := map[string]string{"Accept": accept}
+	for name, value := range headers {
+		streamHeaders[name] = value
+	}
+	resp, err := sendProviderRequest(ctx, streamClient, url, streamHeaders, jsonPayload)
+	if err != nil {
+		return nil, err
+	}
+	if timeout := idleTimeoutFor(ctx); timeout > 0 {
+		resp.Body = newIdleTimeoutBody(resp.Body, timeout)
+	}
+	return resp, nil
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is one event read from a stream response.
+type sseEvent struct {
+	Name string
+	Data map[string]interface{}
+}
+
+// readSSE reads every event of a stream response body.
+func readSSE(t *testing.T, body *bufio.Reader) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	name := ""
+	for {
+		line, err := body.ReadString('\n')
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			var data map[string]interface{}
+			if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &data); err != nil {
+				t.Fatalf("decoding event %q: %v", line, err)
+			}
+			events = append(events, sseEvent{name, data})
+			name = ""
+		}
+		if err != nil {
+			return events
+		}
+	}
+}
+
+func TestCancelStreamCancelsProviderCall(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &persistPartialStreams, true)
+	started := make(chan struct{})
+	upstream := make(chan error, 1)
+	stubStream(t, "gemini", func(ctx context.Context, req ProviderRequest, onDelta func(string) error) (string, error) {
+		if err := onDelta("Once upon"); err != nil {
+			return "", err
+		}
+		close(started)
+		select {
+		case <-ctx.Done():
+			upstream <- ctx.Err()
+			return "Once upon", ctx.Err()
+		case <-time.After(5 * time.Second):
+			upstream <- nil
+			return "Once upon a time", nil
+		}
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chat/stream", chatStreamHandler)
+	mux.HandleFunc("/chat/cancel", cancelStreamHandler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	payload := `{"sessionId":"cancel-1","modelName":"gemini","contents":[{"role":"user","text":"Tell me a story"}]}`
+	resp, err := http.Post(srv.URL+"/chat/stream", "application/json", strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	requestID := resp.Header.Get("X-Request-Id")
+	if requestID == "" {
+		t.Fatal("stream response has no X-Request-Id")
+	}
+	<-started
+
+	cancel, err := http.Post(srv.URL+"/chat/cancel", "application/json", bytes.NewReader([]byte(`{"requestId":"`+requestID+`"}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel.Body.Close()
+	if cancel.StatusCode != http.StatusOK {
+		t.Fatalf("cancel status = %d, want 200", cancel.StatusCode)
+	}
+
+	if err := <-upstream; err != context.Canceled {
+		t.Fatalf("upstream context error = %v, want context.Canceled", err)
+	}
+	events := readSSE(t, bufio.NewReader(resp.Body))
+	last := events[len(events)-1]
+	if last.Name != "done" || last.Data["cancelled"] != true {
+		t.Fatalf("last event = %+v, want a cancelled done event", last)
+	}
+
+	history := storedHistory(t, "cancel-1")
+	if got := history[len(history)-1]; got.Role != "ai" || got.Text != "Once upon" {
+		t.Fatalf("stored reply = %+v, want the partial text", got)
+	}
+}
+
+func TestCancelUnknownStream(t *testing.T) {
+	w := postJSON(t, cancelStreamHandler, "/chat/cancel", map[string]string{"requestId": "nope"})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", w.Code)
+	}
+}
+
+// streamDeltas returns a stream call sending deltas and then failing with
+// err, or finishing when err is nil.
+func streamDeltas(err error, deltas ...string) streamFunc {
+	return func(ctx context.Context, req ProviderRequest, onDelta func(string) error) (string, error) {
+		var text strings.Builder
+		for _, d := range deltas {
+			text.WriteString(d)
+			if err := onDelta(d); err != nil {
+				return text.String(), err
+			}
+		}
+		return text.String(), err
+	}
+}
+
+// postStream serves a /chat/stream request and returns its events.
+func postStream(t *testing.T, payload map[string]interface{}) []sseEvent {
+	t.Helper()
+	w := postJSON(t, chatStreamHandler, "/chat/stream", payload)
+	if w.Code != http.StatusOK {
+		t.Fatalf("stream status = %d, body %s", w.Code, w.Body)
+	}
+	return readSSE(t, bufio.NewReader(w.Body))
+}
+
+func TestInterruptedStreamLeavesCheckpoint(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &streamCheckpointDeltas, 2)
+	stubStream(t, "gemini", streamDeltas(errors.New("connection reset by peer"), "The ", "answer ", "is"))
+
+	events := postStream(t, map[string]interface{}{"sessionId": "checkpoint-1", "modelName": "gemini", "contents": userTurn("What is it?")})
+	if last := events[len(events)-1]; last.Name != "error" {
+		t.Fatalf("last event = %+v, want the stream error", last)
+	}
+
+	history := storedHistory(t, "checkpoint-1")
+	partial := history[len(history)-1]
+	if partial.Role != "ai" || !partial.Partial || partial.Text != "The answer " {
+		t.Fatalf("last stored message = %+v, want the checkpointed partial reply", partial)
+	}
+}
+
+func TestCompletedStreamReplacesCheckpoint(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &streamCheckpointDeltas, 1)
+	stubStream(t, "gemini", streamDeltas(nil, "The ", "answer ", "is 42"))
+
+	postStream(t, map[string]interface{}{"sessionId": "checkpoint-2", "modelName": "gemini", "contents": userTurn("What is it?")})
+
+	history := storedHistory(t, "checkpoint-2")
+	final := history[len(history)-1]
+	if final.Partial || final.Text != "The answer is 42" {
+		t.Fatalf("last stored message = %+v, want the final reply", final)
+	}
+	if n := len(history); history[n-2].Role != "user" {
+		t.Fatalf("history = %+v, want only one reply after the user message", history)
+	}
+}
+
+func TestStreamStartsWithStartEvent(t *testing.T) {
+	setupRedis(t)
+	stubStream(t, "gemini", streamDeltas(nil, "Hello", " there"))
+
+	w := postJSON(t, chatStreamHandler, "/chat/stream", map[string]interface{}{"sessionId": "start-1", "modelName": "gemini", "contents": userTurn("Hi")})
+	events := readSSE(t, bufio.NewReader(w.Body))
+	if len(events) != 4 {
+		t.Fatalf("events = %+v, want start, two deltas and done", events)
+	}
+	start := events[0]
+	if start.Name != "start" || start.Data["model"] != "gemini" || start.Data["requestId"] != w.Header().Get("X-Request-Id") || start.Data["requestId"] == "" {
+		t.Errorf("first event = %+v, want start with the request id and model", start)
+	}
+	for _, e := range events[1:3] {
+		if e.Name != "" || e.Data["text"] == nil {
+			t.Errorf("event = %+v, want a delta after start", e)
+		}
+	}
+	done := events[3]
+	usage, _ := done.Data["usage"].(map[string]interface{})
+	if done.Name != "done" || done.Data["text"] != "Hello there" || usage["totalTokens"] == nil || usage["totalTokens"].(float64) <= 0 {
+		t.Errorf("last event = %+v, want done with the text and usage", done)
+	}
+}
+
+func TestStreamStartEventDisabled(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &streamStartEvent, false)
+	stubStream(t, "gemini", streamDeltas(nil, "Hello"))
+
+	events := postStream(t, map[string]interface{}{"sessionId": "start-2", "modelName": "gemini", "contents": userTurn("Hi")})
+	if events[0].Name == "start" {
+		t.Errorf("first event = %+v, want no start event", events[0])
+	}
+}
+
+// doneUsage returns the usage of a stream's done event.
+func doneUsage(t *testing.T, events []sseEvent) map[string]interface{} {
+	t.Helper()
+	done := events[len(events)-1]
+	if done.Name != "done" {
+		t.Fatalf("last event = %+v, want done", done)
+	}
+	usage, ok := done.Data["usage"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("done event %v has no usage", done.Data)
+	}
+	return usage
+}
+
+func assertUsage(t *testing.T, usage map[string]interface{}, prompt, completion, total float64) {
+	t.Helper()
+	if usage["promptTokens"] != prompt || usage["completionTokens"] != completion || usage["totalTokens"] != total {
+		t.Errorf("usage = %v, want %v/%v/%v", usage, prompt, completion, total)
+	}
+	if usage["estimated"] != nil {
+		t.Errorf("usage = %v, want the provider's counts, not an estimate", usage)
+	}
+}
+
+func TestOpenAIStreamDoneCarriesUsage(t *testing.T) {
+	setupRedis(t)
+	var askedUsage bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload OpenaiPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		askedUsage = payload.StreamOptions != nil && payload.StreamOptions.IncludeUsage
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n"+
+			"data: {\"choices\":[{\"delta\":{\"content\":\"lo\"},\"finish_reason\":\"stop\"}]}\n\n"+
+			"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":12,\"completion_tokens\":2,\"total_tokens\":14}}\n\n"+
+			"data: [DONE]\n\n")
+	}))
+	t.Cleanup(srv.Close)
+	setVar(t, &chatGPTProvider.URL, srv.URL)
+	setVar(t, &chatGPTProvider.APIKey, "test-key")
+
+	events := postStream(t, map[string]interface{}{"sessionId": "usage-openai", "modelName": "chatgpt", "contents": userTurn("Hi")})
+	if !askedUsage {
+		t.Error("stream request did not set stream_options.include_usage")
+	}
+	assertUsage(t, doneUsage(t, events), 12, 2, 14)
+}
+
+func TestClaudeStreamDoneCarriesUsage(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &claudeAPIKey, "test-key")
+	fakeProviderAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":20,\"output_tokens\":1}}}\n\n"+
+			"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"Hello\"}}\n\n"+
+			"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":5}}\n\n"+
+			"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+	})
+
+	events := postStream(t, map[string]interface{}{"sessionId": "usage-claude", "modelName": "claude", "contents": userTurn("Hi")})
+	assertUsage(t, doneUsage(t, events), 20, 5, 25)
+}
+
+func TestGeminiStreamDoneCarriesUsage(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &geminiAPIKey, "test-key")
+	fakeProviderAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `[{"candidates":[{"content":{"parts":[{"text":"Hel"}]}}],"usageMetadata":{"promptTokenCount":9,"candidatesTokenCount":1,"totalTokenCount":10}},
+{"candidates":[{"content":{"parts":[{"text":"lo"}]},"finishReason":"STOP"}],"usageMetadata":{"promptTokenCount":9,"candidatesTokenCount":3,"totalTokenCount":12}}]`)
+	})
+
+	events := postStream(t, map[string]interface{}{"sessionId": "usage-gemini", "modelName": "gemini", "contents": userTurn("Hi")})
+	assertUsage(t, doneUsage(t, events), 9, 3, 12)
+}
+
+func TestStreamDoneEstimatesMissingUsage(t *testing.T) {
+	setupRedis(t)
+	stubStream(t, "gemini", streamDeltas(nil, "Hello ", "there"))
+
+	usage := doneUsage(t, postStream(t, map[string]interface{}{"sessionId": "usage-estimate", "modelName": "gemini", "contents": userTurn("Hi")}))
+	if usage["estimated"] != true || usage["completionTokens"].(float64) == 0 {
+		t.Fatalf("usage = %v, want a tokenizer estimate", usage)
+	}
+}
+
+// stallingStream serves an OpenAI-style stream that sends two tokens and then
+// hangs until the client gives up.
+func stallingStream(t *testing.T) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, token := range []string{"Hello", " there"} {
+			io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\""+token+"\"}}]}\n\n")
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(srv.Close)
+	setVar(t, &chatGPTProvider.URL, srv.URL)
+	setVar(t, &chatGPTProvider.APIKey, "test-key")
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	setupRedis(t)
+	stallingStream(t)
+	setVar(t, &streamIdleTimeout, 100*time.Millisecond)
+
+	start := time.Now()
+	events := postStream(t, map[string]interface{}{"sessionId": "idle-1", "modelName": "chatgpt", "contents": userTurn("Hi")})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("stream took %v, want the idle timeout to end it", elapsed)
+	}
+	var deltas []string
+	for _, e := range events {
+		if e.Name == "" {
+			deltas = append(deltas, e.Data["text"].(string))
+		}
+	}
+	if strings.Join(deltas, "") != "Hello there" {
+		t.Errorf("deltas = %q, want the two tokens before the stall", deltas)
+	}
+	last := events[len(events)-1]
+	if last.Name != "error" || last.Data["code"] != codeProviderUnavailable || !strings.Contains(last.Data["error"].(string), errStreamIdle.Error()) {
+		t.Fatalf("last event = %+v, want a stalled stream error", last)
+	}
+	for _, m := range storedHistory(t, "idle-1") {
+		if m.Role == "ai" {
+			t.Errorf("partial reply stored without PERSIST_PARTIAL_STREAMS: %+v", m)
+		}
+	}
+}
+
+func TestStreamIdleTimeoutKeepsPartialReply(t *testing.T) {
+	setupRedis(t)
+	stallingStream(t)
+	setVar(t, &streamIdleTimeout, 100*time.Millisecond)
+	setVar(t, &persistPartialStreams, true)
+
+	postStream(t, map[string]interface{}{"sessionId": "idle-2", "modelName": "chatgpt", "contents": userTurn("Hi")})
+	history := storedHistory(t, "idle-2")
+	if last := history[len(history)-1]; last.Role != "ai" || last.Text != "Hello there" {
+		t.Fatalf("last stored message = %+v, want the partial reply", last)
+	}
+}
+
+func TestIdleTimeoutFor(t *testing.T) {
+	ctx := withProviderTimeout(context.Background(), "gemini")
+	setVar(t, &streamIdleTimeout, 0)
+	if got := idleTimeoutFor(ctx); got != requestTimeout(ctx) {
+		t.Errorf("default idle timeout = %v, want the provider timeout %v", got, requestTimeout(ctx))
+	}
+	setVar(t, &streamIdleTimeout, 3*time.Second)
+	if got := idleTimeoutFor(ctx); got != 3*time.Second {
+		t.Errorf("idle timeout = %v, want STREAM_IDLE_TIMEOUT", got)
+	}
+	setVar(t, &streamIdleTimeout, -time.Second)
+	if got := idleTimeoutFor(ctx); got != 0 {
+		t.Errorf("negative STREAM_IDLE_TIMEOUT gives %v, want it disabled", got)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// How system messages are handed to a provider.
+const (
+	// systemPromptAsUser sends them as ordinary user turns, which every
+	// provider accepts.
+	systemPromptAsUser = "user"
+	// systemPromptNative uses the provider's own system field (Gemini
+	// systemInstruction, an OpenAI "system" message, Anthropic's system).
+	systemPromptNative = "native"
+	// systemPromptIgnore drops them.
+	systemPromptIgnore = "ignore"
+)
+
+// Client-supplied system messages are capped so a request cannot crowd the
+// context with instructions: at most maxSystemPrompts of them, together at
+// most maxSystemPromptChars characters, both in one request and in all that a
+// session stores. 0 disables either limit.
+var (
+	maxSystemPrompts     = envInt("MAX_SYSTEM_PROMPTS", 4)
+	maxSystemPromptChars = envInt("MAX_SYSTEM_PROMPT_CHARS", 8000)
+)
+
+// systemPromptStrategies holds the strategy per model, read from
+// SYSTEM_PROMPT_STRATEGY as comma-separated model=strategy pairs. An entry
+// without a model sets the default for all others:
+//
+//	SYSTEM_PROMPT_STRATEGY=native,llama=user
+//
+// Models without an entry keep systemPromptAsUser.
+var systemPromptStrategies = loadSystemPromptStrategies()
+
+func loadSystemPromptStrategies() map[string]string {
+	strategies := map[string]string{}
+	value := os.Getenv("SYSTEM_PROMPT_STRATEGY")
+	if value == "" {
+		return strategies
+	}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		model, strategy, ok := strings.Cut(entry, "=")
+		if !ok {
+			model, strategy = "", entry
+		}
+		switch strategy {
+		case systemPromptAsUser, systemPromptNative, systemPromptIgnore:
+			strategies[model] = strategy
+		default:
+			warnConfig("Ignoring invalid SYSTEM_PROMPT_STRATEGY entry", "entry", entry)
+		}
+	}
+	return strategies
+}
+
+// systemPromptStrategy returns the strategy configured for a model.
+func systemPromptStrategy(modelName string) string {
+	if strategy, ok := systemPromptStrategies[modelName]; ok {
+		return strategy
+	}
+	if strategy, ok := systemPromptStrategies[""]; ok {
+		return strategy
+	}
+	return systemPromptAsUser
+}
+
+// systemPromptStrategy returns the strategy a provider call should apply: the
+// request's override, else the one configured for the model.
+func (req ProviderRequest) systemPromptStrategy(modelName string) string {
+	if req.SystemPromptStrategy != "" {
+		return req.SystemPromptStrategy
+	}
+	return systemPromptStrategy(modelName)
+}
+
+// isSystemPromptRejection reports whether err is a provider 400 blaming the
+// system prompt, e.g. Gemma models on the Gemini API answering "Developer
+// instruction is not enabled".
+func isSystemPromptRejection(err error) bool {
+	var statusErr *providerStatusError
+	if !errors.As(err, &statusErr) || statusErr.Status != http.StatusBadRequest {
+		return false
+	}
+	body := strings.ToLower(statusErr.Body)
+	return strings.Contains(body, "system") || strings.Contains(body, "developer instruction")
+}
+
+// withSystemPromptFallback wraps a provider call so that, when the model is
+// configured for native system prompts and the provider rejects them, the
+// call is retried once with the system prompt sent as a user turn instead.
+func withSystemPromptFallback(modelName string, call chatFunc) chatFunc {
+	return func(ctx context.Context, req ProviderRequest) (ProviderResponse, error) {
+		result, err := call(ctx, req)
+		if req.systemPromptStrategy(modelName) != systemPromptNative || !isSystemPromptRejection(err) {
+			return result, err
+		}
+		slog.Warn("Provider rejected the native system prompt, retrying with it inlined", "model", modelName, "error", err)
+		req.SystemPromptStrategy = systemPromptAsUser
+		return call(ctx, req)
+	}
+}
+
+// withStreamSystemPromptFallback is withSystemPromptFallback for streamed
+// calls. The rejection arrives before any delta, so nothing is emitted twice.
+func withStreamSystemPromptFallback(modelName string, stream streamFunc) streamFunc {
+	return func(ctx context.Context, req ProviderRequest, onDelta func(string) error) (string, error) {
+		text, err := stream(ctx, req, onDelta)
+		if req.systemPromptStrategy(modelName) != systemPromptNative || !isSystemPromptRejection(err) {
+			return text, err
+		}
+		slog.Warn("Provider rejected the native system prompt, retrying with it inlined", "model", modelName, "error", err)
+		req.SystemPromptStrategy = systemPromptAsUser
+		return stream(ctx, req, onDelta)
+	}
+}
+
+// applySystemPromptStrategy prepares messages for a provider. Under
+// systemPromptNative the system messages are removed and returned joined as
+// system, for the provider's own field; under systemPromptIgnore they are
+// removed and dropped. systemPromptAsUser leaves them to the role mapping.
+func applySystemPromptStrategy(messages []Message, strategy string) (system string, rest []Message) {
+	if strategy == systemPromptAsUser {
+		return "", messages
+	}
+
+	var prompts []string
+	rest = make([]Message, 0, len(messages))
+	for _, m := range messages {
+		if m.Role == "system" {
+			prompts = append(prompts, m.Text)
+			continue
+		}
+		rest = append(rest, m)
+	}
+	if strategy == systemPromptIgnore {
+		return "", rest
+	}
+	return strings.Join(prompts, "\n\n"), rest
+}
+
+// maxAssistantNameChars caps a per-request assistantName.
+const maxAssistantNameChars = 64
+
+// assistantName is the brand name the default system prompt gives the
+// assistant. Requests may override it with "assistantName". Empty leaves the
+// prompt unnamed.
+var assistantName = envString("ASSISTANT_NAME", "")
+
+// modelSystemPrompts holds system prompts tuned per model, read from
+// SYSTEM_PROMPTS as a JSON object of model to text/template. A new session
+// is seeded with its model's prompt instead of the generic one; templates see
+// the assistant name as .AssistantName and the model as .Model:
+//
+//	SYSTEM_PROMPTS={"gemini":"You are {{or .AssistantName \"an assistant\"}}. Answer briefly."}
+var modelSystemPrompts = loadModelSystemPrompts()
+
+func loadModelSystemPrompts() map[string]*template.Template {
+	prompts := map[string]*template.Template{}
+	value := os.Getenv("SYSTEM_PROMPTS")
+	if value == "" {
+		return prompts
+	}
+	var config map[string]string
+	if err := json.Unmarshal([]byte(value), &config); err != nil {
+		warnConfig("Ignoring invalid SYSTEM_PROMPTS", "error", err)
+		return prompts
+	}
+	for model, text := range config {
+		tmpl, err := template.New(model).Parse(text)
+		if err != nil {
+			warnConfig("Ignoring invalid SYSTEM_PROMPTS template", "model", model, "error", err)
+			continue
+		}
+		prompts[model] = tmpl
+	}
+	return prompts
+}
+
+// defaultSystemPrompt returns the system message seeded into new sessions:
+// the prompt configured for the session's model if there is one, else the
+// generic prompt, naming the assistant when a name is configured or
+// requested. The rendered text is what is stored.
+func defaultSystemPrompt(clientPayload ClientRequestPayload) string {
+	name := assistantName
+	if clientPayload.AssistantName != "" {
+		name = clientPayload.AssistantName
+	}
+	if tmpl, ok := modelSystemPrompts[clientPayload.ModelName]; ok {
+		var prompt strings.Builder
+		err := tmpl.Execute(&prompt, struct{ AssistantName, Model string }{name, clientPayload.ModelName})
+		if err == nil {
+			return prompt.String()
+		}
+		slog.Error("Error rendering the model's system prompt, using the default one", "model", clientPayload.ModelName, "error", err)
+	}
+	if name == "" {
+		return "You are a helpful and friendly AI assistant. Keep your answers concise."
+	}
+	return "You are " + name + ", a helpful and friendly AI assistant. Keep your answers concise."
+}
+
+// Errors of system messages over the limits.
+var (
+	errTooManySystemPrompts = errors.New("too many system messages")
+	errSystemPromptsTooLong = errors.New("system messages too long")
+)
+
+// isSystemPromptLimit reports whether err is one of the system message limit
+// errors, which are the client's to fix.
+func isSystemPromptLimit(err error) bool {
+	return errors.Is(err, errTooManySystemPrompts) || errors.Is(err, errSystemPromptsTooLong)
+}
+
+// checkSystemPromptLimits checks count system messages of chars characters
+// in all against the limits; scope is added to the error to say where they
+// were counted.
+func checkSystemPromptLimits(count, chars int, scope string) error {
+	if maxSystemPrompts > 0 && count > maxSystemPrompts {
+		return fmt.Errorf("%w%s: %d (max %d)", errTooManySystemPrompts, scope, count, maxSystemPrompts)
+	}
+	if maxSystemPromptChars > 0 && chars > maxSystemPromptChars {
+		return fmt.Errorf("%w%s: %d characters (max %d)", errSystemPromptsTooLong, scope, chars, maxSystemPromptChars)
+	}
+	return nil
+}
+
+// checkStoredSystemPrompts applies the limits to the system messages a
+// session stores, a new one included, since they are all sent again with
+// every turn. The prompt the server seeded the session with isn't counted; a
+// session started with disableSystemPrompt has none, so a client system
+// message in its place is.
+func checkStoredSystemPrompts(history []Message) error {
+	count, chars := 0, 0
+	for _, m := range history {
+		if m.Role != "system" || m.Seeded {
+			continue
+		}
+		count++
+		chars += utf8.RuneCountInString(m.Text)
+	}
+	return checkSystemPromptLimits(count, chars, " in the session")
+}
+
+// validateSystemPrompts checks the system messages in a request's Contents
+// against the configured limits.
+func validateSystemPrompts(clientPayload ClientRequestPayload) error {
+	count, chars := 0, 0
+	for _, c := range clientPayload.Contents {
+		if c.Role != "system" {
+			continue
+		}
+		count++
+		chars += utf8.RuneCountInString(c.Text)
+	}
+	if err := checkSystemPromptLimits(count, chars, ""); err != nil {
+		return err
+	}
+	if name := clientPayload.AssistantName; utf8.RuneCountInString(name) > maxAssistantNameChars || strings.ContainsAny(name, "\r\n") {
+		return fmt.Errorf("assistantName must be a single line of at most %d characters", maxAssistantNameChars)
+	}
+	return nil
+}
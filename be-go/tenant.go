@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Global limits, which also apply to tenants that don't override them.
+var (
+	// maxHistoryMessages caps the stored non-system messages of a session;
+	// the oldest are dropped on save. 0 disables it.
+	maxHistoryMessages = envInt("MAX_HISTORY_MESSAGES", 0)
+	// rateLimitPerMinute caps the chat requests of a tenant per minute. For
+	// requests without an API key it is shared by all of them. 0 disables it.
+	rateLimitPerMinute = envInt("RATE_LIMIT_PER_MINUTE", 0)
+)
+
+// Tenant holds the retention and limits applied to one API key's sessions.
+type Tenant struct {
+	Name              string
+	TTL               time.Duration
+	MaxMessages       int
+	RequestsPerMinute int
+	// Namespaces, when set, are the sessionId prefixes the tenant may use;
+	// BlockedNamespaces are prefixes it may not. See allowsSession.
+	Namespaces        []string
+	BlockedNamespaces []string
+}
+
+// defaultTenant applies to requests without an API key.
+var defaultTenant = &Tenant{
+	Name:              "default",
+	TTL:               CHAT_HISTORY_TTL,
+	MaxMessages:       maxHistoryMessages,
+	RequestsPerMinute: rateLimitPerMinute,
+}
+
+// Tenants are read from TENANTS, a JSON object keyed by the API key clients
+// send in X-API-Key. Omitted fields keep the global defaults:
+//
+//	TENANTS={"key-1":{"name":"acme","ttl":"72h","maxMessages":200,"requestsPerMinute":60,"namespaces":["acme:"]}}
+var tenantsByKey, tenantsByName = loadTenants()
+
+var errUnknownAPIKey = errors.New("unknown API key")
+
+func loadTenants() (map[string]*Tenant, map[string]*Tenant) {
+	byKey := make(map[string]*Tenant)
+	byName := map[string]*Tenant{defaultTenant.Name: defaultTenant}
+	value := os.Getenv("TENANTS")
+	if value == "" {
+		return byKey, byName
+	}
+
+	var config map[string]struct {
+		Name              string   `json:"name"`
+		TTL               string   `json:"ttl"`
+		MaxMessages       *int     `json:"maxMessages"`
+		RequestsPerMinute *int     `json:"requestsPerMinute"`
+		Namespaces        []string `json:"namespaces"`
+		BlockedNamespaces []string `json:"blockedNamespaces"`
+	}
+	if err := json.Unmarshal([]byte(value), &config); err != nil {
+		warnConfig("Ignoring invalid TENANTS", "error", err)
+		return byKey, byName
+	}
+	for key, c := range config {
+		t := *defaultTenant
+		t.Name = c.Name
+		if c.TTL != "" {
+			ttl, err := time.ParseDuration(c.TTL)
+			if err != nil || ttl <= 0 {
+				warnConfig("Ignoring invalid tenant TTL", "tenant", c.Name, "ttl", c.TTL)
+			} else {
+				t.TTL = ttl
+			}
+		}
+		if c.MaxMessages != nil {
+			t.MaxMessages = *c.MaxMessages
+		}
+		if c.RequestsPerMinute != nil {
+			t.RequestsPerMinute = *c.RequestsPerMinute
+		}
+		t.Namespaces = c.Namespaces
+		t.BlockedNamespaces = c.BlockedNamespaces
+		if t.Name == "" || byName[t.Name] != nil {
+			warnConfig("Ignoring tenant without a unique name", "name", t.Name)
+			continue
+		}
+		byKey[key] = &t
+		byName[t.Name] = &t
+	}
+	return byKey, byName
+}
+
+// tenantFor resolves the tenant of a request from its X-API-Key header.
+// Requests without one get defaultTenant; an unknown key is an error.
+func tenantFor(r *http.Request) (*Tenant, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return defaultTenant, nil
+	}
+	if t, ok := tenantsByKey[key]; ok {
+		return t, nil
+	}
+	return nil, errUnknownAPIKey
+}
+
+// tenantNamed returns the tenant a session was stored for, falling back to
+// defaultTenant for sessions without one or whose tenant was removed.
+func tenantNamed(name string) *Tenant {
+	if t, ok := tenantsByName[name]; ok {
+		return t
+	}
+	return defaultTenant
+}
+
+// hasNamespace reports whether sessionId starts with one of the prefixes.
+func hasNamespace(sessionId string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(sessionId, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsSession reports whether the tenant may read or write sessionId. A
+// tenant with Namespaces is confined to them. Any other tenant, the default
+// one included, may use every sessionId outside the namespaces claimed by
+// other tenants. BlockedNamespaces are refused either way, and so are IDs
+// that would name internal Redis keys (see isInternalKey).
+func (t *Tenant) allowsSession(sessionId string) bool {
+	if isInternalKey(sessionId) || hasNamespace(sessionId, t.BlockedNamespaces) {
+		return false
+	}
+	if len(t.Namespaces) > 0 {
+		return hasNamespace(sessionId, t.Namespaces)
+	}
+	for _, other := range tenantsByName {
+		if other != t && hasNamespace(sessionId, other.Namespaces) {
+			return false
+		}
+	}
+	return true
+}
+
+// admitSession checks that the request's tenant may use sessionId, writing
+// the error response and returning false when it may not.
+func admitSession(w http.ResponseWriter, tenant *Tenant, sessionId string) bool {
+	if sessionId == "" || tenant.allowsSession(sessionId) {
+		return true
+	}
+	slog.Warn("Refusing session outside the tenant's namespaces", "tenant", tenant.Name, "sessionId", sessionId)
+	writeError(w, http.StatusForbidden, codeForbidden, "Session is outside the namespaces of this API key")
+	return false
+}
+
+// admitSessionRequest resolves the request's tenant without rate limiting it
+// and checks it may use sessionId. It writes the error response and returns
+// nil when the request is refused.
+func admitSessionRequest(w http.ResponseWriter, r *http.Request, sessionId string) *Tenant {
+	tenant, err := tenantFor(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unknown API key")
+		return nil
+	}
+	if !admitSession(w, tenant, sessionId) {
+		return nil
+	}
+	return tenant
+}
+
+// capMessages drops the oldest non-system messages beyond the tenant's
+// MaxMessages.
+func (t *Tenant) capMessages(history []Message) []Message {
+	if t.MaxMessages <= 0 {
+		return history
+	}
+	pinned := 0
+	for pinned < len(history) && history[pinned].Role == "system" {
+		pinned++
+	}
+	excess := len(history) - pinned - t.MaxMessages
+	if excess <= 0 {
+		return history
+	}
+	capped := make([]Message, 0, pinned+t.MaxMessages)
+	capped = append(capped, history[:pinned]...)
+	return append(capped, history[pinned+excess:]...)
+}
+
+// allowRequest counts a chat request against the tenant's per-minute limit
+// and reports whether it may proceed, and if not, how many seconds until the
+// next window. The count lives in Redis so it holds across instances.
+func (t *Tenant) allowRequest() (bool, int, error) {
+	if t.RequestsPerMinute <= 0 || redisClient == nil {
+		return true, 0, nil
+	}
+	now := time.Now()
+	window := now.Truncate(time.Minute)
+	key := fmt.Sprintf("ratelimit:%s:%s", t.Name, strconv.FormatInt(window.Unix(), 10))
+
+	pipe := redisClient.TxPipeline()
+	count := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, time.Minute)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, 0, fmt.Errorf("redis error counting request: %w", err)
+	}
+	if count.Val() > int64(t.RequestsPerMinute) {
+		return false, int(window.Add(time.Minute).Sub(now).Seconds()) + 1, nil
+	}
+	return true, 0, nil
+}
+
+// admitTenant resolves the request's tenant and applies its rate limit,
+// writing the error response and returning nil when the request is refused.
+func admitTenant(w http.ResponseWriter, r *http.Request) *Tenant {
+	tenant, err := tenantFor(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "Unknown API key")
+		return nil
+	}
+	ok, retryAfter, err := tenant.allowRequest()
+	if err != nil {
+		slog.Error("Error applying rate limit", "tenant", tenant.Name, "error", err)
+		writeError(w, http.StatusInternalServerError, codeStorageError, "Internal server error applying rate limit")
+		return nil
+	}
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, http.StatusTooManyRequests, codeRateLimited, "Rate limit exceeded, please retry later")
+		return nil
+	}
+	return tenant
+}
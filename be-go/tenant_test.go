@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setTenants installs the tenants of a TENANTS value for the test.
+func setTenants(t *testing.T, config string) {
+	t.Helper()
+	t.Setenv("TENANTS", config)
+	byKey, byName := loadTenants()
+	setVar(t, &tenantsByKey, byKey)
+	setVar(t, &tenantsByName, byName)
+}
+
+// tenantChat posts a chat turn with an API key and returns the recorder.
+func tenantChat(t *testing.T, apiKey, sessionId string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := newJSONRequest(t, "POST", "/chat", map[string]interface{}{"sessionId": sessionId, "modelName": "gemini", "contents": userTurn("Hi")})
+	if apiKey != "" {
+		r.Header.Set("X-API-Key", apiKey)
+	}
+	w := httptest.NewRecorder()
+	chatHandler(w, r)
+	return w
+}
+
+func TestTenantTTLs(t *testing.T) {
+	mr := setupRedis(t)
+	stubChat(t, "gemini", reply("Hello"))
+	setTenants(t, `{"key-short":{"name":"short","ttl":"1h"},"key-long":{"name":"long","ttl":"72h"}}`)
+
+	tests := []struct {
+		apiKey, sessionId string
+		want              time.Duration
+	}{
+		{"key-short", "tenant-short", time.Hour},
+		{"key-long", "tenant-long", 72 * time.Hour},
+		{"", "tenant-default", CHAT_HISTORY_TTL},
+	}
+	for _, tt := range tests {
+		if w := tenantChat(t, tt.apiKey, tt.sessionId); w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body %s", tt.sessionId, w.Code, w.Body)
+		}
+		if got := mr.TTL(historyKey(tt.sessionId)); got != tt.want {
+			t.Errorf("%s: history TTL = %v, want %v", tt.sessionId, got, tt.want)
+		}
+	}
+}
+
+func TestTenantLimits(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Hello"))
+	setTenants(t, `{"key-capped":{"name":"capped","maxMessages":2,"requestsPerMinute":2}}`)
+
+	for i := 0; i < 2; i++ {
+		if w := tenantChat(t, "key-capped", "tenant-capped"); w.Code != http.StatusOK {
+			t.Fatalf("turn %d: status = %d, body %s", i, w.Code, w.Body)
+		}
+	}
+	if n := conversationTurns(t, "tenant-capped"); n != 2 {
+		t.Errorf("stored turns = %d, want the tenant's cap of 2", n)
+	}
+
+	w := tenantChat(t, "key-capped", "tenant-capped")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("third request: status = %d, Retry-After %q; want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	if w := tenantChat(t, "key-unknown", "tenant-capped"); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown key: status = %d, want 401", w.Code)
+	}
+}
+
+func TestLoadTenantsKeepsDefaults(t *testing.T) {
+	setVar(t, &loggingReady, false)
+	t.Setenv("TENANTS", `{"key-1":{"name":"acme","ttl":"soon"},"key-2":{"name":"acme"}}`)
+	byKey, _ := loadTenants()
+	if len(byKey) != 1 {
+		t.Fatalf("tenants = %d, want the duplicate name ignored", len(byKey))
+	}
+	for _, tenant := range byKey {
+		if tenant.TTL != defaultTenant.TTL {
+			t.Errorf("TTL = %v, want the default for an invalid value", tenant.TTL)
+		}
+	}
+}
+
+func TestTenantNamespaces(t *testing.T) {
+	setupRedis(t)
+	requests := recordRequests(t, "gemini", "Hello")
+	setTenants(t, `{
+		"key-acme":{"name":"acme","namespaces":["acme:"]},
+		"key-globex":{"name":"globex","namespaces":["globex:"],"blockedNamespaces":["globex:archive:"]}
+	}`)
+	if w := tenantChat(t, "key-globex", "globex:1"); w.Code != http.StatusOK {
+		t.Fatalf("own namespace: status = %d, body %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name, apiKey, sessionId string
+	}{
+		{"other tenant's namespace", "key-acme", "globex:1"},
+		{"outside the tenant's namespaces", "key-acme", "shared-1"},
+		{"claimed namespace without a key", "", "globex:1"},
+		{"blocked namespace", "key-globex", "globex:archive:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := tenantChat(t, tt.apiKey, tt.sessionId); w.Code != http.StatusForbidden {
+				t.Errorf("chat status = %d, want 403", w.Code)
+			}
+		})
+	}
+	if len(*requests) != 1 {
+		t.Errorf("provider calls = %d, want only the allowed turn", len(*requests))
+	}
+
+	r := httptest.NewRequest("GET", "/chat/history?sessionId=globex:1", nil)
+	r.Header.Set("X-API-Key", "key-acme")
+	w := httptest.NewRecorder()
+	getChatHistoryHandler(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("reading another tenant's history: status = %d, want 403", w.Code)
+	}
+	if w := tenantChat(t, "", "shared-1"); w.Code != http.StatusOK {
+		t.Errorf("unclaimed session without a key: status = %d, want 200", w.Code)
+	}
+}
+
+func TestInternalKeySessionIdsRefused(t *testing.T) {
+	mr := setupRedis(t)
+	recordRequests(t, "gemini", "Hello")
+	setTenants(t, `{"key-acme":{"name":"acme","namespaces":["acme:"]}}`)
+	if w := tenantChat(t, "key-acme", "acme:1"); w.Code != http.StatusOK {
+		t.Fatalf("own namespace: status = %d, body %s", w.Code, w.Body)
+	}
+	mr.Set(attachmentKey("doc-1"), `{"id":"doc-1","text":"secret"}`)
+
+	// Each ID names one of acme's keys once taken for a legacy bare key.
+	for _, target := range []string{
+		"/chat/history?sessionId=" + historyKey("acme:1"),
+		"/chat/history?sessionId=" + sessionMetaKey("acme:1"),
+		"/chat/export?sessionId=" + historyKey("acme:1"),
+		"/chat/search?sessionId=" + historyKey("acme:1") + "&q=Hello",
+	} {
+		w := httptest.NewRecorder()
+		switch {
+		case strings.HasPrefix(target, "/chat/history"):
+			getChatHistoryHandler(w, httptest.NewRequest("GET", target, nil))
+		case strings.HasPrefix(target, "/chat/export"):
+			exportHandler(w, httptest.NewRequest("GET", target, nil))
+		default:
+			searchHandler(w, httptest.NewRequest("GET", target, nil))
+		}
+		if w.Code != http.StatusForbidden && w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status = %d, want 403 or 404", target, w.Code)
+		}
+		if strings.Contains(w.Body.String(), "Hello") {
+			t.Errorf("GET %s leaked acme's messages: %s", target, w.Body)
+		}
+	}
+	if w := tenantChat(t, "", attachmentKey("doc-1")); w.Code != http.StatusForbidden {
+		t.Errorf("chat on an attachment key: status = %d, want 403", w.Code)
+	}
+	if got, _ := mr.Get(attachmentKey("doc-1")); got != `{"id":"doc-1","text":"secret"}` {
+		t.Errorf("attachment = %q, want it untouched", got)
+	}
+}
+
+func TestDeletingSessionsSparesInternalKeys(t *testing.T) {
+	mr := setupRedis(t)
+	mr.Set(attachmentKey("doc-1"), `{"id":"doc-1","text":"secret"}`)
+	if err := saveSessionMeta(&SessionMeta{SessionID: attachmentKey("doc-1"), Owner: "mallory"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deleteSession("mallory", attachmentKey("doc-1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSessionMeta(&SessionMeta{SessionID: attachmentKey("doc-1"), Owner: "mallory"}); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	flushHandler(w, withAdmin(t, newJSONRequest(t, "POST", "/admin/flush", map[string]string{"owner": "mallory"})))
+	if w.Code != http.StatusOK {
+		t.Fatalf("flush status = %d, body %s", w.Code, w.Body)
+	}
+	if !mr.Exists(attachmentKey("doc-1")) {
+		t.Error("deleting a session removed the attachment its ID names")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+)
+
+// providerTimeout is the default timeout of a single non-streamed provider
+// call, covering the whole exchange including reading the body.
+var providerTimeout = envDuration("PROVIDER_TIMEOUT", 30*time.Second)
+
+// providerTimeouts overrides providerTimeout per model, read from
+// PROVIDER_TIMEOUTS as comma-separated model=duration pairs, so a slow
+// reasoning model gets longer without slowing failure detection elsewhere:
+//
+//	PROVIDER_TIMEOUTS=claude=2m,gemini=15s
+var providerTimeouts = loadProviderTimeouts()
+
+func loadProviderTimeouts() map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	value := os.Getenv("PROVIDER_TIMEOUTS")
+	if value == "" {
+		return timeouts
+	}
+	for _, pair := range strings.Split(value, ",") {
+		model, duration, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		d, err := time.ParseDuration(duration)
+		if model == "" || err != nil || d <= 0 {
+			warnConfig("Ignoring invalid PROVIDER_TIMEOUTS entry", "entry", pair)
+			continue
+		}
+		timeouts[model] = d
+	}
+	return timeouts
+}
+
+// timeoutFor returns the configured timeout of a model.
+func timeoutFor(modelName string) time.Duration {
+	if d, ok := providerTimeouts[modelName]; ok {
+		return d
+	}
+	return providerTimeout
+}
+
+type providerTimeoutKey struct{}
+
+// withProviderTimeout returns a context whose provider calls use the timeout
+// configured for modelName. Unlike a context deadline, it applies to each
+// call separately.
+func withProviderTimeout(parent context.Context, modelName string) context.Context {
+	return context.WithValue(parent, providerTimeoutKey{}, timeoutFor(modelName))
+}
+
+// requestTimeout is the timeout for a provider call made under ctx.
+func requestTimeout(ctx context.Context) time.Duration {
+	if d, ok := ctx.Value(providerTimeoutKey{}).(time.Duration); ok {
+		return d
+	}
+	return providerTimeout
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPerModelProviderTimeout(t *testing.T) {
+	setVar(t, &claudeAPIKey, "test-key")
+	fakeProviderAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		io.WriteString(w, claudeHello)
+	})
+	setVar(t, &providerTimeouts, map[string]time.Duration{"fast": 50 * time.Millisecond, "slow": 5 * time.Second})
+	req := ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}}
+
+	_, err := callClaudeAPI(withProviderTimeout(context.Background(), "fast"), req)
+	var netErr interface{ Timeout() bool }
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("fast model: err = %v, want a timeout", err)
+	}
+
+	resp, err := callClaudeAPI(withProviderTimeout(context.Background(), "slow"), req)
+	if err != nil || resp.Text != "Hello" {
+		t.Fatalf("slow model: %+v, %v; want the reply", resp, err)
+	}
+}
+
+func TestLoadProviderTimeouts(t *testing.T) {
+	t.Setenv("PROVIDER_TIMEOUTS", "claude=2m, gemini=15s, broken=soon, =1s")
+	got := loadProviderTimeouts()
+	if len(got) != 2 || got["claude"] != 2*time.Minute || got["gemini"] != 15*time.Second {
+		t.Fatalf("timeouts = %v", got)
+	}
+	setVar(t, &providerTimeouts, got)
+	if d := timeoutFor("mistral"); d != providerTimeout {
+		t.Errorf("unconfigured model timeout = %v, want the default %v", d, providerTimeout)
+	}
+}
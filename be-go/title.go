@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// autoTitleEnabled makes the service ask the session's model for a short
+// title after the first exchange, replacing the one cut from the first
+// message. It runs in the background and never delays the response.
+var autoTitleEnabled = os.Getenv("AUTO_TITLE") == "true"
+
+const (
+	autoTitleMaxTokens = 20
+	autoTitleTimeout   = 30 * time.Second
+	autoTitlePrompt    = "Write a short title (at most six words) for the following conversation. Reply with the title only, without quotes or punctuation at the end."
+)
+
+// isFirstExchange reports whether history holds exactly one AI reply.
+func isFirstExchange(history []Message) bool {
+	replies := 0
+	for _, m := range history {
+		if m.Role == "ai" {
+			replies++
+		}
+	}
+	return replies == 1
+}
+
+// maybeGenerateTitle starts background title generation for a session that
+// just completed its first exchange, when AUTO_TITLE is on.
+func maybeGenerateTitle(sessionId, modelName string, history []Message) {
+	if !autoTitleEnabled || !isFirstExchange(history) {
+		return
+	}
+	call, ok := providers[modelName]
+	if !ok {
+		return
+	}
+	go func() {
+		if err := generateTitle(sessionId, call, history); err != nil {
+			slog.Warn("Automatic title generation failed", "sessionId", sessionId, "model", modelName, "error", err)
+		}
+	}()
+}
+
+// generateTitle asks the model for a title and stores it in the session
+// metadata unless the client has set its own title meanwhile.
+func generateTitle(sessionId string, call chatFunc, history []Message) error {
+	var transcript strings.Builder
+	for _, m := range history {
+		switch m.Role {
+		case "user":
+			fmt.Fprintf(&transcript, "User: %s\n", m.Text)
+		case "ai":
+			fmt.Fprintf(&transcript, "Assistant: %s\n", m.Text)
+		}
+	}
+
+	titleCtx, cancel := context.WithTimeout(withAttemptBudget(context.Background(), 1), autoTitleTimeout)
+	defer cancel()
+	result, err := call(titleCtx, ProviderRequest{
+		Messages:  []Message{{Role: "user", Text: autoTitlePrompt + "\n\n" + transcript.String()}},
+		MaxTokens: autoTitleMaxTokens,
+	})
+	if err != nil {
+		return err
+	}
+
+	title := cleanGeneratedTitle(result.Text)
+	if title == "" {
+		return fmt.Errorf("model returned an empty title")
+	}
+
+	meta, err := getSessionMeta(sessionId)
+	if err != nil {
+		return err
+	}
+	if meta == nil || !meta.AutoTitle {
+		return nil
+	}
+	meta.Title = title
+	return saveSessionMeta(meta)
+}
+
+// cleanGeneratedTitle keeps the first line of a model answer and strips the
+// quotes and trailing punctuation models like to add.
+func cleanGeneratedTitle(text string) string {
+	title, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	title = strings.Trim(title, " \t\"'`*#")
+	title = strings.TrimRight(title, ".!:;")
+	return titleFromMessage(title)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoTitleStoredFromModel(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &autoTitleEnabled, true)
+	titleRequests := make(chan ProviderRequest, 1)
+	stubChat(t, "gemini", func(ctx context.Context, req ProviderRequest) (ProviderResponse, error) {
+		if strings.HasPrefix(req.Messages[0].Text, autoTitlePrompt) {
+			titleRequests <- req
+			return ProviderResponse{Text: `"Spring Gardens of Japan."`}, nil
+		}
+		return ProviderResponse{Text: "Sure.", Choices: []string{"Sure."}}, nil
+	})
+
+	chatTurn(t, map[string]interface{}{
+		"sessionId": "title-auto",
+		"modelName": "gemini",
+		"contents":  userTurn("Can you help me plan a trip around Japan to see the gardens?"),
+	})
+
+	select {
+	case req := <-titleRequests:
+		if req.MaxTokens != autoTitleMaxTokens {
+			t.Errorf("title request MaxTokens = %d, want %d", req.MaxTokens, autoTitleMaxTokens)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no title request after the first exchange")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		meta, err := getSessionMeta("title-auto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta != nil && meta.Title == "Spring Gardens of Japan" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("meta = %+v, want the generated title stored", meta)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAutoTitleKeepsClientTitle(t *testing.T) {
+	setupRedis(t)
+	if err := saveSessionMeta(&SessionMeta{SessionID: "title-own", Title: "My trip"}); err != nil {
+		t.Fatal(err)
+	}
+	history := []Message{{Role: "user", Text: "Hi"}, {Role: "ai", Text: "Hello"}}
+	if err := generateTitle("title-own", reply("Greetings"), history); err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := getSessionMeta("title-own")
+	if meta.Title != "My trip" {
+		t.Fatalf("title = %q, want the client's title kept", meta.Title)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"unicode/utf8"
+
+	tiktoken "github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// Tokenizer counts the tokens a model sees in a piece of text. Counts are used
+// to keep requests inside the context budget, so an implementation should
+// rather overcount than undercount.
+type Tokenizer interface {
+	CountTokens(text string) int
+}
+
+// messageOverheadTokens is added per message for the role and separators
+// every chat format wraps around the text.
+const messageOverheadTokens = 4
+
+// heuristicTokenizer assumes one token per four characters, a fair average
+// for English text when nothing better is known about the model.
+type heuristicTokenizer struct{}
+
+func (heuristicTokenizer) CountTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// tiktokenTokenizer counts tokens exactly with the BPE encoding an OpenAI
+// model uses (o200k_base for gpt-4o), from merge tables compiled into the
+// binary. They take a moment to load, so that happens on first use; if it
+// fails the heuristic is used instead.
+type tiktokenTokenizer struct {
+	model    string
+	once     sync.Once
+	encoding *tiktoken.Tiktoken
+}
+
+func newTiktokenTokenizer(model string) *tiktokenTokenizer {
+	return &tiktokenTokenizer{model: model}
+}
+
+func (t *tiktokenTokenizer) load() {
+	tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+	encoding, err := tiktoken.EncodingForModel(t.model)
+	if err != nil {
+		encoding, err = tiktoken.GetEncoding("o200k_base")
+	}
+	if err != nil {
+		slog.Error("Error loading the tiktoken encoding, estimating tokens instead", "model", t.model, "error", err)
+		return
+	}
+	t.encoding = encoding
+}
+
+func (t *tiktokenTokenizer) CountTokens(text string) int {
+	t.once.Do(t.load)
+	if t.encoding == nil {
+		return heuristicTokenizer{}.CountTokens(text)
+	}
+	// Special token markup in user text is counted as the plain text it is
+	// sent as.
+	return len(t.encoding.EncodeOrdinary(text))
+}
+
+// providerTokenizers holds the tokenizer of each model that has a better one
+// than the heuristic.
+var providerTokenizers = map[string]Tokenizer{
+	"chatgpt": newTiktokenTokenizer(chatGPTProvider.Model),
+}
+
+// tokenizerFor returns the tokenizer of a model, falling back to the
+// heuristic.
+func tokenizerFor(modelName string) Tokenizer {
+	if t, ok := providerTokenizers[modelName]; ok {
+		return t
+	}
+	return heuristicTokenizer{}
+}
+
+// countMessageTokens estimates the prompt tokens of a conversation.
+func countMessageTokens(t Tokenizer, messages []Message) int {
+	total := 0
+	for _, m := range messages {
+		total += messageOverheadTokens + t.CountTokens(m.Text)
+	}
+	return total
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+const quickFox = "The quick brown fox jumps over the lazy dog."
+
+func TestTiktokenCounts(t *testing.T) {
+	tokenizer := newTiktokenTokenizer(chatGPTProvider.Model)
+	for text, want := range map[string]int{
+		"":            0,
+		"hello world": 2,
+		quickFox:      10,
+	} {
+		if got := tokenizer.CountTokens(text); got != want {
+			t.Errorf("CountTokens(%q) = %d, want %d", text, got, want)
+		}
+	}
+	if tokenizer.encoding == nil {
+		t.Error("tiktoken encoding did not load, counts came from the heuristic")
+	}
+}
+
+func TestHeuristicCounts(t *testing.T) {
+	for text, want := range map[string]int{
+		"":            0,
+		"hello world": 3,
+		quickFox:      11,
+		// Runes, not bytes, are counted.
+		"héllo wörld": 3,
+	} {
+		if got := (heuristicTokenizer{}).CountTokens(text); got != want {
+			t.Errorf("CountTokens(%q) = %d, want %d", text, got, want)
+		}
+	}
+}
+
+func TestTokenizerFor(t *testing.T) {
+	if _, ok := tokenizerFor("chatgpt").(*tiktokenTokenizer); !ok {
+		t.Error("chatgpt does not use tiktoken")
+	}
+	if _, ok := tokenizerFor("gemini").(heuristicTokenizer); !ok {
+		t.Error("gemini does not fall back to the heuristic")
+	}
+	messages := []Message{{Role: "user", Text: "hello world"}, {Role: "ai", Text: quickFox}}
+	if got, want := countMessageTokens(tokenizerFor("chatgpt"), messages), 2*messageOverheadTokens+12; got != want {
+		t.Errorf("countMessageTokens = %d, want %d", got, want)
+	}
+}
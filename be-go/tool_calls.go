@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+)
+
+// toolCallObject returns a tool call's arguments as a JSON object, which
+// Anthropic and Gemini require. Arguments that aren't one are sent as {}.
+func toolCallObject(arguments json.RawMessage) json.RawMessage {
+	if trimmed := bytes.TrimSpace(arguments); len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(trimmed) {
+		return trimmed
+	}
+	return json.RawMessage("{}")
+}
+
+// pairToolResults drops the tool results that don't answer a tool call of an
+// earlier ai message, which providers reject. A result matches a call by ID,
+// or by tool name for calls without one.
+func pairToolResults(messages []Message) []Message {
+	calls := make(map[string]bool)
+	var paired []Message
+	for i, m := range messages {
+		switch m.Role {
+		case "ai":
+			for _, call := range m.ToolCalls {
+				if call.ID != "" {
+					calls["id:"+call.ID] = true
+				} else {
+					calls["name:"+call.Name] = true
+				}
+			}
+		case "tool":
+			if !calls["id:"+m.ToolCallID] && !calls["name:"+m.ToolName] && !calls["name:"+m.ToolCallID] {
+				slog.Debug("Leaving out a tool result without its call", "toolCallId", m.ToolCallID, "toolName", m.ToolName)
+				if paired == nil {
+					paired = append(make([]Message, 0, len(messages)), messages[:i]...)
+				}
+				continue
+			}
+		}
+		if paired != nil {
+			paired = append(paired, m)
+		}
+	}
+	if paired == nil {
+		return messages
+	}
+	return paired
+}
+
+// toolTurnStart returns where the turn holding messages[i] starts when it is
+// a tool result: at the user message before the call it answers, so the call
+// and its results are kept together. Other messages return i. The search
+// stops at floor.
+func toolTurnStart(messages []Message, i, floor int) int {
+	if i >= len(messages) || messages[i].Role != "tool" {
+		return i
+	}
+	for i > floor && messages[i].Role != "user" {
+		i--
+	}
+	return i
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os"
+)
+
+// finishLength is the FinishReason stored on an AI message cut off at the
+// token limit.
+const finishLength = "length"
+
+// lengthReasons are the finish and stop reasons, across providers, of a
+// reply that hit the token limit.
+var lengthReasons = map[string]bool{
+	"length":     true, // OpenAI
+	"MAX_TOKENS": true, // Gemini
+	"max_tokens": true, // Anthropic
+}
+
+// truncationDetails makes /chat report truncation as an object saying whether
+// the history sent was trimmed, by how many messages, and whether the reply
+// hit the token limit. TRUNCATION_DETAILS=false keeps the plain
+// "truncated": true of a reply cut off at the limit.
+var truncationDetails = os.Getenv("TRUNCATION_DETAILS") != "false"
+
+// truncationInfo is the "truncated" object of a /chat response.
+type truncationInfo struct {
+	History         bool `json:"history"`
+	DroppedMessages int  `json:"droppedMessages"`
+	Output          bool `json:"output"`
+}
+
+// truncationFor returns the "truncated" value of a /chat response for a turn
+// that left dropped messages out of the history sent, or nil when there is
+// nothing to report.
+func truncationFor(dropped int, finish *finishReasonRecorder) interface{} {
+	output := finish.stored() == finishLength
+	if !truncationDetails {
+		if output {
+			return true
+		}
+		return nil
+	}
+	return truncationInfo{History: dropped > 0, DroppedMessages: max(dropped, 0), Output: output}
+}
+
+// continueInstruction asks a model without prefill support to carry on from
+// its own truncated reply. It is only sent, never stored.
+const continueInstruction = "Continue your previous answer exactly where it stopped, without repeating anything or adding an introduction."
+
+// finishReasonRecorder holds the finish reason of the last provider call made
+// under a context.
+type finishReasonRecorder struct {
+	reason string
+}
+
+type finishReasonKey struct{}
+
+// withFinishReason returns a context whose provider calls record their
+// finish reason in the returned recorder.
+func withFinishReason(parent context.Context) (context.Context, *finishReasonRecorder) {
+	recorder := &finishReasonRecorder{}
+	return context.WithValue(parent, finishReasonKey{}, recorder), recorder
+}
+
+// recordFinishReason notes a provider's finish reason if ctx asks for it.
+func recordFinishReason(ctx context.Context, reason string) {
+	if recorder, ok := ctx.Value(finishReasonKey{}).(*finishReasonRecorder); ok {
+		recorder.reason = reason
+	}
+}
+
+// stored returns the FinishReason to store on the AI message: finishLength
+// for a reply cut off at the token limit, empty otherwise.
+func (f *finishReasonRecorder) stored() string {
+	if lengthReasons[f.reason] {
+		return finishLength
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// cutOffReply is a provider call whose reply hits the token limit.
+func cutOffReply(ctx context.Context, _ ProviderRequest) (ProviderResponse, error) {
+	recordFinishReason(ctx, "MAX_TOKENS")
+	return ProviderResponse{Text: "Once upon a", Choices: []string{"Once upon a"}}, nil
+}
+
+// truncation decodes the "truncated" object of a /chat response.
+func truncation(t *testing.T, resp ChatResponse) map[string]interface{} {
+	t.Helper()
+	info, ok := resp.Truncated.(map[string]interface{})
+	if !ok {
+		t.Fatalf("truncated = %#v, want an object", resp.Truncated)
+	}
+	return info
+}
+
+func TestTruncationReportsTrimmedHistory(t *testing.T) {
+	setupRedis(t)
+	requests := recordRequests(t, "gemini", "Fine.")
+	setVar(t, &maxContextTokens, 60)
+
+	long := strings.Repeat("word ", 40)
+	resp := chatTurn(t, map[string]interface{}{
+		"sessionId": "trim-1",
+		"modelName": "gemini",
+		"persist":   false,
+		"contents":  []map[string]string{{"role": "user", "text": long}, {"role": "ai", "text": long}, {"role": "user", "text": "And now?"}},
+	})
+	sent := len((*requests)[0].Messages)
+	if sent == 3 {
+		t.Fatal("nothing was trimmed")
+	}
+	info := truncation(t, resp)
+	if info["history"] != true || info["droppedMessages"] != float64(3-sent) || info["output"] != false {
+		t.Fatalf("truncated = %v, want %d dropped messages and no output truncation", info, 3-sent)
+	}
+}
+
+func TestTruncationReportsCappedOutput(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", cutOffReply)
+
+	info := truncation(t, chatTurn(t, map[string]interface{}{"sessionId": "trim-2", "modelName": "gemini", "contents": userTurn("Tell me a story")}))
+	if info["output"] != true || info["history"] != false || info["droppedMessages"] != float64(0) {
+		t.Fatalf("truncated = %v, want only the output flagged", info)
+	}
+	if history := storedHistory(t, "trim-2"); history[len(history)-1].FinishReason != finishLength {
+		t.Errorf("stored reply = %+v, want finishReason length", history[len(history)-1])
+	}
+}
+
+func TestTruncationNothingToReport(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Hello"))
+
+	info := truncation(t, chatTurn(t, map[string]interface{}{"sessionId": "trim-3", "modelName": "gemini", "contents": userTurn("Hi")}))
+	if info["history"] != false || info["output"] != false {
+		t.Fatalf("truncated = %v, want nothing flagged", info)
+	}
+}
+
+func TestTruncationDetailsDisabled(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &truncationDetails, false)
+	stubChat(t, "gemini", cutOffReply)
+
+	if resp := chatTurn(t, map[string]interface{}{"sessionId": "trim-4", "modelName": "gemini", "contents": userTurn("Tell me a story")}); resp.Truncated != true {
+		t.Fatalf("truncated = %#v, want the legacy true", resp.Truncated)
+	}
+
+	stubChat(t, "gemini", reply("Hello"))
+	if resp := chatTurn(t, map[string]interface{}{"sessionId": "trim-5", "modelName": "gemini", "contents": userTurn("Hi")}); resp.Truncated != nil {
+		t.Fatalf("truncated = %#v, want it left out", resp.Truncated)
+	}
+}
+
+func TestStreamTruncationMatchesChat(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", cutOffReply)
+	stubStream(t, "gemini", func(ctx context.Context, _ ProviderRequest, onDelta func(string) error) (string, error) {
+		recordFinishReason(ctx, "MAX_TOKENS")
+		return "Once upon a", onDelta("Once upon a")
+	})
+
+	chat := truncation(t, chatTurn(t, map[string]interface{}{"sessionId": "trim-6", "modelName": "gemini", "contents": userTurn("Tell me a story")}))
+	w := postJSON(t, chatStreamHandler, "/chat/stream", map[string]interface{}{"sessionId": "trim-7", "modelName": "gemini", "contents": userTurn("Tell me a story")})
+	events := readSSE(t, bufio.NewReader(w.Body))
+	done := events[len(events)-1]
+	if done.Name != "done" || !reflect.DeepEqual(done.Data["truncated"], chat) {
+		t.Fatalf("done event = %+v, want truncated %v as /chat reports it", done, chat)
+	}
+	if chat["output"] != true {
+		t.Fatalf("truncated = %v, want the output flagged", chat)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-turn usage records are exported to USAGE_SINK, when set: an http:// or
+// https:// URL each record is POSTed to as JSON, or else a file path records
+// are appended to as JSON lines. Records are queued and written in the
+// background, so a slow sink never delays a response; if the queue of
+// USAGE_BUFFER records is full, new ones are dropped and logged.
+var (
+	usageSinkTarget = os.Getenv("USAGE_SINK")
+	usageBuffer     = envInt("USAGE_BUFFER", 1024)
+	usageTimeout    = envDuration("USAGE_TIMEOUT", 5*time.Second)
+)
+
+// usagePrices holds the USD price per million prompt and completion tokens of
+// each model, read from USAGE_PRICES as comma-separated model=prompt/completion
+// pairs. Models without a price report a cost of 0:
+//
+//	USAGE_PRICES=gemini=0.1/0.4,claude=15/75
+var usagePrices = loadUsagePrices()
+
+type usagePrice struct {
+	Prompt, Completion float64
+}
+
+func loadUsagePrices() map[string]usagePrice {
+	prices := make(map[string]usagePrice)
+	value := os.Getenv("USAGE_PRICES")
+	if value == "" {
+		return prices
+	}
+	for _, pair := range strings.Split(value, ",") {
+		model, price, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		prompt, completion, _ := strings.Cut(price, "/")
+		p, err1 := strconv.ParseFloat(prompt, 64)
+		c, err2 := strconv.ParseFloat(completion, 64)
+		if model == "" || err1 != nil || err2 != nil || p < 0 || c < 0 {
+			warnConfig("Ignoring invalid USAGE_PRICES entry", "entry", pair)
+			continue
+		}
+		prices[model] = usagePrice{Prompt: p, Completion: c}
+	}
+	return prices
+}
+
+// UsageRecord is the usage of one chat turn. Token counts are the estimates
+// of the model's tokenizer.
+type UsageRecord struct {
+	Time             time.Time `json:"time"`
+	SessionID        string    `json:"sessionId,omitempty"`
+	Tenant           string    `json:"tenant"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"promptTokens"`
+	CompletionTokens int       `json:"completionTokens"`
+	TotalTokens      int       `json:"totalTokens"`
+	CostUSD          float64   `json:"costUsd"`
+}
+
+// turnUsage is the token usage of a turn, as reported by the provider or
+// estimated by the model's tokenizer.
+type turnUsage struct {
+	PromptTokens     int  `json:"promptTokens"`
+	CompletionTokens int  `json:"completionTokens"`
+	TotalTokens      int  `json:"totalTokens"`
+	Estimated        bool `json:"estimated,omitempty"`
+}
+
+// estimateUsage counts the tokens of a turn's prompt and completions with
+// the model's tokenizer.
+func estimateUsage(modelName string, prompt []Message, completions ...string) turnUsage {
+	t := tokenizerFor(modelName)
+	usage := turnUsage{PromptTokens: countMessageTokens(t, prompt)}
+	for _, completion := range completions {
+		usage.CompletionTokens += t.CountTokens(completion)
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	usage.Estimated = true
+	return usage
+}
+
+// providerUsageRecorder holds the usage reported by the last provider call
+// made under a context.
+type providerUsageRecorder struct {
+	usage    turnUsage
+	reported bool
+}
+
+type providerUsageKey struct{}
+
+// withProviderUsage returns a context whose provider calls record the usage
+// they report in the returned recorder.
+func withProviderUsage(parent context.Context) (context.Context, *providerUsageRecorder) {
+	recorder := &providerUsageRecorder{}
+	return context.WithValue(parent, providerUsageKey{}, recorder), recorder
+}
+
+// recordProviderUsage notes the usage a provider reported if ctx asks for it.
+func recordProviderUsage(ctx context.Context, prompt, completion, total int) {
+	if recorder, ok := ctx.Value(providerUsageKey{}).(*providerUsageRecorder); ok {
+		if total == 0 {
+			total = prompt + completion
+		}
+		recorder.usage = turnUsage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: total}
+		recorder.reported = true
+	}
+}
+
+// or returns the reported usage, or estimated when the provider reported
+// none.
+func (r *providerUsageRecorder) or(estimated turnUsage) turnUsage {
+	if r.reported {
+		return r.usage
+	}
+	return estimated
+}
+
+// UsageSink receives usage records, one at a time, from a single goroutine.
+type UsageSink interface {
+	WriteUsage(record UsageRecord) error
+}
+
+// fileUsageSink appends records to a file as JSON lines.
+type fileUsageSink struct {
+	file *os.File
+}
+
+func newFileUsageSink(path string) (*fileUsageSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening usage file: %w", err)
+	}
+	return &fileUsageSink{file: file}, nil
+}
+
+func (s *fileUsageSink) WriteUsage(record UsageRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// httpUsageSink POSTs each record to a collector as JSON.
+type httpUsageSink struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPUsageSink(url string) *httpUsageSink {
+	return &httpUsageSink{url: url, client: &http.Client{Timeout: usageTimeout}}
+}
+
+func (s *httpUsageSink) WriteUsage(record UsageRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error posting usage record: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("usage collector returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// newUsageSink picks the sink for a USAGE_SINK value.
+func newUsageSink(target string) (UsageSink, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return newHTTPUsageSink(target), nil
+	}
+	return newFileUsageSink(target)
+}
+
+var (
+	usageMu    sync.Mutex
+	usageQueue chan UsageRecord
+)
+
+// startUsageExport drains queued records into sink in the background.
+func startUsageExport(sink UsageSink) {
+	queue := make(chan UsageRecord, usageBuffer)
+	usageMu.Lock()
+	usageQueue = queue
+	usageMu.Unlock()
+	go func() {
+		for record := range queue {
+			if err := sink.WriteUsage(record); err != nil {
+				slog.Warn("Error exporting usage record", "sessionId", record.SessionID, "error", err)
+			}
+		}
+	}()
+}
+
+// recordUsage queues the usage of a completed turn, as the provider reported
+// it or else estimated, for export. It never blocks and is a no-op without a
+// sink.
+func recordUsage(tenant *Tenant, sessionId, modelName string, usage turnUsage) {
+	usageMu.Lock()
+	queue := usageQueue
+	usageMu.Unlock()
+	if queue == nil {
+		return
+	}
+
+	record := UsageRecord{
+		Time:             time.Now().UTC(),
+		SessionID:        sessionId,
+		Tenant:           tenant.Name,
+		Model:            modelName,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.TotalTokens,
+	}
+	price := usagePrices[modelName]
+	record.CostUSD = (float64(record.PromptTokens)*price.Prompt + float64(record.CompletionTokens)*price.Completion) / 1e6
+
+	select {
+	case queue <- record:
+	default:
+		slog.Warn("Usage queue full, dropping record", "sessionId", sessionId, "model", modelName)
+	}
+}
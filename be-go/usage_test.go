@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// captureSink hands every record it is given to records.
+type captureSink struct {
+	records chan UsageRecord
+}
+
+func (s *captureSink) WriteUsage(record UsageRecord) error {
+	s.records <- record
+	return nil
+}
+
+// exportUsageTo starts usage export into sink for the duration of the test.
+func exportUsageTo(t *testing.T, sink UsageSink) {
+	t.Helper()
+	setVar(t, &usageQueue, usageQueue)
+	startUsageExport(sink)
+	t.Cleanup(func() { close(usageQueue) })
+}
+
+func nextRecord(t *testing.T, sink *captureSink) UsageRecord {
+	t.Helper()
+	select {
+	case record := <-sink.records:
+		return record
+	case <-time.After(time.Second):
+		t.Fatal("no usage record exported")
+		return UsageRecord{}
+	}
+}
+
+func TestUsageRecordPerTurn(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Hello there"))
+	setVar(t, &usagePrices, map[string]usagePrice{"gemini": {Prompt: 1, Completion: 2}})
+	sink := &captureSink{records: make(chan UsageRecord, 4)}
+	exportUsageTo(t, sink)
+
+	for _, text := range []string{"Hi", "Again"} {
+		chatTurn(t, map[string]interface{}{"sessionId": "usage-1", "modelName": "gemini", "contents": userTurn(text)})
+	}
+
+	for i := 0; i < 2; i++ {
+		record := nextRecord(t, sink)
+		if record.SessionID != "usage-1" || record.Model != "gemini" || record.Tenant != defaultTenant.Name {
+			t.Errorf("record %d = %+v, want the session, model and tenant", i, record)
+		}
+		if record.PromptTokens == 0 || record.CompletionTokens == 0 || record.TotalTokens != record.PromptTokens+record.CompletionTokens {
+			t.Errorf("record %d tokens = %+v", i, record)
+		}
+		if want := float64(record.PromptTokens+2*record.CompletionTokens) / 1e6; record.CostUSD != want {
+			t.Errorf("record %d cost = %v, want %v", i, record.CostUSD, want)
+		}
+	}
+	select {
+	case record := <-sink.records:
+		t.Errorf("extra record %+v, want one per turn", record)
+	default:
+	}
+}
+
+func TestSlowUsageSinkDoesNotBlock(t *testing.T) {
+	setVar(t, &usageBuffer, 1)
+	sink := &captureSink{records: make(chan UsageRecord)}
+	exportUsageTo(t, sink)
+
+	// Wait for the exporter to take the first record, so it is stuck
+	// writing it.
+	recordUsage(defaultTenant, "usage-2", "gemini", estimateUsage("gemini", nil, "Hello"))
+	for deadline := time.Now().Add(time.Second); len(usageQueue) > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("first record never taken from the queue")
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2; i++ {
+			recordUsage(defaultTenant, "usage-2", "gemini", estimateUsage("gemini", nil, "Hello"))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("recordUsage blocked on a stalled sink")
+	}
+	// One record was being written and one queued; the third was dropped.
+	nextRecord(t, sink)
+	nextRecord(t, sink)
+	select {
+	case record := <-sink.records:
+		t.Errorf("extra record %+v, want the third dropped", record)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestFileUsageSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	sink, err := newUsageSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, session := range []string{"a", "b"} {
+		if err := sink.WriteUsage(UsageRecord{SessionID: session, Model: "gemini", TotalTokens: 5}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var sessions []string
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var record UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		sessions = append(sessions, record.SessionID)
+	}
+	if len(sessions) != 2 || sessions[0] != "a" || sessions[1] != "b" {
+		t.Fatalf("sessions = %v, want a JSON line per record", sessions)
+	}
+}
+
+func TestHTTPUsageSink(t *testing.T) {
+	var got UsageRecord
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	sink, err := newUsageSink(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteUsage(UsageRecord{SessionID: "c", Model: "claude"}); err != nil {
+		t.Fatal(err)
+	}
+	if got.SessionID != "c" || got.Model != "claude" {
+		t.Fatalf("collector got %+v", got)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	if err := newHTTPUsageSink(failing.URL).WriteUsage(UsageRecord{}); err == nil {
+		t.Error("a 500 from the collector was not reported")
+	}
+}
+
+func TestUsageRecordUsesReportedCounts(t *testing.T) {
+	setupRedis(t)
+	setVar(t, &usagePrices, map[string]usagePrice{"gemini": {Prompt: 1, Completion: 2}})
+	stubChat(t, "gemini", func(ctx context.Context, _ ProviderRequest) (ProviderResponse, error) {
+		recordProviderUsage(ctx, 70, 30, 0)
+		return ProviderResponse{Text: "Hi", Choices: []string{"Hi"}}, nil
+	})
+	stubStream(t, "gemini", func(ctx context.Context, _ ProviderRequest, onDelta func(string) error) (string, error) {
+		recordProviderUsage(ctx, 80, 40, 0)
+		return "Hi", onDelta("Hi")
+	})
+	sink := &captureSink{records: make(chan UsageRecord, 4)}
+	exportUsageTo(t, sink)
+
+	chatTurn(t, map[string]interface{}{"sessionId": "usage-3", "modelName": "gemini", "contents": userTurn("Hello")})
+	postJSON(t, chatStreamHandler, "/chat/stream", map[string]interface{}{"sessionId": "usage-3", "modelName": "gemini", "contents": userTurn("Again")})
+
+	for _, want := range []UsageRecord{
+		{PromptTokens: 70, CompletionTokens: 30, TotalTokens: 100, CostUSD: 130 / 1e6},
+		{PromptTokens: 80, CompletionTokens: 40, TotalTokens: 120, CostUSD: 160 / 1e6},
+	} {
+		got := nextRecord(t, sink)
+		if got.PromptTokens != want.PromptTokens || got.CompletionTokens != want.CompletionTokens || got.TotalTokens != want.TotalTokens || got.CostUSD != want.CostUSD {
+			t.Errorf("record = %+v, want the reported %+v", got, want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// streamUTF8Buffering keeps multibyte characters intact when a provider
+// splits one across stream chunks, as byte-level tokenizers do on
+// OpenAI-compatible servers: the raw bytes of each delta are kept, and an
+// incomplete character at the end of a delta is held back until the next one
+// completes it. STREAM_UTF8_BUFFER=false forwards deltas as decoded, with
+// split characters turned into U+FFFD.
+var streamUTF8Buffering = os.Getenv("STREAM_UTF8_BUFFER") != "false"
+
+// rawByteBase maps a byte that is not valid UTF-8 to a private-use rune so it
+// survives JSON decoding, which would otherwise replace it with U+FFFD.
+// rawByteEscape precedes a private-use rune of the chunk itself in that
+// range, or rawByteEscape itself, so restoreInvalidUTF8 keeps it as it is.
+const (
+	rawByteBase   = 0xF700
+	rawByteEscape = rawByteBase + 0x100
+)
+
+// protectInvalidUTF8 replaces the invalid bytes of a JSON chunk with
+// private-use runes that restoreInvalidUTF8 turns back into the bytes, and
+// reports whether it had to. A valid chunk is returned as it is.
+func protectInvalidUTF8(data string) (string, bool) {
+	if utf8.ValidString(data) {
+		return data, false
+	}
+	var out strings.Builder
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRuneInString(data[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			out.WriteRune(rawByteBase + rune(data[i]))
+		case isProtectedRune(r):
+			out.WriteRune(rawByteEscape)
+			out.WriteRune(r)
+		case r == '\\' && i+1 < len(data):
+			// An escape: \uXXXX may spell a protected rune, and any
+			// other (\\ included) is copied whole.
+			size = 2
+			if data[i+1] == 'u' && i+6 <= len(data) {
+				if n, err := strconv.ParseUint(data[i+2:i+6], 16, 32); err == nil {
+					size = 6
+					if isProtectedRune(rune(n)) {
+						out.WriteString(`\uf800`)
+					}
+				}
+			}
+			out.WriteString(data[i : i+size])
+		default:
+			out.WriteString(data[i : i+size])
+		}
+		i += size
+	}
+	return out.String(), true
+}
+
+// restoreInvalidUTF8 undoes protectInvalidUTF8 on a decoded string.
+func restoreInvalidUTF8(s string) string {
+	var out strings.Builder
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			out.WriteRune(r)
+			escaped = false
+		case r == rawByteEscape:
+			escaped = true
+		case isProtectedRune(r):
+			out.WriteByte(byte(r - rawByteBase))
+		default:
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
+
+// isProtectedRune reports whether protectInvalidUTF8 gives r a meaning.
+func isProtectedRune(r rune) bool {
+	return r >= rawByteBase && r <= rawByteEscape
+}
+
+// utf8Joiner reassembles characters split across deltas.
+type utf8Joiner struct {
+	pending string
+}
+
+// push returns the complete characters of delta, prefixed by what was held
+// back from the previous one, and holds back an incomplete trailing
+// character.
+func (j *utf8Joiner) push(delta string) string {
+	text := j.pending + delta
+	j.pending = ""
+	// A character is at most utf8.UTFMax bytes, so only the last few can
+	// start an incomplete one.
+	for i := len(text) - 1; i >= 0 && i >= len(text)-utf8.UTFMax+1; i-- {
+		if !utf8.RuneStart(text[i]) {
+			continue
+		}
+		if !utf8.FullRuneInString(text[i:]) {
+			text, j.pending = text[:i], text[i:]
+		}
+		break
+	}
+	return strings.ToValidUTF8(text, "\uFFFD")
+}
+
+// flush returns what is still held back, which the stream never completed.
+func (j *utf8Joiner) flush() string {
+	text := strings.ToValidUTF8(j.pending, "\uFFFD")
+	j.pending = ""
+	return text
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// splitUTF8Stream serves an OpenAI-style stream of "café 🎉" whose é and
+// emoji are each split across two chunks as raw bytes.
+func splitUTF8Stream(t *testing.T) *httptest.Server {
+	t.Helper()
+	emoji := "🎉"
+	return contentStream(t, "caf\xc3", "\xa9 "+emoji[:2], emoji[2:])
+}
+
+// contentStream serves an OpenAI-style stream with one chunk per content,
+// each written into the JSON as it is.
+func contentStream(t *testing.T, chunks ...string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\""+chunk+"\"}}]}\n\n")
+		}
+		io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStreamReassemblesSplitCharacters(t *testing.T) {
+	srv := splitUTF8Stream(t)
+
+	var deltas []string
+	full, err := streamOpenaiStyle(context.Background(), "test", srv.URL, nil, []byte("{}"), func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full != "café 🎉" {
+		t.Errorf("full text = %q, want %q", full, "café 🎉")
+	}
+	for _, delta := range deltas {
+		if !utf8.ValidString(delta) || strings.ContainsRune(delta, utf8.RuneError) {
+			t.Errorf("delta %q carries a broken character", delta)
+		}
+	}
+	if joined := strings.Join(deltas, ""); joined != "café 🎉" {
+		t.Errorf("deltas = %q, want them to join to %q", deltas, "café 🎉")
+	}
+}
+
+func TestStreamUTF8BufferingDisabled(t *testing.T) {
+	srv := splitUTF8Stream(t)
+	setVar(t, &streamUTF8Buffering, false)
+
+	full, err := streamOpenaiStyle(context.Background(), "test", srv.URL, nil, []byte("{}"), func(string) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.ContainsRune(full, utf8.RuneError) {
+		t.Errorf("full text = %q, want the split characters replaced", full)
+	}
+}
+
+func TestUTF8Joiner(t *testing.T) {
+	var j utf8Joiner
+	if got := j.push("a\xe4\xbd"); got != "a" {
+		t.Errorf("push = %q, want the incomplete character held back", got)
+	}
+	if got := j.push("\xa0b"); got != "你b" {
+		t.Errorf("push = %q, want the completed character", got)
+	}
+	if got := j.push("c\xf0\x9f"); got != "c" {
+		t.Errorf("push = %q, want the incomplete emoji held back", got)
+	}
+	if got := j.flush(); got != "�" {
+		t.Errorf("flush = %q, want the never-completed bytes replaced", got)
+	}
+	if got := j.flush(); got != "" {
+		t.Errorf("second flush = %q, want nothing held back", got)
+	}
+}
+
+func TestStreamKeepsPrivateUseCharacters(t *testing.T) {
+	emoji := "🎉"
+	// Private-use characters from the protected range, written as escapes
+	// and as they are, in chunks with and without split characters.
+	srv := contentStream(t, `key \uf704 ok`, "\uf7ff\uf800 ", "\uf704 "+emoji[:2], emoji[2:]+` \uf701 \\\uf702`)
+
+	var deltas []string
+	full, err := streamOpenaiStyle(context.Background(), "test", srv.URL, nil, []byte("{}"), func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "key \uf704 ok\uf7ff\uf800 \uf704 " + emoji + " \uf701 \\\uf702"
+	if full != want {
+		t.Errorf("full text = %q, want %q", full, want)
+	}
+	if joined := strings.Join(deltas, ""); joined != want {
+		t.Errorf("deltas = %q, want them to join to %q", deltas, want)
+	}
+}
+
+func TestProtectInvalidUTF8RoundTrip(t *testing.T) {
+	for _, s := range []string{"plain", "\uf704", "\uf800\uf700", "a\xffb\uf7ffc", "\xff\uf7ff\uf800\uf700"} {
+		data, protected := protectInvalidUTF8(s)
+		if protected != !utf8.ValidString(s) {
+			t.Errorf("protectInvalidUTF8(%q) protected = %v", s, protected)
+		}
+		if protected {
+			data = restoreInvalidUTF8(data)
+		}
+		if data != s {
+			t.Errorf("round trip of %q = %q", s, data)
+		}
+	}
+}
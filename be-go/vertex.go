@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GEMINI_PROVIDER=vertex sends Gemini requests through Vertex AI instead of
+// the Generative Language API. Vertex authenticates with an OAuth access
+// token rather than an API key and addresses the model by project and
+// location:
+//
+//	VERTEX_PROJECT         GCP project ID (required)
+//	VERTEX_LOCATION        region, e.g. europe-west4 (default us-central1)
+//	VERTEX_ACCESS_TOKEN    a fixed token, or
+//	VERTEX_TOKEN_FILE      a file holding the token, re-read as it changes;
+//	                       with neither set the token comes from the GCE/GKE
+//	                       metadata server.
+var (
+	geminiUseVertex  = os.Getenv("GEMINI_PROVIDER") == "vertex"
+	vertexProject    = os.Getenv("VERTEX_PROJECT")
+	vertexLocation   = envString("VERTEX_LOCATION", "us-central1")
+	vertexTokenValue = os.Getenv("VERTEX_ACCESS_TOKEN")
+	vertexTokenFile  = os.Getenv("VERTEX_TOKEN_FILE")
+)
+
+// geminiModelID is the Gemini model used through either endpoint.
+const geminiModelID = "gemini-2.0-flash"
+
+// metadataTokenURL serves the access token of the instance's service account.
+var metadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// geminiEndpoint returns the URL and auth headers for a Gemini method such as
+// "generateContent", for whichever endpoint is configured.
+func geminiEndpoint(ctx context.Context, method string) (string, map[string]string, error) {
+	if !geminiUseVertex {
+		if geminiAPIKey == "" {
+			return "", nil, fmt.Errorf("GEMINI_API_KEY environment variable not set")
+		}
+		return fmt.Sprintf("%s:%s?key=%s", geminiModelURL, method, geminiAPIKey), nil, nil
+	}
+
+	if vertexProject == "" {
+		return "", nil, fmt.Errorf("VERTEX_PROJECT environment variable not set")
+	}
+	token, err := vertexTokens.token(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting Vertex AI access token: %w", err)
+	}
+	return vertexURL(vertexProject, vertexLocation, method), map[string]string{"Authorization": "Bearer " + token}, nil
+}
+
+// vertexURL builds the Vertex AI URL of a Gemini method. The "global"
+// location has no regional host.
+func vertexURL(project, location, method string) string {
+	host := location + "-aiplatform.googleapis.com"
+	if location == "global" {
+		host = "aiplatform.googleapis.com"
+	}
+	return fmt.Sprintf("https://%s/v1/projects/%s/locations/%s/publishers/google/models/%s:%s",
+		host, project, location, geminiModelID, method)
+}
+
+// geminiConfigured reports whether the configured Gemini endpoint has
+// credentials.
+func geminiConfigured() bool {
+	if geminiUseVertex {
+		return vertexProject != ""
+	}
+	return geminiAPIKey != ""
+}
+
+// vertexTokenSource hands out Vertex AI access tokens, caching those fetched
+// from the metadata server until shortly before they expire.
+type vertexTokenSource struct {
+	mu      sync.Mutex
+	cached  string
+	expires time.Time
+}
+
+var vertexTokens = &vertexTokenSource{}
+
+func (s *vertexTokenSource) token(ctx context.Context) (string, error) {
+	if vertexTokenValue != "" {
+		return vertexTokenValue, nil
+	}
+	if vertexTokenFile != "" {
+		data, err := os.ReadFile(vertexTokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached != "" && time.Now().Before(s.expires) {
+		return s.cached, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", metadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned status code %d", resp.StatusCode)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("error parsing metadata token: %w", err)
+	}
+	s.cached = body.AccessToken
+	// Refresh a minute early so a token never expires mid-request.
+	s.expires = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - time.Minute)
+	return s.cached, nil
+}
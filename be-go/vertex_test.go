@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVertexURL(t *testing.T) {
+	got := vertexURL("acme-prod", "europe-west4", "generateContent")
+	want := "https://europe-west4-aiplatform.googleapis.com/v1/projects/acme-prod/locations/europe-west4/publishers/google/models/" + geminiModelID + ":generateContent"
+	if got != want {
+		t.Errorf("vertexURL = %q\nwant        %q", got, want)
+	}
+	if got := vertexURL("acme-prod", "global", "streamGenerateContent"); got != "https://aiplatform.googleapis.com/v1/projects/acme-prod/locations/global/publishers/google/models/"+geminiModelID+":streamGenerateContent" {
+		t.Errorf("global vertexURL = %q, want the host without a region", got)
+	}
+}
+
+func TestVertexUsesBearerAuth(t *testing.T) {
+	setVar(t, &geminiUseVertex, true)
+	setVar(t, &geminiAPIKey, "unused-key")
+	setVar(t, &vertexProject, "acme-prod")
+	setVar(t, &vertexLocation, "us-east1")
+	setVar(t, &vertexTokenValue, "vertex-token")
+	var got *http.Request
+	fakeProviderAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		io.WriteString(w, geminiHello)
+	})
+
+	resp, err := callGeminiAPI(context.Background(), ProviderRequest{Messages: []Message{{Role: "user", Text: "Hi"}}})
+	if err != nil || resp.Text != "Hello" {
+		t.Fatalf("call = %+v, %v", resp, err)
+	}
+	if got.Host != "us-east1-aiplatform.googleapis.com" {
+		t.Errorf("host = %q, want the regional Vertex host", got.Host)
+	}
+	if want := "/v1/projects/acme-prod/locations/us-east1/publishers/google/models/" + geminiModelID + ":generateContent"; got.URL.Path != want {
+		t.Errorf("path = %q, want %q", got.URL.Path, want)
+	}
+	if got.URL.Query().Has("key") {
+		t.Errorf("query = %q, want no key= parameter", got.URL.RawQuery)
+	}
+	if auth := got.Header.Get("Authorization"); auth != "Bearer vertex-token" {
+		t.Errorf("Authorization = %q, want the bearer token", auth)
+	}
+}
+
+func TestVertexTokenSources(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setVar(t, &vertexTokenValue, "")
+	setVar(t, &vertexTokenFile, file)
+	if token, err := (&vertexTokenSource{}).token(context.Background()); err != nil || token != "from-file" {
+		t.Errorf("file token = %q, %v", token, err)
+	}
+
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, `{"access_token":"from-metadata","expires_in":3600}`)
+	}))
+	t.Cleanup(metadata.Close)
+	setVar(t, &vertexTokenFile, "")
+	setVar(t, &metadataTokenURL, metadata.URL)
+	if token, err := (&vertexTokenSource{}).token(context.Background()); err != nil || token != "from-metadata" {
+		t.Errorf("metadata token = %q, %v", token, err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// providerWarmup opens a connection to every configured provider at startup,
+// so the first chat request doesn't pay for the TLS handshake.
+var providerWarmup = os.Getenv("PROVIDER_WARMUP") == "true"
+
+const warmupTimeout = 5 * time.Second
+
+// providerEndpoints returns, per model, an endpoint on the provider's host.
+// Only the connection matters, so the URLs carry no credentials.
+var providerEndpoints = map[string]func() string{
+	"gemini": func() string {
+		if geminiUseVertex {
+			return vertexURL(vertexProject, vertexLocation, "generateContent")
+		}
+		return geminiModelURL + ":generateContent"
+	},
+	"claude":  func() string { return "https://api.anthropic.com/v1/messages" },
+	"llama":   func() string { return llamaProvider.URL },
+	"chatgpt": func() string { return chatGPTProvider.URL },
+	"mistral": func() string { return mistralProvider.URL },
+}
+
+// warmupEndpoints returns the endpoints of the configured models.
+func warmupEndpoints() map[string]string {
+	endpoints := make(map[string]string)
+	for _, name := range configuredModels() {
+		if endpoint, ok := providerEndpoints[name]; ok {
+			endpoints[name] = endpoint()
+		}
+	}
+	return endpoints
+}
+
+// warmupProviders sends a HEAD request to each endpoint through the provider
+// transport, leaving an idle connection in its pool. Any answer, even an
+// error status, means the connection is up; failures are only logged.
+func warmupProviders(endpoints map[string]string) {
+	client := &http.Client{Transport: providerTransport, Timeout: warmupTimeout}
+	var wg sync.WaitGroup
+	for name, endpoint := range endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodHead, endpoint, nil)
+			if err != nil {
+				slog.Warn("Provider warmup failed", "model", name, "error", err)
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				slog.Warn("Provider warmup failed", "model", name, "url", redactURL(endpoint), "error", err)
+				return
+			}
+			// Draining the body returns the connection to the pool.
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			slog.Debug("Warmed up provider connection", "model", name, "status", resp.StatusCode, "elapsed", time.Since(start))
+		}()
+	}
+	wg.Wait()
+}
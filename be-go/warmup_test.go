@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// onlyGeminiAndClaude configures credentials for Gemini and Claude alone.
+func onlyGeminiAndClaude(t *testing.T) {
+	t.Helper()
+	setVar(t, &geminiAPIKey, "test-key")
+	setVar(t, &geminiUseVertex, false)
+	setVar(t, &claudeAPIKey, "test-key")
+	setVar(t, &llamaProvider.APIKey, "")
+	setVar(t, &chatGPTProvider.APIKey, "")
+	setVar(t, &mistralProvider.APIKey, "")
+}
+
+func TestWarmupEndpointsCoverConfiguredProviders(t *testing.T) {
+	onlyGeminiAndClaude(t)
+
+	endpoints := warmupEndpoints()
+	want := map[string]string{
+		"gemini": geminiModelURL + ":generateContent",
+		"claude": "https://api.anthropic.com/v1/messages",
+	}
+	if len(endpoints) != len(want) {
+		t.Fatalf("endpoints = %v, want only the configured providers", endpoints)
+	}
+	for name, endpoint := range want {
+		if endpoints[name] != endpoint {
+			t.Errorf("endpoint for %s = %q, want %q", name, endpoints[name], endpoint)
+		}
+	}
+}
+
+func TestWarmupConnectsToEachProvider(t *testing.T) {
+	onlyGeminiAndClaude(t)
+	var mu sync.Mutex
+	var hosts []string
+	fakeProviderAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("warmup method = %s, want HEAD", r.Method)
+		}
+		mu.Lock()
+		hosts = append(hosts, r.Host)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	logs := captureLogs(t, slog.LevelWarn)
+
+	endpoints := warmupEndpoints()
+	// A broken endpoint is only logged and doesn't stop the others.
+	endpoints["broken"] = "http://%zz"
+	warmupProviders(endpoints)
+	if !strings.Contains(logs.String(), "Provider warmup failed") {
+		t.Errorf("logs = %q, want the failed warmup logged", logs)
+	}
+
+	var want []string
+	for _, name := range []string{"claude", "gemini"} {
+		u, err := url.Parse(endpoints[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, u.Host)
+	}
+	sort.Strings(hosts)
+	if len(hosts) != len(want) || hosts[0] != want[0] || hosts[1] != want[1] {
+		t.Fatalf("warmed up hosts = %v, want %v", hosts, want)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Post-turn webhooks: when WEBHOOK_URL is set, every chat turn stored in a
+// session is POSTed to it as a JSON TurnEvent. Deliveries run on
+// WEBHOOK_WORKERS goroutines fed by a queue of WEBHOOK_QUEUE events, so a slow
+// endpoint never delays a response or piles up goroutines; when the queue is
+// full new events are dropped and counted. A failed delivery is retried once
+// after WEBHOOK_RETRY_DELAY.
+var (
+	webhookURL        = os.Getenv("WEBHOOK_URL")
+	webhookWorkers    = envInt("WEBHOOK_WORKERS", 4)
+	webhookQueueDepth = envInt("WEBHOOK_QUEUE", 256)
+	webhookTimeout    = envDuration("WEBHOOK_TIMEOUT", 5*time.Second)
+	webhookRetryDelay = envDuration("WEBHOOK_RETRY_DELAY", time.Second)
+)
+
+var (
+	webhookEventsDropped = newCounter("maya_webhook_events_dropped_total", "Webhook events dropped because the queue was full.")
+	webhookEventsFailed  = newCounter("maya_webhook_events_failed_total", "Webhook events that could not be delivered after the retry.")
+)
+
+// turnCompleted is the Type of the event sent after a chat turn.
+const turnCompleted = "turn.completed"
+
+// TurnEvent is the body POSTed to the webhook after a turn.
+type TurnEvent struct {
+	Type         string    `json:"type"`
+	Time         time.Time `json:"time"`
+	SessionID    string    `json:"sessionId"`
+	Tenant       string    `json:"tenant"`
+	Model        string    `json:"model"`
+	UserText     string    `json:"userText"`
+	AIText       string    `json:"aiText"`
+	MessageCount int       `json:"messageCount"`
+}
+
+// webhookEmitter delivers events from a bounded queue with a fixed pool of
+// workers.
+type webhookEmitter struct {
+	url        string
+	client     *http.Client
+	queue      chan TurnEvent
+	retryDelay time.Duration
+}
+
+// webhooks is the emitter started from main, nil when WEBHOOK_URL is unset.
+var webhooks *webhookEmitter
+
+// newWebhookEmitter starts workers goroutines delivering to url.
+func newWebhookEmitter(url string, workers, depth int) *webhookEmitter {
+	e := &webhookEmitter{
+		url:        url,
+		client:     &http.Client{Timeout: webhookTimeout},
+		queue:      make(chan TurnEvent, max(depth, 0)),
+		retryDelay: webhookRetryDelay,
+	}
+	for range max(workers, 1) {
+		go func() {
+			for event := range e.queue {
+				e.deliver(event)
+			}
+		}()
+	}
+	return e
+}
+
+// emit queues an event without blocking. It reports false if the queue was
+// full and the event dropped.
+func (e *webhookEmitter) emit(event TurnEvent) bool {
+	select {
+	case e.queue <- event:
+		return true
+	default:
+		webhookEventsDropped.Inc()
+		slog.Warn("Webhook queue full, dropping event", "sessionId", event.SessionID, "type", event.Type)
+		return false
+	}
+}
+
+// deliver posts an event, retrying once on failure.
+func (e *webhookEmitter) deliver(event TurnEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error marshaling webhook event", "error", err)
+		return
+	}
+	if err = e.post(body); err == nil {
+		return
+	}
+	slog.Debug("Webhook delivery failed, retrying once", "sessionId", event.SessionID, "error", err)
+	time.Sleep(e.retryDelay)
+	if err = e.post(body); err != nil {
+		webhookEventsFailed.Inc()
+		slog.Warn("Error delivering webhook event", "sessionId", event.SessionID, "error", err)
+	}
+}
+
+func (e *webhookEmitter) post(body []byte) error {
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error posting webhook event: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// emitTurnEvent queues a turn.completed event for the turn at the end of
+// history, as stored: AIText is empty when the reply wasn't. It is a no-op
+// without a webhook.
+func emitTurnEvent(tenant *Tenant, sessionId, modelName string, history []Message) {
+	if webhooks == nil || len(history) == 0 {
+		return
+	}
+	event := TurnEvent{
+		Type:         turnCompleted,
+		Time:         time.Now().UTC(),
+		SessionID:    sessionId,
+		Tenant:       tenant.Name,
+		Model:        modelName,
+		MessageCount: len(history),
+	}
+	last := len(history) - 1
+	if history[last].Role == "ai" {
+		event.AIText = history[last].Text
+		last--
+	}
+	for i := last; i >= 0; i-- {
+		if history[i].Role == "user" {
+			event.UserText = history[i].Text
+			break
+		}
+	}
+	webhooks.emit(event)
+}
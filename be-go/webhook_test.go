@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookServer serves webhook deliveries with handle, passing every decoded
+// event to events.
+func webhookServer(t *testing.T, handle func(w http.ResponseWriter)) (*httptest.Server, chan TurnEvent) {
+	t.Helper()
+	events := make(chan TurnEvent, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event TurnEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decoding webhook event: %v", err)
+		}
+		events <- event
+		handle(w)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, events
+}
+
+func nextEvent(t *testing.T, events chan TurnEvent) TurnEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no webhook delivery")
+		return TurnEvent{}
+	}
+}
+
+func TestWebhookQueueFullDropsEvents(t *testing.T) {
+	release := make(chan struct{})
+	srv, events := webhookServer(t, func(http.ResponseWriter) { <-release })
+	// Registered after the server, so it runs first: the handler is unblocked
+	// and the queued events are delivered before the server closes.
+	t.Cleanup(func() {
+		close(release)
+		nextEvent(t, events)
+		nextEvent(t, events)
+	})
+	setVar(t, &webhookRetryDelay, time.Millisecond)
+	logs := captureLogs(t, slog.LevelWarn)
+	e := newWebhookEmitter(srv.URL, 1, 2)
+	dropped := webhookEventsDropped.Value()
+
+	// The one worker takes the first event and blocks on the endpoint.
+	e.emit(TurnEvent{SessionID: "busy"})
+	nextEvent(t, events)
+	for _, id := range []string{"queued-1", "queued-2"} {
+		if !e.emit(TurnEvent{SessionID: id}) {
+			t.Fatalf("event %s dropped with room in the queue", id)
+		}
+	}
+
+	start := time.Now()
+	for _, id := range []string{"over-1", "over-2", "over-3"} {
+		if e.emit(TurnEvent{SessionID: id}) {
+			t.Fatalf("event %s queued past the queue depth", id)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("emitting to a full queue took %v, want it not to block", elapsed)
+	}
+	if got := webhookEventsDropped.Value() - dropped; got != 3 {
+		t.Errorf("drop metric rose by %d, want 3", got)
+	}
+	if !strings.Contains(logs.String(), "Webhook queue full") {
+		t.Errorf("logs = %q, want a warning per dropped event", logs)
+	}
+}
+
+func TestWebhookRetriesOnce(t *testing.T) {
+	var posts atomic.Int32
+	srv, events := webhookServer(t, func(w http.ResponseWriter) {
+		if posts.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+	setVar(t, &webhookRetryDelay, time.Millisecond)
+	e := newWebhookEmitter(srv.URL, 1, 4)
+	failed := webhookEventsFailed.Value()
+
+	e.emit(TurnEvent{SessionID: "retried"})
+	nextEvent(t, events)
+	if retry := nextEvent(t, events); retry.SessionID != "retried" {
+		t.Fatalf("retried event = %+v", retry)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if posts.Load() != 2 || webhookEventsFailed.Value() != failed {
+		t.Errorf("posts = %d, failures = %d, want one successful retry", posts.Load(), webhookEventsFailed.Value()-failed)
+	}
+}
+
+func TestWebhookGivesUpAfterRetry(t *testing.T) {
+	var posts atomic.Int32
+	srv, events := webhookServer(t, func(w http.ResponseWriter) {
+		posts.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	setVar(t, &webhookRetryDelay, time.Millisecond)
+	e := newWebhookEmitter(srv.URL, 1, 4)
+	failed := webhookEventsFailed.Value()
+
+	e.emit(TurnEvent{SessionID: "failing"})
+	nextEvent(t, events)
+	nextEvent(t, events)
+	deadline := time.Now().Add(2 * time.Second)
+	for webhookEventsFailed.Value() == failed && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := webhookEventsFailed.Value() - failed; got != 1 {
+		t.Errorf("failure metric rose by %d, want 1", got)
+	}
+	if posts.Load() != 2 {
+		t.Errorf("posts = %d, want the event and a single retry", posts.Load())
+	}
+}
+
+func TestTurnEventSentAfterChat(t *testing.T) {
+	setupRedis(t)
+	stubChat(t, "gemini", reply("Hello there"))
+	srv, events := webhookServer(t, func(http.ResponseWriter) {})
+	setVar(t, &webhooks, newWebhookEmitter(srv.URL, 1, 4))
+
+	chatTurn(t, map[string]interface{}{"sessionId": "webhook-1", "modelName": "gemini", "contents": userTurn("Hi")})
+	event := nextEvent(t, events)
+	if event.Type != turnCompleted || event.SessionID != "webhook-1" || event.Model != "gemini" || event.UserText != "Hi" || event.AIText != "Hello there" {
+		t.Fatalf("event = %+v", event)
+	}
+	if event.MessageCount != len(storedHistory(t, "webhook-1")) {
+		t.Errorf("messageCount = %d, want the stored history length", event.MessageCount)
+	}
+}
@@ -161,9 +161,9 @@ export default function Home() {
       });
 
       if (!response.ok) {
-        const errorData = await response.json() as { text: string };
+        const errorData = await response.json() as { error: { code: string; message: string } };
         //const errorData = await response.json();
-        throw new Error(`Server error: ${response.status} - ${errorData.text}`);
+        throw new Error(`Server error: ${response.status} - ${errorData.error.message} (${errorData.error.code})`);
       }
 
       //const result = await response.json();